@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	yaml "github.com/ghodss/yaml"
 	"github.com/rackn/netwrangler"
@@ -13,30 +15,118 @@ import (
 )
 
 func main() {
-	op, inFmt, outFmt, src, dest, physIn, bootMac := "", "", "", "", "", "", ""
-	bindMacs := false
+	op, inFmt, outFmt, src, dest, physIn, bootMac, physExclude, owner, renderer, reloadScript, virtualDrivers, hostnameRoot, macSeed, unitDir, dirMode, forbidPrefixes, rhelRoot := "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", ""
+	bindMacs, lldp, verbose, summary, strictMatch, includeVirtual, checkModules, restorecon := false, false, false, false, false, false, false, false
+	rollbackAfter := 0
 	args := os.Args[:]
 	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
 	fs.StringVar(&op, "op", "",
 		`Operation to perform.
 "gather" gathers information about the physical nics on the system in a form that can be used later with the -phys option
-"compile" translates the -in formatted network spec from -src to -out formatted data at -dest`)
+"compile" translates the -in formatted network spec from -src to -out formatted data at -dest
+"validate" checks that the -in formatted network spec from -src is valid without writing anything
+"render-check" renders the -in formatted network spec from -src as -out formatted data in a temporary directory, reporting any errors without touching -dest
+"match-report" prints a table of which physical nics each ethernet stanza in the -in formatted network spec from -src matches
+"apply" applies the -in formatted network spec from -src to the running system`)
 	fs.StringVar(&inFmt, "in", netwrangler.SrcFormats[0],
 		fmt.Sprintf("Format to expect for input. Options: %v", strings.Join(netwrangler.SrcFormats, ", ")))
-	fs.StringVar(&outFmt, "out", netwrangler.DestFormats[0],
-		fmt.Sprintf("Format to render input to.  Options: %v", strings.Join(netwrangler.DestFormats, ", ")))
+	fs.StringVar(&outFmt, "out", "",
+		fmt.Sprintf("Format to render input to.  Options: %v.  Defaults to nmkeyfile for input with renderer: NetworkManager, and %s otherwise.",
+			strings.Join(netwrangler.DestFormats, ", "), netwrangler.DestFormats[0]))
 	fs.StringVar(&src, "src", "", "Location to get input from.  Defaults to stdin.")
 	fs.StringVar(&dest, "dest", "", "Location to write output to.  Defaults to stdout.")
-	fs.StringVar(&physIn, "phys", "", "File to read to gather current physical nics.  Defaults to reading them from the kernel.")
-	fs.StringVar(&bootMac, "bootmac", "", "Mac address of the nic the system booted from.  Required for magic bootif name matching")
+	fs.StringVar(&physIn, "phys", "", "Comma separated list of files to read to gather current physical nics, either from the gather op or raw gohai JSON.  Phys in later files are merged into the ones with the same name in earlier files.  Defaults to reading them from the kernel.")
+	fs.StringVar(&bootMac, "bootmac", "", "Mac address of the nic the system booted from.  Required for magic bootif name matching.  Defaults to the BOOTIF parameter of the kernel command line, if there is one")
+	fs.StringVar(&physExclude, "phys-exclude", "", "Comma separated list of globs matching physical nics that should never be gathered or configured")
+	fs.StringVar(&renderer, "default-renderer", "", "Renderer to use for input that does not specify one.  Defaults to networkd")
+	fs.StringVar(&owner, "owner", "", "user[:group] that should own the files written to -dest when it is a directory.  Defaults to leaving them as created.  Only works on Linux when running as root")
+	fs.StringVar(&dirMode, "dir-mode", "", "Octal mode to create -dest with when it is a directory that does not exist yet.  Defaults to 0755")
+	fs.StringVar(&reloadScript, "reload-script", "", "When writing systemd output, only replace the files that changed and write the commands that apply the changes to this shell script.  Defaults to replacing every file")
+	fs.StringVar(&hostnameRoot, "hostname-root", "", "When compiling input that sets a hostname, also write it to etc/hostname and etc/hosts under this directory.  Use / to set the hostname of the running system.  Defaults to leaving the hostname alone")
+	fs.StringVar(&forbidPrefixes, "forbid-prefixes", "", "Comma separated list of CIDR prefixes, such as 169.254.0.0/16, that interfaces may not have static addresses in.  Defaults to forbidding nothing")
+	fs.StringVar(&macSeed, "mac-seed", "", "Seed to derive stable MAC addresses for bonds, bridges, vlans, veths, and ethernet tunnels without one from, such as the contents of /etc/machine-id.  Defaults to letting the kernel pick them")
+	fs.StringVar(&unitDir, "unit-dir", "", "Directory to write the systemd drop-ins that apply wait-online-timeout, wait-device-timeout, after, and requires to when writing systemd output, usually /etc/systemd/system.  Defaults to ignoring them")
+	fs.StringVar(&rhelRoot, "rhel-root", "", "Directory to install the files that rhel output needs outside of -dest under, such as sbin/ifup-local, usually /.  Defaults to ignoring the settings that need them")
 	fs.BoolVar(&bindMacs, "bindMacs", false, "Whether to write configs that force matching physical devices on MAC address")
+	fs.BoolVar(&strictMatch, "strict-match", false, "Whether an ethernet stanza that matches more than one physical nic is an error unless it is part of a bond or bridge")
+	fs.BoolVar(&checkModules, "check-modules", false, "Whether to check that the kernel modules needed to create bonds, bridges, vlans, veths, and tunnels can be loaded on this system.  Only works on Linux")
+	fs.BoolVar(&restorecon, "restorecon", false, "Whether to reset the SELinux contexts of the files written to -dest when writing rhel output.  Does nothing when SELinux is disabled or restorecon is not installed")
+	fs.BoolVar(&verbose, "verbose", false, "Whether to print the compiled interface tree when validating")
+	fs.BoolVar(&summary, "summary", false, "Whether to print a one line summary of each interface to stderr after compiling")
+	fs.IntVar(&rollbackAfter, "rollback-after", 0, "Seconds to wait for confirmation on stdin before reverting an applied config.  0 disables the rollback.")
+	fs.BoolVar(&lldp, "lldp", false, "Whether to include LLDP neighbor information from lldpctl when gathering physical nics")
+	fs.BoolVar(&includeVirtual, "include-virtual", false, "Whether to gather the paravirtualized nics of VMs along with the physical nics, so that ethernet stanzas can match them")
+	fs.StringVar(&virtualDrivers, "virtual-drivers", "", fmt.Sprintf("Comma separated list of globs matching the drivers of the virtual nics -include-virtual gathers.  Defaults to %s", strings.Join(util.DefaultVirtualDrivers, ",")))
 	if err := fs.Parse(args[1:]); err != nil {
 		log.Fatal(err)
 	}
+	if physExclude != "" {
+		if err := netwrangler.ExcludePhys(strings.Split(physExclude, ",")...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if includeVirtual || virtualDrivers != "" {
+		drivers := []string{}
+		if virtualDrivers != "" {
+			drivers = strings.Split(virtualDrivers, ",")
+		}
+		if err := netwrangler.IncludeVirtualPhys(drivers...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := netwrangler.Owner(owner); err != nil {
+		log.Fatal(err)
+	}
+	if err := netwrangler.DirMode(dirMode); err != nil {
+		log.Fatal(err)
+	}
+	netwrangler.Restorecon(restorecon)
+	netwrangler.RhelRoot(rhelRoot)
+	netwrangler.StrictMatch(strictMatch)
+	netwrangler.CheckModules(checkModules)
+	netwrangler.MacSeed(macSeed)
+	netwrangler.UnitDir(unitDir)
+	netwrangler.ReloadScript(reloadScript)
+	netwrangler.HostnameRoot(hostnameRoot)
+	if forbidPrefixes != "" {
+		if err := netwrangler.ForbidPrefixes(strings.Split(forbidPrefixes, ",")...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := netwrangler.DefaultRenderer(renderer); err != nil {
+		log.Fatal(err)
+	}
+	gather := netwrangler.GatherPhys
+	if lldp {
+		gather = netwrangler.GatherPhysWithLLDP
+	}
+	setBootMac := func() {
+		if bootMac != "" {
+			netwrangler.BootMac(bootMac)
+		} else if err := netwrangler.AutoBootMac(); err != nil {
+			log.Printf("Ignoring the kernel command line: %v", err)
+		}
+	}
+	readPhys := func() []util.Phy {
+		var (
+			phys []util.Phy
+			err  error
+		)
+		setBootMac()
+		if physIn == "" {
+			phys, err = gather()
+		} else {
+			phys, err = netwrangler.GatherPhysFromFile(strings.Split(physIn, ",")...)
+		}
+		if err != nil {
+			log.Fatalf("Error reading phys: %v", err)
+		}
+		return phys
+	}
 	switch op {
 	case "gather":
-		netwrangler.BootMac(bootMac)
-		phys, err := netwrangler.GatherPhys()
+		setBootMac()
+		phys, err := gather()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -56,22 +146,67 @@ func main() {
 			log.Fatalf("Error saving phys: %v", err)
 		}
 	case "compile":
-		var (
-			phys []util.Phy
-			err  error
-		)
-		netwrangler.BootMac(bootMac)
-		if physIn == "" {
-			phys, err = netwrangler.GatherPhys()
-		} else {
-			phys, err = netwrangler.GatherPhysFromFile(physIn)
+		phys := readPhys()
+		layout, err := netwrangler.Read(phys, inFmt, src)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := netwrangler.Write(layout, outFmt, dest, bindMacs); err != nil {
+			log.Fatal(err)
+		}
+		if summary {
+			fmt.Fprint(os.Stderr, layout.Summary())
 		}
+	case "validate":
+		phys := readPhys()
+		layout, err := netwrangler.Read(phys, inFmt, src)
 		if err != nil {
-			log.Fatalf("Error reading phys: %v", err)
+			log.Fatal(err)
+		}
+		if verbose {
+			fmt.Print(layout)
 		}
-		err = netwrangler.Compile(phys, inFmt, outFmt, src, dest, bindMacs)
+	case "render-check":
+		phys := readPhys()
+		layout, err := netwrangler.Read(phys, inFmt, src)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if err := netwrangler.RenderCheck(layout, outFmt, bindMacs); err != nil {
+			log.Fatal(err)
+		}
+	case "match-report":
+		phys := readPhys()
+		report, err := netwrangler.MatchReport(phys, inFmt, src)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := report.WriteTable(os.Stdout); err != nil {
+			log.Fatalf("Error writing match report: %v", err)
+		}
+		if !report.OK() {
+			os.Exit(1)
+		}
+	case "apply":
+		if rollbackAfter > 0 && src == "" {
+			log.Fatal("-rollback-after reads confirmation from stdin, so -src must be set")
+		}
+		phys := readPhys()
+		layout, err := netwrangler.Read(phys, inFmt, src)
+		if err != nil {
+			log.Fatal(err)
+		}
+		confirm := make(chan struct{})
+		if rollbackAfter > 0 {
+			go func() {
+				if _, err := bufio.NewReader(os.Stdin).ReadString('\n'); err == nil {
+					close(confirm)
+				}
+			}()
+			fmt.Fprintf(os.Stderr, "Press enter within %d seconds to keep the applied config\n", rollbackAfter)
+		}
+		if err := netwrangler.Apply(layout, time.Duration(rollbackAfter)*time.Second, confirm); err != nil {
+			log.Fatal(err)
+		}
 	}
 }
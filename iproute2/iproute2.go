@@ -0,0 +1,572 @@
+// Package iproute2 implements support for applying a Layout directly
+// to a running system with ip and ethtool commands, along with
+// rendering those commands as a shell script for review.
+package iproute2
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+	"github.com/rackn/netwrangler/util"
+)
+
+// Step is a single command that applies part of a Layout, along
+// with the command that reverts it.  Steps that cannot be reverted
+// have an empty Undo.
+type Step struct {
+	// Intf is the name of the interface the step configures.
+	Intf string
+	// Cmd is the command to run, including its arguments.
+	Cmd []string
+	// Undo is the command that reverts Cmd.
+	Undo []string
+}
+
+func shellQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t'\"\\$`;&|<>()*?[]#~") {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// String renders the command of the Step so that it can be run by a
+// shell.
+func (s Step) String() string {
+	res := make([]string, len(s.Cmd))
+	for idx, arg := range s.Cmd {
+		res[idx] = shellQuote(arg)
+	}
+	return strings.Join(res, " ")
+}
+
+// IPRoute2 holds the internal information needed to apply a Layout to
+// the running system.
+type IPRoute2 struct {
+	*util.Layout
+	// Runner runs a single command and returns its combined output.
+	// It defaults to running the command with os/exec.
+	Runner  func(args ...string) ([]byte, error)
+	steps   []Step
+	visited map[string]struct{}
+	up      map[string]struct{}
+}
+
+// BindMacs is a no-op, as the running system is always configured by
+// interface name.
+func (r *IPRoute2) BindMacs() {}
+
+func New(l *util.Layout) *IPRoute2 {
+	return &IPRoute2{Layout: l, Runner: run}
+}
+
+func run(args ...string) ([]byte, error) {
+	return exec.Command(args[0], args[1:]...).CombinedOutput()
+}
+
+func (r *IPRoute2) add(intf string, cmd string, undo string) {
+	s := Step{Intf: intf, Cmd: strings.Fields(cmd)}
+	if undo != "" {
+		s.Undo = strings.Fields(undo)
+	}
+	r.steps = append(r.steps, s)
+}
+
+// setUp brings name up as part of configuring intf.
+func (r *IPRoute2) setUp(intf, name string) {
+	if _, ok := r.up[name]; ok {
+		return
+	}
+	r.up[name] = struct{}{}
+	r.add(intf, "ip link set dev "+name+" up", "")
+}
+
+// bondOpts maps bond parameters to their ip-link(8) names.
+var bondOpts = map[string]string{
+	"mode":                    "mode",
+	"transmit-hash-policy":    "xmit_hash_policy",
+	"lacp-rate":               "lacp_rate",
+	"mii-monitor-interval":    "miimon",
+	"min-links":               "min_links",
+	"ad-select":               "ad_select",
+	"ad-actor-system":         "ad_actor_system",
+	"ad-actor-sys-prio":       "ad_actor_sys_prio",
+	"all-slaves-active":       "all_slaves_active",
+	"arp-interval":            "arp_interval",
+	"arp-ip-targets":          "arp_ip_target",
+	"arp-validate":            "arp_validate",
+	"arp-all-targets":         "arp_all_targets",
+	"ns-ip6-targets":          "ns_ip6_target",
+	"up-delay":                "updelay",
+	"down-delay":              "downdelay",
+	"fail-over-mac-policy":    "fail_over_mac",
+	"gratuitous-arp":          "num_grat_arp",
+	"packets-per-slave":       "packets_per_slave",
+	"primary-reselect-policy": "primary_reselect",
+	"resend-igmp":             "resend_igmp",
+	"learn-packet-interval":   "lp_interval",
+	"tlb-dynamic-lb":          "tlb_dynamic_lb",
+}
+
+// bridgeOpts maps bridge parameters to their ip-link(8) names.  The
+// timers are in seconds in the Layout, and in hundredths of a second
+// for ip.
+var bridgeOpts = map[string]string{
+	"stp":                "stp_state",
+	"priority":           "priority",
+	"max-age":            "max_age",
+	"hello-time":         "hello_time",
+	"forward-delay":      "forward_delay",
+	"ageing-time":        "ageing_time",
+	"group-forward-mask": "group_fwd_mask",
+	"vlan-filtering":     "vlan_filtering",
+	"vlan-default-pvid":  "vlan_default_pvid",
+}
+
+// addBridgeVlans adds the VLANs of the port child of the bridge i.
+// The port starts out with the default PVID of the bridge, which has
+// to be removed when the port has a PVID of its own, including a PVID
+// of 0 that makes it a trunk.
+func (r *IPRoute2) addBridgeVlans(i util.Interface, child string) {
+	if !i.VlanFiltering() {
+		return
+	}
+	for _, vlan := range i.PortVlans(child) {
+		r.add(i.Name,
+			"bridge vlan add vid "+vlan+" dev "+child,
+			"bridge vlan del vid "+vlan+" dev "+child)
+	}
+	pvid, set := i.PortPvid(child)
+	dfl := i.DefaultPvid()
+	if !set || pvid == dfl {
+		return
+	}
+	if dfl != 0 {
+		r.add(i.Name,
+			fmt.Sprintf("bridge vlan del vid %d pvid untagged dev %s", dfl, child),
+			fmt.Sprintf("bridge vlan add vid %d pvid untagged dev %s", dfl, child))
+	}
+	if pvid != 0 {
+		r.add(i.Name,
+			fmt.Sprintf("bridge vlan add vid %d pvid untagged dev %s", pvid, child),
+			fmt.Sprintf("bridge vlan del vid %d dev %s", pvid, child))
+	}
+}
+
+func optVal(k string, v interface{}) string {
+	switch val := v.(type) {
+	case bool:
+		if val {
+			return "1"
+		}
+		return "0"
+	case string:
+		return val
+	}
+	switch k {
+	case "max-age", "hello-time", "forward-delay", "ageing-time":
+		secs, _ := util.ValidateInt(&util.Err{}, k, v, 0, 1<<31-1)
+		return fmt.Sprintf("%d", secs*100)
+	}
+	vals := []string{}
+	if util.Remarshal(v, &vals) == nil {
+		return strings.Join(vals, ",")
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func opts(i util.Interface, names map[string]string) string {
+	res := []string{}
+	for _, k := range sortedKeys(i.Parameters) {
+		if name, ok := names[k]; ok {
+			res = append(res, name, optVal(k, i.Parameters[k]))
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	res := []string{}
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func family(addrs ...*gnet.IPNet) string {
+	for _, a := range addrs {
+		if a != nil && a.IP.To4() == nil {
+			return "ip -6"
+		}
+	}
+	return "ip"
+}
+
+func (r *IPRoute2) link(i util.Interface, e *util.Err) {
+	address := ""
+	if len(i.MacAddress) > 0 {
+		address = " address " + i.MacAddress.String()
+	}
+	switch i.Type {
+	case "physical":
+		if address != "" {
+			undo := ""
+			if len(i.CurrentHwAddr) > 0 {
+				undo = "ip link set dev " + i.Name + " address " + i.CurrentHwAddr.String()
+			}
+			r.add(i.Name, "ip link set dev "+i.Name+address, undo)
+		}
+		if i.Rename {
+			e.Warnf("%s: renaming physical interfaces is unsupported by iproute2, ignoring it", i.Name)
+		}
+		for _, name := range i.AlternativeNames {
+			r.add(i.Name,
+				"ip link property add dev "+i.Name+" altname "+name,
+				"ip link property del dev "+i.Name+" altname "+name)
+		}
+		if wol := i.EthtoolWol(); wol != "" {
+			r.add(i.Name, "ethtool -s "+i.Name+" "+wol, "ethtool -s "+i.Name+" wol d")
+		}
+	case "bond", "bridge":
+		names := bondOpts
+		if i.Type == "bridge" {
+			names = bridgeOpts
+		}
+		r.add(i.Name,
+			strings.TrimSpace("ip link add name "+i.Name+address+" type "+i.Type+" "+opts(i, names)),
+			"ip link del dev "+i.Name)
+		for _, child := range i.Interfaces {
+			if i.Type == "bond" {
+				// Interfaces must be down before they can be enslaved to
+				// a bond.  Reverting brings them back up unless they
+				// were down to begin with, so a rollback does not leave
+				// the system cut off.
+				undo := "ip link set dev " + child + " up"
+				if r.Interfaces[child].WasDown() {
+					undo = ""
+				}
+				r.add(i.Name, "ip link set dev "+child+" down", undo)
+			}
+			r.add(i.Name,
+				"ip link set dev "+child+" master "+i.Name,
+				"ip link set dev "+child+" nomaster")
+			if i.Type == "bridge" {
+				r.addBridgeVlans(i, child)
+			}
+			if id := i.QueueID(child); id != 0 && i.Type == "bond" {
+				r.add(i.Name,
+					fmt.Sprintf("ip link set dev %s type bond_slave queue_id %d", child, id),
+					fmt.Sprintf("ip link set dev %s type bond_slave queue_id 0", child))
+			}
+		}
+		if v, ok := i.Parameters["primary"]; ok && i.Type == "bond" {
+			r.add(i.Name, fmt.Sprintf("ip link set dev %s type bond primary %v", i.Name, v), "")
+		}
+	case "vlan":
+		cmd := fmt.Sprintf("ip link add link %s name %s%s type vlan id %v", i.Interfaces[0], i.Name, address, i.Parameters["id"])
+		for _, k := range []string{"ingress-qos-map", "egress-qos-map"} {
+			if maps := i.QOSMap(k); len(maps) > 0 {
+				cmd += " " + k + " " + strings.Join(maps, " ")
+			}
+		}
+		r.add(i.Name, cmd, "ip link del dev "+i.Name)
+	case "tunnel":
+		// ipip6 and ip6ip6 are both modes of ip6tnl.
+		mode := i.TunnelMode()
+		cmd := "ip link add name " + i.Name + address + " type " + mode
+		if mode == "ipip6" || mode == "ip6ip6" {
+			cmd = "ip link add name " + i.Name + " type ip6tnl mode " + mode
+		}
+		for _, k := range []string{"local", "remote", "ttl"} {
+			if v, ok := i.Parameters[k]; ok {
+				cmd += fmt.Sprintf(" %s %v", k, v)
+			}
+		}
+		r.add(i.Name, cmd, "ip link del dev "+i.Name)
+	case "veth":
+		// Both ends of the pair are created together, by whichever
+		// end is walked first.
+		peer := i.VethPeer()
+		if _, ok := r.visited[peer]; ok {
+			break
+		}
+		cmd := "ip link add name " + i.Name + address + " type veth peer name " + peer
+		if other := r.Interfaces[peer]; len(other.MacAddress) > 0 {
+			cmd += " address " + other.MacAddress.String()
+		}
+		r.add(i.Name, cmd, "ip link del dev "+i.Name)
+	default:
+		e.Errorf("Cannot apply interface %s:%s", i.Type, i.Name)
+	}
+	if i.MTU != 0 {
+		r.add(i.Name, fmt.Sprintf("ip link set dev %s mtu %d", i.Name, i.MTU), "")
+	}
+	for _, f := range i.LinkFlags() {
+		undo := util.LinkFlag{Name: f.Name, On: !f.On}
+		r.add(i.Name, "ip link set dev "+i.Name+" "+f.IPArgs(), "ip link set dev "+i.Name+" "+undo.IPArgs())
+	}
+	if i.Group != 0 {
+		r.add(i.Name, fmt.Sprintf("ip link set dev %s group %d", i.Name, i.Group), "ip link set dev "+i.Name+" group 0")
+	}
+	if cmd := i.LLDPToolCmd(); cmd != "" {
+		r.add(i.Name, cmd, "")
+	}
+	for _, cmd := range i.QueueCmds() {
+		// Each queue has its own mask, so it takes a shell to set them.
+		r.steps = append(r.steps, Step{Intf: i.Name, Cmd: []string{"sh", "-c", cmd}})
+	}
+	alias := i.Alias
+	if alias == "" {
+		alias = i.Description
+	}
+	if alias != "" {
+		// Aliases can contain spaces, so they cannot go through add.
+		r.steps = append(r.steps, Step{
+			Intf: i.Name,
+			Cmd:  []string{"ip", "link", "set", "dev", i.Name, "alias", alias},
+			Undo: []string{"ip", "link", "set", "dev", i.Name, "alias", ""},
+		})
+	}
+	for _, child := range i.Interfaces {
+		r.setUp(i.Name, child)
+	}
+}
+
+func (r *IPRoute2) route(i util.Interface, route util.Route) {
+	args := route.IPString(i, r.RouteMetric())
+	ip := family(route.To, route.Via, route.From)
+	r.add(i.Name, ip+" route add "+args, ip+" route del "+args)
+}
+
+func (r *IPRoute2) network(i util.Interface, e *util.Err) {
+	n := i.Network
+	if n == nil {
+		return
+	}
+	if n.Dhcp4 || n.Dhcp6 {
+		e.Warnf("%s: DHCP is not started when applying, run a DHCP client on it if needed", i.Name)
+	}
+	if n.Nameservers != nil {
+		e.Warnf("%s: nameservers are not applied to the running system", i.Name)
+	}
+	if cmd := n.NdiscNotifyCmd(i.Name, true); cmd != "" {
+		r.add(i.Name, cmd, n.NdiscNotifyCmd(i.Name, false))
+	}
+	if n.IPv6MTU != 0 {
+		r.add(i.Name, fmt.Sprintf("sysctl -q -w net/ipv6/conf/%s/mtu=%d", i.Name, n.IPv6MTU), "")
+	}
+	for _, setting := range n.ForwardSysctls() {
+		r.add(i.Name, "sysctl -q -w "+setting, "")
+	}
+	if n.IPMasquerade != "" && n.IPMasquerade != "no" {
+		e.Warnf("%s: ip-masquerade needs firewall rules, which are not applied, ignoring it", i.Name)
+	}
+	// Addresses are probed as they are added, so this goes first.
+	if setting := n.DadTransmitsSysctl(i.Name); setting != "" {
+		r.add(i.Name, "sysctl -q -w "+setting, "")
+	}
+	if n.IPv6Token != "" {
+		r.add(i.Name, "ip token set "+n.IPv6Token+"/64 dev "+i.Name, "ip token del "+n.IPv6Token+"/64 dev "+i.Name)
+	}
+	for _, a := range n.Addresses {
+		args := a.String() + " dev " + i.Name
+		if opts := n.AddressOpts(a); opts != nil {
+			args = opts.IPString(a, i)
+		}
+		r.add(i.Name, "ip addr add "+args, "ip addr del "+a.String()+" dev "+i.Name)
+	}
+	for _, gw := range []struct {
+		via    *gnet.IPNet
+		metric int
+	}{{n.Gateway4, n.Gateway4Metric}, {n.Gateway6, n.Gateway6Metric}} {
+		if gw.via == nil {
+			continue
+		}
+		route := util.Route{Via: gw.via, Metric: gw.metric, OnLink: n.GatewayOnLink}
+		args := "default " + route.IPString(i, r.RouteMetric())
+		r.add(i.Name, family(gw.via)+" route add "+args, family(gw.via)+" route del "+args)
+	}
+	for _, route := range n.Routes {
+		if route.DevFor(i) == i.Name {
+			r.route(i, route)
+		}
+	}
+	for _, rule := range n.RoutingPolicy {
+		args := rule.IPString()
+		ip := family(rule.To, rule.From)
+		r.add(i.Name, ip+" rule add "+args, ip+" rule del "+args)
+	}
+	for _, neigh := range n.Neighbors {
+		r.add(i.Name,
+			"ip neigh add "+neigh.IPString(i),
+			"ip neigh del "+neigh.IP.String()+" dev "+i.Name)
+	}
+}
+
+// walk adds the steps for i after the steps for the interfaces it is
+// built on.
+func (r *IPRoute2) walk(i util.Interface, e *util.Err) {
+	if _, ok := r.visited[i.Name]; ok {
+		return
+	}
+	r.visited[i.Name] = struct{}{}
+	for _, dep := range i.OrderAfter() {
+		r.walk(r.Interfaces[dep], e)
+	}
+	for _, child := range i.Interfaces {
+		r.walk(r.Interfaces[child], e)
+	}
+	r.link(i, e)
+	if _, ok := r.Child2Parent[i.Name]; !ok {
+		r.setUp(i.Name, i.Name)
+	}
+	r.network(i, e)
+}
+
+// Steps returns the commands needed to apply the Layout to the
+// running system, in the order they must be run.
+func (r *IPRoute2) Steps() ([]Step, error) {
+	e := &util.Err{Prefix: "iproute2"}
+	r.steps = []Step{}
+	r.visited = map[string]struct{}{}
+	r.up = map[string]struct{}{}
+	for _, k := range r.Roots {
+		r.walk(r.Interfaces[k], e)
+	}
+	// Routes out of other interfaces go last, once every interface
+	// they could refer to has been created.
+	names := []string{}
+	for k := range r.Interfaces {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		i := r.Interfaces[k]
+		if i.Network == nil {
+			continue
+		}
+		for _, route := range i.Network.Routes {
+			if route.DevFor(i) != i.Name {
+				r.route(i, route)
+			}
+		}
+	}
+	// Gratuitous ARPs can only be sent once everything is up.
+	for _, k := range names {
+		i := r.Interfaces[k]
+		for _, cmd := range i.Network.ArpingCmds(i.Name) {
+			r.add(i.Name, cmd, "")
+		}
+	}
+	return r.steps, e.OrNil()
+}
+
+// Write implements the util.Writer interface.  For IPRoute2, dest is
+// the file the commands that would be run by Apply are written to as a
+// shell script, or stdout if dest is empty.  Nothing is applied to the
+// running system.
+func (r *IPRoute2) Write(dest string) error {
+	steps, err := r.Steps()
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if dest != "" {
+		o, e := os.Create(dest)
+		if e != nil {
+			return e
+		}
+		defer o.Close()
+		out = o
+	}
+	fmt.Fprintf(out, "#!/bin/sh\n# Created by netwrangler\nset -e\n")
+	last := ""
+	for _, s := range steps {
+		if s.Intf != last {
+			fmt.Fprintf(out, "\n# %s\n", s.Intf)
+			last = s.Intf
+		}
+		fmt.Fprintln(out, s)
+	}
+	return nil
+}
+
+func (r *IPRoute2) revert(done []Step, e *util.Err) {
+	for idx := len(done) - 1; idx >= 0; idx-- {
+		undo := done[idx].Undo
+		if len(undo) == 0 {
+			continue
+		}
+		if out, err := r.Runner(undo...); err != nil {
+			e.Errorf("%s: reverting with %s failed: %v: %s", done[idx].Intf, strings.Join(undo, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// builtOn returns whether name is intf or is built on top of it.
+func (r *IPRoute2) builtOn(name, intf string) bool {
+	if name == intf {
+		return true
+	}
+	for _, child := range r.Interfaces[name].Interfaces {
+		if r.builtOn(child, intf) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply runs the commands from Steps against the running system.  If
+// a command fails, the rest of the commands for that interface and
+// for every interface built on it are skipped, and once everything
+// else has been tried all the commands that succeeded are reverted.
+//
+// If rollbackAfter is not zero, the applied config must be confirmed
+// by closing confirm within that time, or it will be reverted as well.
+func (r *IPRoute2) Apply(rollbackAfter time.Duration, confirm <-chan struct{}) error {
+	steps, err := r.Steps()
+	if err != nil {
+		return err
+	}
+	e := &util.Err{Prefix: "iproute2"}
+	done := []Step{}
+	failed := []string{}
+	for _, s := range steps {
+		skip := false
+		for _, f := range failed {
+			if r.builtOn(s.Intf, f) {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		if out, err := r.Runner(s.Cmd...); err != nil {
+			e.Errorf("%s: %s failed: %v: %s", s.Intf, s, err, strings.TrimSpace(string(out)))
+			failed = append(failed, s.Intf)
+			continue
+		}
+		done = append(done, s)
+	}
+	if !e.Empty() {
+		r.revert(done, e)
+		return e
+	}
+	if rollbackAfter == 0 {
+		return nil
+	}
+	select {
+	case <-confirm:
+		return nil
+	case <-time.After(rollbackAfter):
+	}
+	e.Errorf("config was not confirmed within %s, reverted it", rollbackAfter)
+	r.revert(done, e)
+	return e
+}
@@ -0,0 +1,136 @@
+package netplan
+
+import (
+	"fmt"
+
+	"github.com/rackn/netwrangler/util"
+)
+
+// extensions holds the checks added by RegisterExtension, keyed by
+// the kind of stanza they are valid in and then by key.
+var extensions = map[string]map[string]*util.Check{}
+
+// extensionKinds are the kinds of stanzas extensions can be
+// registered for, along with the validator of their built-in keys.
+// network extensions are valid in every kind of stanza.
+var extensionKinds = map[string]func() util.Validator{
+	"ethernet": ethernet,
+	"bond":     bond,
+	"bridge":   bridge,
+	"vlan":     vlan,
+	"tunnel":   tunnel,
+	"veth":     veth,
+	"network":  network,
+}
+
+// RegisterExtension registers check to validate key in stanzas of
+// kind, which is one of ethernet, bond, bridge, vlan, tunnel, veth, or
+// network for a key that is valid in all of them.  key must start with
+// util.ExtensionPrefix so that it can never clash with a netplan key.
+// The validated value is kept in the Parameters of the interface the
+// stanza is for, and output formats other than netplan ignore it.
+func RegisterExtension(kind, key string, check *util.Check) error {
+	builtin, ok := extensionKinds[kind]
+	if !ok {
+		return fmt.Errorf("Cannot register extension %s for unknown stanza kind %s", key, kind)
+	}
+	if !util.IsExtension(key) {
+		return fmt.Errorf("Extension %s must start with %s", key, util.ExtensionPrefix)
+	}
+	if _, found := extensionChecks(kind)[key]; found {
+		return fmt.Errorf("Extension %s is already registered for %s", key, kind)
+	}
+	if props, ok := util.SchemaOf(builtin())["properties"].(map[string]interface{}); ok {
+		if _, found := props[key]; found {
+			return fmt.Errorf("Extension %s is already a %s key", key, kind)
+		}
+	}
+	if extensions[kind] == nil {
+		extensions[kind] = map[string]*util.Check{}
+	}
+	extensions[kind][key] = check
+	return nil
+}
+
+// extensionChecks returns the checks registered for stanzas of kind,
+// including the ones registered for network.
+func extensionChecks(kind string) map[string]*util.Check {
+	res := map[string]*util.Check{}
+	for _, k := range []string{"network", kind} {
+		for key, check := range extensions[k] {
+			res[key] = check
+		}
+	}
+	return res
+}
+
+// validateExtensions validates the extensions registered for kind in
+// the stanza v, and adds them to params.
+func validateExtensions(e *util.Err, kind string, v interface{}, params map[string]interface{}) bool {
+	checks := extensionChecks(kind)
+	if len(checks) == 0 {
+		return true
+	}
+	res := map[string]interface{}{}
+	if !util.ValidateAndMarshal(e, v, checks, &res) {
+		return false
+	}
+	for k, val := range res {
+		params[k] = val
+	}
+	return true
+}
+
+// splitExtensions returns params without any extensions, along with
+// the extensions that were in it.
+func splitExtensions(params map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	if params == nil {
+		return nil, nil
+	}
+	res, exts := map[string]interface{}{}, map[string]interface{}{}
+	for k, v := range params {
+		if util.IsExtension(k) {
+			exts[k] = v
+		} else {
+			res[k] = v
+		}
+	}
+	return res, exts
+}
+
+// addExtensions adds the extensions of the stanzas in out to doc,
+// which is out in generic form.
+func addExtensions(out *netplanOut, doc map[string]interface{}) {
+	nw, _ := doc["network"].(map[string]interface{})
+	add := func(section, name string, c Common) {
+		if len(c.Extensions) == 0 {
+			return
+		}
+		stanzas, _ := nw[section].(map[string]interface{})
+		stanza, _ := stanzas[name].(map[string]interface{})
+		if stanzas == nil || stanza == nil {
+			return
+		}
+		for k, v := range c.Extensions {
+			stanza[k] = v
+		}
+	}
+	for k, v := range out.Network.Ethernets {
+		add("ethernets", k, v.Common)
+	}
+	for k, v := range out.Network.Bonds {
+		add("bonds", k, v.Common)
+	}
+	for k, v := range out.Network.Bridges {
+		add("bridges", k, v.Common)
+	}
+	for k, v := range out.Network.Vlans {
+		add("vlans", k, v.Common)
+	}
+	for k, v := range out.Network.Tunnels {
+		add("tunnels", k, v.Common)
+	}
+	for k, v := range out.Network.Veths {
+		add("virtual-ethernets", k, v.Common)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"math"
 	"os"
 	"sort"
+	"time"
 
 	yaml "github.com/ghodss/yaml"
 	gnet "github.com/rackn/gohai/plugins/net"
@@ -34,6 +35,9 @@ func nameservers() util.Validator {
 		"addresses": util.C(util.VIPS(false)),
 	}
 	return func(e *util.Err, k string, ns interface{}) (interface{}, bool) {
+		if util.Probing(ns) {
+			return util.ChecksSchema(checks), true
+		}
 		res := &util.NSInfo{}
 		resOK := util.ValidateAndMarshal(e, ns, checks, res)
 		return res, resOK
@@ -48,10 +52,16 @@ func routes() util.Validator {
 		"on-link": util.C(util.VB()),
 		"metric":  util.C(util.VI(0, math.MaxUint32)),
 		"table":   util.C(util.VI(0, math.MaxUint32)),
-		"scope":   util.C(util.VS("global", "link", "host")),
-		"type":    util.D("unicast", util.VS("unicast", "unreachable", "blackhole", "prohibit")),
+		"scope":   util.C(util.VS(util.Scopes...)),
+		"type":    util.D("unicast", util.VS(util.RouteTypes...)),
+		// dev and auto-rule are netwrangler extensions.
+		"dev":       util.C(util.VS()),
+		"auto-rule": util.C(util.VB()),
 	}
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.Schema{"type": "array", "items": util.ChecksSchema(checks)}, true
+		}
 		res := []util.Route{}
 		resOK := true
 		ra, ok := v.([]interface{})
@@ -80,8 +90,20 @@ func routepolicy() util.Validator {
 		"priority": util.C(util.VI(0, math.MaxUint32)),
 		"mark":     util.C(util.VI(0, math.MaxUint8)),
 		"tos":      util.C(util.VI(0, math.MaxUint8)),
+		// iif, oif, ipproto, sport, dport, mark-mask, and
+		// suppress-prefix-length are netwrangler extensions.
+		"mark-mask":              util.C(util.VI(1, math.MaxUint32)),
+		"suppress-prefix-length": util.C(util.VI(0, 128)),
+		"iif":                    util.C(util.VS()),
+		"oif":                    util.C(util.VS()),
+		"ipproto":                util.C(util.VIPProto()),
+		"sport":                  util.C(util.VPortRange()),
+		"dport":                  util.C(util.VPortRange()),
 	}
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.Schema{"type": "array", "items": util.ChecksSchema(checks)}, true
+		}
 		res := []util.RoutePolicy{}
 		resOK := true
 		ra, ok := v.([]interface{})
@@ -102,23 +124,290 @@ func routepolicy() util.Validator {
 	}
 }
 
-func network() util.Validator {
+// lifetime validates an address lifetime, which is either a number of
+// seconds or "forever".
+func lifetime() util.Validator {
+	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.Schema{"anyOf": []util.Schema{
+				{"type": "integer", "minimum": 0, "maximum": int64(util.LifetimeForever)},
+				{"type": "string", "enum": []interface{}{"forever", "infinity"}},
+			}}, true
+		}
+		if s, ok := v.(string); ok && (s == "forever" || s == "infinity") {
+			return util.LifetimeForever, true
+		}
+		res, valid := util.ValidateInt(e, k, v, 0, int64(util.LifetimeForever))
+		return util.Lifetime(res), valid
+	}
+}
+
+func addressOptions() util.Validator {
+	checks := map[string]*util.Check{
+		"broadcast":          util.C(util.VIP4()),
+		"preferred-lifetime": util.C(lifetime()),
+		"valid-lifetime":     util.C(lifetime()),
+		// scope is a netwrangler extension.
+		"scope": util.C(util.VS(util.Scopes...)),
+	}
+	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checks), true
+		}
+		res := &util.AddressOptions{}
+		resOK := util.ValidateAndMarshal(e, v, checks, res)
+		return res, resOK
+	}
+}
+
+// splitAddresses handles the netplan form of addresses that allows
+// individual addresses to carry additional options:
+//
+//	addresses:
+//	  - 10.0.0.5/24:
+//	      broadcast: 10.0.0.255
+//
+// It returns a copy of v with the addresses flattened into a plain list,
+// along with the options for any addresses that had them.
+func splitAddresses(e *util.Err, v interface{}) (interface{}, map[string]*util.AddressOptions, bool) {
+	vm, ok := v.(map[string]interface{})
+	if !ok {
+		return v, nil, true
+	}
+	addrs, ok := vm["addresses"].([]interface{})
+	if !ok {
+		return v, nil, true
+	}
+	res := map[string]interface{}{}
+	for k, val := range vm {
+		res[k] = val
+	}
+	flat := []interface{}{}
+	opts := map[string]*util.AddressOptions{}
+	resOK := true
+	for _, addr := range addrs {
+		am, ok := addr.(map[string]interface{})
+		if !ok {
+			flat = append(flat, addr)
+			continue
+		}
+		if len(am) != 1 {
+			e.Errorf("addresses: %v must have exactly one address", am)
+			resOK = false
+			continue
+		}
+		for a, ao := range am {
+			ip, valid := util.ValidateIP(e, "addresses", a)
+			if !valid {
+				resOK = false
+				continue
+			}
+			flat = append(flat, a)
+			if ao == nil {
+				continue
+			}
+			opt, valid := addressOptions()(e, a, ao)
+			if !valid {
+				resOK = false
+				continue
+			}
+			opts[ip.String()] = opt.(*util.AddressOptions)
+		}
+	}
+	res["addresses"] = flat
+	return res, opts, resOK
+}
+
+func duid() util.Validator {
+	checks := map[string]*util.Check{
+		"type":     util.C(util.VS("link-layer-time", "vendor", "link-layer", "uuid")),
+		"raw-data": util.C(util.VS()),
+	}
+	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checks), true
+		}
+		res := &util.Duid{}
+		resOK := util.ValidateAndMarshal(e, v, checks, res)
+		return res, resOK
+	}
+}
+
+func neighbors() util.Validator {
 	checks := map[string]*util.Check{
+		"ip":         util.C(util.VIP()),
+		"macaddress": util.C(util.VMAC()),
+	}
+	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.Schema{"type": "array", "items": util.ChecksSchema(checks)}, true
+		}
+		res := []util.Neighbor{}
+		resOK := true
+		na, ok := v.([]interface{})
+		if !ok {
+			e.Errorf("neighbors in invalid format: %T", v)
+			return res, false
+		}
+		for i, vv := range na {
+			neigh := util.Neighbor{}
+			if !util.ValidateAndMarshal(e, vv, checks, &neigh) {
+				e.Errorf("Invalid neighbor %d", i)
+				resOK = false
+				continue
+			}
+			res = append(res, neigh)
+		}
+		return res, resOK
+	}
+}
+
+// addressesSchema updates the schema for addresses in a network to
+// allow the map form that splitAddresses handles.
+func addressesSchema(s util.Schema) util.Schema {
+	props := s["properties"].(map[string]interface{})
+	props["addresses"] = util.Schema{
+		"type": "array",
+		"items": util.Schema{"anyOf": []util.Schema{
+			{"type": "string", "format": "cidr"},
+			{
+				"type":          "object",
+				"minProperties": 1,
+				"maxProperties": 1,
+				"propertyNames": util.Schema{"format": "cidr"},
+				"additionalProperties": util.Schema{"anyOf": []util.Schema{
+					{"type": "null"},
+					util.SchemaOf(addressOptions()),
+				}},
+			},
+		}},
+	}
+	return s
+}
+
+// networkChecks are the checks for the network config that all
+// interfaces share.
+func networkChecks() map[string]*util.Check {
+	return map[string]*util.Check{
 		"dhcp4":           util.D(false, util.VB()),
 		"dhcp4-overrides": util.C(overrides()),
 		"dhcp6":           util.D(false, util.VB()),
 		"dhcp6-overrides": util.C(overrides()),
 		"dhcp-identifier": util.C(util.VS()),
+		// duid and iaid are netwrangler extensions.
+		"duid":            util.C(duid()),
+		"iaid":            util.C(util.VI(0, math.MaxUint32)),
 		"accept-ra":       util.D(true, util.VB()),
+		"ra-overrides":    util.C(raOverrides()),
 		"addresses":       util.C(util.VIPS(true)),
 		"gateway4":        util.C(util.VIP4()),
 		"gateway6":        util.C(util.VIP6()),
+		"gateway4-metric": util.C(util.VI(0, math.MaxUint32)),
+		"gateway6-metric": util.C(util.VI(0, math.MaxUint32)),
+		// gateway-metric is a netwrangler extension.
+		"gateway-metric": util.C(util.VI(0, math.MaxUint32)),
+		// gateway-on-link is a netwrangler extension.
+		"gateway-on-link": util.C(util.VB()),
 		"nameservers":     util.C(nameservers()),
 		"routes":          util.C(routes()),
 		"routing-policy":  util.C(routepolicy()),
+		"neighbors":       util.C(neighbors()),
+		// gratuitous-arp-count and unsolicited-na are netwrangler
+		// extensions.
+		"gratuitous-arp-count": util.C(util.VI(1, util.MaxGratuitousArpCount)),
+		"unsolicited-na":       util.C(util.VB()),
+		"ignore-carrier":       util.C(util.VB()),
+		// configure-without-carrier and dns-default-route are
+		// netwrangler extensions.
+		"configure-without-carrier": util.C(util.VB()),
+		"dns-default-route":         util.C(util.VB()),
+		"ipv6-mtu":                  util.C(util.VI(util.MinIPv6MTU, util.MaxIPv6MTU)),
+		"ipv6-address-token":        util.C(util.VS()),
+		// ipv6-dad-transmits is a netwrangler extension.
+		"ipv6-dad-transmits": util.C(util.VI(0, util.MaxDadTransmits)),
+		"critical":           util.C(util.VB()),
+		// keep-configuration is a netwrangler extension.
+		"keep-configuration": util.C(keepConfiguration()),
+		// ip-forward and ip-masquerade are netwrangler extensions.
+		"ip-forward":    util.C(boolOrStrIn("yes", "no", util.IPForwards...)),
+		"ip-masquerade": util.C(boolOrStrIn("ipv4", "no", util.IPMasquerades...)),
 	}
+}
+
+func network() util.Validator {
+	checks := networkChecks()
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return addressesSchema(util.ChecksSchema(checks)), true
+		}
 		res := &util.Network{}
+		v, opts, resOK := splitAddresses(e, v)
+		resOK = util.ValidateAndMarshal(e, v, checks, res) && resOK
+		if len(opts) > 0 {
+			res.AddressOptions = opts
+		}
+		return res, resOK
+	}
+}
+
+// virtualNetwork validates the network config of a virtual interface
+// that only needs one when it sets any network keys, so that one
+// without any is left unconfigured rather than accepting RAs.
+func virtualNetwork(e *util.Err, v interface{}) (*util.Network, bool) {
+	nw, ok := network()(e, "network", v)
+	if !ok {
+		return nil, false
+	}
+	m, _ := v.(map[string]interface{})
+	for key := range networkChecks() {
+		if _, set := m[key]; set {
+			if network := nw.(*util.Network); network.Configure() {
+				return network, true
+			}
+			break
+		}
+	}
+	return nil, true
+}
+
+// keepConfiguration validates keep-configuration, which is either a
+// boolean or one of util.KeepConfigurations.
+func keepConfiguration() util.Validator {
+	return boolOrStrIn("yes", "no", util.KeepConfigurations...)
+}
+
+// boolOrStrIn validates a value that is either a boolean, which is
+// turned into yes or no, or one of vals.
+func boolOrStrIn(yes, no string, vals ...string) util.Validator {
+	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.Schema{"anyOf": []util.Schema{
+				{"type": "boolean"},
+				util.SchemaOf(util.VS(vals...)),
+			}}, true
+		}
+		if b, ok := v.(bool); ok {
+			if b {
+				return yes, true
+			}
+			return no, true
+		}
+		return util.ValidateStrIn(e, k, v, vals...)
+	}
+}
+
+func raOverrides() util.Validator {
+	checks := map[string]*util.Check{
+		"use-dns": util.D(true, util.VB()),
+		"table":   util.C(util.VI(1, math.MaxUint32)),
+		// use-autonomous-prefix is a netwrangler extension.
+		"use-autonomous-prefix": util.D(true, util.VB()),
+	}
+	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checks), true
+		}
+		res := &util.RaOverrides{}
 		resOK := util.ValidateAndMarshal(e, v, checks, res)
 		return res, resOK
 	}
@@ -134,21 +423,41 @@ func overrides() util.Validator {
 		"use-routes": util.D(true, util.VB()),
 		"route-metric": util.C(util.VI(0, math.MaxUint32)),
 		"use-domains": util.D("true", util.VS("true", "false", "route")),
+		// route-table, use-gateway, request-options, send-options,
+		// max-attempts, and listen-port are netwrangler extensions.
+		"route-table": util.C(util.VTable()),
+		"use-gateway": util.C(util.VB()),
+		"request-options": util.C(util.VDhcpOptionCodes()),
+		"send-options":    util.C(util.VDhcpOptions()),
+		"max-attempts":    util.C(util.VI(1, math.MaxUint32)),
+		"listen-port":     util.C(util.VI(1, math.MaxUint16)),
 	}
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checks), true
+		}
 		res := &util.Overrides{}
 		resOK := util.ValidateAndMarshal(e, v, checks, res)
+		if err := util.ValidateHostnameTemplate(res.Hostname); err != nil {
+			e.Errorf("%s: invalid hostname template %q: %v", k, res.Hostname, err)
+			resOK = false
+		}
 		return res, resOK
 	}
 }
 
 func phymatch() util.Validator {
 	checks := map[string]*util.Check{
-		"name":       util.C(util.VS()),
-		"macaddress": util.C(util.VMAC()),
-		"driver":     util.C(util.VS()),
+		"name":        util.C(util.VS()),
+		"macaddress":  util.C(util.VMAC()),
+		"driver":      util.C(util.VS()),
+		"lldp-port":   util.C(util.VS()),
+		"lldp-switch": util.C(util.VS()),
 	}
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checks), true
+		}
 		res := util.Match{}
 		resOK := util.ValidateAndMarshal(e, v, checks, &res)
 		return res, resOK
@@ -156,30 +465,90 @@ func phymatch() util.Validator {
 }
 
 type phy struct {
-	Intf     util.Interface
-	Match    util.Match `json:"match"`
-	WOL      bool       `json:"wakeonlan"`
-	Optional bool       `json:"optional"`
+	Intf             util.Interface
+	Match            util.Match `json:"match"`
+	WOL              bool       `json:"wakeonlan"`
+	WOLModes         []string   `json:"wakeonlan-modes"`
+	WOLPassword      string     `json:"wakeonlan-password"`
+	Optional         bool       `json:"optional"`
+	AlternativeNames []string   `json:"alternative-names"`
+	Description      string     `json:"description"`
+	Alias            string     `json:"alias"`
+	RequiredFamily   string     `json:"required-family"`
+	WaitOnline       int        `json:"wait-online-timeout"`
+	WaitDevice       int        `json:"wait-device-timeout"`
+	RpsCpus          string     `json:"rps-cpus"`
+	XpsCpus          string     `json:"xps-cpus"`
+	Autoconnect      *bool      `json:"autoconnect"`
+	AutoconnectPrio  *int       `json:"autoconnect-priority"`
+	EmitLLDP         string     `json:"emit-lldp"`
+	LLDP             *bool      `json:"lldp"`
+	ARP              *bool      `json:"arp"`
+	Multicast        *bool      `json:"multicast"`
+	AllMulticast     *bool      `json:"allmulticast"`
+	Group            int        `json:"group"`
+	After            []string   `json:"after"`
+	Requires         []string   `json:"requires"`
+	MTU              int        `json:"mtu"`
+	SetName          string     `json:"set-name"`
 }
 
-func (pi phy) matchPhys(phys []util.Phy) ([]util.Interface, error) {
-	if pi.Match.Name == "" &&
-		pi.Match.Driver == "" &&
-		len(pi.Match.MacAddress) == 0 {
-		pi.Match.Name = pi.Intf.MatchID
+// effectiveMatch returns the match that will be used for the
+// ethernet stanza named id.  A stanza without any match criteria
+// matches on its own name.
+func effectiveMatch(m util.Match, id string) util.Match {
+	if m.Name == "" &&
+		m.Driver == "" &&
+		m.LLDPPort == "" &&
+		m.LLDPSwitch == "" &&
+		len(m.MacAddress) == 0 {
+		m.Name = id
 	}
-	return util.MatchPhys(pi.Match, pi.Intf, phys)
+	return m
+}
+
+func (pi phy) matchPhys(phys []util.Phy) ([]util.Interface, error) {
+	return util.MatchPhys(effectiveMatch(pi.Match, pi.Intf.MatchID), pi.Intf, phys)
 }
 
 func ethernet() util.Validator {
 	checks := map[string]*util.Check{
 		"match":      util.C(phymatch()),
 		"wakeonlan":  util.C(util.VB()),
-		"set-name":   util.C(util.ValidateUnsupp),
+		"set-name":   util.C(util.VS()),
 		"macaddress": util.C(util.ValidateUnsupp),
 		"optional":   util.C(util.VB()),
+		"emit-lldp":  util.C(util.VEmitLLDP()),
+		"mtu":        util.C(util.VI(util.MinMTU, util.MaxMTU)),
+		// alternative-names, wakeonlan-modes, wakeonlan-password,
+		// description, alias, required-family, wait-online-timeout,
+		// wait-device-timeout, rps-cpus, xps-cpus, autoconnect,
+		// autoconnect-priority, lldp, arp, multicast, allmulticast,
+		// group, after, and requires are netwrangler extensions.
+		"alternative-names":    util.C(util.VSS()),
+		"description":          util.C(util.VS()),
+		"alias":                util.C(util.VS()),
+		"required-family":      util.C(util.VS(util.RequiredFamilies...)),
+		"wait-online-timeout":  util.C(util.VI(1, util.MaxWaitOnlineTimeout)),
+		"wait-device-timeout":  util.C(util.VT(time.Second, 1, util.MaxWaitOnlineTimeout)),
+		"rps-cpus":             util.C(util.VCPUs()),
+		"xps-cpus":             util.C(util.VCPUs()),
+		"autoconnect":          util.C(util.VB()),
+		"autoconnect-priority": util.C(util.VI(util.MinAutoconnectPriority, util.MaxAutoconnectPriority)),
+		"lldp":                 util.C(util.VB()),
+		"arp":                  util.C(util.VB()),
+		"multicast":            util.C(util.VB()),
+		"allmulticast":         util.C(util.VB()),
+		"group":                util.C(util.VI(0, util.MaxLinkGroup)),
+		"after":                util.C(util.VSS()),
+		"requires":             util.C(util.VSS()),
+		"wakeonlan-modes":      util.C(util.VSS(util.WolModes...)),
+		"wakeonlan-password":   util.C(util.VWOLPW()),
 	}
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checks).Merge(util.SchemaOf(network()), util.ChecksSchema(extensionChecks("ethernet"))), true
+		}
 		res := phy{}
 		res.Intf = util.NewInterface()
 		if !util.ValidateAndMarshal(e, v, checks, &res) {
@@ -194,14 +563,48 @@ func ethernet() util.Validator {
 		if res.WOL {
 			res.Intf.Parameters["wakeonlan"] = res.WOL
 		}
+		if len(res.WOLModes) > 0 {
+			res.Intf.Parameters["wakeonlan-modes"] = res.WOLModes
+		}
+		if res.WOLPassword != "" {
+			res.Intf.Parameters["wakeonlan-password"] = res.WOLPassword
+		}
+		for _, mode := range res.WOLModes {
+			if mode == "secureon" && res.WOLPassword == "" {
+				e.Errorf("%s: wakeonlan-modes secureon needs a wakeonlan-password", k)
+				return res, false
+			}
+		}
 		res.Intf.Optional = res.Optional
+		res.Intf.AlternativeNames = res.AlternativeNames
+		res.Intf.Description = res.Description
+		res.Intf.Alias = res.Alias
+		res.Intf.RequiredFamily = res.RequiredFamily
+		res.Intf.WaitOnlineTimeout = res.WaitOnline
+		res.Intf.WaitDeviceTimeout = res.WaitDevice
+		res.Intf.RpsCpus = res.RpsCpus
+		res.Intf.XpsCpus = res.XpsCpus
+		res.Intf.Autoconnect = res.Autoconnect
+		res.Intf.AutoconnectPriority = res.AutoconnectPrio
+		res.Intf.EmitLLDP = res.EmitLLDP
+		res.Intf.LLDP = res.LLDP
+		res.Intf.ARP = res.ARP
+		res.Intf.Multicast = res.Multicast
+		res.Intf.AllMulticast = res.AllMulticast
+		res.Intf.Group = res.Group
+		res.Intf.After = res.After
+		res.Intf.Requires = res.Requires
+		res.Intf.MTU = res.MTU
 		res.Intf.Network = nw.(*util.Network)
-		return res, true
+		return res, validateExtensions(e, "ethernet", v, res.Intf.Parameters)
 	}
 }
 
 func pValidate(checks map[string]*util.Check) util.Validator {
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checks), true
+		}
 		res := map[string]interface{}{}
 		resOK := util.ValidateAndMarshal(e, v, checks, &res)
 		return res, resOK
@@ -214,8 +617,30 @@ func bb(kind string, pchecks map[string]*util.Check) util.Validator {
 		"interfaces": util.C(util.VSS()),
 		"parameters": util.C(pValidate(pchecks)),
 		"optional":   util.C(util.VB()),
+		"mtu":        util.C(util.VI(util.MinMTU, util.MaxMTU)),
+		// description, alias, required-family, wait-online-timeout,
+		// autoconnect, autoconnect-priority, emit-lldp, lldp, arp,
+		// multicast, allmulticast, group, after, and requires are
+		// netwrangler extensions.
+		"description":          util.C(util.VS()),
+		"alias":                util.C(util.VS()),
+		"required-family":      util.C(util.VS(util.RequiredFamilies...)),
+		"wait-online-timeout":  util.C(util.VI(1, util.MaxWaitOnlineTimeout)),
+		"autoconnect":          util.C(util.VB()),
+		"autoconnect-priority": util.C(util.VI(util.MinAutoconnectPriority, util.MaxAutoconnectPriority)),
+		"emit-lldp":            util.C(util.VEmitLLDP()),
+		"lldp":                 util.C(util.VB()),
+		"arp":                  util.C(util.VB()),
+		"multicast":            util.C(util.VB()),
+		"allmulticast":         util.C(util.VB()),
+		"group":                util.C(util.VI(0, util.MaxLinkGroup)),
+		"after":                util.C(util.VSS()),
+		"requires":             util.C(util.VSS()),
 	}
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checks).Merge(util.SchemaOf(network()), util.ChecksSchema(extensionChecks(kind))), true
+		}
 		res := util.NewInterface()
 		if !util.ValidateAndMarshal(e, v, checks, &res) {
 			e.Errorf("%T not castable to a %s interface", v, kind)
@@ -227,35 +652,48 @@ func bb(kind string, pchecks map[string]*util.Check) util.Validator {
 		}
 		res.Type = kind
 		res.Network = nw.(*util.Network)
-		return res, true
+		if res.Parameters == nil {
+			res.Parameters = map[string]interface{}{}
+		}
+		return res, validateExtensions(e, kind, v, res.Parameters)
 	}
 }
 
 func bridge() util.Validator {
 	return bb("bridge", map[string]*util.Check{
 		"stp":           util.D(true, util.VB()),
-		"max-age":       util.C(util.VI(0, math.MaxInt8)),
-		"hello-time":    util.C(util.VI(0, math.MaxInt8)),
-		"forward-delay": util.C(util.VI(0, math.MaxInt8)),
-		"ageing-time":   util.C(util.VI(0, math.MaxInt8)),
-		"priority":      util.D(32768, util.VI(0, math.MaxInt16)),
+		"max-age":       util.C(util.VT(time.Second, 0, math.MaxInt8)),
+		"hello-time":    util.C(util.VT(time.Second, 0, math.MaxInt8)),
+		"forward-delay": util.C(util.VT(time.Second, 0, math.MaxInt8)),
+		"ageing-time":   util.C(util.VT(time.Second, 0, math.MaxInt8)),
+		"priority":      util.D(32768, util.VI(0, math.MaxUint16)),
+		// group-forward-mask is a netwrangler extension.
+		"group-forward-mask": util.C(util.VI(0, math.MaxUint16)),
+		// vlan-filtering, vlan-default-pvid, port-vlans, and port-pvid
+		// are netwrangler extensions.
+		"vlan-filtering":    util.C(util.VB()),
+		"vlan-default-pvid": util.C(util.VI(0, util.MaxVlanID)),
+		"port-vlans":        util.C(util.VPortVlans()),
+		"port-pvid":         util.C(util.VPortPvids()),
 	})
 }
 
 func bond() util.Validator {
 	return bb("bond", map[string]*util.Check{
+		"ad-actor-sys-prio":       util.C(util.VI(1, 65535)),
+		"ad-actor-system":         util.C(util.VMAC()),
 		"ad-select":               util.C(util.VS("stable", "bandwidth", "count")),
 		"all-slaves-active":       util.C(util.VB()),
 		"arp-all-targets":         util.C(util.VS("any", "all")),
-		"arp-interval":            util.C(util.VI(0, math.MaxInt8)),
+		"arp-interval":            util.C(util.VT(time.Millisecond, 0, math.MaxInt32)),
 		"arp-ip-targets":          util.C(util.VIPS(false)),
 		"arp-validate":            util.C(util.VS("none", "active", "backup", "all")),
-		"down-delay":              util.C(util.VI(0, math.MaxInt8)),
+		"down-delay":              util.C(util.VT(time.Millisecond, 0, math.MaxInt32)),
 		"fail-over-mac-policy":    util.C(util.VS("none", "active", "follow")),
 		"gratuitous-arp":          util.C(util.VI(1, 127)),
 		"lacp-rate":               util.C(util.VS("fast", "slow")),
-		"learn-packet-interval":   util.C(util.VI(1, 0x7fffffff)),
-		"mii-monitor-interval":    util.C(util.VI(0, math.MaxInt8)),
+		"learn-packet-interval":   util.C(util.VT(time.Second, 1, 0x7fffffff)),
+		"mii-monitor-interval":    util.C(util.VT(time.Millisecond, 0, math.MaxInt32)),
 		"min-links":               util.C(util.VI(1, math.MaxInt8)),
 		"mode":                    util.C(util.VS("balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb")),
 		"packets-per-slave":       util.C(util.VI(0, 65535)),
@@ -263,24 +701,56 @@ func bond() util.Validator {
 		"primary-reselect-policy": util.C(util.VS("always", "better", "failure")),
 		"resend-igmp":             util.C(util.VI(0, 255)),
 		"transmit-hash-policy":    util.C(util.VS("layer2", "layer3+4", "layer2+3", "encap2+3", "encap3+4")),
-		"up-delay":                util.C(util.VI(0, math.MaxInt8)),
+		"up-delay":                util.C(util.VT(time.Millisecond, 0, math.MaxInt32)),
+		// ns-ip6-targets, queue-ids, and tlb-dynamic-lb are netwrangler
+		// extensions.
+		"ns-ip6-targets": util.C(util.VIPS(false)),
+		"queue-ids":      util.C(util.VQueueIDs()),
+		"tlb-dynamic-lb": util.C(util.VB()),
 	})
 }
 
 func vlan() util.Validator {
 
 	type li struct {
-		L string `json:"link"`
-		I int    `json:"id"`
+		L  string   `json:"link"`
+		I  int      `json:"id"`
+		IQ []string `json:"ingress-qos-map"`
+		EQ []string `json:"egress-qos-map"`
 	}
 	checksI := map[string]*util.Check{
 		"macaddress": util.C(util.VMAC()),
+		"optional":   util.C(util.VB()),
+		"mtu":        util.C(util.VI(util.MinMTU, util.MaxMTU)),
+		// description, alias, required-family, wait-online-timeout,
+		// autoconnect, autoconnect-priority, emit-lldp, lldp, arp,
+		// multicast, allmulticast, group, after, and requires are
+		// netwrangler extensions.
+		"description":          util.C(util.VS()),
+		"alias":                util.C(util.VS()),
+		"required-family":      util.C(util.VS(util.RequiredFamilies...)),
+		"wait-online-timeout":  util.C(util.VI(1, util.MaxWaitOnlineTimeout)),
+		"autoconnect":          util.C(util.VB()),
+		"autoconnect-priority": util.C(util.VI(util.MinAutoconnectPriority, util.MaxAutoconnectPriority)),
+		"emit-lldp":            util.C(util.VEmitLLDP()),
+		"lldp":                 util.C(util.VB()),
+		"arp":                  util.C(util.VB()),
+		"multicast":            util.C(util.VB()),
+		"allmulticast":         util.C(util.VB()),
+		"group":                util.C(util.VI(0, util.MaxLinkGroup)),
+		"after":                util.C(util.VSS()),
+		"requires":             util.C(util.VSS()),
 	}
 	checksLI := map[string]*util.Check{
-		"link": util.C(util.VS()),
-		"id":   util.C(util.VI(0, 4094)),
+		"link":            util.C(util.VS()),
+		"id":              util.C(util.VI(0, 4094)),
+		"ingress-qos-map": util.C(util.VQOSMap(util.VlanPrioMax, util.SkbPrioMax)),
+		"egress-qos-map":  util.C(util.VQOSMap(util.SkbPrioMax, util.VlanPrioMax)),
 	}
 	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checksLI).Merge(util.ChecksSchema(checksI), util.SchemaOf(network()), util.ChecksSchema(extensionChecks("vlan"))), true
+		}
 		rres := &li{}
 		rresOK := util.ValidateAndMarshal(e, v, checksLI, rres)
 		res := util.NewInterface()
@@ -288,38 +758,218 @@ func vlan() util.Validator {
 		resOK := util.ValidateAndMarshal(e, v, checksI, &res)
 		res.Interfaces = []string{rres.L}
 		res.Parameters["id"] = rres.I
-		if nw, nwok := network()(e, "network", v); nwok {
-			if nw != nil {
-				network := nw.(*util.Network)
-				if network.Configure() {
-					res.Network = network
-				}
-			}
+		if rresOK && rres.I == 0 {
+			e.Warnf("%s: vlan id 0 only marks frames as priority tagged", k)
+		}
+		if len(rres.IQ) > 0 {
+			res.Parameters["ingress-qos-map"] = rres.IQ
+		}
+		if len(rres.EQ) > 0 {
+			res.Parameters["egress-qos-map"] = rres.EQ
+		}
+		if nw, nwok := virtualNetwork(e, v); nwok {
+			res.Network = nw
 		} else {
 			resOK = false
 		}
+		resOK = validateExtensions(e, "vlan", v, res.Parameters) && resOK
 		return res, (resOK && rresOK)
 	}
 }
 
+func tunnel() util.Validator {
+
+	type mlrt struct {
+		M string `json:"mode"`
+		L string `json:"local"`
+		R string `json:"remote"`
+		T int    `json:"ttl"`
+	}
+	checksI := map[string]*util.Check{
+		"macaddress": util.C(util.VMAC()),
+		"optional":   util.C(util.VB()),
+		"mtu":        util.C(util.VI(util.MinMTU, util.MaxMTU)),
+		// description, alias, required-family, wait-online-timeout,
+		// autoconnect, autoconnect-priority, arp, multicast,
+		// allmulticast, group, after, and requires are netwrangler
+		// extensions.
+		"description":          util.C(util.VS()),
+		"alias":                util.C(util.VS()),
+		"required-family":      util.C(util.VS(util.RequiredFamilies...)),
+		"wait-online-timeout":  util.C(util.VI(1, util.MaxWaitOnlineTimeout)),
+		"autoconnect":          util.C(util.VB()),
+		"autoconnect-priority": util.C(util.VI(util.MinAutoconnectPriority, util.MaxAutoconnectPriority)),
+		"arp":                  util.C(util.VB()),
+		"multicast":            util.C(util.VB()),
+		"allmulticast":         util.C(util.VB()),
+		"group":                util.C(util.VI(0, util.MaxLinkGroup)),
+		"after":                util.C(util.VSS()),
+		"requires":             util.C(util.VSS()),
+	}
+	modes := []string{}
+	for k := range util.TunnelModes {
+		modes = append(modes, k)
+	}
+	sort.Strings(modes)
+	checksMLRT := map[string]*util.Check{
+		"mode":   util.C(util.VS(modes...)),
+		"local":  util.C(util.VS()),
+		"remote": util.C(util.VS()),
+		"ttl":    util.C(util.VI(1, 255)),
+	}
+	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checksMLRT).Merge(util.ChecksSchema(checksI), util.SchemaOf(network()), util.ChecksSchema(extensionChecks("tunnel"))), true
+		}
+		rres := &mlrt{}
+		rresOK := util.ValidateAndMarshal(e, v, checksMLRT, rres)
+		res := util.NewInterface()
+		res.Type = "tunnel"
+		resOK := util.ValidateAndMarshal(e, v, checksI, &res)
+		res.Parameters["mode"] = rres.M
+		if rres.L != "" {
+			res.Parameters["local"] = rres.L
+		}
+		if rres.R != "" {
+			res.Parameters["remote"] = rres.R
+		}
+		if rres.T != 0 {
+			res.Parameters["ttl"] = rres.T
+		}
+		if nw, nwok := virtualNetwork(e, v); nwok {
+			res.Network = nw
+		} else {
+			resOK = false
+		}
+		resOK = validateExtensions(e, "tunnel", v, res.Parameters) && resOK
+		return res, (resOK && rresOK)
+	}
+}
+
+func veth() util.Validator {
+	type p struct {
+		P string `json:"peer"`
+	}
+	checksI := map[string]*util.Check{
+		"macaddress": util.C(util.VMAC()),
+		"optional":   util.C(util.VB()),
+		"mtu":        util.C(util.VI(util.MinMTU, util.MaxMTU)),
+		// description, alias, required-family, wait-online-timeout,
+		// autoconnect, autoconnect-priority, arp, multicast,
+		// allmulticast, group, after, and requires are netwrangler
+		// extensions.
+		"description":          util.C(util.VS()),
+		"alias":                util.C(util.VS()),
+		"required-family":      util.C(util.VS(util.RequiredFamilies...)),
+		"wait-online-timeout":  util.C(util.VI(1, util.MaxWaitOnlineTimeout)),
+		"autoconnect":          util.C(util.VB()),
+		"autoconnect-priority": util.C(util.VI(util.MinAutoconnectPriority, util.MaxAutoconnectPriority)),
+		"arp":                  util.C(util.VB()),
+		"multicast":            util.C(util.VB()),
+		"allmulticast":         util.C(util.VB()),
+		"group":                util.C(util.VI(0, util.MaxLinkGroup)),
+		"after":                util.C(util.VSS()),
+		"requires":             util.C(util.VSS()),
+	}
+	checksP := map[string]*util.Check{
+		"peer": util.C(util.VS()),
+	}
+	return func(e *util.Err, k string, v interface{}) (interface{}, bool) {
+		if util.Probing(v) {
+			return util.ChecksSchema(checksP).Merge(util.ChecksSchema(checksI), util.SchemaOf(network()), util.ChecksSchema(extensionChecks("veth"))), true
+		}
+		pres := &p{}
+		presOK := util.ValidateAndMarshal(e, v, checksP, pres)
+		res := util.NewInterface()
+		res.Type = "veth"
+		resOK := util.ValidateAndMarshal(e, v, checksI, &res)
+		res.Parameters["peer"] = pres.P
+		if nw, nwok := virtualNetwork(e, v); nwok {
+			res.Network = nw
+		} else {
+			resOK = false
+		}
+		resOK = validateExtensions(e, "veth", v, res.Parameters) && resOK
+		return res, (resOK && presOK)
+	}
+}
+
 // Netplan is the basic struct for netplan.io style network configs.
+// The top-level hostname and default-metric are netwrangler
+// extensions.
 type Netplan struct {
 	Network struct {
-		Version   int                    `json:"version"`
-		Renderer  string                 `json:"renderer,omitempty"`
-		Ethernets map[string]interface{} `json:"ethernets,omitempty"`
-		Bridges   map[string]interface{} `json:"bridges,omitempty"`
-		Bonds     map[string]interface{} `json:"bonds,omitempty"`
-		Vlans     map[string]interface{} `json:"vlans,omitempty"`
-		Wifis     map[string]interface{} `json:"wifis,omitempty"`
+		Version       int                    `json:"version"`
+		Renderer      string                 `json:"renderer,omitempty"`
+		Hostname      string                 `json:"hostname,omitempty"`
+		DefaultMetric int                    `json:"default-metric,omitempty"`
+		Ethernets     map[string]interface{} `json:"ethernets,omitempty"`
+		Bridges       map[string]interface{} `json:"bridges,omitempty"`
+		Bonds         map[string]interface{} `json:"bonds,omitempty"`
+		Vlans         map[string]interface{} `json:"vlans,omitempty"`
+		Tunnels       map[string]interface{} `json:"tunnels,omitempty"`
+		Veths         map[string]interface{} `json:"virtual-ethernets,omitempty"`
+		Wifis         map[string]interface{} `json:"wifis,omitempty"`
+	} `json:"network"`
+	bindMac     bool
+	strictMatch bool
+	out         *netplanOut
+}
+
+// netplanOut is the typed form of a Netplan that New renders a
+// Layout into for writing.
+type netplanOut struct {
+	Network struct {
+		Version       int               `json:"version"`
+		Renderer      string            `json:"renderer,omitempty"`
+		Hostname      string            `json:"hostname,omitempty"`
+		DefaultMetric int               `json:"default-metric,omitempty"`
+		Ethernets     map[string]Ether  `json:"ethernets,omitempty"`
+		Bridges       map[string]Bridge `json:"bridges,omitempty"`
+		Bonds         map[string]Bond   `json:"bonds,omitempty"`
+		Vlans         map[string]Vlan   `json:"vlans,omitempty"`
+		Tunnels       map[string]Tunnel `json:"tunnels,omitempty"`
+		Veths         map[string]Veth   `json:"virtual-ethernets,omitempty"`
 	} `json:"network"`
-	bindMac bool
 }
 
 func (n *Netplan) BindMacs() {
 	n.bindMac = true
 }
 
+// StrictMatch makes Compile fail when an ethernet stanza matches more
+// than one interface and is not used by a bond or a bridge, which
+// keeps an overly broad match from configuring NICs it was not meant
+// to.
+func (n *Netplan) StrictMatch() {
+	n.strictMatch = true
+}
+
+// checkAmbiguous adds an error to e for every ethernet stanza in
+// matchChildren that matched more than one interface without being
+// used by a bond or bridge in l.
+func checkAmbiguous(l *util.Layout, matchChildren map[string][]string, e *util.Err) {
+	aggregated := map[string]bool{}
+	for _, i := range l.Interfaces {
+		if i.Type != "bond" && i.Type != "bridge" {
+			continue
+		}
+		for _, sub := range i.Interfaces {
+			aggregated[sub] = true
+		}
+	}
+	ids := []string{}
+	for k := range matchChildren {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	for _, k := range ids {
+		if len(matchChildren[k]) > 1 && !aggregated[k] {
+			e.Errorf("ethernet:%s matches %d interfaces %v, only bonds and bridges can use an ambiguous match", k, len(matchChildren[k]), matchChildren[k])
+		}
+	}
+}
+
 func getNames(i map[string]interface{}) []string {
 	res := []string{}
 	if i == nil {
@@ -334,33 +984,114 @@ func getNames(i map[string]interface{}) []string {
 
 type Common struct {
 	*util.Network
-	MacAddress gnet.HardwareAddr `json:"macaddress,omitempty"`
-	Renderer   string            `json:"renderer,omitempty"`
-	Optional   bool              `json:"optional,omitempty"`
+	// AcceptRa shadows Network.AcceptRa so that a false value is
+	// written out instead of falling back to the netplan default.
+	AcceptRa *bool `json:"accept-ra,omitempty"`
+	// Addresses shadows Network.Addresses so that addresses with
+	// options can be written in the netplan map form, and
+	// AddressOptions hides Network.AddressOptions.
+	Addresses       []interface{}     `json:"addresses,omitempty"`
+	AddressOptions  *struct{}         `json:"address-options,omitempty"`
+	MacAddress      gnet.HardwareAddr `json:"macaddress,omitempty"`
+	MTU             int               `json:"mtu,omitempty"`
+	Renderer        string            `json:"renderer,omitempty"`
+	Optional        bool              `json:"optional,omitempty"`
+	Description     string            `json:"description,omitempty"`
+	Alias           string            `json:"alias,omitempty"`
+	RequiredFamily  string            `json:"required-family,omitempty"`
+	WaitOnline      int               `json:"wait-online-timeout,omitempty"`
+	WaitDevice      int               `json:"wait-device-timeout,omitempty"`
+	RpsCpus         string            `json:"rps-cpus,omitempty"`
+	XpsCpus         string            `json:"xps-cpus,omitempty"`
+	Autoconnect     *bool             `json:"autoconnect,omitempty"`
+	AutoconnectPrio *int              `json:"autoconnect-priority,omitempty"`
+	// EmitLLDP is written as a boolean unless it names an agent.
+	EmitLLDP     interface{} `json:"emit-lldp,omitempty"`
+	LLDP         *bool       `json:"lldp,omitempty"`
+	ARP          *bool       `json:"arp,omitempty"`
+	Multicast    *bool       `json:"multicast,omitempty"`
+	AllMulticast *bool       `json:"allmulticast,omitempty"`
+	Group        int         `json:"group,omitempty"`
+	After        []string    `json:"after,omitempty"`
+	Requires     []string    `json:"requires,omitempty"`
+	// Extensions are written at the top level of the stanza by Write.
+	Extensions map[string]interface{} `json:"-"`
 }
 
 func asCommon(i util.Interface) Common {
-	return Common{
-		Network:    i.Network,
-		Optional:   i.Optional,
-		MacAddress: i.MacAddress,
+	res := Common{
+		Network:         i.Network,
+		Optional:        i.Optional,
+		MacAddress:      i.MacAddress,
+		MTU:             i.MTU,
+		Description:     i.Description,
+		Alias:           i.Alias,
+		RequiredFamily:  i.RequiredFamily,
+		WaitOnline:      i.WaitOnlineTimeout,
+		WaitDevice:      i.WaitDeviceTimeout,
+		RpsCpus:         i.RpsCpus,
+		XpsCpus:         i.XpsCpus,
+		Autoconnect:     i.Autoconnect,
+		AutoconnectPrio: i.AutoconnectPriority,
+		LLDP:            i.LLDP,
+		ARP:             i.ARP,
+		Multicast:       i.Multicast,
+		AllMulticast:    i.AllMulticast,
+		Group:           i.Group,
+		After:           i.After,
+		Requires:        i.Requires,
+	}
+	_, res.Extensions = splitExtensions(i.Parameters)
+	switch i.EmitLLDP {
+	case "":
+	case "true", "false":
+		res.EmitLLDP = i.EmitLLDP == "true"
+	default:
+		res.EmitLLDP = i.EmitLLDP
+	}
+	if i.Network != nil {
+		acceptRa := i.Network.AcceptRa
+		res.AcceptRa = &acceptRa
+		for _, addr := range i.Network.Addresses {
+			if opts := i.Network.AddressOpts(addr); opts != nil {
+				res.Addresses = append(res.Addresses, map[string]*util.AddressOptions{addr.String(): opts})
+			} else {
+				res.Addresses = append(res.Addresses, addr)
+			}
+		}
 	}
+	return res
 }
 
 type Ether struct {
 	Common
-	Match     map[string]string `json:"match,omitempty"`
-	WakeOnLan bool              `json:"wakeonlan,omitempty"`
+	Match             map[string]string `json:"match,omitempty"`
+	WakeOnLan         bool              `json:"wakeonlan,omitempty"`
+	WakeOnLanModes    []string          `json:"wakeonlan-modes,omitempty"`
+	WakeOnLanPassword string            `json:"wakeonlan-password,omitempty"`
+	AlternativeNames  []string          `json:"alternative-names,omitempty"`
+	SetName           string            `json:"set-name,omitempty"`
 }
 
 func asEther(i util.Interface) Ether {
-	res := Ether{Common: asCommon(i)}
+	res := Ether{Common: asCommon(i), AlternativeNames: i.AlternativeNames}
 	res.MacAddress = nil
-	if v, ok := i.Parameters[`wakeonlan`]; ok && v.(bool) {
-		res.WakeOnLan = true
+	if v, ok := i.Parameters[`wakeonlan`]; ok {
+		res.WakeOnLan, _ = util.ValidateBool(&util.Err{}, "wakeonlan", v)
 	}
-	res.Match = map[string]string{
-		"macaddress": i.CurrentHwAddr.String(),
+	if v, ok := i.Parameters[`wakeonlan-modes`]; ok {
+		util.Remarshal(v, &res.WakeOnLanModes)
+	}
+	if v, ok := i.Parameters[`wakeonlan-password`]; ok {
+		res.WakeOnLanPassword, _ = v.(string)
+	}
+	if mac := i.BindHwAddr(); len(mac) > 0 {
+		res.Match = map[string]string{
+			"macaddress": mac.String(),
+		}
+	}
+	if i.Rename {
+		res.SetName = i.Name
 	}
 	return res
 }
@@ -372,9 +1103,10 @@ type Bond struct {
 }
 
 func asBond(i util.Interface) Bond {
+	params, _ := splitExtensions(i.Parameters)
 	return Bond{
 		Common:     asCommon(i),
-		Parameters: i.Parameters,
+		Parameters: params,
 		Interfaces: i.Interfaces,
 	}
 }
@@ -386,27 +1118,70 @@ type Bridge struct {
 }
 
 func asBridge(i util.Interface) Bridge {
+	params, _ := splitExtensions(i.Parameters)
 	return Bridge{
 		Common:     asCommon(i),
-		Parameters: i.Parameters,
+		Parameters: params,
 		Interfaces: i.Interfaces,
 	}
 }
 
 type Vlan struct {
 	Common
-	ID   int    `json:"id"`
-	Link string `json:"link"`
+	ID            int      `json:"id"`
+	Link          string   `json:"link"`
+	IngressQOSMap []string `json:"ingress-qos-map,omitempty"`
+	EgressQOSMap  []string `json:"egress-qos-map,omitempty"`
 }
 
 func asVlan(i util.Interface) Vlan {
-	return Vlan{
-		Common: asCommon(i),
-		ID:     i.Parameters[`id`].(int),
-		Link:   i.Interfaces[0],
+	res := Vlan{Common: asCommon(i)}
+	id, _ := util.ValidateInt(&util.Err{}, "id", i.Parameters[`id`], 0, 4094)
+	res.ID = int(id)
+	if m := i.QOSMap("ingress-qos-map"); len(m) > 0 {
+		res.IngressQOSMap = m
+	}
+	if m := i.QOSMap("egress-qos-map"); len(m) > 0 {
+		res.EgressQOSMap = m
+	}
+	if len(i.Interfaces) > 0 {
+		res.Link = i.Interfaces[0]
+	}
+	return res
+}
+
+type Tunnel struct {
+	Common
+	Mode   string `json:"mode"`
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+func asTunnel(i util.Interface) Tunnel {
+	res := Tunnel{Common: asCommon(i), Mode: i.TunnelMode()}
+	res.Local, _ = i.Parameters["local"].(string)
+	res.Remote, _ = i.Parameters["remote"].(string)
+	if v, ok := i.Parameters["ttl"]; ok {
+		ttl, _ := util.ValidateInt(&util.Err{}, "ttl", v, 1, 255)
+		res.TTL = int(ttl)
 	}
+	return res
+}
+
+// Veth is one end of a veth pair.
+type Veth struct {
+	Common
+	Peer string `json:"peer"`
+}
+
+func asVeth(i util.Interface) Veth {
+	res := Veth{Common: asCommon(i), Peer: i.VethPeer()}
+	return res
 }
 
+// Write renders the Layout the Netplan was created from as a single
+// netplan.io config file at dest, or to stdout if dest is empty.
 func (n *Netplan) Write(dest string) error {
 	out := os.Stdout
 	if dest != "" {
@@ -417,20 +1192,49 @@ func (n *Netplan) Write(dest string) error {
 		defer o.Close()
 		out = o
 	}
-	toElide := []string{}
-	for k := range n.Network.Ethernets {
-		if !n.bindMac {
-			delete(n.Network.Ethernets[k].(Ether).Match, "macaddress")
-		}
-		buf, err := yaml.Marshal(n.Network.Ethernets[k])
-		if err == nil && string(buf) == "{}\n" {
-			toElide = append(toElide, k)
+	res := &netplanOut{}
+	res.Network.Version = 2
+	res.Network.Renderer = n.Network.Renderer
+	res.Network.Hostname = n.Network.Hostname
+	res.Network.DefaultMetric = n.Network.DefaultMetric
+	if n.out != nil {
+		res.Network.Bonds = n.out.Network.Bonds
+		res.Network.Bridges = n.out.Network.Bridges
+		res.Network.Vlans = n.out.Network.Vlans
+		res.Network.Tunnels = n.out.Network.Tunnels
+		res.Network.Veths = n.out.Network.Veths
+		res.Network.Ethernets = map[string]Ether{}
+		for k, eth := range n.out.Network.Ethernets {
+			// Renamed interfaces can only be matched by MAC address.
+			if !n.bindMac && eth.Match != nil && eth.SetName == "" {
+				match := map[string]string{}
+				for mk, mv := range eth.Match {
+					if mk != "macaddress" {
+						match[mk] = mv
+					}
+				}
+				eth.Match = match
+			}
+			if len(eth.Match) == 0 {
+				eth.Match = nil
+			}
+			buf, err := yaml.Marshal(eth)
+			if err == nil && string(buf) == "{}\n" && len(eth.Extensions) == 0 {
+				continue
+			}
+			res.Network.Ethernets[k] = eth
 		}
 	}
-	for _, k := range toElide {
-		delete(n.Network.Ethernets, k)
+	var doc interface{} = res
+	if len(extensions) > 0 {
+		generic := map[string]interface{}{}
+		if err := util.Remarshal(res, &generic); err != nil {
+			return err
+		}
+		addExtensions(res, generic)
+		doc = generic
 	}
-	buf, err := yaml.Marshal(n)
+	buf, err := yaml.Marshal(doc)
 	if err != nil {
 		return err
 	}
@@ -438,25 +1242,38 @@ func (n *Netplan) Write(dest string) error {
 	return err
 }
 
-// New creates a new Netplan that will render using networkd.
+// New creates a new Netplan that will render using the renderer l
+// was read with, or util.DefaultRenderer if l does not have one.
 func New(l *util.Layout) *Netplan {
-	res := &Netplan{}
+	res := &Netplan{out: &netplanOut{}}
 	res.Network.Version = 2
-	res.Network.Renderer = "networkd"
-	res.Network.Ethernets = map[string]interface{}{}
-	res.Network.Bridges = map[string]interface{}{}
-	res.Network.Bonds = map[string]interface{}{}
-	res.Network.Vlans = map[string]interface{}{}
+	res.Network.Renderer = util.DefaultRenderer
+	if l.Renderer != "" {
+		res.Network.Renderer = l.Renderer
+	}
+	res.Network.Hostname = l.Hostname
+	res.Network.DefaultMetric = l.DefaultMetric
+	nw := &res.out.Network
+	nw.Ethernets = map[string]Ether{}
+	nw.Bridges = map[string]Bridge{}
+	nw.Bonds = map[string]Bond{}
+	nw.Vlans = map[string]Vlan{}
+	nw.Tunnels = map[string]Tunnel{}
+	nw.Veths = map[string]Veth{}
 	for _, i := range l.Interfaces {
 		switch i.Type {
 		case "physical":
-			res.Network.Ethernets[i.Name] = asEther(i)
+			nw.Ethernets[i.Name] = asEther(i)
 		case "bond":
-			res.Network.Bonds[i.Name] = asBond(i)
+			nw.Bonds[i.Name] = asBond(i)
 		case "bridge":
-			res.Network.Bridges[i.Name] = asBridge(i)
+			nw.Bridges[i.Name] = asBridge(i)
 		case "vlan":
-			res.Network.Vlans[i.Name] = asVlan(i)
+			nw.Vlans[i.Name] = asVlan(i)
+		case "tunnel":
+			nw.Tunnels[i.Name] = asTunnel(i)
+		case "veth":
+			nw.Veths[i.Name] = asVeth(i)
 		default:
 			log.Panicf("Unknown interface type %s", i.Type)
 		}
@@ -470,6 +1287,9 @@ func (n *Netplan) Compile(phys []util.Phy) (*util.Layout, error) {
 		Interfaces: map[string]util.Interface{},
 	}
 	util.ValidateInt(e, "version", n.Network.Version, 2, 2)
+	l.Renderer, _ = util.ValidateRenderer(e, "renderer", n.Network.Renderer)
+	l.Hostname = n.Network.Hostname
+	l.DefaultMetric = n.Network.DefaultMetric
 	if n.Network.Wifis != nil {
 		e.Errorf("Wifi interfaces not supported")
 	}
@@ -525,6 +1345,20 @@ func (n *Netplan) Compile(phys []util.Phy) (*util.Layout, error) {
 			e.Errorf("Ethernet interface %s does not resolve to any interfaces", k)
 			continue
 		}
+		if intf.SetName != "" {
+			// Without match criteria the stanza would stop matching
+			// the interface once it has been renamed.
+			if intf.Match.Name == "" && effectiveMatch(intf.Match, k).Name != "" {
+				e.Errorf("ethernet:%s: set-name requires a match", k)
+				continue
+			}
+			if len(realInts) != 1 {
+				e.Errorf("ethernet:%s: set-name requires a match that resolves to a single interface, not %d", k, len(realInts))
+				continue
+			}
+			realInts[0].Name = intf.SetName
+			realInts[0].Rename = true
+		}
 		intNames := []string{}
 		for _, realInt := range realInts {
 			intNames = append(intNames, realInt.Name)
@@ -550,31 +1384,94 @@ func (n *Netplan) Compile(phys []util.Phy) (*util.Layout, error) {
 			addOther(k, k, nv.(util.Interface))
 		}
 	}
+	for _, k := range getNames(n.Network.Tunnels) {
+		nv, valid := tunnel()(e, "tunnel:"+k, n.Network.Tunnels[k])
+		if valid {
+			addOther(k, k, nv.(util.Interface))
+		}
+	}
+	for _, k := range getNames(n.Network.Veths) {
+		nv, valid := veth()(e, "veth:"+k, n.Network.Veths[k])
+		if valid {
+			addOther(k, k, nv.(util.Interface))
+		}
+	}
+	// Peers of veths that are not declared themselves are created
+	// without any config, as the kernel creates both ends at once.
+	for _, k := range getNames(n.Network.Veths) {
+		peer := l.Interfaces[k].VethPeer()
+		if _, ok := l.Interfaces[peer]; ok || peer == "" || peer == k {
+			continue
+		}
+		intf := util.NewInterface()
+		intf.Type = "veth"
+		intf.Parameters["peer"] = k
+		addOther(peer, peer, intf)
+	}
+	if n.strictMatch {
+		checkAmbiguous(l, matchChildren, e)
+	}
 	for k, v := range l.Interfaces {
 		v.Interfaces = realSubs(v.Interfaces)
 		l.Interfaces[k] = v
 	}
+	e.Merge(l.ExpandHostnames(phys))
 	e.Merge(l.Validate())
 	return l, e.OrNil()
 }
 
-// Read satisfies the Reader interface so that Netplan can be used as
-// a input format.
-func (n *Netplan) Read(src string, phys []util.Phy) (*util.Layout, error) {
+// MatchReport reports how the ethernet stanzas in n resolve against
+// phys without compiling the rest of the config.  Only the match
+// sections of the stanzas are validated.
+func (n *Netplan) MatchReport(phys []util.Phy) (*util.MatchReport, error) {
+	e := &util.Err{Prefix: "netplan"}
+	checks := map[string]*util.Check{
+		"match": util.C(phymatch()),
+	}
+	matches := map[string]util.Match{}
+	for _, k := range getNames(n.Network.Ethernets) {
+		res := phy{}
+		if !util.ValidateAndMarshal(e, n.Network.Ethernets[k], checks, &res) {
+			continue
+		}
+		matches[k] = effectiveMatch(res.Match, k)
+	}
+	if !e.Empty() {
+		return nil, e
+	}
+	return util.NewMatchReport(matches, phys), nil
+}
+
+func (n *Netplan) load(src string) error {
 	in := os.Stdin
 	if src != "" {
 		i, e := os.Open(src)
 		if e != nil {
-			return nil, e
+			return e
 		}
 		defer i.Close()
 		in = i
 	}
 	buf, err := ioutil.ReadAll(in)
 	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(buf, n)
+}
+
+// ReadMatchReport reads a netplan config from src and reports how its
+// ethernet stanzas resolve against phys.
+func (n *Netplan) ReadMatchReport(src string, phys []util.Phy) (*util.MatchReport, error) {
+	if err := n.load(src); err != nil {
 		return nil, err
 	}
-	if err := yaml.Unmarshal(buf, n); err != nil {
+	return n.MatchReport(phys)
+}
+
+// Read satisfies the Reader interface so that Netplan can be used as
+// a input format.
+func (n *Netplan) Read(src string, phys []util.Phy) (*util.Layout, error) {
+	if err := n.load(src); err != nil {
 		return nil, err
 	}
 	return n.Compile(phys)
@@ -0,0 +1,64 @@
+package netplan
+
+import (
+	"fmt"
+
+	yaml "github.com/ghodss/yaml"
+)
+
+// mergeDoc merges override into base the way netplan merges the files
+// it reads: mappings are merged key by key, and any other value in
+// override replaces the one in base.  Lists are leaves as well, so an
+// override that sets the addresses of an interface replaces them
+// instead of adding to them.  base is modified in place.
+func mergeDoc(base, override interface{}) interface{} {
+	b, bok := base.(map[string]interface{})
+	o, ook := override.(map[string]interface{})
+	if !bok || !ook {
+		return override
+	}
+	for k, v := range o {
+		if bv, ok := b[k]; ok {
+			b[k] = mergeDoc(bv, v)
+		} else {
+			b[k] = v
+		}
+	}
+	return b
+}
+
+// loadDoc parses a netplan document into its generic form.  An empty
+// document is an empty mapping.
+func loadDoc(name string, buf []byte) (map[string]interface{}, error) {
+	res := map[string]interface{}{}
+	if err := yaml.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if res == nil {
+		res = map[string]interface{}{}
+	}
+	return res, nil
+}
+
+// Patch deep merges the netplan document override into base with
+// netplan's leaf override semantics, and returns the merged document.
+// This lets callers that keep a base config and small overrides to it
+// compute the effective config before compiling it.
+func Patch(base, override []byte) ([]byte, error) {
+	b, err := loadDoc("base", base)
+	if err != nil {
+		return nil, err
+	}
+	o, err := loadDoc("override", override)
+	if err != nil {
+		return nil, err
+	}
+	res, err := yaml.Marshal(mergeDoc(b, o))
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(res, &Netplan{}); err != nil {
+		return nil, fmt.Errorf("merged document is not netplan: %v", err)
+	}
+	return res, nil
+}
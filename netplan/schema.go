@@ -0,0 +1,65 @@
+package netplan
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	yaml "github.com/ghodss/yaml"
+	"github.com/rackn/netwrangler/util"
+)
+
+// Schema returns a JSON Schema describing the subset of netplan that
+// netwrangler supports.  It is generated from the same validators
+// that Compile uses.  Keys that netwrangler does not know about are
+// ignored by Compile, so the schema allows them as well.
+func Schema() util.Schema {
+	stanzas := func(v util.Validator) util.Schema {
+		return util.Schema{
+			"type":                 "object",
+			"additionalProperties": util.SchemaOf(v),
+		}
+	}
+	return util.Schema{
+		"$schema":  "http://json-schema.org/draft-07/schema#",
+		"title":    "netplan (netwrangler subset)",
+		"type":     "object",
+		"required": []string{"network"},
+		"properties": map[string]interface{}{
+			"network": util.Schema{
+				"type":     "object",
+				"required": []string{"version"},
+				"properties": map[string]interface{}{
+					"version":           util.Schema{"type": "integer", "enum": []interface{}{2}},
+					"renderer":          util.SchemaOf(util.VS(util.RendererNames()...)),
+					"hostname":          util.SchemaOf(util.VS()),
+					"default-metric":    util.SchemaOf(util.VI(1, math.MaxUint32)),
+					"ethernets":         stanzas(ethernet()),
+					"bonds":             stanzas(bond()),
+					"bridges":           stanzas(bridge()),
+					"vlans":             stanzas(vlan()),
+					"tunnels":           stanzas(tunnel()),
+					"virtual-ethernets": stanzas(veth()),
+					"wifis":             util.Schema{"not": util.Schema{}},
+				},
+			},
+		},
+	}
+}
+
+// ValidateSchema checks a raw netplan document (in either YAML or
+// JSON form) against Schema, and returns all the ways in which it
+// does not conform.  A document that passes can still fail to
+// compile, as the schema cannot express constraints that span keys
+// or that depend on the physical interfaces present.
+func ValidateSchema(buf []byte) []error {
+	js, err := yaml.YAMLToJSON(buf)
+	if err != nil {
+		return []error{fmt.Errorf("Error parsing netplan: %v", err)}
+	}
+	var doc interface{}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return []error{fmt.Errorf("Error parsing netplan: %v", err)}
+	}
+	return Schema().Validate("", doc)
+}
@@ -0,0 +1,703 @@
+// Package nmkeyfile implements support for writing NetworkManager
+// keyfile connection profiles, as found in
+// /etc/NetworkManager/system-connections/*.nmconnection
+package nmkeyfile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+	"github.com/rackn/netwrangler/util"
+)
+
+// NMKeyfile holds the internal information needed to write out a
+// keyfile for every interface in a Layout.
+type NMKeyfile struct {
+	*util.Layout
+	bindMacs        bool
+	dest, finalDest string
+	profiles        []*profile
+}
+
+func (n *NMKeyfile) BindMacs() {
+	n.bindMacs = true
+}
+
+// New returns a new NMKeyfile for l.
+func New(l *util.Layout) *NMKeyfile {
+	return &NMKeyfile{Layout: l}
+}
+
+// uuid derives a stable UUID for the connection profile of name, so
+// that rewriting a Layout does not create new connections.
+func uuid(name string) string {
+	sum := sha1.Sum([]byte("netwrangler:" + name))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// connTypes maps Interface types to NetworkManager connection types.
+var connTypes = map[string]string{
+	"physical": "ethernet",
+	"bond":     "bond",
+	"bridge":   "bridge",
+	"vlan":     "vlan",
+	"tunnel":   "ip-tunnel",
+	"veth":     "veth",
+}
+
+// tunnelModes maps tunnel modes to the numbers NetworkManager uses
+// for them in the [ip-tunnel] section.
+var tunnelModes = map[string]int{
+	"ipip":      1,
+	"gre":       2,
+	"sit":       3,
+	"ip6ip6":    6,
+	"ipip6":     7,
+	"ip6gre":    8,
+	"gretap":    10,
+	"ip6gretap": 11,
+}
+
+// bondOpts maps bond parameters to the names of the kernel bonding
+// options NetworkManager expects in the [bond] section.
+var bondOpts = map[string]string{
+	"mode":                    "mode",
+	"transmit-hash-policy":    "xmit_hash_policy",
+	"lacp-rate":               "lacp_rate",
+	"mii-monitor-interval":    "miimon",
+	"min-links":               "min_links",
+	"ad-select":               "ad_select",
+	"ad-actor-system":         "ad_actor_system",
+	"ad-actor-sys-prio":       "ad_actor_sys_prio",
+	"all-slaves-active":       "all_slaves_active",
+	"arp-interval":            "arp_interval",
+	"arp-ip-targets":          "arp_ip_target",
+	"arp-validate":            "arp_validate",
+	"arp-all-targets":         "arp_all_targets",
+	"ns-ip6-targets":          "ns_ip6_target",
+	"up-delay":                "updelay",
+	"down-delay":              "downdelay",
+	"fail-over-mac-policy":    "fail_over_mac",
+	"gratuitous-arp":          "num_grat_arp",
+	"packets-per-slave":       "packets_per_slave",
+	"primary":                 "primary",
+	"primary-reselect-policy": "primary_reselect",
+	"resend-igmp":             "resend_igmp",
+	"learn-packet-interval":   "lp_interval",
+	"tlb-dynamic-lb":          "tlb_dynamic_lb",
+}
+
+// bridgeOpts maps bridge parameters to their names in the [bridge]
+// section.
+var bridgeOpts = map[string]string{
+	"stp":                "stp",
+	"priority":           "priority",
+	"max-age":            "max-age",
+	"hello-time":         "hello-time",
+	"forward-delay":      "forward-delay",
+	"ageing-time":        "ageing-time",
+	"group-forward-mask": "group-forward-mask",
+	"vlan-filtering":     "vlan-filtering",
+	"vlan-default-pvid":  "vlan-default-pvid",
+}
+
+// wolFlags are the NetworkManager wake-on-lan flags for each mode.
+var wolFlags = map[string]int{
+	"phy":       0x2,
+	"unicast":   0x4,
+	"multicast": 0x8,
+	"broadcast": 0x10,
+	"arp":       0x20,
+	"magic":     0x40,
+}
+
+// portVlans returns the bridge-port vlans of the port of the bridge
+// parent.  NetworkManager only gives the port the VLANs listed, so a
+// port without a PVID of its own lists the default one, and a trunk
+// port with a PVID of 0 lists none.
+func portVlans(parent util.Interface, port string) string {
+	res := parent.PortVlans(port)
+	if pvid, _ := parent.PortPvid(port); pvid != 0 {
+		res = append([]string{fmt.Sprintf("%d pvid untagged", pvid)}, res...)
+	}
+	return strings.Join(res, ",")
+}
+
+func optVal(v interface{}) string {
+	switch val := v.(type) {
+	case bool:
+		if val {
+			return "1"
+		}
+		return "0"
+	case string:
+		return val
+	}
+	vals := []string{}
+	if util.Remarshal(v, &vals) == nil {
+		return strings.Join(vals, ",")
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	res := []string{}
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// keyfile accumulates the sections of a keyfile in the order they
+// are first written to.
+type keyfile struct {
+	order    []string
+	sections map[string][]string
+}
+
+func (k *keyfile) set(section, key string, v interface{}) {
+	if k.sections == nil {
+		k.sections = map[string][]string{}
+	}
+	if _, ok := k.sections[section]; !ok {
+		k.order = append(k.order, section)
+	}
+	k.sections[section] = append(k.sections[section], fmt.Sprintf("%s=%v", key, v))
+}
+
+func (k *keyfile) write(f io.Writer) {
+	for idx, section := range k.order {
+		if idx > 0 {
+			fmt.Fprintln(f)
+		}
+		fmt.Fprintf(f, "[%s]\n", section)
+		for _, line := range k.sections[section] {
+			fmt.Fprintln(f, line)
+		}
+	}
+}
+
+func (n *NMKeyfile) writeLink(i util.Interface, e *util.Err, kf *keyfile) {
+	kf.set("connection", "id", i.Name)
+	kf.set("connection", "uuid", uuid(i.Name))
+	kf.set("connection", "type", connTypes[i.Type])
+	if !(n.bindMacs && i.Type == "physical") {
+		kf.set("connection", "interface-name", i.Name)
+	}
+	if !i.Autoconnects() {
+		kf.set("connection", "autoconnect", false)
+	}
+	if i.AutoconnectPriority != nil {
+		kf.set("connection", "autoconnect-priority", *i.AutoconnectPriority)
+	}
+	if len(i.OrderAfter()) > 0 {
+		e.Warnf("%s: after and requires are unsupported by NetworkManager, use autoconnect-priority instead, ignoring them", i.Name)
+	}
+	for _, pName := range n.Child2Parent[i.Name] {
+		parent := n.Interfaces[pName]
+		if parent.Type == "bond" || parent.Type == "bridge" {
+			kf.set("connection", "master", parent.Name)
+			kf.set("connection", "slave-type", parent.Type)
+		}
+		if id := parent.QueueID(i.Name); id != 0 && parent.Type == "bond" {
+			kf.set("bond-port", "queue-id", id)
+		}
+		if parent.Type == "bridge" && parent.VlanFiltering() && parent.HasPortVlans(i.Name) {
+			kf.set("bridge-port", "vlans", portVlans(parent, i.Name))
+		}
+	}
+	if i.LLDP != nil {
+		lldp := "disable"
+		if *i.LLDP {
+			lldp = "enable"
+		}
+		kf.set("connection", "lldp", lldp)
+	}
+	if i.EmitLLDP != "" {
+		e.Warnf("%s: NetworkManager can only receive LLDP, ignoring emit-lldp", i.Name)
+	}
+	if i.Alias != "" {
+		e.Warnf("%s: aliases are unsupported by NetworkManager, ignoring alias", i.Name)
+	}
+	if i.WaitOnlineTimeout != 0 {
+		e.Warnf("%s: wait-online-timeout is unsupported by NetworkManager, ignoring it", i.Name)
+	}
+	if i.WaitDeviceTimeout != 0 {
+		e.Warnf("%s: wait-device-timeout is unsupported by NetworkManager, ignoring it", i.Name)
+	}
+	for _, f := range i.LinkFlags() {
+		e.Warnf("%s: %s is unsupported by NetworkManager, ignoring it", i.Name, f.Name)
+	}
+	if i.Group != 0 {
+		e.Warnf("%s: group is unsupported by NetworkManager, ignoring it", i.Name)
+	}
+	if i.RpsCpus != "" {
+		e.Warnf("%s: rps-cpus is unsupported by NetworkManager, ignoring it", i.Name)
+	}
+	if i.XpsCpus != "" {
+		e.Warnf("%s: xps-cpus is unsupported by NetworkManager, ignoring it", i.Name)
+	}
+	if i.MTU != 0 && i.Type != "tunnel" {
+		kf.set("ethernet", "mtu", i.MTU)
+	}
+	switch i.Type {
+	case "physical":
+		if n.bindMacs {
+			kf.set("ethernet", "mac-address", i.BindHwAddr())
+		}
+		if len(i.MacAddress) > 0 {
+			kf.set("ethernet", "cloned-mac-address", i.MacAddress)
+		}
+		modes, password := i.WakeOnLan()
+		flags := 0
+		for _, mode := range modes {
+			flags |= wolFlags[mode]
+		}
+		if flags != 0 {
+			kf.set("ethernet", "wake-on-lan", flags)
+		}
+		if password != "" {
+			kf.set("ethernet", "wake-on-lan-password", password)
+		}
+		if i.Rename {
+			e.Warnf("%s: renaming physical interfaces is unsupported by NetworkManager, ignoring it", i.Name)
+		}
+		if len(i.AlternativeNames) > 0 {
+			e.Warnf("%s: alternative-names are unsupported by NetworkManager, ignoring %v", i.Name, i.AlternativeNames)
+		}
+	case "bond":
+		for _, k := range sortedKeys(i.Parameters) {
+			if name, ok := bondOpts[k]; ok {
+				kf.set("bond", name, optVal(i.Parameters[k]))
+			}
+		}
+		if len(i.MacAddress) > 0 {
+			kf.set("ethernet", "cloned-mac-address", i.MacAddress)
+		}
+	case "bridge":
+		for _, k := range sortedKeys(i.Parameters) {
+			if name, ok := bridgeOpts[k]; ok {
+				v := i.Parameters[k]
+				if b, isBool := v.(bool); isBool {
+					v = fmt.Sprintf("%t", b)
+				}
+				kf.set("bridge", name, v)
+			}
+		}
+		if len(i.MacAddress) > 0 {
+			kf.set("bridge", "mac-address", i.MacAddress)
+		}
+	case "vlan":
+		kf.set("vlan", "id", i.Parameters["id"])
+		kf.set("vlan", "parent", i.Interfaces[0])
+		if maps := i.QOSMap("ingress-qos-map"); len(maps) > 0 {
+			kf.set("vlan", "ingress-priority-map", strings.Join(maps, ","))
+		}
+		if maps := i.QOSMap("egress-qos-map"); len(maps) > 0 {
+			kf.set("vlan", "egress-priority-map", strings.Join(maps, ","))
+		}
+		if len(i.MacAddress) > 0 {
+			kf.set("ethernet", "cloned-mac-address", i.MacAddress)
+		}
+	case "tunnel":
+		kf.set("ip-tunnel", "mode", tunnelModes[i.TunnelMode()])
+		for _, k := range []string{"local", "remote", "ttl"} {
+			if v, ok := i.Parameters[k]; ok {
+				kf.set("ip-tunnel", k, v)
+			}
+		}
+		if i.MTU != 0 {
+			kf.set("ip-tunnel", "mtu", i.MTU)
+		}
+		if len(i.MacAddress) > 0 {
+			kf.set("ethernet", "cloned-mac-address", i.MacAddress)
+		}
+	case "veth":
+		kf.set("veth", "peer", i.VethPeer())
+		if len(i.MacAddress) > 0 {
+			kf.set("ethernet", "cloned-mac-address", i.MacAddress)
+		}
+	default:
+		e.Errorf("Cannot write interface %s:%s", i.Type, i.Name)
+	}
+}
+
+// writeRaOverrides writes the ra-overrides of nw.  NetworkManager
+// applies the same settings to DHCPv6 and router advertisements, so
+// ignoring the DNS servers from one ignores them from both.
+func writeRaOverrides(name string, e *util.Err, kf *keyfile, nw *util.Network) {
+	o := nw.RaOverrides
+	if o == nil {
+		return
+	}
+	if !o.UseDNS && (nw.Dhcp6Overrides == nil || nw.Dhcp6Overrides.UseDNS) {
+		kf.set("ipv6", "ignore-auto-dns", true)
+	}
+	if o.Table != 0 {
+		kf.set("ipv6", "route-table", o.Table)
+	}
+	if !o.UseAutonomousPrefix {
+		e.Warnf("%s: use-autonomous-prefix is unsupported by NetworkManager, ignoring it", name)
+	}
+}
+
+// writeDhcpTable writes the table the routes from DHCPv4 go in.
+// NetworkManager puts every IPv4 route of the connection that does not
+// set a table of its own there, so the table is only written when
+// there are no such static routes.
+func (n *NMKeyfile) writeDhcpTable(i util.Interface, e *util.Err, kf *keyfile, table int) {
+	static := i.Network.Gateway4 != nil
+	for _, r := range n.routes(i) {
+		if r.To != nil && r.To.IP.To4() != nil && r.Table == 0 {
+			static = true
+		}
+	}
+	if static {
+		e.Warnf("%s: NetworkManager would also put the static IPv4 routes without a table in dhcp4-overrides route-table, ignoring it", i.Name)
+		return
+	}
+	kf.set("ipv4", "route-table", table)
+}
+
+func writeOverrides(kf *keyfile, section string, o *util.Overrides) {
+	if o == nil {
+		return
+	}
+	if !o.UseDNS {
+		kf.set(section, "ignore-auto-dns", true)
+	}
+	if !o.UseRoutes {
+		kf.set(section, "ignore-auto-routes", true)
+	}
+	if !o.SendHostname {
+		kf.set(section, "dhcp-send-hostname", false)
+	} else if o.Hostname != "" {
+		kf.set(section, "dhcp-hostname", o.Hostname)
+	}
+	if o.RouteMetric != 0 {
+		kf.set(section, "route-metric", o.RouteMetric)
+	}
+}
+
+// routes returns the routes that go out of i.  Routes that another
+// interface sends out of i with dev belong to the connection for i.
+func (n *NMKeyfile) routes(i util.Interface) []util.Route {
+	res := []util.Route{}
+	for _, r := range i.Network.Routes {
+		if r.DevFor(i) == i.Name {
+			res = append(res, r)
+		}
+	}
+	names := []string{}
+	for k := range n.Interfaces {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, other := range names {
+		on := n.Interfaces[other].Network
+		if other == i.Name || on == nil {
+			continue
+		}
+		for _, r := range on.Routes {
+			if r.Dev == i.Name {
+				res = append(res, r)
+			}
+		}
+	}
+	return res
+}
+
+func (n *NMKeyfile) writeFamily(i util.Interface, e *util.Err, kf *keyfile, v6 bool) {
+	nw := i.Network
+	section, method := "ipv4", "disabled"
+	if v6 {
+		section = "ipv6"
+	}
+	isFamily := func(a *gnet.IPNet) bool {
+		return a != nil && (a.IP.To4() == nil) == v6
+	}
+	addrs := []*gnet.IPNet{}
+	for _, a := range nw.Addresses {
+		if isFamily(a) {
+			addrs = append(addrs, a)
+		}
+	}
+	switch {
+	case !v6 && nw.Dhcp4, v6 && nw.AcceptRa:
+		method = "auto"
+	case v6 && nw.Dhcp6:
+		method = "dhcp"
+	case len(addrs) > 0:
+		method = "manual"
+	}
+	kf.set(section, "method", method)
+	if v6 && nw.IPv6MTU != 0 {
+		kf.set(section, "mtu", nw.IPv6MTU)
+	}
+	if v6 && nw.IPv6Token != "" {
+		// NetworkManager only uses the token with EUI-64 addresses.
+		kf.set(section, "addr-gen-mode", "eui64")
+		kf.set(section, "token", nw.IPv6Token)
+	}
+	for idx, a := range addrs {
+		kf.set(section, fmt.Sprintf("address%d", idx+1), a)
+		if opts := nw.AddressOpts(a); opts != nil {
+			e.Warnf("%s: address options for %s are unsupported by NetworkManager, ignoring them", i.Name, a)
+		}
+	}
+	routes := n.routes(i)
+	gw, metric, bits := nw.Gateway4, nw.Gateway4Metric, 32
+	dhcp, o := nw.Dhcp4, nw.Dhcp4Overrides
+	if v6 {
+		gw, metric, bits = nw.Gateway6, nw.Gateway6Metric, 128
+		dhcp, o = nw.Dhcp6, nw.Dhcp6Overrides
+	}
+	// route-metric is also the metric of the routes from DHCP, so a
+	// gateway with a different metric becomes a route as well.
+	dhcpMetric := dhcp && o != nil && o.RouteMetric != 0 && metric != 0
+	if gw != nil && (nw.GatewayOnLink || dhcpMetric) {
+		// The gateway key cannot be on-link, so it becomes a route.
+		zero := &gnet.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, bits)}
+		if v6 {
+			zero.IP = net.IPv6zero
+		}
+		routes = append([]util.Route{{To: zero, Via: gw, Metric: metric, OnLink: nw.GatewayOnLink}}, routes...)
+	} else if gw != nil {
+		kf.set(section, "gateway", gw.IP)
+		if metric != 0 {
+			kf.set(section, "route-metric", metric)
+		}
+	}
+	if nw.Nameservers != nil {
+		dns := []string{}
+		for _, a := range nw.Nameservers.Addresses {
+			if isFamily(a) {
+				dns = append(dns, a.IP.String())
+			}
+		}
+		if len(dns) > 0 {
+			kf.set(section, "dns", strings.Join(dns, ";")+";")
+		}
+	}
+	if !v6 {
+		domains := nw.Nameservers.Domains()
+		if nw.DNSDefaultRoute != nil && *nw.DNSDefaultRoute {
+			// NetworkManager routes every lookup that matches no
+			// other domain to connections with the root domain.
+			ns := util.NSInfo{Search: append(domains, util.RoutingOnlyPrefix+".")}
+			domains = ns.Domains()
+		}
+		if len(domains) > 0 {
+			kf.set(section, "dns-search", strings.Join(domains, ";")+";")
+		}
+	}
+	idx := 0
+	for _, r := range routes {
+		if !isFamily(r.To) && !isFamily(r.Via) {
+			continue
+		}
+		if r.Type == "nat" || r.Type == "multicast" {
+			e.Warnf("%s: %s routes are unsupported by NetworkManager, ignoring route to %s", i.Name, r.Type, r.To)
+			continue
+		}
+		idx++
+		to := r.To
+		if to == nil {
+			to = &gnet.IPNet{}
+		}
+		val := to.String()
+		if r.Via != nil {
+			val += "," + r.Via.IP.String()
+		}
+		if r.Metric != 0 {
+			if r.Via == nil {
+				val += ","
+			}
+			val += fmt.Sprintf(",%d", r.Metric)
+		}
+		kf.set(section, fmt.Sprintf("route%d", idx), val)
+		opts := []string{}
+		if r.Table != 0 {
+			opts = append(opts, fmt.Sprintf("table=%d", r.Table))
+		}
+		if r.OnLink {
+			opts = append(opts, "onlink=true")
+		}
+		if r.Type != "" && r.Type != "unicast" {
+			opts = append(opts, "type="+r.Type)
+		}
+		if r.Scope != "" && r.Scope != "global" {
+			e.Warnf("%s: route scopes are unsupported by NetworkManager, ignoring scope %s", i.Name, r.Scope)
+		}
+		if r.From != nil {
+			opts = append(opts, "src="+r.From.IP.String())
+		}
+		if len(opts) > 0 {
+			kf.set(section, fmt.Sprintf("route%d_options", idx), strings.Join(opts, ","))
+		}
+	}
+	idx = 0
+	for _, rule := range nw.RoutingPolicy {
+		if !isFamily(rule.From) && !isFamily(rule.To) {
+			continue
+		}
+		idx++
+		// NetworkManager requires every rule to have a priority, which
+		// always goes first so rules read back the same way.
+		prio := rule.Priority
+		if prio == 0 {
+			prio = 32765 - idx
+		}
+		rule.Priority = 0
+		kf.set(section, fmt.Sprintf("routing-rule%d", idx), fmt.Sprintf("priority %d %s", prio, rule.IPString()))
+	}
+	if v6 {
+		writeOverrides(kf, section, nw.Dhcp6Overrides)
+		writeRaOverrides(i.Name, e, kf, nw)
+		if nw.Duid != nil {
+			writeDuid(i.Name, e, kf, nw.Duid)
+		}
+	} else {
+		if nw.DhcpIdentifier != "" {
+			kf.set(section, "dhcp-client-id", nw.DhcpIdentifier)
+		}
+		writeOverrides(kf, section, nw.Dhcp4Overrides)
+		// never-default keeps the gateway from the lease out, but it
+		// would keep a static gateway out as well.  Without routes
+		// from the lease, ignore-auto-routes covers it already.
+		if o := nw.Dhcp4Overrides; nw.Dhcp4 && o != nil && o.UseRoutes && !o.UsesGateway() {
+			if nw.Gateway4 != nil {
+				e.Warnf("%s: NetworkManager would also ignore gateway4 for dhcp4-overrides use-gateway, ignoring it", i.Name)
+			} else {
+				kf.set(section, "never-default", true)
+			}
+		}
+		for _, k := range nw.Dhcp4Overrides.DhcpOptionKeys() {
+			e.Warnf("%s: dhcp4-overrides %s is unsupported by NetworkManager, ignoring it", i.Name, k)
+		}
+		if o := nw.Dhcp4Overrides; nw.Dhcp4 && o != nil && o.RouteTable != 0 {
+			n.writeDhcpTable(i, e, kf, o.RouteTable)
+		}
+	}
+	if nw.Iaid != nil {
+		kf.set(section, "dhcp-iaid", fmt.Sprintf("%d", *nw.Iaid))
+	}
+}
+
+// writeDuid writes the DUID NetworkManager uses for both DHCPv6 and
+// DHCPv4 with a duid client id.  It only generates link-layer DUIDs
+// by itself, so other kinds need their raw data.
+func writeDuid(name string, e *util.Err, kf *keyfile, d *util.Duid) {
+	val := d.String()
+	switch {
+	case val != "":
+	case d.Type == "link-layer":
+		val = "ll"
+	case d.Type == "link-layer-time":
+		val = "llt"
+	default:
+		e.Warnf("%s: NetworkManager cannot generate a %s duid without raw-data, ignoring it", name, d.Type)
+		return
+	}
+	kf.set("ipv6", "dhcp-duid", val)
+}
+
+func (n *NMKeyfile) writeNetwork(i util.Interface, e *util.Err, kf *keyfile) {
+	for _, pName := range n.Child2Parent[i.Name] {
+		if t := n.Interfaces[pName].Type; t == "bond" || t == "bridge" {
+			// Ports do not get any IP configuration of their own.
+			return
+		}
+	}
+	if !i.Network.Configure() {
+		kf.set("ipv4", "method", "disabled")
+		kf.set("ipv6", "method", "disabled")
+		return
+	}
+	if len(i.Network.Neighbors) > 0 {
+		e.Warnf("%s: static neighbors are unsupported by NetworkManager, ignoring them", i.Name)
+	}
+	if i.Network.WithoutCarrier() {
+		e.Warnf("%s: NetworkManager only ignores carrier for all devices in NetworkManager.conf, ignoring ignore-carrier and configure-without-carrier", i.Name)
+	}
+	if i.Network.GratuitousArpCount != 0 || i.Network.UnsolicitedNa {
+		e.Warnf("%s: gratuitous-arp-count and unsolicited-na are unsupported by NetworkManager, ignoring them", i.Name)
+	}
+	if i.Network.IPv6DadTransmits != nil {
+		e.Warnf("%s: ipv6-dad-transmits is unsupported by NetworkManager, ignoring it", i.Name)
+	}
+	if i.Network.IPForward != "" || i.Network.IPMasquerade != "" {
+		e.Warnf("%s: ip-forward and ip-masquerade are unsupported by NetworkManager, ignoring them", i.Name)
+	}
+	if dr := i.Network.DNSDefaultRoute; dr != nil && !*dr {
+		e.Warnf("%s: NetworkManager cannot keep a connection from being the default DNS route, ignoring dns-default-route", i.Name)
+	}
+	n.writeFamily(i, e, kf, false)
+	n.writeFamily(i, e, kf, true)
+}
+
+func (n *NMKeyfile) writeOut(i util.Interface, e *util.Err) {
+	kf := &keyfile{}
+	n.writeLink(i, e, kf)
+	n.writeNetwork(i, e, kf)
+	name := path.Join(n.dest, i.Name+".nmconnection")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		e.Errorf("Error creating %s: %v", name, err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "# Created by netwrangler\n")
+	if i.Description != "" {
+		fmt.Fprintf(f, "# %s\n", i.Description)
+	}
+	kf.write(f)
+}
+
+// Write implements the util.Writer interface.  For NMKeyfile, dest
+// must refer to a directory where the keyfiles will reside.  Like the
+// systemd writer, everything is rendered to a temp directory first,
+// and the contents of dest are only replaced if that succeeded.
+// NetworkManager ignores keyfiles that other users can read, so they
+// are all made readable only by their owner.
+func (n *NMKeyfile) Write(dest string) error {
+	tmp, err := ioutil.TempDir("", "netwrangler-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	e := &util.Err{Prefix: "nmkeyfile"}
+	n.finalDest = dest
+	n.dest = tmp
+	names := []string{}
+	for k := range n.Interfaces {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		n.writeOut(n.Interfaces[k], e)
+	}
+	if !e.Empty() {
+		return e
+	}
+	os.MkdirAll(n.finalDest, util.DirMode())
+	old, err := filepath.Glob(path.Join(n.finalDest, "*"))
+	if err != nil {
+		e.Merge(err)
+		return e
+	}
+	util.Replace(n.dest, n.finalDest, old, e)
+	return e.OrNil()
+}
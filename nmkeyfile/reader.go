@@ -0,0 +1,813 @@
+package nmkeyfile
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+	"github.com/rackn/netwrangler/util"
+)
+
+// createdBy is the comment the writer starts every keyfile with.
+const createdBy = "Created by netwrangler"
+
+// profile is a parsed keyfile connection profile.  NetworkManager
+// uses the last value of a key that is repeated in a section, so only
+// that one is kept.
+type profile struct {
+	name        string
+	description string
+	sections    map[string]map[string]string
+}
+
+func (p *profile) get(section, key string) (string, bool) {
+	v, ok := p.sections[section][key]
+	return v, ok
+}
+
+// has returns whether the profile has section at all.
+func (p *profile) has(section string) bool {
+	_, ok := p.sections[section]
+	return ok
+}
+
+func parseProfile(name string, buf []byte) (*profile, error) {
+	res := &profile{name: name, sections: map[string]map[string]string{}}
+	var cur map[string]string
+	sc := bufio.NewScanner(strings.NewReader(string(buf)))
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" {
+			continue
+		}
+		if l[0] == '#' || l[0] == ';' {
+			// Comments before the first section describe the
+			// connection, as the writer puts the description there.
+			if comment := strings.TrimSpace(l[1:]); cur == nil && comment != createdBy {
+				res.description = comment
+			}
+			continue
+		}
+		if l[0] == '[' {
+			if l[len(l)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: malformed section header %s", name, lineNo, l)
+			}
+			sName := l[1 : len(l)-1]
+			if cur = res.sections[sName]; cur == nil {
+				cur = map[string]string{}
+				res.sections[sName] = cur
+			}
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key=value, got %s", name, lineNo, l)
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("%s:%d: %s is not in a section", name, lineNo, l)
+		}
+		cur[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return res, sc.Err()
+}
+
+// Read satisfies the util.Reader interface.  For NMKeyfile, src must
+// be a directory containing NetworkManager keyfiles, usually
+// /etc/NetworkManager/system-connections.  Only files ending in
+// .nmconnection are read.
+func (n *NMKeyfile) Read(src string, phys []util.Phy) (*util.Layout, error) {
+	names, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	n.profiles = []*profile{}
+	for _, fi := range names {
+		if fi.IsDir() || path.Ext(fi.Name()) != ".nmconnection" {
+			continue
+		}
+		buf, err := ioutil.ReadFile(path.Join(src, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		p, err := parseProfile(fi.Name(), buf)
+		if err != nil {
+			return nil, err
+		}
+		n.profiles = append(n.profiles, p)
+	}
+	return n.Compile(phys)
+}
+
+// rTypes maps NetworkManager connection types to Interface types.
+var rTypes = map[string]string{
+	"802-3-ethernet": "physical",
+}
+
+func init() {
+	for k, v := range connTypes {
+		rTypes[v] = k
+	}
+}
+
+// rBool parses a keyfile boolean.
+func rBool(e *util.Err, k, v string) bool {
+	res, _ := util.ValidateBool(e, k, strings.ToLower(v))
+	return res
+}
+
+// rInt parses a keyfile integer.
+func rInt(e *util.Err, k, v string) int {
+	res, _ := util.ValidateInt(e, k, v, 0, 1<<32-1)
+	return int(res)
+}
+
+// rIP parses an address with an optional prefix.
+func rIP(e *util.Err, k, v string) *gnet.IPNet {
+	res, ok := util.ValidateIP(e, k, v)
+	if !ok {
+		return nil
+	}
+	return res
+}
+
+// rList splits a keyfile list, which is separated by semicolons and
+// usually has a trailing one.
+func rList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ';'
+	})
+}
+
+// numbered returns the values of the keys in section named prefix
+// followed by a number, ordered by that number, which is the order
+// NetworkManager applies them in.
+func (p *profile) numbered(section, prefix string) []string {
+	nums := []int{}
+	vals := map[int]string{}
+	for k, v := range p.sections[section] {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimPrefix(k, prefix))
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+		vals[num] = v
+	}
+	sort.Ints(nums)
+	res := make([]string, len(nums))
+	for idx, num := range nums {
+		res[idx] = vals[num]
+	}
+	return res
+}
+
+// hasGateway returns whether section sets a gateway the route-metric
+// can apply to.
+func (p *profile) hasGateway(section string) bool {
+	if _, ok := p.get(section, "gateway"); ok {
+		return true
+	}
+	for _, v := range p.numbered(section, "address") {
+		if strings.Contains(v, ",") {
+			return true
+		}
+	}
+	return false
+}
+
+// rParam translates a [bond] or [bridge] option into a Parameter
+// value.
+func rParam(e *util.Err, k, v string) interface{} {
+	switch k {
+	case "arp-ip-targets", "ns-ip6-targets":
+		return strings.Split(v, ",")
+	case "stp", "all-slaves-active", "tlb-dynamic-lb", "vlan-filtering":
+		return rBool(e, k, v)
+	case "ad-actor-system":
+		res, _ := util.ValidateMac(e, k, v)
+		return res
+	}
+	if res, ok := util.ValidateInt(&util.Err{}, k, v, 0, 1<<32-1); ok {
+		return int(res)
+	}
+	return v
+}
+
+// rOpts reads the options in section that opts maps Parameters to.
+func rOpts(e *util.Err, p *profile, section string, opts map[string]string, i *util.Interface) {
+	for param, key := range opts {
+		if v, ok := p.get(section, key); ok {
+			i.Parameters[param] = rParam(e, param, v)
+		}
+	}
+}
+
+// rPortVlans reads the bridge-port vlans of port into the VLAN config
+// of the bridge parent.  A Layout only has untagged frames on the
+// PVID.
+func rPortVlans(e *util.Err, p *profile, parent util.Interface, port, v string) {
+	vlans, pvid := []string{}, int64(0)
+	for _, entry := range strings.Split(v, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		isPvid, untagged := false, false
+		for _, flag := range fields[1:] {
+			switch flag {
+			case "pvid":
+				isPvid = true
+			case "untagged":
+				untagged = true
+			default:
+				e.Errorf("%s: unknown bridge-port vlan flag %s", p.name, flag)
+			}
+		}
+		switch {
+		case isPvid:
+			pvid = int64(rInt(e, "vlans", fields[0]))
+		case untagged:
+			e.Warnf("%s: only the PVID of a port can be untagged, keeping %s tagged", p.name, fields[0])
+			fallthrough
+		default:
+			vlans = append(vlans, fields[0])
+		}
+	}
+	parent.SetPortVlans(port, vlans, pvid)
+}
+
+// rMac parses a MAC address key.  NetworkManager also accepts the
+// names of ways to generate one, which a Layout cannot express.
+func rMac(e *util.Err, p *profile, section, key string) gnet.HardwareAddr {
+	v, ok := p.get(section, key)
+	if !ok {
+		return nil
+	}
+	switch v {
+	case "preserve", "permanent", "random", "stable":
+		e.Warnf("%s: %s %s is unsupported, ignoring it", p.name, key, v)
+		return nil
+	}
+	res, _ := util.ValidateMac(e, p.name, v)
+	return res
+}
+
+// rWol reads the wake-on-lan settings of an [ethernet] section into
+// the Parameters of i.
+func rWol(e *util.Err, p *profile, i *util.Interface) {
+	if v, ok := p.get("ethernet", "wake-on-lan-password"); ok {
+		if pw, ok := util.ValidateWolPassword(e, p.name, v); ok {
+			i.Parameters["wakeonlan-password"] = pw
+		}
+	}
+	if v, ok := p.get("ethernet", "wake-on-lan"); ok {
+		flags := rInt(e, "wake-on-lan", v)
+		modes := []string{}
+		for _, mode := range util.WolModes {
+			switch {
+			case flags&wolFlags[mode] == 0:
+			case mode == "magic":
+				i.Parameters["wakeonlan"] = true
+			case mode == "secureon" && i.Parameters["wakeonlan-password"] == nil:
+				e.Warnf("%s: wake-on-lan secureon needs a wake-on-lan-password, ignoring it", p.name)
+			default:
+				modes = append(modes, mode)
+			}
+		}
+		if len(modes) > 0 {
+			i.Parameters["wakeonlan-modes"] = modes
+		}
+	}
+}
+
+// rPhy finds the physical nic an ethernet profile applies to, either
+// by its interface-name or by the mac-address it is bound to.
+func rPhy(e *util.Err, p *profile, phys []util.Phy) (util.Interface, bool) {
+	m := util.Match{}
+	if name, ok := p.get("connection", "interface-name"); ok {
+		m.Name = name
+	} else if mac := rMac(e, p, "ethernet", "mac-address"); len(mac) > 0 {
+		m.MacAddress = mac
+	} else {
+		e.Errorf("%s: needs an interface-name or mac-address to find its nic", p.name)
+		return util.Interface{}, false
+	}
+	intfs, _ := util.MatchPhys(m, util.NewInterface(), phys)
+	if len(intfs) == 0 {
+		e.Errorf("%s: does not match any interfaces", p.name)
+		return util.Interface{}, false
+	}
+	res := intfs[0]
+	res.MatchID = res.Name
+	return res, true
+}
+
+// rLink translates the [connection] section of p and the section of
+// its connection type into an Interface.
+func rLink(e *util.Err, p *profile, phys []util.Phy) (util.Interface, bool) {
+	connType, _ := p.get("connection", "type")
+	typ, ok := rTypes[connType]
+	if !ok {
+		e.Errorf("%s: connection type %s is not supported", p.name, connType)
+		return util.Interface{}, false
+	}
+	var i util.Interface
+	if typ == "physical" {
+		if i, ok = rPhy(e, p, phys); !ok {
+			return i, false
+		}
+	} else {
+		i = util.NewInterface()
+		i.Type = typ
+		if i.Name, ok = p.get("connection", "interface-name"); !ok {
+			i.Name, _ = p.get("connection", "id")
+		}
+		i.MatchID = i.Name
+	}
+	i.Description = p.description
+	if v, ok := p.get("connection", "autoconnect"); ok && !rBool(e, "autoconnect", v) {
+		autoconnect := false
+		i.Autoconnect = &autoconnect
+	}
+	if v, ok := p.get("connection", "autoconnect-priority"); ok {
+		prio, _ := util.ValidateInt(e, "autoconnect-priority", v, util.MinAutoconnectPriority, util.MaxAutoconnectPriority)
+		i.AutoconnectPriority = new(int)
+		*i.AutoconnectPriority = int(prio)
+	}
+	if v, ok := p.get("connection", "lldp"); ok {
+		switch v {
+		case "default", "-1":
+		case "disable", "0":
+			lldp := false
+			i.LLDP = &lldp
+		default:
+			lldp := true
+			i.LLDP = &lldp
+		}
+	}
+	if v, ok := p.get("ethernet", "mtu"); ok && typ != "tunnel" {
+		i.MTU = rInt(e, "mtu", v)
+	}
+	i.MacAddress = rMac(e, p, "ethernet", "cloned-mac-address")
+	switch typ {
+	case "physical":
+		rWol(e, p, &i)
+	case "bond":
+		rOpts(e, p, "bond", bondOpts, &i)
+	case "bridge":
+		rOpts(e, p, "bridge", bridgeOpts, &i)
+		if mac := rMac(e, p, "bridge", "mac-address"); len(mac) > 0 {
+			i.MacAddress = mac
+		}
+	case "vlan":
+		id, ok := p.get("vlan", "id")
+		if !ok {
+			e.Errorf("%s: vlan %s is missing [vlan] id", p.name, i.Name)
+			return i, false
+		}
+		i.Parameters["id"] = rInt(e, "id", id)
+		for k, key := range map[string]string{"ingress-qos-map": "ingress-priority-map", "egress-qos-map": "egress-priority-map"} {
+			if v, ok := p.get("vlan", key); ok {
+				i.Parameters[k] = strings.Split(v, ",")
+			}
+		}
+	case "tunnel":
+		mode, _ := p.get("ip-tunnel", "mode")
+		for name, num := range tunnelModes {
+			if strconv.Itoa(num) == mode {
+				i.Parameters["mode"] = name
+			}
+		}
+		if _, ok := i.Parameters["mode"]; !ok {
+			e.Errorf("%s: ip-tunnel mode %s is not supported", p.name, mode)
+			return i, false
+		}
+		for _, k := range []string{"local", "remote"} {
+			if v, ok := p.get("ip-tunnel", k); ok {
+				i.Parameters[k] = v
+			}
+		}
+		if v, ok := p.get("ip-tunnel", "ttl"); ok {
+			i.Parameters["ttl"] = rInt(e, "ttl", v)
+		}
+		if v, ok := p.get("ip-tunnel", "mtu"); ok {
+			i.MTU = rInt(e, "mtu", v)
+		}
+	case "veth":
+		peer, ok := p.get("veth", "peer")
+		if !ok {
+			e.Errorf("%s: veth %s is missing [veth] peer", p.name, i.Name)
+			return i, false
+		}
+		i.Parameters["peer"] = peer
+	}
+	return i, true
+}
+
+// rOverrides returns the overrides of nw for a DHCP family, creating
+// them with their defaults if need be.
+func rOverrides(o **util.Overrides) *util.Overrides {
+	if *o == nil {
+		*o = &util.Overrides{
+			UseDNS:       true,
+			UseNTP:       true,
+			SendHostname: true,
+			UseMTU:       true,
+			UseRoutes:    true,
+			UseDomains:   "true",
+		}
+	}
+	return *o
+}
+
+// rRaOverrides returns the ra-overrides of nw, creating them with
+// their defaults if need be.
+func rRaOverrides(nw *util.Network) *util.RaOverrides {
+	if nw.RaOverrides == nil {
+		nw.RaOverrides = &util.RaOverrides{UseDNS: true, UseAutonomousPrefix: true}
+	}
+	return nw.RaOverrides
+}
+
+// rRoute parses a route, which is the destination followed by an
+// optional gateway and metric, and its options.
+func rRoute(e *util.Err, v, opts string) util.Route {
+	res := util.Route{}
+	parts := strings.Split(v, ",")
+	res.To = rIP(e, "route", parts[0])
+	if len(parts) > 1 && parts[1] != "" {
+		res.Via = rIP(e, "route", parts[1])
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		res.Metric = rInt(e, "route", parts[2])
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "table":
+			res.Table = rInt(e, "table", kv[1])
+		case "onlink":
+			res.OnLink = rBool(e, "onlink", kv[1])
+		case "type":
+			res.Type = kv[1]
+		case "src":
+			res.From = rIP(e, "src", kv[1])
+		}
+	}
+	return res
+}
+
+// rRule parses a routing rule, which is in the same form as the
+// arguments of ip rule.
+func rRule(e *util.Err, name, v string) util.RoutePolicy {
+	res := util.RoutePolicy{}
+	fields := strings.Fields(v)
+	for idx := 0; idx+1 < len(fields); idx += 2 {
+		k, val := fields[idx], fields[idx+1]
+		switch k {
+		case "priority", "pref", "preference", "order":
+			res.Priority = rInt(e, k, val)
+		case "from":
+			res.From = rIP(e, k, val)
+		case "to":
+			res.To = rIP(e, k, val)
+		case "table", "lookup":
+			res.Table = rInt(e, k, val)
+		case "fwmark":
+			var err error
+			if res.FWMark, res.FWMask, err = util.ParseFWMark(val); err != nil {
+				e.Errorf("%s: %s: %v", name, k, err)
+			}
+		case "tos", "dsfield":
+			res.TOS = rInt(e, k, val)
+		case "iif":
+			res.IIF = val
+		case "oif":
+			res.OIF = val
+		case "ipproto":
+			res.IPProto, _ = util.ValidateIPProto(e, k, val)
+		case "sport":
+			res.SPort, _ = util.ValidatePortRange(e, k, val)
+		case "dport":
+			res.DPort, _ = util.ValidatePortRange(e, k, val)
+		case "suppress_prefixlength":
+			l := rInt(e, k, val)
+			res.SuppressPrefixLength = &l
+		default:
+			e.Warnf("%s: routing rule %s is unsupported, ignoring it", name, k)
+		}
+	}
+	return res
+}
+
+// rDuid parses a dhcp-duid.  NetworkManager generates link-layer
+// DUIDs by itself, and takes other kinds as hex bytes.
+func rDuid(e *util.Err, name, v string) *util.Duid {
+	switch v {
+	case "ll":
+		return &util.Duid{Type: "link-layer"}
+	case "llt":
+		return &util.Duid{Type: "link-layer-time"}
+	}
+	buf, err := (&util.Duid{RawData: v}).Bytes()
+	if err != nil || len(buf) < 3 {
+		e.Warnf("%s: dhcp-duid %s is unsupported, ignoring it", name, v)
+		return nil
+	}
+	code := int(buf[0])<<8 | int(buf[1])
+	for typ, c := range util.DuidTypes {
+		if c == code {
+			return &util.Duid{Type: typ, RawData: v[6:]}
+		}
+	}
+	e.Warnf("%s: dhcp-duid type %d is unsupported, ignoring it", name, code)
+	return nil
+}
+
+// rFamily reads the [ipv4] or [ipv6] section of p into nw, and
+// returns whether that family is configured at all.  A missing
+// section gets the automatic configuration NetworkManager defaults to.
+func rFamily(e *util.Err, p *profile, nw *util.Network, v6 bool) bool {
+	section, gw, gwMetric, o := "ipv4", &nw.Gateway4, &nw.Gateway4Metric, &nw.Dhcp4Overrides
+	if v6 {
+		section, gw, gwMetric, o = "ipv6", &nw.Gateway6, &nw.Gateway6Metric, &nw.Dhcp6Overrides
+	}
+	method, ok := p.get(section, "method")
+	if !ok {
+		method = "auto"
+	}
+	dhcp := false
+	switch method {
+	case "auto":
+		if !v6 {
+			nw.Dhcp4, dhcp = true, true
+			break
+		}
+		// auto also runs DHCPv6 when the router asks for it, so
+		// settings that only apply to DHCP mean it is expected.
+		nw.AcceptRa = true
+		for k := range p.sections[section] {
+			if strings.HasPrefix(k, "dhcp-") || k == "ignore-auto-routes" {
+				dhcp = true
+			}
+		}
+		if _, ok := p.get(section, "route-metric"); ok && !p.hasGateway(section) {
+			dhcp = true
+		}
+		nw.Dhcp6 = dhcp
+	case "dhcp":
+		nw.Dhcp6, dhcp = true, true
+	case "manual":
+	case "disabled", "ignore":
+		return false
+	default:
+		e.Errorf("%s: %s method %s is not supported", p.name, section, method)
+		return false
+	}
+	for _, v := range p.numbered(section, "address") {
+		parts := strings.SplitN(v, ",", 2)
+		if addr := rIP(e, "address", parts[0]); addr != nil {
+			nw.Addresses = append(nw.Addresses, addr)
+		}
+		// Old keyfiles put the gateway after the first address.
+		if len(parts) == 2 && *gw == nil {
+			*gw = rIP(e, "address", parts[1])
+		}
+	}
+	if v, ok := p.get(section, "gateway"); ok {
+		*gw = rIP(e, "gateway", v)
+	}
+	if v, ok := p.get(section, "route-metric"); ok {
+		// route-metric applies to the routes from DHCP and the
+		// gateway alike.  The writer only uses it for the gateway when
+		// there is no DHCP.
+		switch {
+		case dhcp:
+			rOverrides(o).RouteMetric = rInt(e, "route-metric", v)
+		case *gw != nil:
+			*gwMetric = rInt(e, "route-metric", v)
+		}
+	}
+	if v, ok := p.get(section, "dns"); ok {
+		if nw.Nameservers == nil {
+			nw.Nameservers = &util.NSInfo{}
+		}
+		for _, addr := range rList(v) {
+			if ip := rIP(e, "dns", addr); ip != nil {
+				nw.Nameservers.Addresses = append(nw.Nameservers.Addresses, ip)
+			}
+		}
+	}
+	if v, ok := p.get(section, "dns-search"); ok {
+		if nw.Nameservers == nil {
+			nw.Nameservers = &util.NSInfo{}
+		}
+		for _, domain := range rList(v) {
+			if domain == util.RoutingOnlyPrefix+"." {
+				dr := true
+				nw.DNSDefaultRoute = &dr
+				continue
+			}
+			nw.Nameservers.Search = append(nw.Nameservers.Search, domain)
+		}
+	}
+	opts := p.numbered(section, "route")
+	for idx, v := range opts {
+		// numbered skips the options, as they do not end in a number.
+		routeOpts, _ := p.get(section, fmt.Sprintf("route%d_options", idx+1))
+		nw.Routes = append(nw.Routes, rRoute(e, v, routeOpts))
+	}
+	for _, v := range p.numbered(section, "routing-rule") {
+		nw.RoutingPolicy = append(nw.RoutingPolicy, rRule(e, p.name, v))
+	}
+	if v, ok := p.get(section, "ignore-auto-dns"); ok && rBool(e, "ignore-auto-dns", v) {
+		switch {
+		case dhcp:
+			rOverrides(o).UseDNS = false
+		case nw.AcceptRa:
+			rRaOverrides(nw).UseDNS = false
+		}
+	}
+	if v, ok := p.get(section, "ignore-auto-routes"); ok && dhcp && rBool(e, "ignore-auto-routes", v) {
+		rOverrides(o).UseRoutes = false
+	}
+	if v, ok := p.get(section, "never-default"); ok && dhcp && !v6 && rBool(e, "never-default", v) {
+		useGateway := false
+		rOverrides(o).UseGateway = &useGateway
+	}
+	if v, ok := p.get(section, "dhcp-send-hostname"); ok && dhcp && !rBool(e, "dhcp-send-hostname", v) {
+		rOverrides(o).SendHostname = false
+	}
+	if v, ok := p.get(section, "dhcp-hostname"); ok && dhcp {
+		rOverrides(o).Hostname = v
+	}
+	if v, ok := p.get(section, "dhcp-client-id"); ok && !v6 {
+		nw.DhcpIdentifier = v
+	}
+	if v, ok := p.get(section, "dhcp-duid"); ok && v6 {
+		nw.Duid = rDuid(e, p.name, v)
+	}
+	if v, ok := p.get(section, "dhcp-iaid"); ok {
+		iaid := uint32(rInt(e, "dhcp-iaid", v))
+		nw.Iaid = &iaid
+	}
+	if v, ok := p.get(section, "route-table"); ok {
+		switch {
+		case v6:
+			rRaOverrides(nw).Table = rInt(e, "route-table", v)
+		case dhcp:
+			rOverrides(o).RouteTable = rInt(e, "route-table", v)
+		}
+	}
+	if v, ok := p.get(section, "mtu"); ok && v6 {
+		nw.IPv6MTU = rInt(e, "mtu", v)
+	}
+	if v, ok := p.get(section, "token"); ok && v6 {
+		nw.IPv6Token = v
+	}
+	return true
+}
+
+// rNetwork reads the layer 3 config of p, or returns nil if it has
+// none.
+func rNetwork(e *util.Err, p *profile) *util.Network {
+	res := &util.Network{}
+	v4 := rFamily(e, p, res, false)
+	v6 := rFamily(e, p, res, true)
+	if !v4 && !v6 {
+		return nil
+	}
+	return res
+}
+
+// controller returns the name of the connection or interface p is a
+// port of, and what kind of port it is.  NetworkManager has used
+// both master and slave-type and controller and port-type for these.
+func controller(p *profile) (string, string) {
+	name, ok := p.get("connection", "controller")
+	if !ok {
+		name, _ = p.get("connection", "master")
+	}
+	kind, ok := p.get("connection", "port-type")
+	if !ok {
+		kind, _ = p.get("connection", "slave-type")
+	}
+	return name, kind
+}
+
+// Compile satisfies the util.Reader interface.  It translates the
+// profiles loaded by Read into a Layout.
+func (n *NMKeyfile) Compile(phys []util.Phy) (*util.Layout, error) {
+	e := &util.Err{Prefix: "nmkeyfile"}
+	l := &util.Layout{Interfaces: map[string]util.Interface{}, Renderer: "NetworkManager"}
+	// names maps the ids, uuids, and interface names that profiles
+	// can refer to each other by to the name of the interface.
+	names := map[string]string{}
+	byName := map[string]*profile{}
+	for _, p := range n.profiles {
+		i, ok := rLink(e, p, phys)
+		if !ok {
+			continue
+		}
+		if _, ok := l.Interfaces[i.Name]; ok {
+			e.Errorf("%s: %s is already configured by another profile", p.name, i.Name)
+			continue
+		}
+		if ctrl, _ := controller(p); ctrl == "" {
+			i.Network = rNetwork(e, p)
+		}
+		l.Interfaces[i.Name] = i
+		byName[i.Name] = p
+		for _, k := range []string{"id", "uuid"} {
+			if v, ok := p.get("connection", k); ok {
+				names[v] = i.Name
+			}
+		}
+		names[i.Name] = i.Name
+	}
+	// parent returns the interface a profile refers to by ref, which
+	// can also be a nic no profile applies to.
+	parent := func(p *profile, ref string) (string, bool) {
+		if name, ok := names[ref]; ok {
+			return name, true
+		}
+		if intfs, _ := util.MatchPhys(util.Match{Name: ref}, util.NewInterface(), phys); len(intfs) > 0 {
+			i := intfs[0]
+			i.MatchID = i.Name
+			l.Interfaces[i.Name] = i
+			names[i.Name] = i.Name
+			return i.Name, true
+		}
+		e.Errorf("%s: %s does not refer to a connection or interface", p.name, ref)
+		return "", false
+	}
+	ifNames := []string{}
+	for k := range byName {
+		ifNames = append(ifNames, k)
+	}
+	sort.Strings(ifNames)
+	for _, name := range ifNames {
+		p, i := byName[name], l.Interfaces[name]
+		switch i.Type {
+		case "vlan":
+			ref, _ := p.get("vlan", "parent")
+			if pName, ok := parent(p, ref); ok {
+				i.Interfaces = []string{pName}
+				l.Interfaces[name] = i
+			}
+		case "veth":
+			// The profile creates both ends of the pair.
+			peer := i.VethPeer()
+			if _, ok := l.Interfaces[peer]; !ok {
+				other := util.NewInterface()
+				other.Name, other.MatchID, other.Type = peer, peer, "veth"
+				other.Parameters["peer"] = name
+				l.Interfaces[peer] = other
+			}
+		}
+		ctrl, kind := controller(p)
+		if ctrl == "" {
+			continue
+		}
+		pName, ok := parent(p, ctrl)
+		if !ok {
+			continue
+		}
+		pIntf := l.Interfaces[pName]
+		if pIntf.Type != "bond" && pIntf.Type != "bridge" {
+			e.Errorf("%s: %s is not a bond or bridge", p.name, ctrl)
+			continue
+		}
+		if kind != "" && kind != pIntf.Type {
+			e.Errorf("%s: port type %s does not match %s %s", p.name, kind, pIntf.Type, pName)
+			continue
+		}
+		pIntf.Interfaces = append(pIntf.Interfaces, name)
+		sort.Strings(pIntf.Interfaces)
+		l.Interfaces[pName] = pIntf
+		if v, ok := p.get("bond-port", "queue-id"); ok && pIntf.Type == "bond" {
+			pIntf.SetQueueID(name, int64(rInt(e, "queue-id", v)))
+		}
+		if v, ok := p.get("bridge-port", "vlans"); ok && pIntf.Type == "bridge" {
+			rPortVlans(e, p, pIntf, name, v)
+		}
+	}
+	if !e.Empty() {
+		return l, e
+	}
+	e.Merge(l.Validate())
+	return l, e.OrNil()
+}
+
+// ensure NMKeyfile can be used as an input format.
+var _ util.Reader = &NMKeyfile{}
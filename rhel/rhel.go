@@ -21,15 +21,207 @@ import (
 type Rhel struct {
 	*util.Layout
 	bindMacs        bool
+	restorecon      bool
 	dest, finalDest string
+	root, rootDest  string
+	postUp          map[string][]string
+	postUpWhat      map[string][]string
 }
 
 func (r *Rhel) BindMacs() {
 	r.bindMacs = true
 }
 
+// Restorecon makes Write reset the SELinux contexts of the files it
+// writes, as initscripts cannot read ifcfg files with the wrong
+// context on systems where SELinux is enforcing.
+func (r *Rhel) Restorecon() {
+	r.restorecon = true
+}
+
+// Root makes Write install the files that initscripts and the tools
+// it relies on only look for outside of the network-scripts dir under
+// root, which is usually /.  Without a root, the settings that need
+// them are ignored.
+func (r *Rhel) Root(root string) {
+	r.root = root
+}
+
 func New(l *util.Layout) *Rhel {
-	return &Rhel{Layout: l}
+	return &Rhel{Layout: l, postUp: map[string][]string{}, postUpWhat: map[string][]string{}}
+}
+
+// rootFile is a kind of file Write installs in dir under the root,
+// where the tool that reads it looks.  glob matches the files of that
+// kind netwrangler wrote there before.
+type rootFile struct {
+	dir, glob string
+}
+
+// postUpFile is the ifup-local script.  initscripts runs
+// /sbin/ifup-local with the name of the interface after bringing it
+// up.
+var postUpFile = rootFile{"sbin", "ifup-local"}
+
+// renameRuleFile is the udev rules that rename nics.  udev only reads
+// rules from /etc/udev/rules.d, and applies them as the nic is added.
+var renameRuleFile = rootFile{"etc/udev/rules.d", "70-netwrangler-*.rules"}
+
+// sysctlFile is the sysctl drop-ins.  systemd-sysctl only reads them
+// from /etc/sysctl.d, and udev applies them as the interface is
+// added.
+var sysctlFile = rootFile{"etc/sysctl.d", "70-netwrangler-*.conf"}
+
+// rootFiles are all the kinds of files Write installs under the root.
+var rootFiles = []rootFile{postUpFile, renameRuleFile, sysctlFile}
+
+// addPostUp arranges for cmd to be run after i has been brought up.
+// ifcfg files have no way to express some settings, so they are
+// applied with ip commands from an ifup-local script instead.  what
+// names the setting cmd applies for the warning given when there is
+// no root to install the script under.
+func (r *Rhel) addPostUp(i util.Interface, what, cmd string) {
+	r.postUp[i.Name] = append(r.postUp[i.Name], cmd)
+	for _, w := range r.postUpWhat[i.Name] {
+		if w == what {
+			return
+		}
+	}
+	r.postUpWhat[i.Name] = append(r.postUpWhat[i.Name], what)
+}
+
+// writePostUp writes the ifup-local script that applies any settings
+// that could not be expressed in the ifcfg files.
+func (r *Rhel) writePostUp(e *util.Err) {
+	if len(r.postUp) == 0 {
+		return
+	}
+	names := []string{}
+	for name := range r.postUp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if r.root == "" {
+		for _, name := range names {
+			e.Warnf("%s: ifcfg files cannot set %s, which need ifup-local and a root to install it under, ignoring them",
+				name, strings.Join(r.postUpWhat[name], ", "))
+		}
+		return
+	}
+	scriptDir := path.Join(r.rootDest, postUpFile.dir)
+	if err := os.MkdirAll(scriptDir, 0755); err != nil {
+		e.Merge(err)
+		return
+	}
+	scriptPath := path.Join(scriptDir, postUpFile.glob)
+	script, err := os.OpenFile(scriptPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		e.Errorf("Error creating %s: %v", scriptPath, err)
+		return
+	}
+	defer script.Close()
+	fmt.Fprintf(script, "#!/bin/sh\n# Created by netwrangler\ncase \"$1\" in\n")
+	for _, name := range names {
+		fmt.Fprintf(script, "%s)\n", name)
+		for _, cmd := range r.postUp[name] {
+			fmt.Fprintf(script, "\t%s\n", cmd)
+		}
+		fmt.Fprintf(script, "\t;;\n")
+	}
+	fmt.Fprintf(script, "esac\n")
+}
+
+// uplinks4 counts the interfaces that have an IPv4 default gateway.
+// The GATEWAY key can only express a single default route, so when
+// there is more than one they are all written to route files instead.
+func (r *Rhel) uplinks4() int {
+	res := 0
+	for _, i := range r.Interfaces {
+		if i.Network != nil && i.Network.Gateway4 != nil {
+			res++
+		}
+	}
+	return res
+}
+
+// dhcpv6cOptions returns the dhclient options that make it send the
+// DUID of nw.  dhclient can only be told which kind of link-layer DUID
+// to generate, the rest of the DUID settings are ignored.
+func dhcpv6cOptions(name string, e *util.Err, nw *util.Network) string {
+	res := ""
+	if d := nw.Duid; d != nil {
+		switch {
+		case d.RawData != "":
+			e.Warnf("%s: duid raw-data is unsupported by dhclient, ignoring it", name)
+		case d.Type == "link-layer":
+			res = "-D LL"
+		case d.Type == "link-layer-time":
+			res = "-D LLT"
+		default:
+			e.Warnf("%s: %s duids are unsupported by dhclient, ignoring it", name, d.Type)
+		}
+	}
+	if nw.Iaid != nil {
+		e.Warnf("%s: iaid is unsupported by dhclient, ignoring it", name)
+	}
+	return res
+}
+
+// maxSearchDomains is the number of search domains older resolvers
+// will honor from the search line initscripts writes to resolv.conf.
+const maxSearchDomains = 6
+
+// writeRenameRule writes the udev rule that gives the nic i is for
+// its name.  ifcfg files cannot rename a nic, and without the rule
+// the nic would never get the name they use, so renaming needs a
+// root to install the rule under.
+func (r *Rhel) writeRenameRule(i util.Interface, e *util.Err) {
+	if r.root == "" {
+		e.Errorf("%s: renaming a nic on rhel needs a root to install its udev rule under", i.Name)
+		return
+	}
+	ruleDir := path.Join(r.rootDest, renameRuleFile.dir)
+	if err := os.MkdirAll(ruleDir, 0755); err != nil {
+		e.Merge(err)
+		return
+	}
+	rulePath := path.Join(ruleDir, "70-netwrangler-"+i.Name+".rules")
+	rule := fmt.Sprintf("# Created by netwrangler\n"+
+		"SUBSYSTEM==\"net\", ACTION==\"add\", DRIVERS==\"?*\", ATTR{address}==\"%s\", ATTR{type}==\"1\", NAME=\"%s\"\n",
+		i.PermanentHwAddr, i.Name)
+	if err := ioutil.WriteFile(rulePath, []byte(rule), 0644); err != nil {
+		e.Errorf("Error creating %s: %v", rulePath, err)
+	}
+}
+
+// writeSysctl writes the sysctl drop-in that applies setting to the
+// interface i.  ifup adds addresses before running ifup-local, so
+// settings that must be in place first have to come from sysctl.d.
+// what names the settings for the warning given when there is no root
+// to install the drop-in under.
+func (r *Rhel) writeSysctl(i util.Interface, what, setting string, e *util.Err) {
+	if r.root == "" {
+		e.Warnf("%s: %s need a sysctl drop-in on rhel and a root to install it under, ignoring them", i.Name, what)
+		return
+	}
+	confDir := path.Join(r.rootDest, sysctlFile.dir)
+	if err := os.MkdirAll(confDir, 0755); err != nil {
+		e.Merge(err)
+		return
+	}
+	confPath := path.Join(confDir, "70-netwrangler-"+i.Name+".conf")
+	conf := "# Created by netwrangler\n" + setting + "\n"
+	if err := ioutil.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		e.Errorf("Error creating %s: %v", confPath, err)
+	}
+}
+
+// tunnelTypes maps the tunnel modes ifup-tunnel can bring up to the
+// TYPE it expects for them.
+var tunnelTypes = map[string]string{
+	"gre":   "GRE",
+	"ipip":  "IPIP",
+	"ipip6": "IPIP6",
 }
 
 func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
@@ -44,6 +236,10 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 `, k, v)
 	}
 	fmt.Fprintf(ifcfg, "# Created by netwrangler\n")
+	if i.Description != "" {
+		fmt.Fprintf(ifcfg, "# %s\n", i.Description)
+		writeKey("NAME", i.Description)
+	}
 	writeKey("DEVICE", i.Name)
 	switch i.Type {
 	case "bridge":
@@ -52,16 +248,26 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 			if v.(bool) {
 				writeKey("STP", "yes")
 				if vv, ok := i.Parameters["forward-delay"]; ok {
-					delay := vv.(int)
-					writeKey("DELAY", delay)
+					writeKey("DELAY", vv)
 				}
 			} else {
 				writeKey("STP", "no")
 			}
 		}
+		if v, ok := i.Parameters["group-forward-mask"]; ok {
+			writeKey("BRIDGING_OPTS", fmt.Sprintf("group_fwd_mask=%v", v))
+		}
+		for _, k := range util.BridgeVlanParams {
+			if _, ok := i.Parameters[k]; ok {
+				e.Warnf("%s: %s is unsupported on rhel, ignoring it", i.Name, k)
+			}
+		}
 	case "bond":
 		bondopts := []string{}
 		for k, v := range i.Parameters {
+			if util.IsExtension(k) {
+				continue
+			}
 			key := strings.Replace(k, "-", "_", -1)
 			switch key {
 			case "all_slaves_active":
@@ -70,19 +276,16 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 				} else {
 					v = "0"
 				}
-			case "arp_all_targets":
+			case "arp_all_targets", "tlb_dynamic_lb":
 				if v.(bool) {
 					v = "1"
 				} else {
 					v = "0"
 				}
-			case "arp_ip_targets":
-				key = "arp_ip_target"
-				val := v.([]net.IP)
+			case "arp_ip_targets", "ns_ip6_targets":
+				key = strings.TrimSuffix(key, "s")
 				vals := []string{}
-				for _, ip := range val {
-					vals = append(vals, ip.String())
-				}
+				util.Remarshal(v, &vals)
 				v = strings.Join(vals, ",")
 			case "down_delay":
 				key = "downdelay"
@@ -98,6 +301,15 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 				key = "xmit_hash_policy"
 			case "up_delay":
 				key = "updelay"
+			case "queue_ids":
+				// Members only get their queue once they are
+				// enslaved, which is after BONDING_OPTS is applied.
+				for _, child := range i.Interfaces {
+					if id := i.QueueID(child); id != 0 {
+						r.addPostUp(i, "queue-ids", fmt.Sprintf("ip link set dev %s type bond_slave queue_id %d", child, id))
+					}
+				}
+				continue
 			}
 			bondopts = append(bondopts, fmt.Sprintf("%s=%v", key, v))
 		}
@@ -107,10 +319,38 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 		writeKey("VLAN", "yes")
 		writeKey("VID", i.Parameters["id"])
 		writeKey("PHYSDEV", i.Interfaces[0])
+		if maps := i.QOSMap("ingress-qos-map"); len(maps) > 0 {
+			writeKey("VLAN_INGRESS_PRIORITY_MAP", strings.Join(maps, ","))
+		}
+		if maps := i.QOSMap("egress-qos-map"); len(maps) > 0 {
+			writeKey("VLAN_EGRESS_PRIORITY_MAP", strings.Join(maps, ","))
+		}
+	case "tunnel":
+		typ, ok := tunnelTypes[i.TunnelMode()]
+		if !ok {
+			e.Errorf("%s: %s tunnels are unsupported on rhel", i.Name, i.TunnelMode())
+			break
+		}
+		writeKey("TYPE", typ)
+		if v, ok := i.Parameters["local"]; ok {
+			writeKey("MY_OUTER_IPADDR", v)
+		}
+		writeKey("PEER_OUTER_IPADDR", i.Parameters["remote"])
+		if v, ok := i.Parameters["ttl"]; ok {
+			writeKey("TTL", v)
+		}
+	case "veth":
+		e.Warnf("%s: ifup cannot create veth pairs, so it and its peer %s must be created before they are brought up", i.Name, i.VethPeer())
 	case "physical":
 		writeKey("TYPE", "Ethernet")
 		if r.bindMacs {
-			writeKey("HWADDR", i.CurrentHwAddr.String())
+			writeKey("HWADDR", i.BindHwAddr().String())
+		}
+		if i.Rename {
+			r.writeRenameRule(i, e)
+		}
+		if len(i.AlternativeNames) > 0 {
+			e.Warnf("%s: alternative-names are unsupported on rhel, ignoring %v", i.Name, i.AlternativeNames)
 		}
 	}
 	parents := r.Child2Parent[i.Name]
@@ -126,18 +366,65 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 			}
 		}
 	}
-	if i.Optional {
+	if wol := i.EthtoolWol(); wol != "" {
+		writeKey("ETHTOOL_OPTS", wol)
+	}
+	if len(i.MacAddress) > 0 {
+		writeKey("MACADDR", i.MacAddress.String())
+	}
+	if i.MTU != 0 {
+		writeKey("MTU", i.MTU)
+	}
+	if i.AutoconnectPriority != nil {
+		e.Warnf("%s: autoconnect-priority is unsupported on rhel, ignoring it", i.Name)
+	}
+	if i.WaitOnlineTimeout != 0 {
+		e.Warnf("%s: wait-online-timeout is unsupported on rhel, ignoring it", i.Name)
+	}
+	if len(i.OrderAfter()) > 0 {
+		e.Warnf("%s: after and requires are unsupported on rhel, ignoring them", i.Name)
+	}
+	if i.WaitDeviceTimeout != 0 {
+		e.Warnf("%s: wait-device-timeout is unsupported on rhel, ignoring it", i.Name)
+	}
+	if i.Optional || !i.Autoconnects() {
 		writeKey("ONBOOT", "no")
 	} else {
 		writeKey("ONBOOT", "yes")
 	}
+	// ifcfg files cannot configure lldpad.
+	if cmd := i.LLDPToolCmd(); cmd != "" {
+		r.addPostUp(i, "lldp", cmd)
+	}
+	if i.Alias != "" {
+		r.addPostUp(i, "alias", fmt.Sprintf("ip link set dev %s alias \"%s\"", i.Name, i.Alias))
+	}
+	for _, cmd := range i.QueueCmds() {
+		r.addPostUp(i, "rps-cpus and xps-cpus", cmd)
+	}
+	for _, f := range i.LinkFlags() {
+		r.addPostUp(i, f.Name, fmt.Sprintf("ip link set dev %s %s", i.Name, f.IPArgs()))
+	}
+	if i.Group != 0 {
+		r.addPostUp(i, "group", fmt.Sprintf("ip link set dev %s group %d", i.Name, i.Group))
+	}
 	nw := i.Network
 	if !nw.Configure() {
 		return
 	}
-	v4addrs, v6addrs := []*gnet.IPNet{}, []*gnet.IPNet{}
+	// ifup keeps addresses when carrier is lost, so only bringing
+	// the interface up without carrier needs to be asked for.
+	if nw.WithoutCarrier() {
+		writeKey("CHECK_LINK_DOWN", "no")
+	}
+	v4addrs, v6addrs, scoped := []*gnet.IPNet{}, []*gnet.IPNet{}, false
 	if len(nw.Addresses) > 0 {
 		for _, addr := range nw.Addresses {
+			if opts := nw.AddressOpts(addr); opts != nil && opts.HasScope() {
+				// ifcfg cannot set a scope, so these are added by ifup-local.
+				scoped = scoped || addr.IP.To4() == nil
+				continue
+			}
 			if addr.IP.To4() != nil {
 				v4addrs = append(v4addrs, addr)
 			} else {
@@ -147,6 +434,56 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 	}
 	if nw.Dhcp4 {
 		writeKey("BOOTPROTO", "dhcp")
+		if o := nw.Dhcp4Overrides; o != nil && o.SendHostname && o.Hostname != "" {
+			writeKey("DHCP_HOSTNAME", o.Hostname)
+		}
+		if o := nw.Dhcp4Overrides; o != nil && !o.UseDNS {
+			writeKey("PEERDNS", "no")
+		}
+		// ifup only adds the default route from the lease when the
+		// interface may have the default route, which goes for a
+		// static gateway as well.
+		o := nw.Dhcp4Overrides
+		ignoreGateway := o != nil && o.UseGateway != nil && !*o.UseGateway
+		if ignoreGateway && nw.Gateway4 != nil {
+			e.Warnf("%s: ifup would also ignore gateway4 for dhcp4-overrides use-gateway, ignoring it", i.Name)
+			ignoreGateway = false
+		}
+		if o := nw.Dhcp4Overrides; o != nil && o.RouteMetric != 0 {
+			// dhclient-script gives the default route from the
+			// lease this metric.
+			writeKey("METRIC", o.RouteMetric)
+		}
+		if o := nw.Dhcp4Overrides; o != nil && o.RouteTable != 0 {
+			e.Warnf("%s: dhcp4-overrides route-table is unsupported on rhel, ignoring it", i.Name)
+		}
+		for _, k := range nw.Dhcp4Overrides.DhcpOptionKeys() {
+			e.Warnf("%s: dhcp4-overrides %s is unsupported on rhel, ignoring it", i.Name, k)
+		}
+		// dhclient identifies the client by its MAC unless told
+		// otherwise, and cannot send the DUID over DHCPv4.
+		switch nw.DhcpIdentifier {
+		case "", "mac":
+		case "duid":
+			e.Warnf("%s: dhcp-identifier duid is unsupported on rhel, ignoring it", i.Name)
+		default:
+			writeKey("DHCP_CLIENT_ID", nw.DhcpIdentifier)
+		}
+		if len(v4addrs) > 0 {
+			// Make sure ifup applies the static addresses and the
+			// routes that come with the lease alongside each other.
+			peerRoutes := "yes"
+			if o := nw.Dhcp4Overrides; o != nil && !o.UseRoutes {
+				peerRoutes = "no"
+			}
+			if !ignoreGateway {
+				writeKey("DEFROUTE", "yes")
+			}
+			writeKey("PEERROUTES", peerRoutes)
+		}
+		if ignoreGateway {
+			writeKey("DEFROUTE", "no")
+		}
 	} else {
 		writeKey("BOOTPROTO", "none")
 	}
@@ -158,21 +495,88 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 			writeKey(fmt.Sprintf("DNS%d", idx+1), addr.String())
 		}
 	}
+	if search := nw.Nameservers.SearchDomains(); len(search) > 0 {
+		if len(search) > maxSearchDomains {
+			e.Warnf("%s: only the first %d search domains will be used, ignoring %v", i.Name, maxSearchDomains, search[maxSearchDomains:])
+			search = search[:maxSearchDomains]
+		}
+		writeKey("DOMAIN", strings.Join(search, " "))
+	}
+	if routing := nw.Nameservers.RoutingDomains(); len(routing) > 0 {
+		e.Warnf("%s: routing-only domains are unsupported on rhel, ignoring %v", i.Name, routing)
+	}
+	if nw.DNSDefaultRoute != nil {
+		e.Warnf("%s: dns-default-route is unsupported on rhel, ignoring it", i.Name)
+	}
+	if keep := nw.Keep(); keep != "" {
+		e.Warnf("%s: keep-configuration %s is unsupported on rhel, ignoring it", i.Name, keep)
+	}
 	for idx, addr := range v4addrs {
 		writeKey(fmt.Sprintf("IPADDR%d", idx), addr.IP.To4().String())
 		writeKey(fmt.Sprintf("NETMASK%d", idx), net.IP(addr.Mask).To4().String())
+		if opts := nw.AddressOpts(addr); opts != nil && opts.Broadcast != nil {
+			writeKey(fmt.Sprintf("BROADCAST%d", idx), opts.Broadcast.IP.String())
+		}
+	}
+	for _, addr := range nw.Addresses {
+		if opts := nw.AddressOpts(addr); opts != nil && opts.HasScope() {
+			r.addPostUp(i, "address scopes", "ip addr add "+opts.IPString(addr, i))
+		} else if opts != nil && opts.HasLifetimes() {
+			r.addPostUp(i, "address lifetimes", "ip addr change "+opts.IPString(addr, i))
+		}
+	}
+	for _, neigh := range nw.Neighbors {
+		r.addPostUp(i, "neighbors", "ip neigh replace "+neigh.IPString(i))
 	}
+	if cmd := nw.NdiscNotifyCmd(i.Name, true); cmd != "" {
+		r.addPostUp(i, "unsolicited-na", cmd)
+	}
+	for _, cmd := range nw.ArpingCmds(i.Name) {
+		r.addPostUp(i, "gratuitous-arp-count", cmd)
+	}
+	routes := []util.Route{}
 	if nw.Gateway4 != nil {
-		writeKey("GATEWAY0", nw.Gateway4.IP.String())
+		gwMetric := util.Route{Metric: nw.Gateway4Metric}
+		if !gwMetric.HasMetric(r.RouteMetric()) && r.uplinks4() == 1 && !nw.GatewayOnLink {
+			writeKey("GATEWAY0", nw.Gateway4.IP.String())
+		} else {
+			routes = append(routes, util.Route{
+				Via:    nw.Gateway4,
+				Metric: nw.Gateway4Metric,
+				OnLink: nw.GatewayOnLink,
+				To: &gnet.IPNet{
+					IP:   net.IPv4zero.To4(),
+					Mask: net.CIDRMask(0, 32),
+				},
+			})
+		}
 	}
-	if len(v6addrs) > 0 || nw.Dhcp6 || nw.AcceptRa {
+	routes = append(routes, nw.Routes...)
+	if len(v6addrs) > 0 || scoped || nw.Dhcp6 || nw.AcceptRa {
 		writeKey("IPV6INIT", "yes")
 	}
 	if nw.AcceptRa {
 		writeKey("IPV6_AUTOCONF", "yes")
 	}
+	if o := nw.RaOverrides; o != nil {
+		if !o.UseDNS {
+			writeKey("IPV6_PEERDNS", "no")
+		}
+		if !o.UseAutonomousPrefix {
+			e.Warnf("%s: use-autonomous-prefix is unsupported on rhel, ignoring it", i.Name)
+		}
+		if o.Table != 0 {
+			e.Warnf("%s: ra-overrides table is unsupported on rhel, ignoring it", i.Name)
+		}
+	}
 	if nw.Dhcp6 {
 		writeKey("DHCPV6C", "yes")
+		if o := nw.Dhcp6Overrides; o != nil && o.RouteMetric != 0 {
+			e.Warnf("%s: dhcp6-overrides route-metric is unsupported on rhel, ignoring it", i.Name)
+		}
+		if opts := dhcpv6cOptions(i.Name, e, nw); opts != "" {
+			writeKey("DHCPV6C_OPTIONS", opts)
+		}
 	}
 	if len(v6addrs) > 0 {
 		writeKey("IPV6ADDR", v6addrs[0].String())
@@ -185,27 +589,46 @@ func (r *Rhel) writeOut(i util.Interface, e *util.Err) {
 			writeKey("IPV6ADDR_SECONDARIES", strings.Join(addrs, ","))
 		}
 	}
+	if nw.IPv6MTU != 0 {
+		writeKey("IPV6_MTU", nw.IPv6MTU)
+	}
+	if nw.IPv6Token != "" {
+		writeKey("IPV6_TOKEN", nw.IPv6Token)
+	}
+	sysctls, what := nw.ForwardSysctls(), []string{}
+	if len(sysctls) > 0 {
+		what = append(what, "ip-forward")
+	}
+	if setting := nw.DadTransmitsSysctl(i.Name); setting != "" {
+		sysctls = append(sysctls, setting)
+		what = append(what, "ipv6-dad-transmits")
+	}
+	if len(sysctls) > 0 {
+		r.writeSysctl(i, strings.Join(what, " and "), strings.Join(sysctls, "\n"), e)
+	}
+	if nw.IPMasquerade != "" && nw.IPMasquerade != "no" {
+		e.Warnf("%s: ip-masquerade needs firewall rules on rhel, which netwrangler does not write, ignoring it", i.Name)
+	}
 	if nw.Gateway6 != nil {
-		if nw.Routes == nil {
-			nw.Routes = []util.Route{}
-		}
-		nw.Routes = append(nw.Routes, util.Route{
-			Via: nw.Gateway6,
+		routes = append(routes, util.Route{
+			Via:    nw.Gateway6,
+			Metric: nw.Gateway6Metric,
+			OnLink: nw.GatewayOnLink,
 			To: &gnet.IPNet{
 				IP:   net.IPv6zero,
 				Mask: net.IPMask(net.IPv6zero),
 			},
 		})
 	}
-	if len(nw.Routes) > 0 {
+	if len(routes) > 0 {
 		routecfgPath := path.Join(r.dest, "route-"+i.Name)
 		routecfg, err := os.Create(routecfgPath)
 		if err != nil {
 			e.Errorf("Error creating %s: %v", routecfgPath, err)
 		}
 		defer routecfg.Close()
-		for idx := range nw.Routes {
-			fmt.Fprintln(routecfg, nw.Routes[idx].IPString(i))
+		for idx := range routes {
+			fmt.Fprintln(routecfg, routes[idx].IPString(i, r.RouteMetric()))
 		}
 	}
 	if len(nw.RoutingPolicy) > 0 {
@@ -262,15 +685,26 @@ func (r *Rhel) Write(dest string) error {
 	defer os.RemoveAll(tmp)
 	e := &util.Err{Prefix: "rhel"}
 	r.finalDest = dest
-	r.dest = tmp
+	r.dest = path.Join(tmp, "network-scripts")
+	r.rootDest = path.Join(tmp, "root")
+	if err := os.MkdirAll(r.dest, 0755); err != nil {
+		return err
+	}
 	for _, k := range r.Interfaces {
 		r.writeOut(k, e)
 	}
+	r.writePostUp(e)
+	if !e.Empty() {
+		return e
+	}
+	r.install(e)
 	if !e.Empty() {
 		return e
 	}
 	toRemove := []string{}
-	for _, glob := range []string{"ifcfg-*", "route-*", "rule-*", "rule6-*"} {
+	// ifup-local, the udev rules, and the sysctl drop-ins used to be
+	// written here as well.
+	for _, glob := range []string{"ifcfg-*", "route-*", "rule-*", "rule6-*", "ifup-local", "70-netwrangler-*.rules", "70-netwrangler-*.conf"} {
 		names, err := filepath.Glob(path.Join(r.finalDest, glob))
 		if err != nil {
 			e.Merge(err)
@@ -278,13 +712,47 @@ func (r *Rhel) Write(dest string) error {
 		}
 		toRemove = append(toRemove, names...)
 	}
+	stale := []string{}
 	for _, name := range toRemove {
 		base := path.Base(name)
 		if strings.HasSuffix(base, "-lo") {
 			continue
 		}
-		os.Remove(name)
+		stale = append(stale, name)
+	}
+	util.Replace(r.dest, r.finalDest, stale, e)
+	if r.restorecon && e.Empty() {
+		util.Restorecon(r.finalDest, e)
 	}
-	util.Copy(r.dest, r.finalDest, e)
 	return e.OrNil()
 }
+
+// install replaces the files of each kind in rootFiles under the root
+// with the ones Write rendered, removing the ones that are no longer
+// needed.
+func (r *Rhel) install(e *util.Err) {
+	if r.root == "" {
+		return
+	}
+	for _, f := range rootFiles {
+		src, target := path.Join(r.rootDest, f.dir), path.Join(r.root, f.dir)
+		stale, err := filepath.Glob(path.Join(target, f.glob))
+		if err != nil {
+			e.Merge(err)
+			return
+		}
+		news, _ := filepath.Glob(path.Join(src, f.glob))
+		if len(news) == 0 && len(stale) == 0 {
+			continue
+		}
+		util.Replace(src, target, stale, e)
+		if !e.Empty() {
+			return
+		}
+		if r.restorecon {
+			for _, name := range news {
+				util.Restorecon(path.Join(target, path.Base(name)), e)
+			}
+		}
+	}
+}
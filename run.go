@@ -5,10 +5,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	yaml "github.com/ghodss/yaml"
+	"github.com/rackn/netwrangler/iproute2"
 	"github.com/rackn/netwrangler/netplan"
+	"github.com/rackn/netwrangler/nmkeyfile"
 	"github.com/rackn/netwrangler/rhel"
 	"github.com/rackn/netwrangler/systemd"
 	"github.com/rackn/netwrangler/util"
@@ -16,60 +22,166 @@ import (
 
 var (
 	// The input formats we accept.  internal is the intermediate format netwrangler uses.
-	SrcFormats = []string{"netplan", "internal"}
+	SrcFormats = []string{"netplan", "systemd", "nmkeyfile", "internal"}
 	// The output formats we can handle.  internal is the intermediate format netwrangler uses.
-	DestFormats = []string{"netplan", "systemd", "rhel", "internal"}
+	DestFormats = []string{"netplan", "systemd", "rhel", "iproute2", "nmkeyfile", "internal"}
 	// The MAC address of the device we booted from.
 	bootMac net.HardwareAddr
+	// Globs of the physical nics that should never be gathered.
+	physExclude []string
+	// Which virtual nics should be gathered along with the physical
+	// ones.
+	physOpts util.GatherPhysOpts
+	// Whether ethernet stanzas that match more than one nic outside
+	// of a bond or bridge are an error.
+	strictMatch bool
+	// Where the systemd output format writes the commands that apply
+	// only what changed, if anywhere.
+	reloadScript string
+	// The directory etc/hostname and etc/hosts are written under when
+	// the input sets a hostname, if anywhere.
+	hostnameRoot string
+	// Whether Read checks that the kernel modules the interfaces need
+	// are available.
+	checkModules bool
+	// The seed Read derives the MAC addresses of virtual interfaces
+	// from, if they should get stable ones.
+	macSeed string
+	// The directory the systemd output format writes drop-ins for
+	// systemd units to, if anywhere.
+	unitDir string
+	// Whether the rhel output format resets the SELinux contexts of
+	// the files it writes.
+	restorecon bool
+	// The directory the rhel output format installs the files that do
+	// not go in network-scripts under, if anywhere.
+	rhelRoot string
 )
 
 func fillBootIf(phys []util.Phy) {
 	if phys != nil && bootMac != nil {
 		for i := range phys {
-			phys[i].BootIf = bytes.Equal(phys[i].HardwareAddr, bootMac)
+			phys[i].BootIf = phys[i].MatchesMac(bootMac)
 		}
 	}
 }
 
+// finishPhys drops excluded phys and marks the one we booted from.
+func finishPhys(phys []util.Phy, err error) ([]util.Phy, error) {
+	if err != nil {
+		return phys, err
+	}
+	phys, err = util.ExcludePhys(phys, physExclude)
+	fillBootIf(phys)
+	return phys, err
+}
+
 // GatherPhys gathers the physical nics that the system knows about.
 // It is currently only supported on Linux systems.
 func GatherPhys() ([]util.Phy, error) {
-	res, err := util.GatherPhys()
-	fillBootIf(res)
-	return res, err
+	return finishPhys(util.GatherPhys(physOpts))
 }
 
-// GatherPhysFromFile gathers the physical nic information from a saved file.
-// This can be used for unit testing or buld offline operations.
-func GatherPhysFromFile(src string) (phys []util.Phy, err error) {
+// GatherPhysWithLLDP gathers the physical nics that the system knows
+// about along with any LLDP neighbor information lldpd has for them.
+// If lldpctl is not available, it behaves like GatherPhys.
+func GatherPhysWithLLDP() ([]util.Phy, error) {
+	return finishPhys(util.GatherPhysWithLLDP(physOpts))
+}
+
+// GatherPhysFromFile gathers the physical nic information from saved
+// files.  This can be used for unit testing or buld offline
+// operations.  Each file can either be a list of phys, or the JSON
+// output of gohai.  When there is more than one, the phys in them are
+// merged by name with util.MergePhys, so that later files can add to
+// what earlier ones know.
+func GatherPhysFromFile(srcs ...string) ([]util.Phy, error) {
+	sets := [][]util.Phy{}
+	for _, src := range srcs {
+		phys, err := readPhysFile(src)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, phys)
+	}
+	return finishPhys(util.MergePhys(sets...))
+}
+
+// readPhysFile reads the phys saved in src.
+func readPhysFile(src string) (phys []util.Phy, err error) {
 	var buf []byte
 	buf, err = ioutil.ReadFile(src)
 	if err != nil {
 		err = fmt.Errorf("Error reading phys: %v", err)
 		return
 	}
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '{' {
+		return util.PhysFromGohai(trimmed, physOpts)
+	}
 	if err = yaml.Unmarshal(buf, &phys); err != nil {
 		err = fmt.Errorf("Error unmarshalling phys: %v", err)
 	}
-	fillBootIf(phys)
 	return
 }
 
-// Write writes out the compiled Layout in the specified format and location
-func Write(layout *util.Layout, destFmt, destLoc string, bindMacs bool) error {
-	var out util.Writer
-	var err error
+// DefaultFormat returns the output format layout is written in when
+// no format is asked for.  Layouts that want to be rendered by
+// NetworkManager are written as keyfiles, and everything else is
+// written in the first of DestFormats.
+func DefaultFormat(layout *util.Layout) string {
+	if layout.Renderer != "" && layout.Renderer != "networkd" {
+		if f, ok := util.Renderers[layout.Renderer]; ok {
+			return f
+		}
+	}
+	return DestFormats[0]
+}
+
+// newWriter returns the Writer that renders layout in destFmt.  The
+// options that change the system outside of the destination, such as
+// a reload script or systemd drop-ins, are only set when live is true.
+func newWriter(layout *util.Layout, destFmt string, live bool) (util.Writer, error) {
 	switch destFmt {
 	case "internal":
-		out = layout
+		return layout, nil
 	case "netplan":
-		out = netplan.New(layout)
+		return netplan.New(layout), nil
 	case "systemd":
-		out = systemd.New(layout)
+		sd := systemd.New(layout)
+		if live && reloadScript != "" {
+			sd.Minimal()
+		}
+		if live && unitDir != "" {
+			sd.UnitDir(unitDir)
+		}
+		return sd, nil
 	case "rhel":
-		out = rhel.New(layout)
-	default:
-		return fmt.Errorf("Unknown output format %s", destFmt)
+		rh := rhel.New(layout)
+		if live && restorecon {
+			rh.Restorecon()
+		}
+		if live && rhelRoot != "" {
+			rh.Root(rhelRoot)
+		}
+		return rh, nil
+	case "iproute2":
+		return iproute2.New(layout), nil
+	case "nmkeyfile":
+		return nmkeyfile.New(layout), nil
+	}
+	return nil, fmt.Errorf("Unknown output format %s", destFmt)
+}
+
+// Write writes out the compiled Layout in the specified format and
+// location.  If destFmt is empty, the format is picked by
+// DefaultFormat.
+func Write(layout *util.Layout, destFmt, destLoc string, bindMacs bool) error {
+	if destFmt == "" {
+		destFmt = DefaultFormat(layout)
+	}
+	out, err := newWriter(layout, destFmt, true)
+	if err != nil {
+		return err
 	}
 	if bindMacs {
 		out.BindMacs()
@@ -78,6 +190,44 @@ func Write(layout *util.Layout, destFmt, destLoc string, bindMacs bool) error {
 	if err != nil {
 		return fmt.Errorf("Error writing '%s': %v", destFmt, err)
 	}
+	if sd, ok := out.(*systemd.Systemd); ok && reloadScript != "" {
+		if err = sd.WriteReloadScript(reloadScript); err != nil {
+			return fmt.Errorf("Error writing reload script: %v", err)
+		}
+	}
+	if hostnameRoot != "" {
+		if err = layout.WriteHostname(hostnameRoot); err != nil {
+			return fmt.Errorf("Error writing hostname: %v", err)
+		}
+	}
+	return nil
+}
+
+// RenderCheck renders layout in destFmt into a temporary directory
+// that is removed afterwards, and returns any errors the writer
+// reports.  Some problems, such as features an output format cannot
+// express, are only found when writing, so this catches what Read
+// cannot without touching the live config.  If destFmt is empty, the
+// format is picked by DefaultFormat.
+func RenderCheck(layout *util.Layout, destFmt string, bindMacs bool) error {
+	if destFmt == "" {
+		destFmt = DefaultFormat(layout)
+	}
+	out, err := newWriter(layout, destFmt, false)
+	if err != nil {
+		return err
+	}
+	if bindMacs {
+		out.BindMacs()
+	}
+	tmp, err := ioutil.TempDir("", "netwrangler-check-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err = out.Write(path.Join(tmp, destFmt)); err != nil {
+		return fmt.Errorf("Error writing '%s': %v", destFmt, err)
+	}
 	return nil
 }
 
@@ -88,6 +238,27 @@ func Write(layout *util.Layout, destFmt, destLoc string, bindMacs bool) error {
 // addresses), otherwise the interface names at srcLoc must match what
 // is present on the system at the time netwrangler is run.
 func Compile(phys []util.Phy, srcFmt, destFmt, srcLoc, destLoc string, bindMacs bool) error {
+	layout, err := Read(phys, srcFmt, srcLoc)
+	if err != nil {
+		return err
+	}
+	return Write(layout, destFmt, destLoc, bindMacs)
+}
+
+// Apply applies layout to the running system with ip and ethtool.
+// If rollbackAfter is not zero, the applied config is reverted unless
+// confirm is closed within that time.
+func Apply(layout *util.Layout, rollbackAfter time.Duration, confirm <-chan struct{}) error {
+	if err := iproute2.New(layout).Apply(rollbackAfter, confirm); err != nil {
+		return fmt.Errorf("Error applying: %v", err)
+	}
+	return nil
+}
+
+// Read reads the network configuration settings from srcLoc in
+// srcFmt, and compiles them into a Layout using phys as
+// the base physical interfaces to build on.
+func Read(phys []util.Phy, srcFmt, srcLoc string) (*util.Layout, error) {
 	var (
 		layout *util.Layout
 		err    error
@@ -95,18 +266,210 @@ func Compile(phys []util.Phy, srcFmt, destFmt, srcLoc, destLoc string, bindMacs
 	)
 	switch srcFmt {
 	case "netplan":
-		in = &netplan.Netplan{}
+		np := &netplan.Netplan{}
+		if strictMatch {
+			np.StrictMatch()
+		}
+		in = np
+	case "systemd":
+		in = &systemd.Systemd{}
+	case "nmkeyfile":
+		in = &nmkeyfile.NMKeyfile{}
 	case "internal":
 		in = layout
 	default:
-		return fmt.Errorf("Unknown input format %s", srcFmt)
+		return nil, fmt.Errorf("Unknown input format %s", srcFmt)
 	}
 	layout, err = in.Read(srcLoc, phys)
+	if err == nil {
+		err = layout.ValidateNames(phys)
+	}
+	if err == nil && macSeed != "" {
+		err = layout.GenerateMacs(macSeed)
+	}
+	if err == nil && checkModules {
+		err = layout.CheckModules(util.ModuleAvailable)
+	}
 	if err != nil {
-		return fmt.Errorf("Error reading '%s': %v", srcFmt, err)
+		return nil, fmt.Errorf("Error reading '%s': %v", srcFmt, err)
 	}
+	return layout, nil
+}
 
-	return Write(layout, destFmt, destLoc, bindMacs)
+// MatchReport reports how the ethernet stanzas in the srcFmt config
+// at srcLoc resolve against phys, without compiling the rest of the
+// config.  Only the netplan format has ethernet stanzas to report on.
+func MatchReport(phys []util.Phy, srcFmt, srcLoc string) (*util.MatchReport, error) {
+	if srcFmt != "netplan" {
+		return nil, fmt.Errorf("Match reports are not supported for input format %s", srcFmt)
+	}
+	res, err := (&netplan.Netplan{}).ReadMatchReport(srcLoc, phys)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading '%s': %v", srcFmt, err)
+	}
+	return res, nil
+}
+
+// ExcludePhys arranges for physical nics whose names match any of the
+// passed globs to be dropped when phys are gathered, so that they can
+// never be claimed by a network config.  Must be called before phys
+// are gathered.
+func ExcludePhys(globs ...string) error {
+	for _, glob := range globs {
+		if glob == "" {
+			continue
+		}
+		if _, err := util.Glob2RE(glob); err != nil {
+			return fmt.Errorf("Invalid phys exclusion %s: %v", glob, err)
+		}
+	}
+	physExclude = globs
+	return nil
+}
+
+// IncludeVirtualPhys arranges for virtual nics whose driver matches one
+// of the passed globs to be gathered as if they were physical, which
+// lets ethernet stanzas match the paravirtualized nics of VMs.  With
+// no globs, util.DefaultVirtualDrivers are used.  Must be called
+// before phys are gathered.
+func IncludeVirtualPhys(drivers ...string) error {
+	for _, glob := range drivers {
+		if glob == "" {
+			continue
+		}
+		if _, err := util.Glob2RE(glob); err != nil {
+			return fmt.Errorf("Invalid virtual driver %s: %v", glob, err)
+		}
+	}
+	physOpts = util.GatherPhysOpts{IncludeVirtual: true, Drivers: drivers}
+	return nil
+}
+
+// StrictMatch arranges for Read to fail when an ethernet stanza
+// matches more than one nic and is not part of a bond or bridge.
+func StrictMatch(strict bool) {
+	strictMatch = strict
+}
+
+// CheckModules makes Read fail when a kernel module needed to create
+// an interface, such as bonding for bonds, cannot be loaded on the
+// system netwrangler is running on.  It does nothing off Linux.
+func CheckModules(check bool) {
+	checkModules = check
+}
+
+// MacSeed makes Read give the bonds, bridges, vlans, veths, and
+// ethernet tunnels that have no MAC address a stable one derived from
+// seed and their name, so that they keep their DHCP reservations
+// across reboots.  Using the machine id as the seed keeps the addresses
+// unique across machines.  An empty seed leaves them to the kernel,
+// which is the default.
+func MacSeed(seed string) {
+	macSeed = seed
+}
+
+// ForbidPrefixes makes Read fail when an interface has a static
+// address in one of the passed CIDR prefixes, such as 169.254.0.0/16
+// or a management range that data interfaces must stay out of.  With
+// no prefixes, nothing is forbidden, which is the default.
+func ForbidPrefixes(prefixes ...string) error {
+	e := &util.Err{Prefix: "forbid-prefixes"}
+	addrs := []string{}
+	for _, prefix := range prefixes {
+		if prefix != "" {
+			addrs = append(addrs, strings.TrimSpace(prefix))
+		}
+	}
+	res, ok := util.ValidatePrefixes(e, "prefixes", addrs)
+	if !ok {
+		return e
+	}
+	util.DefaultForbiddenPrefixes = res
+	return nil
+}
+
+// DefaultRenderer sets the renderer used for input that does not ask
+// for one, which in turn picks the output format when none is given.
+func DefaultRenderer(renderer string) error {
+	if renderer == "" {
+		return nil
+	}
+	e := &util.Err{Prefix: "default-renderer"}
+	if _, ok := util.ValidateRenderer(e, "renderer", renderer); !ok {
+		return e
+	}
+	util.DefaultRenderer = renderer
+	return nil
+}
+
+// ReloadScript arranges for the systemd output format to only replace
+// the unit files that changed, and to write the commands that make
+// systemd-networkd apply those changes to a shell script at dest.  An
+// empty dest rewrites every unit file, which is the default.
+func ReloadScript(dest string) {
+	reloadScript = dest
+}
+
+// HostnameRoot makes Write also write the hostname the input sets, if
+// any, to etc/hostname under root and map it to 127.0.1.1 in
+// etc/hosts there.  An empty root leaves the hostname alone, which is
+// the default.
+func HostnameRoot(root string) {
+	hostnameRoot = root
+}
+
+// UnitDir sets the directory the systemd output format writes drop-ins
+// for systemd units to, which is usually /etc/systemd/system.  It is
+// needed for wait-online-timeout to have an effect.
+func UnitDir(dir string) {
+	unitDir = dir
+}
+
+// Owner arranges for the files written by the output formats that
+// write a directory of files to be owned by spec, which is in
+// user[:group] form.  An empty spec leaves them as created.
+func Owner(spec string) error {
+	if spec == "" {
+		util.SetOwner(-1, -1)
+		return nil
+	}
+	uid, gid, err := util.ParseOwner(spec)
+	if err != nil {
+		return err
+	}
+	util.SetOwner(uid, gid)
+	return nil
+}
+
+// DirMode sets the mode, in octal, that the output formats that write
+// a directory of files create it with.  An empty spec uses 0755.
+func DirMode(spec string) error {
+	if spec == "" {
+		util.SetDirMode(0755)
+		return nil
+	}
+	mode, err := strconv.ParseUint(spec, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("Invalid directory mode %s", spec)
+	}
+	util.SetDirMode(os.FileMode(mode))
+	return nil
+}
+
+// Restorecon makes the rhel output format reset the SELinux contexts
+// of the files it writes, which initscripts needs when SELinux is
+// enforcing.  It does nothing when SELinux is disabled or restorecon
+// is not installed.
+func Restorecon(restore bool) {
+	restorecon = restore
+}
+
+// RhelRoot sets the directory the rhel output format installs the
+// files that initscripts only looks for outside of network-scripts
+// under, such as /sbin/ifup-local.  It is usually /.  Without it, the
+// settings that need those files are ignored, which is the default.
+func RhelRoot(root string) {
+	rhelRoot = root
 }
 
 // BootMac arranges for setting the BootIf flag on the phy corresponding to the
@@ -125,3 +488,35 @@ func BootMac(mac string) error {
 	bootMac, err = net.ParseMAC(mac)
 	return err
 }
+
+// cmdlinePath is where AutoBootMac reads the kernel command line from.
+var cmdlinePath = "/proc/cmdline"
+
+// bootIf returns the value of the BOOTIF parameter PXELINUX and iPXE
+// add to the kernel command line, or an empty string if there is not
+// one.
+func bootIf(cmdline string) string {
+	res := ""
+	for _, arg := range strings.Fields(cmdline) {
+		if strings.HasPrefix(arg, "BOOTIF=") {
+			res = strings.TrimPrefix(arg, "BOOTIF=")
+		}
+	}
+	return res
+}
+
+// AutoBootMac is BootMac with the MAC address from the BOOTIF
+// parameter of the kernel command line, which PXE bootloaders set to
+// the nic the system booted from.  It does nothing if the kernel
+// command line cannot be read or has no BOOTIF.
+func AutoBootMac() error {
+	buf, err := ioutil.ReadFile(cmdlinePath)
+	if err != nil {
+		return nil
+	}
+	mac := bootIf(string(buf))
+	if err := BootMac(mac); err != nil {
+		return fmt.Errorf("Invalid BOOTIF %s: %v", mac, err)
+	}
+	return nil
+}
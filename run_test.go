@@ -1,8 +1,11 @@
 package netwrangler
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
@@ -11,9 +14,14 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	yaml "github.com/ghodss/yaml"
 	gnet "github.com/rackn/gohai/plugins/net"
+	"github.com/rackn/netwrangler/iproute2"
+	"github.com/rackn/netwrangler/netplan"
+	"github.com/rackn/netwrangler/nmkeyfile"
+	"github.com/rackn/netwrangler/systemd"
 	"github.com/rackn/netwrangler/util"
 )
 
@@ -180,6 +188,11 @@ func testRun(t *testing.T, loc, in, out string, wantErr bool) {
 	if strings.HasSuffix(loc, "-bindMacs") {
 		args = append(args, "-bindMacs")
 	}
+	if out == "rhel" {
+		RhelRoot(path.Join(actualOut, "root"))
+		defer RhelRoot("")
+		args = append(args, "-rhel-root", path.Join(actualOut, "root"))
+	}
 	t.Logf("Running with args %v", args)
 	if err = Compile(phys, in, out, in+".yaml", actualOut, strings.HasSuffix(loc, "-bindMacs")); err != nil {
 		if !wantErr {
@@ -223,6 +236,257 @@ func TestPhys(t *testing.T) {
 	}
 }
 
+func TestGatherPhysFromGohai(t *testing.T) {
+	gohai := `{"DMI": {}, "Networking": {"Interfaces": [
+  {"Name": "lo", "MTU": 65536, "Flags": "up|loopback|running", "HardwareAddr": "",
+   "Sys": {"IsPhysical": false, "BusAddress": "virtual"}},
+  {"Name": "enp3s0", "StableName": "enp3s0", "OrdinalName": "onboard:0", "Driver": "e1000e",
+   "Flags": "up|broadcast|multicast|running", "HardwareAddr": "52:54:00:12:34:56",
+   "Addrs": ["192.0.2.2/24"], "Sys": {"IsPhysical": true, "BusAddress": "0000:03:00.0"}},
+  {"Name": "br0", "Flags": "up|broadcast|multicast", "HardwareAddr": "52:54:00:12:34:56",
+   "Sys": {"IsPhysical": false, "IsBridge": true}}
+]}}`
+	tmp, err := ioutil.TempFile("", "netwrangler-gohai-")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(gohai); err != nil {
+		t.Fatalf("Error writing gohai output: %v", err)
+	}
+	tmp.Close()
+	phys, err := GatherPhysFromFile(tmp.Name())
+	if err != nil {
+		t.Fatalf("Error reading gohai phys: %v", err)
+	}
+	if len(phys) != 2 || phys[0].Name != "lo" || phys[1].Name != "enp3s0" {
+		t.Fatalf("Expected phys lo and enp3s0, got %v", phys)
+	}
+	if phys[1].HardwareAddr.String() != "52:54:00:12:34:56" || phys[1].OrdinalName != "onboard:0" {
+		t.Errorf("enp3s0 not read correctly: %v", phys[1])
+	}
+	if _, err := util.PhysFromGohai([]byte(`{"Networking": {}}`), util.GatherPhysOpts{}); err == nil {
+		t.Errorf("Expected an error for gohai output without interfaces")
+	}
+}
+
+func TestDerivedNames(t *testing.T) {
+	gohai := []byte(`{"Interfaces": [
+  {"Name": "lo", "Flags": "up|loopback", "Sys": {"IsPhysical": false, "BusAddress": "virtual"}},
+  {"Name": "eth0", "Flags": "up|broadcast|multicast", "HardwareAddr": "52:54:00:12:34:56",
+   "Sys": {"IsPhysical": true, "BusAddress": "pci0000:00/0000:00:1c.0/0000:03:00.0"}},
+  {"Name": "eth1", "Flags": "up|broadcast|multicast", "HardwareAddr": "52:54:00:12:34:57",
+   "Sys": {"IsPhysical": true, "BusAddress": "pci0000:00/0000:00:1c.0/0000:04:00.1"}},
+  {"Name": "eth2", "Flags": "up|broadcast|multicast", "HardwareAddr": "52:54:00:12:34:58",
+   "Path": "pci-0001:05:00.0", "Sys": {"IsPhysical": true}},
+  {"Name": "eth3", "Flags": "up|broadcast|multicast", "HardwareAddr": "52:54:00:12:34:59",
+   "Sys": {"IsPhysical": true, "BusAddress": "pci0000:00/0000:00:14.0/usb1/1-1/1-1:1.0"}},
+  {"Name": "eth4", "StableName": "eno1", "Flags": "up|broadcast|multicast", "HardwareAddr": "52:54:00:12:34:5a",
+   "Sys": {"IsPhysical": true, "BusAddress": "pci0000:00/0000:00:1f.6"}},
+  {"Name": "enp6s0", "Flags": "up|broadcast|multicast", "HardwareAddr": "52:54:00:12:34:5b",
+   "Sys": {"IsPhysical": true, "BusAddress": "pci0000:00/0000:00:1c.2/0000:06:00.0"}}
+]}`)
+	phys, err := util.PhysFromGohai(gohai, util.GatherPhysOpts{})
+	if err != nil {
+		t.Fatalf("Error reading gohai phys: %v", err)
+	}
+	expect := map[string]string{
+		"lo":     "",
+		"eth0":   "enp3s0",
+		"eth1":   "enp4s0f1",
+		"eth2":   "enP1p5s0",
+		"eth3":   "enx525400123459",
+		"eth4":   "",
+		"enp6s0": "",
+	}
+	for _, phy := range phys {
+		if phy.DerivedName != expect[phy.Name] {
+			t.Errorf("%s: expected derived name %q, got %q", phy.Name, expect[phy.Name], phy.DerivedName)
+		}
+	}
+	buf, err := yaml.Marshal(phys)
+	if err != nil {
+		t.Fatalf("Error marshalling phys: %v", err)
+	}
+	if !strings.Contains(string(buf), "DerivedName: enp4s0f1") {
+		t.Errorf("Expected the derived names in the gathered phys, got\n%s", string(buf))
+	}
+	matched, err := util.MatchPhys(util.Match{Name: "enp4s*"}, util.Interface{}, phys)
+	if err != nil {
+		t.Fatalf("Error matching phys: %v", err)
+	}
+	if len(matched) != 1 || matched[0].Name != "eth1" {
+		t.Errorf("Expected enp4s* to match eth1, got %v", matched)
+	}
+	kept, err := util.ExcludePhys(phys, []string{"enx*"})
+	if err != nil {
+		t.Fatalf("Error excluding phys: %v", err)
+	}
+	if len(kept) != len(phys)-1 {
+		t.Errorf("Expected enx* to exclude eth3, got %v", kept)
+	}
+}
+
+func TestGatherVirtualPhys(t *testing.T) {
+	gohai := []byte(`{"Interfaces": [
+  {"Name": "lo", "Flags": "up|loopback", "Sys": {"IsPhysical": false, "BusAddress": "virtual"}},
+  {"Name": "eth0", "Driver": "virtio_net", "Flags": "up|broadcast|multicast",
+   "HardwareAddr": "52:54:00:12:34:56", "Sys": {"IsPhysical": false, "BusAddress": "virtual"}},
+  {"Name": "eth1", "Driver": "vmxnet3", "Flags": "up|broadcast|multicast",
+   "HardwareAddr": "52:54:00:12:34:57", "Sys": {"IsPhysical": false, "BusAddress": "virtual"}},
+  {"Name": "veth0", "Driver": "veth", "Flags": "up|broadcast|multicast",
+   "HardwareAddr": "52:54:00:12:34:58", "Sys": {"IsPhysical": false, "BusAddress": "virtual"}}
+]}`)
+	for _, tc := range []struct {
+		opts util.GatherPhysOpts
+		want []string
+	}{
+		{util.GatherPhysOpts{}, []string{"lo"}},
+		{util.GatherPhysOpts{IncludeVirtual: true}, []string{"lo", "eth0", "eth1"}},
+		{util.GatherPhysOpts{IncludeVirtual: true, Drivers: []string{"virtio*"}}, []string{"lo", "eth0"}},
+		{util.GatherPhysOpts{Drivers: []string{"veth"}}, []string{"lo"}},
+	} {
+		phys, err := util.PhysFromGohai(gohai, tc.opts)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.opts, err)
+			continue
+		}
+		names := []string{}
+		for _, phy := range phys {
+			names = append(names, phy.Name)
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%+v: expected phys %v, got %v", tc.opts, tc.want, names)
+		}
+	}
+	if err := IncludeVirtualPhys("^virtio("); err == nil {
+		t.Errorf("Expected an error for an invalid driver glob")
+	}
+}
+
+func TestGatherPhysFromFiles(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	files := map[string]string{
+		"drivers.yaml": `
+- Name: enp1s0
+  Driver: e1000
+  HardwareAddr: "52:54:01:23:00:01"
+- Name: enp2s0
+  Driver: e1000
+`,
+		"lldp.yaml": `
+- Name: enp2s0
+  HardwareAddr: "52:54:01:23:00:02"
+  LLDP:
+    SysName: tor1
+    PortID: Gi1/0/2
+- Name: enp3s0
+  Driver: ixgbe
+`,
+		"conflict.yaml": `
+- Name: enp1s0
+  HardwareAddr: "52:54:01:23:00:09"
+`,
+	}
+	for name, buf := range files {
+		if err := ioutil.WriteFile(path.Join(tmp, name), []byte(buf), 0644); err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+	phys, err := GatherPhysFromFile(path.Join(tmp, "drivers.yaml"), path.Join(tmp, "lldp.yaml"))
+	if err != nil {
+		t.Fatalf("Unexpected error merging phys: %v", err)
+	}
+	names := []string{}
+	for _, phy := range phys {
+		names = append(names, phy.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"enp1s0", "enp2s0", "enp3s0"}) {
+		t.Errorf("Expected phys enp1s0, enp2s0, and enp3s0, got %v", names)
+	}
+	enp2s0 := phys[1]
+	if enp2s0.Driver != "e1000" || enp2s0.HardwareAddr.String() != "52:54:01:23:00:02" ||
+		enp2s0.LLDP == nil || enp2s0.LLDP.SysName != "tor1" {
+		t.Errorf("Expected enp2s0 to have fields from both files, got %+v", enp2s0)
+	}
+	_, err = GatherPhysFromFile(path.Join(tmp, "drivers.yaml"), path.Join(tmp, "conflict.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "conflicting MAC addresses") {
+		t.Errorf("Expected a conflicting MAC address error, got %v", err)
+	}
+}
+
+var fails = map[string]bool{
+	"test-data/invalid_ad_actor_system":          true,
+	"test-data/invalid_address_prefix":           true,
+	"test-data/invalid_address_scope":            true,
+	"test-data/invalid_alias":                    true,
+	"test-data/invalid_alternative_names":        true,
+	"test-data/invalid_auto_rule":                true,
+	"test-data/invalid_autoconnect_priority":     true,
+	"test-data/invalid_bond_delays":              true,
+	"test-data/invalid_bond_lacp_rate":           true,
+	"test-data/invalid_bond_min_links":           true,
+	"test-data/invalid_bond_packets_per_slave":   true,
+	"test-data/invalid_bond_queue_ids":           true,
+	"test-data/invalid_bond_tlb_dynamic_lb":      true,
+	"test-data/invalid_bridge_trunk_pvid":        true,
+	"test-data/invalid_broadcast":                true,
+	"test-data/invalid_description":              true,
+	"test-data/invalid_dhcp_client_id":           true,
+	"test-data/invalid_dhcp_options":             true,
+	"test-data/invalid_dhcp_route_table":         true,
+	"test-data/invalid_duid":                     true,
+	"test-data/invalid_emit_lldp":                true,
+	"test-data/invalid_gateway_conflict":         true,
+	"test-data/invalid_gratuitous_arp":           true,
+	"test-data/invalid_group_forward_mask":       true,
+	"test-data/invalid_hostname":                 true,
+	"test-data/invalid_hostname_template":        true,
+	"test-data/invalid_ip_masquerade":            true,
+	"test-data/invalid_ipv6_dad":                 true,
+	"test-data/invalid_ipv6_mtu":                 true,
+	"test-data/invalid_ipv6_token":               true,
+	"test-data/invalid_keep_configuration":       true,
+	"test-data/invalid_lifetime":                 true,
+	"test-data/invalid_link_group":               true,
+	"test-data/invalid_mac":                      true,
+	"test-data/invalid_macaddress":               true,
+	"test-data/invalid_mtu":                      true,
+	"test-data/invalid_name_collision":           true,
+	"test-data/invalid_neighbors":                true,
+	"test-data/invalid_ns_targets":               true,
+	"test-data/invalid_order_cycle":              true,
+	"test-data/invalid_order_unknown":            true,
+	"test-data/invalid_queue_cpus":               true,
+	"test-data/invalid_rename":                   true,
+	"test-data/invalid_rename_member":            true,
+	"test-data/invalid_renderer":                 true,
+	"test-data/invalid_renderer_alias":           true,
+	"test-data/invalid_required_family":          true,
+	"test-data/invalid_route_conflict":           true,
+	"test-data/invalid_route_conflict_options":   true,
+	"test-data/invalid_route_default_metric":     true,
+	"test-data/invalid_route_dev":                true,
+	"test-data/invalid_route_type":               true,
+	"test-data/invalid_routing_policy_mark_mask": true,
+	"test-data/invalid_routing_policy_ports":     true,
+	"test-data/invalid_search_domain":            true,
+	"test-data/invalid_time_suffix":              true,
+	"test-data/invalid_tunnel_endpoint":          true,
+	"test-data/invalid_veth":                     true,
+	"test-data/invalid_vlan_qos":                 true,
+	"test-data/invalid_wait_device":              true,
+	"test-data/invalid_wait_online":              true,
+	"test-data/invalid_wakeonlan_password":       true,
+	"test-data/invalid_wakeonlan_secureon":       true,
+	"test-data/loopback_interface":               true,
+	"test-data/wireless":                         true,
+}
+
 func TestNetMangler(t *testing.T) {
 	tests, err := filepath.Glob(path.Join("test-data", "*"))
 	if err != nil {
@@ -230,11 +494,6 @@ func TestNetMangler(t *testing.T) {
 		return
 	}
 	sort.Strings(tests)
-	fails := map[string]bool{
-		"test-data/direct_connect_gateway": true,
-		"test-data/loopback_interface":     true,
-		"test-data/wireless":               true,
-	}
 	for _, testPath := range tests {
 		if st, err := os.Stat(testPath); err == nil && !st.IsDir() {
 			continue
@@ -244,3 +503,1590 @@ func TestNetMangler(t *testing.T) {
 		rt(t, testPath, fail)
 	}
 }
+
+func TestParseLLDP(t *testing.T) {
+	single := `{"lldp": {"interface": {"enp3s0": {
+  "chassis": {"tor1": {"id": {"type": "mac", "value": "00:11:22:33:44:55"}}},
+  "port": {"id": {"type": "ifname", "value": "Gi1/0/3"}, "descr": "GigabitEthernet1/0/3"}}}}}`
+	multi := `{"lldp": {"interface": [
+  {"enp3s0": {"chassis": {"id": {"type": "mac", "value": "00:11:22:33:44:55"}},
+              "port": {"id": {"type": "ifname", "value": "Gi1/0/3"}}}},
+  {"enp4s0": {"chassis": {"tor2": {"id": {"type": "mac", "value": "00:11:22:33:44:66"}}},
+              "port": {"id": {"type": "ifname", "value": "Gi1/0/4"}}}}]}}`
+	for _, tc := range []struct {
+		src    string
+		expect map[string]util.LLDPNeighbor
+	}{
+		{`{"lldp": {}}`, map[string]util.LLDPNeighbor{}},
+		{single, map[string]util.LLDPNeighbor{
+			"enp3s0": {SysName: "tor1", ChassisID: "00:11:22:33:44:55", PortID: "Gi1/0/3", PortDescr: "GigabitEthernet1/0/3"},
+		}},
+		{multi, map[string]util.LLDPNeighbor{
+			"enp3s0": {ChassisID: "00:11:22:33:44:55", PortID: "Gi1/0/3"},
+			"enp4s0": {SysName: "tor2", ChassisID: "00:11:22:33:44:66", PortID: "Gi1/0/4"},
+		}},
+	} {
+		actual, err := util.ParseLLDP([]byte(tc.src))
+		if err != nil {
+			t.Errorf("Unexpected error parsing %s: %v", tc.src, err)
+		} else if !reflect.DeepEqual(actual, tc.expect) {
+			t.Errorf("Expected %v, got %v", tc.expect, actual)
+		}
+	}
+	if _, err := util.ParseLLDP([]byte("not json")); err == nil {
+		t.Errorf("Expected an error parsing invalid lldpctl output")
+	}
+}
+
+func roundTrip(t *testing.T, loc string) {
+	t.Helper()
+	phys := testPhys
+	if st, err := os.Stat(path.Join(loc, "phys.yaml")); err == nil && st.Mode().IsRegular() {
+		if phys, err = GatherPhysFromFile(path.Join(loc, "phys.yaml")); err != nil {
+			t.Errorf("%s: %v", loc, err)
+			return
+		}
+	}
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Errorf("Error creating temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	bindMacs := strings.HasSuffix(loc, "-bindMacs")
+	layouts, srcs := []string{}, []string{path.Join(loc, "netplan.yaml")}
+	for i := 0; i < 2; i++ {
+		layout, err := (&netplan.Netplan{}).Read(srcs[i], phys)
+		if err != nil {
+			t.Errorf("%s: Error reading %s: %v", loc, srcs[i], err)
+			return
+		}
+		for k, v := range layout.Interfaces {
+			v.MatchID = ""
+			layout.Interfaces[k] = v
+		}
+		buf, _ := yaml.Marshal(layout)
+		layouts = append(layouts, string(buf))
+		out := netplan.New(layout)
+		if bindMacs {
+			out.BindMacs()
+		}
+		srcs = append(srcs, path.Join(tmp, fmt.Sprintf("netplan-%d.yaml", i)))
+		if err := out.Write(srcs[i+1]); err != nil {
+			t.Errorf("%s: Error writing %s: %v", loc, srcs[i+1], err)
+			return
+		}
+	}
+	if layouts[0] != layouts[1] {
+		t.Errorf("%s: Layout changed after netplan round trip:\n%s\n%s", loc, layouts[0], layouts[1])
+	}
+	if out, err := diff(srcs[1], srcs[2]); out != "" || err != nil {
+		t.Errorf("%s: Rendered netplan not stable after round trip: %v\n%s", loc, err, out)
+	}
+}
+
+func TestNetplanRoundTrip(t *testing.T) {
+	tests, err := filepath.Glob(path.Join("test-data", "*", "netplan.yaml"))
+	if err != nil {
+		t.Errorf("FATAL: Error getting tests: %v", err)
+		return
+	}
+	sort.Strings(tests)
+	for _, test := range tests {
+		loc := path.Dir(test)
+		if fails[loc] {
+			continue
+		}
+		roundTrip(t, loc)
+	}
+}
+
+func TestSystemdRoundTrip(t *testing.T) {
+	tests, err := filepath.Glob(path.Join("test-data", "*", "systemd", "expect"))
+	if err != nil {
+		t.Errorf("FATAL: Error getting tests: %v", err)
+		return
+	}
+	sort.Strings(tests)
+	for _, test := range tests {
+		loc := path.Dir(path.Dir(test))
+		if fails[loc] {
+			continue
+		}
+		phys := testPhys
+		if st, err := os.Stat(path.Join(loc, "phys.yaml")); err == nil && st.Mode().IsRegular() {
+			if phys, err = GatherPhysFromFile(path.Join(loc, "phys.yaml")); err != nil {
+				t.Errorf("%s: %v", loc, err)
+				continue
+			}
+		}
+		layout, err := (&systemd.Systemd{}).Read(test, phys)
+		if err != nil {
+			t.Errorf("%s: Error reading %s: %v", loc, test, err)
+			continue
+		}
+		tmp, err := ioutil.TempDir("", "netwrangler-test-")
+		if err != nil {
+			t.Errorf("Error creating temp dir: %v", err)
+			return
+		}
+		out := systemd.New(layout)
+		if strings.HasSuffix(loc, "-bindMacs") {
+			out.BindMacs()
+		}
+		if err := out.Write(path.Join(tmp, "out")); err != nil {
+			t.Errorf("%s: Error writing systemd: %v", loc, err)
+		} else if res, err := diff(test, path.Join(tmp, "out")); res != "" || err != nil {
+			t.Errorf("%s: Rendered systemd not stable after round trip: %v\n%s", loc, err, res)
+		}
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestNMKeyfileRoundTrip(t *testing.T) {
+	tests, err := filepath.Glob(path.Join("test-data", "*", "nmkeyfile", "expect"))
+	if err != nil {
+		t.Errorf("FATAL: Error getting tests: %v", err)
+		return
+	}
+	sort.Strings(tests)
+	for _, test := range tests {
+		loc := path.Dir(path.Dir(test))
+		// Keyfiles do not record which nic gets renamed, so renames
+		// cannot be read back.
+		if fails[loc] || loc == path.Join("test-data", "rename") {
+			continue
+		}
+		phys := testPhys
+		if st, err := os.Stat(path.Join(loc, "phys.yaml")); err == nil && st.Mode().IsRegular() {
+			if phys, err = GatherPhysFromFile(path.Join(loc, "phys.yaml")); err != nil {
+				t.Errorf("%s: %v", loc, err)
+				continue
+			}
+		}
+		layout, err := (&nmkeyfile.NMKeyfile{}).Read(test, phys)
+		if err != nil {
+			t.Errorf("%s: Error reading %s: %v", loc, test, err)
+			continue
+		}
+		tmp, err := ioutil.TempDir("", "netwrangler-test-")
+		if err != nil {
+			t.Errorf("Error creating temp dir: %v", err)
+			return
+		}
+		out := nmkeyfile.New(layout)
+		if strings.HasSuffix(loc, "-bindMacs") {
+			out.BindMacs()
+		}
+		if err := out.Write(path.Join(tmp, "out")); err != nil {
+			t.Errorf("%s: Error writing nmkeyfile: %v", loc, err)
+		} else if res, err := diff(test, path.Join(tmp, "out")); res != "" || err != nil {
+			t.Errorf("%s: Rendered nmkeyfile not stable after round trip: %v\n%s", loc, err, res)
+		}
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestNMKeyfileControllers(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	files := map[string]string{
+		"br0.nmconnection": "[connection]\nid=br0\nuuid=5b5d4a2e-4b3c-4e41-9a55-1f0d1e7c4a10\ntype=bridge\ninterface-name=br0\n\n[ipv4]\nmethod=manual\naddress1=192.168.1.10/24,192.168.1.1\n\n[ipv6]\nmethod=ignore\n",
+		// The newer key names, referring to the bridge by uuid.
+		"enp3s0.nmconnection": "[connection]\nid=port1\ntype=ethernet\ninterface-name=enp3s0\ncontroller=5b5d4a2e-4b3c-4e41-9a55-1f0d1e7c4a10\nport-type=bridge\n",
+		// The older ones, referring to it by interface name.
+		"enp4s0.nmconnection": "[connection]\nid=port2\ntype=802-3-ethernet\ninterface-name=enp4s0\nmaster=br0\nslave-type=bridge\n",
+		"ignored.txt":         "not a keyfile",
+	}
+	for name, buf := range files {
+		if err := ioutil.WriteFile(path.Join(tmp, name), []byte(buf), 0644); err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+	layout, err := (&nmkeyfile.NMKeyfile{}).Read(tmp, testPhys)
+	if err != nil {
+		t.Fatalf("Error reading keyfiles: %v", err)
+	}
+	for _, port := range []string{"enp3s0", "enp4s0"} {
+		if parents := layout.Child2Parent[port]; !reflect.DeepEqual(parents, []string{"br0"}) {
+			t.Errorf("%s: expected br0 as its parent, not %v", port, parents)
+		}
+		if layout.Interfaces[port].Network != nil {
+			t.Errorf("%s: ports should not have a network", port)
+		}
+	}
+	nw := layout.Interfaces["br0"].Network
+	if nw == nil || len(nw.Addresses) != 1 || nw.Gateway4 == nil || nw.Gateway4.IP.String() != "192.168.1.1" || nw.AcceptRa {
+		t.Errorf("br0: unexpected network %+v", nw)
+	}
+}
+
+func TestIPRoute2Apply(t *testing.T) {
+	layout, err := (&netplan.Netplan{}).Read(path.Join("test-data", "bonding", "netplan.yaml"), testPhys)
+	if err != nil {
+		t.Fatalf("Error reading netplan: %v", err)
+	}
+	var ran []string
+	runner := func(failOn string) func(...string) ([]byte, error) {
+		return func(args ...string) ([]byte, error) {
+			cmd := strings.Join(args, " ")
+			ran = append(ran, cmd)
+			if cmd == failOn {
+				return []byte("RTNETLINK answers: Operation not permitted"), fmt.Errorf("exit status 2")
+			}
+			return nil, nil
+		}
+	}
+	apply := func(failOn string, rollbackAfter time.Duration, confirm chan struct{}) error {
+		ran = []string{}
+		out := iproute2.New(layout)
+		out.Runner = runner(failOn)
+		return out.Apply(rollbackAfter, confirm)
+	}
+	confirm := make(chan struct{})
+	close(confirm)
+	if err := apply("", time.Minute, confirm); err != nil {
+		t.Errorf("Unexpected error applying confirmed config: %v", err)
+	}
+	if len(ran) != 9 {
+		t.Errorf("Expected 9 commands to be run, got %d: %v", len(ran), ran)
+	}
+	err = apply("ip link set dev enp4s0 master bond0", 0, nil)
+	if err == nil || !strings.Contains(err.Error(), "bond0: ip link set dev enp4s0 master bond0 failed") {
+		t.Errorf("Expected a failure enslaving enp4s0, got %v", err)
+	}
+	expect := []string{
+		"ip link add name bond0 type bond mode active-backup",
+		"ip link set dev enp3s0 down",
+		"ip link set dev enp3s0 master bond0",
+		"ip link set dev enp4s0 down",
+		"ip link set dev enp4s0 master bond0",
+		"ip link set dev enp4s0 up",
+		"ip link set dev enp3s0 nomaster",
+		"ip link set dev enp3s0 up",
+		"ip link del dev bond0",
+	}
+	if !reflect.DeepEqual(ran, expect) {
+		t.Errorf("Expected failed apply to run\n%v\ngot\n%v", expect, ran)
+	}
+	err = apply("", 10*time.Millisecond, make(chan struct{}))
+	if err == nil || !strings.Contains(err.Error(), "not confirmed") {
+		t.Errorf("Expected an unconfirmed config to be reverted, got %v", err)
+	}
+	if len(ran) != 14 || ran[13] != "ip link del dev bond0" {
+		t.Errorf("Expected unconfirmed config to be reverted, got %v", ran)
+	}
+	// Members that were down before are left down.
+	phys := append([]util.Phy{}, testPhys...)
+	for idx := range phys {
+		phys[idx].Flags = gnet.Flags(net.FlagBroadcast | net.FlagMulticast)
+		if phys[idx].Name == "enp3s0" {
+			phys[idx].Flags |= gnet.Flags(net.FlagUp)
+		}
+	}
+	if layout, err = (&netplan.Netplan{}).Read(path.Join("test-data", "bonding", "netplan.yaml"), phys); err != nil {
+		t.Fatalf("Error reading netplan: %v", err)
+	}
+	apply("ip link set dev enp4s0 master bond0", 0, nil)
+	expect = append(expect[:5], "ip link set dev enp3s0 nomaster", "ip link set dev enp3s0 up", "ip link del dev bond0")
+	if !reflect.DeepEqual(ran, expect) {
+		t.Errorf("Expected failed apply to run\n%v\ngot\n%v", expect, ran)
+	}
+}
+
+func TestMatchReport(t *testing.T) {
+	src := `network:
+  version: 2
+  ethernets:
+    enp3s0: {}
+    realteks:
+      match:
+        driver: realtek
+    boot:
+      match:
+        name: bootif
+    missing:
+      match:
+        macaddress: "00:11:22:33:44:55"
+`
+	np := &netplan.Netplan{}
+	if err := yaml.Unmarshal([]byte(src), np); err != nil {
+		t.Fatalf("Error parsing netplan: %v", err)
+	}
+	report, err := np.MatchReport(testPhys)
+	if err != nil {
+		t.Fatalf("Unexpected error building match report: %v", err)
+	}
+	phys := map[string][]string{}
+	for _, mr := range report.Results {
+		phys[mr.Stanza] = mr.Phys
+	}
+	expectPhys := map[string][]string{
+		"boot":     {"eno1"},
+		"enp3s0":   {"enp3s0"},
+		"missing":  {},
+		"realteks": {"ens3", "ens5", "eno1"},
+	}
+	if !reflect.DeepEqual(phys, expectPhys) {
+		t.Errorf("Expected matches %v, got %v", expectPhys, phys)
+	}
+	if !reflect.DeepEqual(report.Unmatched, []string{"missing"}) {
+		t.Errorf("Expected only missing to be unmatched, got %v", report.Unmatched)
+	}
+	expectConflicts := map[string][]string{"eno1": {"boot", "realteks"}}
+	if !reflect.DeepEqual(report.Conflicts, expectConflicts) {
+		t.Errorf("Expected conflicts %v, got %v", expectConflicts, report.Conflicts)
+	}
+	if report.OK() {
+		t.Errorf("Expected report with unmatched and conflicting stanzas to not be OK")
+	}
+	buf := &strings.Builder{}
+	if err := report.WriteTable(buf); err != nil {
+		t.Errorf("Error writing match report: %v", err)
+	}
+	if !strings.Contains(buf.String(), "eno1 also claimed by realteks") {
+		t.Errorf("Expected conflict in match report table, got:\n%s", buf.String())
+	}
+}
+
+func TestExcludePhys(t *testing.T) {
+	phys, err := util.ExcludePhys(testPhys, []string{"enp*", "onboard:1"})
+	if err != nil {
+		t.Fatalf("Unexpected error excluding phys: %v", err)
+	}
+	names := []string{}
+	for _, phy := range phys {
+		names = append(names, phy.Name)
+	}
+	if expect := []string{"ens3", "ens5"}; !reflect.DeepEqual(names, expect) {
+		t.Errorf("Expected phys %v after exclusion, got %v", expect, names)
+	}
+	if _, err := util.ExcludePhys(testPhys, []string{"^enp("}); err == nil {
+		t.Errorf("Expected an error for an invalid exclusion")
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	phy := func(name string, mac string) util.Interface {
+		return util.Interface{Name: name, Type: "physical", CurrentHwAddr: m(mac)}
+	}
+	for _, tc := range []struct {
+		intfs  []util.Interface
+		expect string
+	}{
+		{[]util.Interface{phy("enp3s0", "52:54:01:23:00:03")}, ""},
+		{[]util.Interface{phy("wan0", "52:54:01:23:00:03")}, ""},
+		{[]util.Interface{phy("enp3s0", "52:54:01:23:00:04"), phy("lan0", "52:54:01:23:00:03")}, ""},
+		{[]util.Interface{phy("enp1s0", "52:54:01:23:00:02")},
+			"enp1s0: cannot rename enp2s0 to enp1s0, which is already used by a physical nic"},
+		{[]util.Interface{phy("enp3s0", "52:54:01:23:00:04"), phy("enp4s0", "52:54:01:23:00:03")},
+			"rename cycle: enp3s0 -> enp4s0 -> enp3s0"},
+	} {
+		l := &util.Layout{Interfaces: map[string]util.Interface{}}
+		for _, intf := range tc.intfs {
+			l.Interfaces[intf.Name] = intf
+		}
+		err := l.ValidateNames(testPhys)
+		switch {
+		case err == nil && tc.expect != "":
+			t.Errorf("%v: expected error %q", tc.intfs, tc.expect)
+		case err != nil && tc.expect == "":
+			t.Errorf("%v: unexpected error %v", tc.intfs, err)
+		case err != nil && !strings.Contains(err.Error(), tc.expect):
+			t.Errorf("%v: expected error %q, got %v", tc.intfs, tc.expect, err)
+		}
+	}
+}
+
+func TestClaimedPhys(t *testing.T) {
+	for loc, expect := range map[string][]string{
+		"test-data/bonding": {"enp3s0", "enp4s0"},
+		"test-data/mtu":     {"enp1s0", "enp3s0", "enp4s0"},
+	} {
+		layout, err := Read(testPhys, "netplan", path.Join(loc, "netplan.yaml"))
+		if err != nil {
+			t.Errorf("%s: Error reading: %v", loc, err)
+			continue
+		}
+		if actual := layout.ClaimedPhys(); !reflect.DeepEqual(actual, expect) {
+			t.Errorf("%s: Expected claimed phys %v, got %v", loc, expect, actual)
+		}
+	}
+}
+
+func TestDefaultFormat(t *testing.T) {
+	for loc, expect := range map[string]string{
+		"test-data/network_manager": "nmkeyfile",
+		"test-data/bonding":         DestFormats[0],
+	} {
+		layout, err := Read(testPhys, "netplan", path.Join(loc, "netplan.yaml"))
+		if err != nil {
+			t.Errorf("%s: Error reading: %v", loc, err)
+			continue
+		}
+		if actual := DefaultFormat(layout); actual != expect {
+			t.Errorf("%s: Expected default format %s, got %s", loc, expect, actual)
+		}
+	}
+	layout, err := Read(testPhys, "netplan", "test-data/network_manager/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := Write(layout, "", tmp, false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	st, err := os.Stat(path.Join(tmp, "enp3s0.nmconnection"))
+	if err != nil {
+		t.Fatalf("Expected a keyfile for enp3s0: %v", err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("Expected keyfile mode 0600, got %v", st.Mode().Perm())
+	}
+}
+
+func TestDefaultRenderer(t *testing.T) {
+	defer DefaultRenderer("networkd")
+	if err := DefaultRenderer("systemd"); err == nil {
+		t.Errorf("Expected an error for default renderer systemd")
+	}
+	if err := DefaultRenderer("NetworkManager"); err != nil {
+		t.Fatalf("Error setting default renderer: %v", err)
+	}
+	layout, err := Read(testPhys, "netplan", "test-data/windows_dhcp_server/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if actual := DefaultFormat(layout); actual != "nmkeyfile" {
+		t.Errorf("Expected default format nmkeyfile, got %s", actual)
+	}
+}
+
+func TestStrictMatch(t *testing.T) {
+	defer StrictMatch(false)
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	broad := `network:
+  version: 2
+  ethernets:
+    nics:
+      match:
+        name: "enp*"
+      dhcp4: true
+`
+	bonded := `network:
+  version: 2
+  ethernets:
+    nics:
+      match:
+        name: "enp*"
+  bonds:
+    bond0:
+      interfaces: [ nics ]
+      dhcp4: true
+`
+	for _, tc := range []struct {
+		src     string
+		strict  bool
+		wantErr bool
+	}{
+		{broad, false, false},
+		{broad, true, true},
+		{bonded, true, false},
+	} {
+		src := path.Join(tmp, "netplan.yaml")
+		if err := ioutil.WriteFile(src, []byte(tc.src), 0644); err != nil {
+			t.Fatalf("Error writing %s: %v", src, err)
+		}
+		StrictMatch(tc.strict)
+		_, err := Read(testPhys, "netplan", src)
+		if tc.wantErr && err == nil {
+			t.Errorf("Expected an error with strict match %v for:\n%s", tc.strict, tc.src)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("Unexpected error with strict match %v: %v", tc.strict, err)
+		}
+	}
+}
+
+func TestReloadScript(t *testing.T) {
+	defer ReloadScript("")
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	script := path.Join(tmp, "reload.sh")
+	ReloadScript(script)
+	dest := path.Join(tmp, "network")
+	header := "#!/bin/sh\n# Created by netwrangler\nset -e\n"
+	for i, tc := range []struct {
+		mode, expect string
+	}{
+		{"active-backup", "networkctl reload\nnetworkctl reconfigure bond0\nnetworkctl reconfigure enp3s0\nnetworkctl reconfigure enp4s0\n"},
+		{"active-backup", ""},
+		{"balance-rr", "networkctl delete bond0\nnetworkctl reload\n"},
+	} {
+		layout, err := Read(testPhys, "netplan", "test-data/bonding/netplan.yaml")
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		layout.Interfaces["bond0"].Parameters["mode"] = tc.mode
+		if err := Write(layout, "systemd", dest, false); err != nil {
+			t.Fatalf("%d: Error writing: %v", i, err)
+		}
+		buf, err := ioutil.ReadFile(script)
+		if err != nil {
+			t.Fatalf("%d: Error reading reload script: %v", i, err)
+		}
+		if string(buf) != header+tc.expect {
+			t.Errorf("%d: Expected reload script\n%s\ngot\n%s", i, header+tc.expect, string(buf))
+		}
+	}
+	// Renamed nics do not have their new name until udev applies
+	// their link files, so they are triggered by MAC address.
+	phys, err := GatherPhysFromFile("test-data/rename/phys.yaml")
+	if err != nil {
+		t.Fatalf("Error gathering phys: %v", err)
+	}
+	layout, err := Read(phys, "netplan", "test-data/rename/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "systemd", path.Join(tmp, "renamed"), false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	buf, err := ioutil.ReadFile(script)
+	if err != nil {
+		t.Fatalf("Error reading reload script: %v", err)
+	}
+	for _, mac := range []string{"52:54:01:23:00:01", "52:54:01:23:00:02"} {
+		trigger := "udevadm trigger --action=add --subsystem-match=net --attr-match=address=" + mac + "\n"
+		if !strings.Contains(string(buf), trigger) {
+			t.Errorf("Expected reload script to contain %q, got\n%s", trigger, string(buf))
+		}
+	}
+}
+
+func TestHostnameRoot(t *testing.T) {
+	defer HostnameRoot("")
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	HostnameRoot(tmp)
+	etc := path.Join(tmp, "etc")
+	if err := os.MkdirAll(etc, 0755); err != nil {
+		t.Fatalf("Error creating etc: %v", err)
+	}
+	hosts := "127.0.0.1\tlocalhost\n127.0.1.1\told.example.com old\n10.0.0.1\tgateway\n"
+	if err := ioutil.WriteFile(path.Join(etc, "hosts"), []byte(hosts), 0644); err != nil {
+		t.Fatalf("Error writing hosts: %v", err)
+	}
+	layout, err := Read(testPhys, "netplan", "test-data/hostname/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "systemd", path.Join(tmp, "network"), false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	for name, expect := range map[string]string{
+		"hostname": "node1.example.com\n",
+		"hosts":    "127.0.0.1\tlocalhost\n10.0.0.1\tgateway\n127.0.1.1\tnode1.example.com node1\n",
+	} {
+		buf, err := ioutil.ReadFile(path.Join(etc, name))
+		if err != nil {
+			t.Errorf("Error reading %s: %v", name, err)
+		} else if string(buf) != expect {
+			t.Errorf("Expected %s\n%s\ngot\n%s", name, expect, string(buf))
+		}
+	}
+}
+
+func TestCheckModules(t *testing.T) {
+	layout, err := Read(testPhys, "netplan", "test-data/tunnels/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	asked := map[string]int{}
+	available := func(mod string) bool {
+		asked[mod]++
+		return mod != "ip_gre"
+	}
+	err = layout.CheckModules(available)
+	if err == nil || !strings.Contains(err.Error(), "kernel module ip_gre is not available") {
+		t.Errorf("Expected an error about ip_gre, not %v", err)
+	}
+	for mod, n := range asked {
+		if n != 1 {
+			t.Errorf("Expected to be asked about %s once, not %d times", mod, n)
+		}
+	}
+	if err := layout.CheckModules(func(string) bool { return true }); err != nil {
+		t.Errorf("Unexpected error with every module available: %v", err)
+	}
+	layout, err = Read(testPhys, "netplan", "test-data/dhcp/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := layout.CheckModules(func(string) bool { return false }); err != nil {
+		t.Errorf("Unexpected error for physical interfaces: %v", err)
+	}
+}
+
+func TestMacSeed(t *testing.T) {
+	defer MacSeed("")
+	MacSeed("machine-1")
+	layout, err := Read(testPhys, "netplan", "test-data/bonding/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	mac := layout.Interfaces["bond0"].MacAddress
+	if mac.String() != util.StableMac("machine-1", "bond0").String() {
+		t.Errorf("Expected bond0 to get %s, not %s", util.StableMac("machine-1", "bond0"), mac)
+	}
+	if len(mac) != 6 || mac[0]&3 != 2 {
+		t.Errorf("Expected a locally administered unicast MAC, not %s", mac)
+	}
+	if other := util.StableMac("machine-2", "bond0"); other.String() == mac.String() {
+		t.Errorf("Expected different seeds to give different MACs, got %s for both", mac)
+	}
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := Write(layout, "rhel", tmp, false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	buf, err := ioutil.ReadFile(path.Join(tmp, "ifcfg-bond0"))
+	if err != nil {
+		t.Fatalf("Error reading ifcfg-bond0: %v", err)
+	}
+	if !strings.Contains(string(buf), fmt.Sprintf("MACADDR=%q", mac.String())) {
+		t.Errorf("Expected ifcfg-bond0 to set MACADDR to %s:\n%s", mac, string(buf))
+	}
+	layout, err = Read(testPhys, "netplan", "test-data/bonding/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	bond := layout.Interfaces["bond0"]
+	bond.MacAddress = nil
+	layout.Interfaces["bond0"] = bond
+	member := layout.Interfaces["enp3s0"]
+	member.MacAddress = util.StableMac("machine-1", "bond0")
+	layout.Interfaces["enp3s0"] = member
+	if err := layout.GenerateMacs("machine-1"); err == nil {
+		t.Errorf("Expected an error generating a MAC that is already used")
+	}
+}
+
+func TestForbidPrefixes(t *testing.T) {
+	defer ForbidPrefixes()
+	if err := ForbidPrefixes("10.10.10.1"); err == nil {
+		t.Errorf("Expected an error for a prefix without a length")
+	}
+	if err := ForbidPrefixes("169.254.0.0/16", " 10.10.0.0/16"); err != nil {
+		t.Fatalf("Error setting forbidden prefixes: %v", err)
+	}
+	_, err := Read(testPhys, "netplan", "test-data/static/netplan.yaml")
+	if err == nil || !strings.Contains(err.Error(), "enp3s0: address 10.10.10.2/24 is in the forbidden range 10.10.0.0/16") {
+		t.Errorf("Expected an error about 10.10.10.2/24, not %v", err)
+	}
+	if _, err := Read(testPhys, "netplan", "test-data/dhcp/netplan.yaml"); err != nil {
+		t.Errorf("Unexpected error for DHCP addresses: %v", err)
+	}
+	if err := ForbidPrefixes(); err != nil {
+		t.Fatalf("Error clearing forbidden prefixes: %v", err)
+	}
+	layout, err := Read(testPhys, "netplan", "test-data/static/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading with nothing forbidden: %v", err)
+	}
+	if err := ForbidPrefixes("192.0.2.0/24"); err != nil {
+		t.Fatalf("Error setting forbidden prefixes: %v", err)
+	}
+	layout.ForbiddenPrefixes = util.DefaultForbiddenPrefixes
+	util.DefaultForbiddenPrefixes = nil
+	layout.Interfaces["enp3s0"].Network.Addresses[0].IP = []byte{192, 0, 2, 7}
+	layout.Roots = nil
+	if err := layout.Validate(); err == nil || !strings.Contains(err.Error(), "in the forbidden range 192.0.2.0/24") {
+		t.Errorf("Expected an error about the forbidden prefixes of the layout, not %v", err)
+	}
+}
+
+func TestUnitDir(t *testing.T) {
+	defer UnitDir("")
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	UnitDir(path.Join(tmp, "system"))
+	dropIn := path.Join(tmp, "system", "systemd-networkd-wait-online.service.d", "10-netwrangler.conf")
+	expect := `# Created by netwrangler
+[Service]
+ExecStart=
+ExecStart=/lib/systemd/systemd-networkd-wait-online --interface=enp3s0
+ExecStart=/lib/systemd/systemd-networkd-wait-online --timeout=5 --interface=vlan20
+ExecStart=/lib/systemd/systemd-networkd-wait-online --timeout=30 --interface=enp4s0 --interface=vlan10
+`
+	layout, err := Read(testPhys, "netplan", "test-data/wait_online/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "systemd", path.Join(tmp, "network"), false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if buf, err := ioutil.ReadFile(dropIn); err != nil {
+		t.Errorf("Error reading drop-in: %v", err)
+	} else if string(buf) != expect {
+		t.Errorf("Expected drop-in\n%s\ngot\n%s", expect, string(buf))
+	}
+	layout, err = Read(testPhys, "netplan", "test-data/dhcp/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "systemd", path.Join(tmp, "network"), false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if _, err := os.Stat(dropIn); !os.IsNotExist(err) {
+		t.Errorf("Expected the drop-in to be removed once nothing has a wait-online-timeout, got %v", err)
+	}
+}
+
+func TestOrderDropIns(t *testing.T) {
+	defer UnitDir("")
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	UnitDir(path.Join(tmp, "system"))
+	layout, err := Read(testPhys, "netplan", "test-data/ordering/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "systemd", path.Join(tmp, "network"), false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	for name, expect := range map[string]string{
+		"sys-subsystem-net-devices-gre1.device.d": `# Created by netwrangler
+[Unit]
+After=sys-subsystem-net-devices-enp3s0.device
+Requires=sys-subsystem-net-devices-enp3s0.device
+`,
+		"sys-subsystem-net-devices-enp4s0.device.d": `# Created by netwrangler
+[Unit]
+After=sys-subsystem-net-devices-gre1.device
+`,
+	} {
+		if buf, err := ioutil.ReadFile(path.Join(tmp, "system", name, "10-netwrangler.conf")); err != nil {
+			t.Errorf("Error reading drop-in for %s: %v", name, err)
+		} else if string(buf) != expect {
+			t.Errorf("Expected drop-in for %s\n%s\ngot\n%s", name, expect, string(buf))
+		}
+	}
+	if _, err := os.Stat(path.Join(tmp, "system", "sys-subsystem-net-devices-enp3s0.device.d")); !os.IsNotExist(err) {
+		t.Errorf("Expected no drop-in for enp3s0, got %v", err)
+	}
+}
+
+func TestRhelRoot(t *testing.T) {
+	defer RhelRoot("")
+	buf := &strings.Builder{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	dest, root := path.Join(tmp, "network-scripts"), path.Join(tmp, "root")
+	script := path.Join(root, "sbin", "ifup-local")
+	write := func(src string) {
+		layout, err := Read(testPhys, "netplan", src)
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", src, err)
+		}
+		if err := Write(layout, "rhel", dest, false); err != nil {
+			t.Fatalf("Error writing %s: %v", src, err)
+		}
+	}
+	// Without a root, ifup-local is not written anywhere, and the
+	// settings that need it are warned about.
+	write("test-data/link_flags/netplan.yaml")
+	expect := "enp3s0: ifcfg files cannot set arp, multicast, which need ifup-local and a root to install it under, ignoring them"
+	if !strings.Contains(buf.String(), expect) {
+		t.Errorf("Expected a warning containing %q, got %s", expect, buf.String())
+	}
+	for _, name := range []string{path.Join(dest, "ifup-local"), script} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s without a root, got %v", name, err)
+		}
+	}
+	// Gratuitous ARPs and unsolicited NAs are only sent by ifup-local,
+	// like systemd-networkd and NetworkManager they are warned about.
+	buf.Reset()
+	write("test-data/gratuitous_arp/netplan.yaml")
+	for _, expect := range []string{
+		"enp1s0: ifcfg files cannot set unsolicited-na, gratuitous-arp-count, which need ifup-local",
+		"vlan20: ifcfg files cannot set gratuitous-arp-count, which need ifup-local",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("Expected a warning containing %q, got %s", expect, buf.String())
+		}
+	}
+	buf.Reset()
+	write("test-data/ipv6_dad/netplan.yaml")
+	expect = "enp3s0: ipv6-dad-transmits need a sysctl drop-in on rhel and a root to install it under, ignoring them"
+	if !strings.Contains(buf.String(), expect) {
+		t.Errorf("Expected a warning containing %q, got %s", expect, buf.String())
+	}
+	RhelRoot(root)
+	buf.Reset()
+	write("test-data/link_flags/netplan.yaml")
+	if strings.Contains(buf.String(), "ifup-local") {
+		t.Errorf("Expected no warnings about ifup-local with a root, got %s", buf.String())
+	}
+	if st, err := os.Stat(script); err != nil || st.Mode()&0111 == 0 {
+		t.Errorf("Expected an executable %s, got %v", script, err)
+	}
+	// A config that needs no ifup-local removes the one written before.
+	write("test-data/bonding/netplan.yaml")
+	if _, err := os.Stat(script); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed, got %v", script, err)
+	}
+	// Renaming a nic cannot be done at all without a udev rule.
+	RhelRoot("")
+	phys, err := GatherPhysFromFile("test-data/rename/phys.yaml")
+	if err != nil {
+		t.Fatalf("Error gathering phys: %v", err)
+	}
+	layout, err := Read(phys, "netplan", "test-data/rename/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "rhel", dest, false); err == nil || !strings.Contains(err.Error(), "lan0: renaming a nic on rhel needs a root to install its udev rule under") {
+		t.Errorf("Expected an error renaming without a root, got %v", err)
+	}
+	RhelRoot(root)
+	if err := Write(layout, "rhel", dest, false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	for _, name := range []string{"70-netwrangler-lan0.rules", "70-netwrangler-wan0.rules"} {
+		if _, err := os.Stat(path.Join(root, "etc", "udev", "rules.d", name)); err != nil {
+			t.Errorf("Expected %s to be installed: %v", name, err)
+		}
+	}
+}
+
+func TestRenderCheck(t *testing.T) {
+	defer UnitDir("")
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	src := path.Join(tmp, "netplan.yaml")
+	if err := ioutil.WriteFile(src, []byte(`network:
+  version: 2
+  ethernets:
+    enp3s0:
+      addresses: [192.0.2.10/24]
+  tunnels:
+    sit1:
+      mode: sit
+      local: 192.0.2.10
+      remote: 198.51.100.1
+`), 0644); err != nil {
+		t.Fatalf("Error writing netplan: %v", err)
+	}
+	layout, err := Read(testPhys, "netplan", src)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := RenderCheck(layout, "systemd", false); err != nil {
+		t.Errorf("Unexpected error checking systemd: %v", err)
+	}
+	if err := RenderCheck(layout, "rhel", false); err == nil || !strings.Contains(err.Error(), "sit1: sit tunnels are unsupported on rhel") {
+		t.Errorf("Expected an error about the sit tunnel, not %v", err)
+	}
+	if err := RenderCheck(layout, "bogus", false); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+	UnitDir(path.Join(tmp, "system"))
+	layout, err = Read(testPhys, "netplan", "test-data/wait_online/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := RenderCheck(layout, "systemd", false); err != nil {
+		t.Errorf("Unexpected error checking systemd: %v", err)
+	}
+	if _, err := os.Stat(path.Join(tmp, "system")); !os.IsNotExist(err) {
+		t.Errorf("Expected checking to leave the unit dir alone, got %v", err)
+	}
+}
+
+func TestWaitDevice(t *testing.T) {
+	defer UnitDir("")
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	unitDir := path.Join(tmp, "system")
+	UnitDir(unitDir)
+	expect := map[string]string{
+		"systemd-networkd-wait-online.service.d/10-netwrangler.conf": `# Created by netwrangler
+[Unit]
+Wants=sys-subsystem-net-devices-enp3s0.device
+After=sys-subsystem-net-devices-enp3s0.device
+Wants=sys-subsystem-net-devices-enp4s0.device
+After=sys-subsystem-net-devices-enp4s0.device
+
+[Service]
+ExecStart=
+ExecStart=/lib/systemd/systemd-networkd-wait-online --interface=enp3s0
+ExecStart=/lib/systemd/systemd-networkd-wait-online --timeout=30 --interface=enp4s0
+`,
+		"sys-subsystem-net-devices-enp3s0.device.d/10-netwrangler.conf": "# Created by netwrangler\n[Unit]\nJobRunningTimeoutSec=90\n",
+		"sys-subsystem-net-devices-enp4s0.device.d/10-netwrangler.conf": "# Created by netwrangler\n[Unit]\nJobRunningTimeoutSec=20\n",
+	}
+	layout, err := Read(testPhys, "netplan", "test-data/wait_device/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "systemd", path.Join(tmp, "network"), false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	for rel, want := range expect {
+		if buf, err := ioutil.ReadFile(path.Join(unitDir, rel)); err != nil {
+			t.Errorf("Error reading %s: %v", rel, err)
+		} else if string(buf) != want {
+			t.Errorf("Expected %s\n%s\ngot\n%s", rel, want, string(buf))
+		}
+	}
+	layout, err = Read(testPhys, "netplan", "test-data/dhcp/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "systemd", path.Join(tmp, "network"), false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	for rel := range expect {
+		if _, err := os.Stat(path.Join(unitDir, rel)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed once nothing needs it, got %v", rel, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(unitDir, "sys-subsystem-net-devices-enp3s0.device.d")); !os.IsNotExist(err) {
+		t.Errorf("Expected the empty drop-in dir to be removed, got %v", err)
+	}
+}
+
+func TestDropInsRollback(t *testing.T) {
+	defer UnitDir("")
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	unitDir, dest := path.Join(tmp, "system"), path.Join(tmp, "network")
+	waitOnline := path.Join(unitDir, "systemd-networkd-wait-online.service.d", "10-netwrangler.conf")
+	before, err := Read(testPhys, "netplan", "test-data/wait_online/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	after, err := Read(testPhys, "netplan", "test-data/wait_device/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	// Find out which units the new layout writes without touching the
+	// unit dir.
+	probe := path.Join(tmp, "probe")
+	if err := Write(after, "systemd", probe, false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	UnitDir(unitDir)
+	if err := Write(before, "systemd", dest, false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	expect, err := ioutil.ReadFile(waitOnline)
+	if err != nil {
+		t.Fatalf("Error reading drop-in: %v", err)
+	}
+	// Directories in the way of the staged units make replacing the
+	// network config fail after the drop-ins are swapped in, and the
+	// drop-ins have to be put back as they were.
+	names, _ := filepath.Glob(path.Join(probe, "*"))
+	for _, name := range names {
+		os.MkdirAll(path.Join(dest, "."+path.Base(name)+".new~", "x"), 0755)
+	}
+	if err := Write(after, "systemd", dest, false); err == nil {
+		t.Errorf("Expected an error replacing the network config")
+	}
+	if buf, err := ioutil.ReadFile(waitOnline); err != nil {
+		t.Errorf("Error reading drop-in: %v", err)
+	} else if string(buf) != string(expect) {
+		t.Errorf("Expected the drop-in to be put back as\n%s\ngot\n%s", string(expect), string(buf))
+	}
+	for _, dev := range []string{"enp3s0", "enp4s0"} {
+		dir := path.Join(unitDir, "sys-subsystem-net-devices-"+dev+".device.d")
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed again, got %v", dir, err)
+		}
+	}
+}
+
+func TestAutoBootMac(t *testing.T) {
+	defer func(orig string) {
+		cmdlinePath = orig
+		bootMac = nil
+	}(cmdlinePath)
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	cmdlinePath = path.Join(tmp, "cmdline")
+	if err := AutoBootMac(); err != nil || bootMac != nil {
+		t.Errorf("Expected no error or boot MAC without a kernel command line, got %v and %s", err, bootMac)
+	}
+	for i, tc := range []struct {
+		cmdline, mac string
+		wantErr      bool
+	}{
+		{"BOOT_IMAGE=/vmlinuz ro quiet", "", false},
+		{"BOOT_IMAGE=/vmlinuz BOOTIF=01-52-54-01-23-00-03 quiet", "52:54:01:23:00:03", false},
+		{"BOOTIF=52:54:01:23:00:04", "52:54:01:23:00:04", false},
+		{"BOOTIF=01-52-54", "", true},
+	} {
+		bootMac = nil
+		if err := ioutil.WriteFile(cmdlinePath, []byte(tc.cmdline+"\n"), 0644); err != nil {
+			t.Fatalf("Error writing cmdline: %v", err)
+		}
+		err := AutoBootMac()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%d: Unexpected error state %v", i, err)
+		}
+		got := ""
+		if bootMac != nil {
+			got = bootMac.String()
+		}
+		if !tc.wantErr && got != tc.mac {
+			t.Errorf("%d: Expected boot MAC %q, got %q", i, tc.mac, got)
+		}
+	}
+}
+
+func TestDefaultMetric(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	src := path.Join(tmp, "netplan.yaml")
+	if err := ioutil.WriteFile(src, []byte(`network:
+  version: 2
+  ethernets:
+    enp3s0:
+      addresses: [10.0.0.5/24]
+      routes:
+        - {to: 10.10.0.0/16, via: 10.0.0.2, metric: 100}
+        - {to: 10.20.0.0/16, via: 10.0.0.3, metric: 200}
+`), 0644); err != nil {
+		t.Fatalf("Error writing netplan.yaml: %v", err)
+	}
+	for i, defaultMetric := range []int{0, 100, 200} {
+		layout, err := Read(testPhys, "netplan", src)
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		layout.DefaultMetric = defaultMetric
+		omitted := layout.RouteMetric()
+		for _, format := range []string{"systemd", "rhel"} {
+			dest := path.Join(tmp, fmt.Sprintf("%s-%d", format, i))
+			if err := Write(layout, format, dest, false); err != nil {
+				t.Fatalf("Error writing %s: %v", format, err)
+			}
+			name, metric := "route-enp3s0", "metric %d"
+			if format == "systemd" {
+				name, metric = "60-enp3s0.network", "Metric=%d"
+			}
+			buf, err := ioutil.ReadFile(path.Join(dest, name))
+			if err != nil {
+				t.Fatalf("Error reading %s: %v", name, err)
+			}
+			for _, m := range []int{100, 200} {
+				written := strings.Contains(string(buf), fmt.Sprintf(metric, m))
+				if written == (m == omitted) {
+					t.Errorf("%s with default metric %d: expected metric %d written to be %t:\n%s",
+						format, omitted, m, !written, string(buf))
+				}
+			}
+		}
+	}
+}
+
+func TestDirMode(t *testing.T) {
+	defer DirMode("")
+	for _, spec := range []string{"888", "1777", "rwx"} {
+		if err := DirMode(spec); err == nil {
+			t.Errorf("Expected an error for directory mode %s", spec)
+		}
+	}
+	if err := DirMode("0750"); err != nil {
+		t.Fatalf("Unexpected error setting the directory mode: %v", err)
+	}
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	layout, err := Read(testPhys, "netplan", "test-data/dhcp/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	for _, format := range []string{"rhel", "systemd", "nmkeyfile"} {
+		dest := path.Join(tmp, format, "network")
+		if err := Write(layout, format, dest, false); err != nil {
+			t.Fatalf("Error writing %s: %v", format, err)
+		}
+		if st, err := os.Stat(dest); err != nil {
+			t.Errorf("%s: Error checking %s: %v", format, dest, err)
+		} else if st.Mode().Perm() != 0750 {
+			t.Errorf("%s: Expected %s to be created 0750, not %o", format, dest, st.Mode().Perm())
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	src, target := path.Join(tmp, "src"), path.Join(tmp, "target")
+	write := func(dir string, files map[string]string) {
+		os.MkdirAll(dir, 0755)
+		for name, buf := range files {
+			if err := ioutil.WriteFile(path.Join(dir, name), []byte(buf), 0644); err != nil {
+				t.Fatalf("Error writing %s: %v", name, err)
+			}
+		}
+	}
+	check := func(when string, expect map[string]string) {
+		names, _ := filepath.Glob(path.Join(target, "*"))
+		hidden, _ := filepath.Glob(path.Join(target, ".*"))
+		if len(names)+len(hidden) != len(expect) {
+			t.Errorf("%s: expected %d files, got %v %v", when, len(expect), names, hidden)
+		}
+		for name, buf := range expect {
+			if actual, err := ioutil.ReadFile(path.Join(target, name)); err != nil || string(actual) != buf {
+				t.Errorf("%s: expected %s to be %q, got %q: %v", when, name, buf, actual, err)
+			}
+		}
+	}
+	write(src, map[string]string{"a": "new a", "c": "new c"})
+	write(target, map[string]string{"a": "old a", "b": "old b"})
+	// A stale file that vanished makes moving the old files aside fail,
+	// and everything has to be put back as it was.
+	e := &util.Err{}
+	util.Replace(src, target, []string{path.Join(target, "b"), path.Join(target, "gone")}, e)
+	if e.Empty() {
+		t.Errorf("Expected an error replacing a missing file")
+	}
+	check("after failing", map[string]string{"a": "old a", "b": "old b"})
+	e = &util.Err{}
+	util.Replace(src, target, []string{path.Join(target, "b")}, e)
+	if !e.Empty() {
+		t.Errorf("Unexpected error replacing files: %v", e)
+	}
+	check("after replacing", map[string]string{"a": "new a", "c": "new c"})
+	// Only writing the changed units goes through Replace as well, so
+	// a failure there leaves the live units alone.
+	defer ReloadScript("")
+	ReloadScript(path.Join(tmp, "reload.sh"))
+	dest := path.Join(tmp, "network")
+	layout, err := Read(testPhys, "netplan", "test-data/bonding/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if err := Write(layout, "systemd", dest, false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	before := map[string]string{}
+	names, _ := filepath.Glob(path.Join(dest, "*"))
+	for _, name := range names {
+		buf, _ := ioutil.ReadFile(name)
+		before[path.Base(name)] = string(buf)
+	}
+	netdevs, _ := filepath.Glob(path.Join(dest, "*-bond0.netdev"))
+	if len(netdevs) != 1 {
+		t.Fatalf("Expected one bond0 netdev, got %v", netdevs)
+	}
+	// A directory in the way of the staged netdev makes Replace fail.
+	blocker := path.Join(dest, "."+path.Base(netdevs[0])+".new~")
+	os.MkdirAll(path.Join(blocker, "x"), 0755)
+	layout.Interfaces["bond0"].Parameters["mode"] = "balance-rr"
+	if err := Write(layout, "systemd", dest, false); err == nil {
+		t.Errorf("Expected an error replacing changed units")
+	}
+	os.RemoveAll(blocker)
+	target = dest
+	check("after failing in minimal mode", before)
+}
+
+func TestRegisterExtension(t *testing.T) {
+	if err := netplan.RegisterExtension("wifi", "x-site-rack", util.C(util.VS())); err == nil {
+		t.Errorf("Expected an error registering an extension for wifi")
+	}
+	if err := netplan.RegisterExtension("ethernet", "site-rack", util.C(util.VS())); err == nil {
+		t.Errorf("Expected an error registering an extension without the x- prefix")
+	}
+	if err := netplan.RegisterExtension("ethernet", "x-site-rack", util.C(util.VS())); err != nil {
+		t.Fatalf("Error registering x-site-rack: %v", err)
+	}
+	if err := netplan.RegisterExtension("ethernet", "x-site-rack", util.C(util.VS())); err == nil {
+		t.Errorf("Expected an error registering x-site-rack twice")
+	}
+	if err := netplan.RegisterExtension("network", "x-cost", util.C(util.VI(0, 100))); err != nil {
+		t.Fatalf("Error registering x-cost: %v", err)
+	}
+	tmp, err := ioutil.TempDir("", "netwrangler-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	src := path.Join(tmp, "netplan.yaml")
+	cfg := `network:
+  version: 2
+  renderer: networkd
+  ethernets:
+    enp3s0:
+      x-site-rack: r12
+    enp4s0: {}
+  bonds:
+    bond0:
+      interfaces: [enp3s0, enp4s0]
+      x-cost: %s
+      parameters:
+        mode: active-backup
+`
+	if err := ioutil.WriteFile(src, []byte(fmt.Sprintf(cfg, "200")), 0644); err != nil {
+		t.Fatalf("Error writing netplan: %v", err)
+	}
+	if _, err := Read(testPhys, "netplan", src); err == nil || !strings.Contains(err.Error(), "x-cost") {
+		t.Errorf("Expected an error about x-cost, got %v", err)
+	}
+	if err := ioutil.WriteFile(src, []byte(fmt.Sprintf(cfg, "20")), 0644); err != nil {
+		t.Fatalf("Error writing netplan: %v", err)
+	}
+	layout, err := Read(testPhys, "netplan", src)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if v := layout.Interfaces["enp3s0"].Parameters["x-site-rack"]; v != "r12" {
+		t.Errorf("Expected x-site-rack r12, got %v", v)
+	}
+	dest := path.Join(tmp, "out.yaml")
+	if err := Write(layout, "netplan", dest, false); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	buf, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("Error reading output: %v", err)
+	}
+	for _, want := range []string{"      x-site-rack: r12\n", "      x-cost: 20\n"} {
+		if !strings.Contains(string(buf), want) {
+			t.Errorf("Expected %q in output:\n%s", want, string(buf))
+		}
+	}
+	if err := Write(layout, "rhel", tmp, false); err != nil {
+		t.Fatalf("Error writing rhel: %v", err)
+	}
+	if buf, _ = ioutil.ReadFile(path.Join(tmp, "ifcfg-bond0")); strings.Contains(string(buf), "x_cost") {
+		t.Errorf("Extension leaked into rhel bond options:\n%s", string(buf))
+	}
+}
+
+func TestOwner(t *testing.T) {
+	defer Owner("")
+	for _, spec := range []string{"", "0", "0:0", "root:0", ":0"} {
+		if err := Owner(spec); err != nil {
+			t.Errorf("Unexpected error setting owner %q: %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"no-such-user-netwrangler", "0:no-such-group-netwrangler"} {
+		if err := Owner(spec); err == nil {
+			t.Errorf("Expected an error setting owner %q", spec)
+		}
+	}
+}
+
+func TestBridgeMTUWarnings(t *testing.T) {
+	buf := &strings.Builder{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	for _, tc := range []struct {
+		bridge int
+		expect string
+	}{
+		{0, "bridge br0: ports enp3s0 (mtu 9000), enp4s0 (mtu 1500) have different mtus, set the mtu of the bridge to 1500"},
+		{9000, "bridge br0: mtu 9000 is larger than the mtu of ports enp4s0 (mtu 1500)"},
+		{1500, ""},
+	} {
+		buf.Reset()
+		l := &util.Layout{
+			Interfaces: map[string]util.Interface{
+				"br0":    {Name: "br0", Type: "bridge", MTU: tc.bridge, Interfaces: []string{"enp3s0", "enp4s0", "enp5s0"}},
+				"enp3s0": {Name: "enp3s0", Type: "physical", MTU: 9000},
+				"enp4s0": {Name: "enp4s0", Type: "physical", MTU: 1500},
+				"enp5s0": {Name: "enp5s0", Type: "physical"},
+			},
+		}
+		if err := l.Validate(); err != nil {
+			t.Fatalf("Error validating: %v", err)
+		}
+		actual := buf.String()
+		if tc.expect == "" && actual != "" {
+			t.Errorf("Expected no warnings with a bridge mtu of %d, got %s", tc.bridge, actual)
+		} else if !strings.Contains(actual, tc.expect) {
+			t.Errorf("Expected a warning containing %q with a bridge mtu of %d, got %s", tc.expect, tc.bridge, actual)
+		}
+	}
+}
+
+func TestPhysicalNetworkValidated(t *testing.T) {
+	gw := &gnet.IPNet{}
+	if err := gw.UnmarshalText([]byte("2001:db8::1")); err != nil {
+		t.Fatalf("Error parsing address: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		l    *util.Layout
+	}{
+		{"physical", &util.Layout{
+			Interfaces: map[string]util.Interface{
+				"enp3s0": {Name: "enp3s0", Type: "physical", Network: &util.Network{Gateway4: gw}},
+			},
+		}},
+		{"enslaved", &util.Layout{
+			Interfaces: map[string]util.Interface{
+				"bond0":  {Name: "bond0", Type: "bond", Interfaces: []string{"enp3s0"}},
+				"enp3s0": {Name: "enp3s0", Type: "physical", Network: &util.Network{Gateway4: gw}},
+			},
+		}},
+	} {
+		err := tc.l.Validate()
+		if err == nil || !strings.Contains(err.Error(), "Gateway4 2001:db8::1 is not an IPv4 address") {
+			t.Errorf("%s: expected an invalid gateway4 to be rejected, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestEnslavedLayer3Warning(t *testing.T) {
+	buf := &strings.Builder{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	addr := &gnet.IPNet{}
+	if err := addr.UnmarshalText([]byte("192.168.3.30/24")); err != nil {
+		t.Fatalf("Error parsing address: %v", err)
+	}
+	for _, tc := range []struct {
+		nw     *util.Network
+		expect string
+	}{
+		{&util.Network{Addresses: []*gnet.IPNet{addr}}, "interface enp3s0 has layer-3 config that will be discarded because it is enslaved to bond0"},
+		{&util.Network{Dhcp4: true}, "interface enp3s0 has layer-3 config that will be discarded because it is enslaved to bond0"},
+		{&util.Network{AcceptRa: true}, ""},
+		{nil, ""},
+	} {
+		buf.Reset()
+		l := &util.Layout{
+			Interfaces: map[string]util.Interface{
+				"bond0":  {Name: "bond0", Type: "bond", Interfaces: []string{"enp3s0", "enp4s0"}},
+				"enp3s0": {Name: "enp3s0", Type: "physical", Network: tc.nw},
+				"enp4s0": {Name: "enp4s0", Type: "physical"},
+			},
+		}
+		if err := l.Validate(); err != nil {
+			t.Fatalf("Error validating: %v", err)
+		}
+		if l.Interfaces["enp3s0"].Network != nil {
+			t.Errorf("Expected the network of enp3s0 to be discarded, got %v", l.Interfaces["enp3s0"].Network)
+		}
+		actual := buf.String()
+		if tc.expect == "" && actual != "" {
+			t.Errorf("Expected no warnings for %v, got %s", tc.nw, actual)
+		} else if !strings.Contains(actual, tc.expect) {
+			t.Errorf("Expected a warning containing %q for %v, got %s", tc.expect, tc.nw, actual)
+		}
+		if strings.Contains(actual, "enp4s0") {
+			t.Errorf("Expected no warning for enp4s0, got %s", actual)
+		}
+	}
+}
+
+func TestLayoutString(t *testing.T) {
+	l := &util.Layout{
+		Interfaces: map[string]util.Interface{
+			"br0":  {Name: "br0", Type: "bridge", Interfaces: []string{"br1"}},
+			"br1":  {Name: "br1", Type: "bridge", Interfaces: []string{"br0", "eth0"}},
+			"eth0": {Name: "eth0", Type: "physical", Network: &util.Network{Dhcp4: true}},
+		},
+		Roots: []string{"br0"},
+	}
+	expect := `br0 (bridge)
+  br1 (bridge)
+    br0 (cycle)
+    eth0 (physical) dhcp4
+`
+	if actual := l.String(); actual != expect {
+		t.Errorf("Expected layout tree:\n%s\ngot:\n%s", expect, actual)
+	}
+}
+
+func TestLayoutSummary(t *testing.T) {
+	addr := &gnet.IPNet{}
+	if err := addr.UnmarshalText([]byte("10.0.0.5/24")); err != nil {
+		t.Fatalf("Error parsing address: %v", err)
+	}
+	l := &util.Layout{
+		Interfaces: map[string]util.Interface{
+			"bond0": {
+				Name:       "bond0",
+				Type:       "bond",
+				Interfaces: []string{"eth1", "eth2"},
+				Parameters: map[string]interface{}{"mode": "802.3ad"},
+				Network:    &util.Network{Addresses: []*gnet.IPNet{addr}},
+			},
+			"vlan10": {
+				Name:       "vlan10",
+				Type:       "vlan",
+				Interfaces: []string{"bond0"},
+				Parameters: map[string]interface{}{"id": 10},
+				Network:    &util.Network{Dhcp6: true},
+				Optional:   true,
+			},
+			"eth0": {Name: "eth0", Type: "physical", Network: &util.Network{Dhcp4: true}},
+			"eth1": {Name: "eth1", Type: "physical"},
+			"eth2": {Name: "eth2", Type: "physical"},
+		},
+		Roots: []string{"eth0", "vlan10"},
+	}
+	expect := `eth0: physical, dhcp4
+vlan10: vlan 10 over bond0, dhcp6, optional
+bond0: 802.3ad over eth1,eth2, 10.0.0.5/24
+eth1: physical
+eth2: physical
+`
+	if actual := l.Summary(); actual != expect {
+		t.Errorf("Expected layout summary:\n%s\ngot:\n%s", expect, actual)
+	}
+}
+
+func TestNetplanPatch(t *testing.T) {
+	base, err := ioutil.ReadFile("test-data/static/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error reading base: %v", err)
+	}
+	override := []byte(`network:
+  ethernets:
+    enp3s0:
+      addresses:
+        - 10.10.10.3/24
+    enp4s0:
+      dhcp4: true
+`)
+	merged, err := netplan.Patch(base, override)
+	if err != nil {
+		t.Fatalf("Error patching: %v", err)
+	}
+	np := &netplan.Netplan{}
+	if err := yaml.Unmarshal(merged, np); err != nil {
+		t.Fatalf("Error parsing merged document: %v", err)
+	}
+	layout, err := np.Compile(testPhys)
+	if err != nil {
+		t.Fatalf("Error compiling merged document: %v", err)
+	}
+	enp3s0 := layout.Interfaces["enp3s0"].Network
+	if len(enp3s0.Addresses) != 1 || enp3s0.Addresses[0].String() != "10.10.10.3/24" {
+		t.Errorf("Expected the addresses of enp3s0 to be replaced, got %v", enp3s0.Addresses)
+	}
+	if enp3s0.Gateway4 == nil || enp3s0.Gateway4.String() != "10.10.10.1" {
+		t.Errorf("Expected the gateway of enp3s0 to be kept, got %v", enp3s0.Gateway4)
+	}
+	if enp4s0 := layout.Interfaces["enp4s0"].Network; enp4s0 == nil || !enp4s0.Dhcp4 {
+		t.Errorf("Expected enp4s0 to be added with dhcp4")
+	}
+	if again, err := netplan.Patch(base, nil); err != nil || !strings.Contains(string(again), "10.10.10.2/24") {
+		t.Errorf("Expected an empty override to leave base alone, got %s, %v", again, err)
+	}
+	if _, err := netplan.Patch(base, []byte("network:\n  ethernets: [enp3s0]\n")); err == nil {
+		t.Errorf("Expected an error for an override that is not netplan")
+	}
+}
+
+func TestNetplanSchema(t *testing.T) {
+	if _, err := json.Marshal(netplan.Schema()); err != nil {
+		t.Fatalf("Error marshalling netplan schema: %v", err)
+	}
+	locs, err := filepath.Glob("test-data/*/netplan.yaml")
+	if err != nil {
+		t.Fatalf("Error finding test data: %v", err)
+	}
+	for _, loc := range locs {
+		if fails[filepath.Dir(loc)] {
+			continue
+		}
+		buf, err := ioutil.ReadFile(loc)
+		if err != nil {
+			t.Errorf("Error reading %s: %v", loc, err)
+			continue
+		}
+		if errs := netplan.ValidateSchema(buf); len(errs) > 0 {
+			t.Errorf("%s: unexpected schema errors: %v", loc, errs)
+		}
+	}
+	bad := `network:
+  version: 3
+  ethernets:
+    eth0:
+      dhcp4: maybe
+      addresses: [10.0.0.5, {"10.0.1.5/24": {broadcast: "2001:db8::ff"}}]
+  bonds:
+    bond0:
+      parameters:
+        mode: sideways
+        mii-monitor-interval: 100us
+`
+	expect := []string{
+		"network.bonds.bond0.parameters.mii-monitor-interval: 100us does not match any allowed form",
+		"network.bonds.bond0.parameters.mode: sideways is not one of",
+		"network.ethernets.eth0.addresses[0]: 10.0.0.5 does not match any allowed form",
+		"network.ethernets.eth0.addresses[1]:",
+		"network.ethernets.eth0.dhcp4: expected boolean, got string",
+		"network.version: 3 is not one of [2]",
+	}
+	errs := netplan.ValidateSchema([]byte(bad))
+	if len(errs) != len(expect) {
+		t.Fatalf("Expected %d schema errors, got %d: %v", len(expect), len(errs), errs)
+	}
+	for i := range expect {
+		if !strings.HasPrefix(errs[i].Error(), expect[i]) {
+			t.Errorf("Expected schema error %d to start with %q, got %q", i, expect[i], errs[i])
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	gnet "github.com/rackn/gohai/plugins/net"
@@ -25,6 +27,10 @@ type Systemd struct {
 	written         map[string]struct{}
 	ctr             int
 	dest, finalDest string
+	units           []*unit
+	minimal         bool
+	reloads         []string
+	unitDir         string
 }
 
 // BindMacs forces all Match sections for physical interfaces to match
@@ -64,6 +70,15 @@ func (s *Systemd) create(ctr int, intf util.Interface, e *util.Err) (io.WriteClo
 	return nil, nil
 }
 
+func (s *Systemd) sortedNames() []string {
+	res := []string{}
+	for k := range s.Interfaces {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
 // New returns a new Systemd for l.
 func New(l *util.Layout) *Systemd {
 	return &Systemd{
@@ -97,19 +112,94 @@ func (s *Systemd) writeParents(i util.Interface, e *util.Err, nw io.Writer) {
 	}
 }
 
+// writeBridgeVlans writes the [BridgeVLAN] sections of i for the
+// VLAN filtering bridges it is a port of.  Once a port has any,
+// networkd removes the VLANs it does not list, so a port without a
+// PVID of its own lists the default one, and a trunk port with a
+// PVID of 0 lists none.
+func (s *Systemd) writeBridgeVlans(i util.Interface, nw io.Writer) {
+	for _, pName := range s.Child2Parent[i.Name] {
+		parent := s.Interfaces[pName]
+		if parent.Type != "bridge" || !parent.VlanFiltering() || !parent.HasPortVlans(i.Name) {
+			continue
+		}
+		for _, vlan := range parent.PortVlans(i.Name) {
+			fmt.Fprintf(nw, "\n[BridgeVLAN]\nVLAN=%s\n", vlan)
+		}
+		if id, _ := parent.PortPvid(i.Name); id != 0 {
+			fmt.Fprintf(nw, "\n[BridgeVLAN]\nPVID=%d\nEgressUntagged=%d\n", id, id)
+		}
+	}
+}
+
+// writeLLDP writes the EmitLLDP and LLDP settings of i.
+func writeLLDP(i util.Interface, nw io.Writer) {
+	if i.EmitLLDP != "" {
+		fmt.Fprintf(nw, "EmitLLDP=%s\n", i.EmitLLDP)
+	}
+	if i.LLDP != nil {
+		fmt.Fprintf(nw, "LLDP=%t\n", *i.LLDP)
+	}
+}
+
+// macMatch returns the [Match] line that binds to a physical
+// interface by MAC address.  The permanent MAC is used when it is
+// known, since the current one changes when the interface is
+// enslaved to a bond.
+func macMatch(i util.Interface) string {
+	if len(i.PermanentHwAddr) > 0 {
+		return fmt.Sprintf("PermanentMACAddress=%s", i.PermanentHwAddr)
+	}
+	return fmt.Sprintf("MACAddress=%s", i.CurrentHwAddr)
+}
+
+// descriptionPrefix marks the comment that holds the description of
+// an interface, as networkd has no setting for one.
+const descriptionPrefix = "# Description: "
+
+func writeDescription(i util.Interface, f io.Writer) {
+	if i.Description != "" {
+		fmt.Fprintf(f, "%s%s\n", descriptionPrefix, i.Description)
+	}
+}
+
 func (s *Systemd) writePhy(i util.Interface, e *util.Err, link io.Writer) {
 	// Link file
-	if v, ok := i.Parameters["wakeonlan"]; ok && v.(bool) {
-		fmt.Fprintf(link, `[Match]
-MACAddress=%s
-
-[Link]
-MACAddressPolicy=persistent
-WakeOnLan=magic
-`, i.CurrentHwAddr)
+	wol, wolPassword := i.WakeOnLan()
+	if i.XpsCpus != "" {
+		e.Warnf("%s: xps-cpus is unsupported by systemd-networkd, ignoring it", i.Name)
+	}
+	if len(wol) == 0 && len(i.AlternativeNames) == 0 && i.Alias == "" && !i.Rename && i.RpsCpus == "" {
+		return
+	}
+	fmt.Fprintf(link, "[Match]\n%s\n", macMatch(i))
+	fmt.Fprintf(link, "\n[Link]\nMACAddressPolicy=persistent\n")
+	// This link file takes the place of 99-default.link for the nic,
+	// so without a Name it would lose the name it has now.
+	fmt.Fprintf(link, "Name=%s\n", i.Name)
+	if len(wol) > 0 {
+		fmt.Fprintf(link, "WakeOnLan=%s\n", strings.Join(wol, " "))
+	}
+	if wolPassword != "" {
+		fmt.Fprintf(link, "WakeOnLanPassword=%s\n", wolPassword)
+	}
+	for _, name := range i.AlternativeNames {
+		fmt.Fprintf(link, "AlternativeName=%s\n", name)
+	}
+	if i.Alias != "" {
+		fmt.Fprintf(link, "Alias=%s\n", i.Alias)
+	}
+	if i.RpsCpus != "" {
+		fmt.Fprintf(link, "ReceivePacketSteeringCPUMask=%s\n", i.RpsCpus)
 	}
 }
 
+// msec renders a time kept in milliseconds.  networkd takes a number
+// without a suffix as seconds.
+func msec(v interface{}) interface{} {
+	return fmt.Sprintf("%vms", v)
+}
+
 func s2s(sep string) func(interface{}) interface{} {
 	return func(i interface{}) interface{} {
 		res := ""
@@ -126,6 +216,12 @@ func s2s(sep string) func(interface{}) interface{} {
 				}
 				res = strings.Join(ips, sep)
 			}
+		case []interface{}:
+			vals := make([]string, len(v))
+			for i := range v {
+				vals[i] = fmt.Sprintf("%v", v[i])
+			}
+			res = strings.Join(vals, sep)
 		default:
 			log.Panicf("s2s: cannot handle %v", i)
 		}
@@ -144,11 +240,105 @@ func writeParams(f io.Writer,
 		key := checks[k].Key(k)
 		nv, valid := checks[k].Validate(e, k, val)
 		if valid {
-			fmt.Fprintf(f, "%s=%v\n", key, nv)
+			fmt.Fprintf(f, "%s=%v\n", key, checks[k].Translate(nv))
 		}
 	}
 }
 
+// bondParams are the bond parameters that can be written to a
+// [Bond] section, in the order they are written.
+var bondParams = []string{
+	"mode",
+	"transmit-hash-policy",
+	"lacp-rate",
+	"mii-monitor-interval",
+	"min-links",
+	"ad-select",
+	"ad-actor-system",
+	"ad-actor-sys-prio",
+	"all-slaves-active",
+	"arp-interval",
+	"arp-ip-targets",
+	"arp-validate",
+	"arp-all-targets",
+	"up-delay",
+	"down-delay",
+	"fail-over-mac-policy",
+	"gratuitous-arp",
+	"packets-per-slave",
+	"primary-reselect-policy",
+	"resend-igmp",
+	"learn-packet-interval",
+	"tlb-dynamic-lb",
+}
+
+var bondChecks = map[string]*util.Check{
+	"mode":                    util.X().D("balance-rr").K("Mode"),
+	"transmit-hash-policy":    util.X().D("layer2").K("TransmitHashPolicy"),
+	"lacp-rate":               util.X().D("slow").K("LacpTransmitRate"),
+	"mii-monitor-interval":    util.X().D(0).K("MiiMonitorSec").V(msec),
+	"min-links":               util.X().K("MinLinks"),
+	"ad-select":               util.X().K("AdSelect"),
+	"ad-actor-system":         util.X().K("AdActorSystem"),
+	"ad-actor-sys-prio":       util.X().K("AdActorSystemPriority"),
+	"all-slaves-active":       util.X().K("AllSlavesActive"),
+	"arp-interval":            util.X().K("ARPIntervalSec").V(msec),
+	"arp-ip-targets":          util.X().K("ARPIPTargets").V(s2s(",")),
+	"arp-validate":            util.X().K("ARPValidate"),
+	"arp-all-targets":         util.X().K("ARPAllTargets"),
+	"up-delay":                util.X().K("UpDelaySec").V(msec),
+	"down-delay":              util.X().K("DownDelaySec").V(msec),
+	"fail-over-mac-policy":    util.X().K("FailOverMACPolicy"),
+	"gratuitous-arp":          util.X().K("GratuitousARP"),
+	"packets-per-slave":       util.X().K("PacketsPerSlave"),
+	"primary-reselect-policy": util.X().K("PrimaryReselectPolicy"),
+	"resend-igmp":             util.X().K("ResendIGMP"),
+	"learn-packet-interval":   util.X().K("LearnPacketIntervalSec"),
+	"tlb-dynamic-lb":          util.X().K("DynamicTransmitLoadBalancing"),
+}
+
+// bridgeParams are the bridge parameters that can be written to a
+// [Bridge] section, in the order they are written.
+var bridgeParams = []string{
+	"stp",
+	"max-age",
+	"hello-time",
+	"forward-delay",
+	"ageing-time",
+	"priority",
+	"group-forward-mask",
+	"vlan-filtering",
+	"vlan-default-pvid",
+}
+
+// stpTimers are the bridge parameters that only apply when STP is on.
+// networkd warns about them when it is off.
+var stpTimers = map[string]struct{}{
+	"max-age":       {},
+	"hello-time":    {},
+	"forward-delay": {},
+}
+
+var bridgeChecks = map[string]*util.Check{
+	"stp":                util.X().K("STP"),
+	"max-age":            util.X().K("MaxAgeSec"),
+	"hello-time":         util.X().K("HelloTimeSec"),
+	"forward-delay":      util.X().K("ForwardDelaySec"),
+	"ageing-time":        util.X().K("AgeingTimeSec"),
+	"priority":           util.X().K("Priority"),
+	"group-forward-mask": util.X().K("GroupForwardMask"),
+	"vlan-filtering":     util.X().K("VLANFiltering"),
+	"vlan-default-pvid":  util.X().K("DefaultPVID").V(pvid),
+}
+
+// pvid translates a PVID into a DefaultPVID, where 0 is none.
+func pvid(v interface{}) interface{} {
+	if id, _ := util.ValidateInt(&util.Err{}, "pvid", v, 0, util.MaxVlanID); id == 0 {
+		return "none"
+	}
+	return v
+}
+
 func (s *Systemd) writeBond(i util.Interface, e *util.Err, link io.Writer) {
 	fmt.Fprintf(link, `[NetDev]
 Name=%s
@@ -156,51 +346,13 @@ Kind=bond
 
 [Bond]
 `, i.Name)
-	writeParams(link,
-		e,
-		[]string{
-			"mode",
-			"transmit-hash-policy",
-			"lacp-rate",
-			"mii-monitor-interval",
-			"min-links",
-			"ad-select",
-			"all-slaves-active",
-			"arp-interval",
-			"arp-ip-targets",
-			"arp-validate",
-			"arp-all-targets",
-			"up-delay",
-			"down-delay",
-			"fail-over-mac-policy",
-			"gratuitous-arp",
-			"packets-per-slave",
-			"primary-reselect-policy",
-			"resend-igmp",
-			"learn-packet-interval",
-		},
-		map[string]*util.Check{
-			"mode":                    util.X().D("balance-rr").K("Mode"),
-			"transmit-hash-policy":    util.X().D("layer2").K("TransmitHashPolicy"),
-			"lacp-rate":               util.X().D("slow").K("LacpTransmitRate"),
-			"mii-monitor-interval":    util.X().D(0).K("MiiMonitorSec"),
-			"min-links":               util.X().K("MinLinks"),
-			"ad-select":               util.X().K("AdSelect"),
-			"all-slaves-active":       util.X().K("AllSlavesActive"),
-			"arp-interval":            util.X().K("ARPIntervalSec"),
-			"arp-ip-targets":          util.X().K("ARPIPTargets").V(s2s(",")),
-			"arp-validate":            util.X().K("ARPValidate"),
-			"arp-all-targets":         util.X().K("ARPAllTargets"),
-			"up-delay":                util.X().K("UpDelaySec"),
-			"down-delay":              util.X().K("DownDelaySec"),
-			"fail-over-mac-policy":    util.X().K("FailOverMACPolicy"),
-			"gratuitous-arp":          util.X().K("GratuitousARP"),
-			"packets-per-slave":       util.X().K("PacketsPerSlave"),
-			"primary-reselect-policy": util.X().K("PrimaryReselectPolicy"),
-			"resend-igmp":             util.X().K("ResendIGMP"),
-			"learn-packet-interval":   util.X().K("LearnPacketIntervalSec"),
-		},
-		i.Parameters)
+	writeParams(link, e, bondParams, bondChecks, i.Parameters)
+	if _, ok := i.Parameters["ns-ip6-targets"]; ok {
+		e.Warnf("%s: ns-ip6-targets are unsupported by systemd-networkd, ignoring them", i.Name)
+	}
+	if _, ok := i.Parameters["queue-ids"]; ok {
+		e.Warnf("%s: queue-ids are unsupported by systemd-networkd, ignoring them", i.Name)
+	}
 }
 
 func (s *Systemd) writeBridge(i util.Interface, e *util.Err, link io.Writer) {
@@ -210,25 +362,18 @@ Kind=bridge
 
 [Bridge]
 `, i.Name)
-	writeParams(link,
-		e,
-		[]string{
-			"stp",
-			"max-age",
-			"hello-time",
-			"forward-delay",
-			"ageing-time",
-			"priority",
-		},
-		map[string]*util.Check{
-			"stp":           util.X().K("STP"),
-			"max-age":       util.X().K("MaxAgeSec"),
-			"hello-time":    util.X().K("HelloTimeSec"),
-			"forward-delay": util.X().K("ForwardDelaySec"),
-			"ageing-time":   util.X().K("AgeingTimeSec"),
-			"priority":      util.X().K("Priority"),
-		},
-		i.Parameters)
+	params := bridgeParams
+	if stp, ok := i.Parameters["stp"].(bool); ok && !stp {
+		params = []string{}
+		for _, k := range bridgeParams {
+			if _, timer := stpTimers[k]; !timer {
+				params = append(params, k)
+			} else if _, set := i.Parameters[k]; set {
+				e.Warnf("%s: %s only applies when stp is on, ignoring it", i.Name, k)
+			}
+		}
+	}
+	writeParams(link, e, params, bridgeChecks, i.Parameters)
 }
 
 func (s *Systemd) writeVlan(i util.Interface, e *util.Err, link io.Writer) {
@@ -239,9 +384,123 @@ Kind=vlan
 [VLAN]
 Id=%v
 `, i.Name, i.Parameters["id"])
+	for _, k := range []string{"ingress-qos-map", "egress-qos-map"} {
+		maps := i.QOSMap(k)
+		if len(maps) == 0 {
+			continue
+		}
+		for idx := range maps {
+			maps[idx] = strings.Replace(maps[idx], ":", "-", 1)
+		}
+		key := "IngressQOSMaps"
+		if k == "egress-qos-map" {
+			key = "EgressQOSMaps"
+		}
+		fmt.Fprintf(link, "%s=%s\n", key, strings.Join(maps, " "))
+	}
+}
+
+// writeTunnel writes the netdev of a tunnel.  ipip6 and ip6ip6 are
+// both modes of the ip6tnl kind.  The tunnel is independent of any
+// other link, as the route to its remote endpoint picks the link its
+// packets go out of.
+func (s *Systemd) writeTunnel(i util.Interface, e *util.Err, link io.Writer) {
+	mode, kind := i.TunnelMode(), i.TunnelMode()
+	if mode == "ipip6" || mode == "ip6ip6" {
+		kind = "ip6tnl"
+	}
+	fmt.Fprintf(link, "[NetDev]\nName=%s\nKind=%s\n", i.Name, kind)
+	if i.MTU != 0 {
+		fmt.Fprintf(link, "MTUBytes=%d\n", i.MTU)
+	}
+	if len(i.MacAddress) > 0 {
+		fmt.Fprintf(link, "MACAddress=%s\n", i.MacAddress)
+	}
+	fmt.Fprintf(link, "\n[Tunnel]\n")
+	if kind != mode {
+		fmt.Fprintf(link, "Mode=%s\n", mode)
+	}
+	for _, k := range []string{"local", "remote", "ttl"} {
+		if v, ok := i.Parameters[k]; ok {
+			fmt.Fprintf(link, "%s=%v\n", tunnelKeys[k], v)
+		}
+	}
+	fmt.Fprintf(link, "Independent=true\n")
+}
+
+// hasNetdev returns whether i gets a netdev.  Physical interfaces do
+// not, and only the end of a veth pair written first does, as the
+// netdev creates both ends and networkd would otherwise try to create
+// the pair twice.
+func (s *Systemd) hasNetdev(i util.Interface) bool {
+	if i.Type == "veth" {
+		_, ok := s.written[i.VethPeer()]
+		return !ok
+	}
+	return i.Type != "physical"
+}
+
+// writeVeth writes the netdev of a veth pair, if i is the end of it
+// that gets one.
+func (s *Systemd) writeVeth(i util.Interface, e *util.Err, link io.Writer) {
+	if !s.hasNetdev(i) {
+		return
+	}
+	peer := i.VethPeer()
+	fmt.Fprintf(link, "[NetDev]\nName=%s\nKind=veth\n", i.Name)
+	if i.MTU != 0 {
+		fmt.Fprintf(link, "MTUBytes=%d\n", i.MTU)
+	}
+	if len(i.MacAddress) > 0 {
+		fmt.Fprintf(link, "MACAddress=%s\n", i.MacAddress)
+	}
+	fmt.Fprintf(link, "\n[Peer]\nName=%s\n", peer)
+	if other := s.Interfaces[peer]; len(other.MacAddress) > 0 {
+		fmt.Fprintf(link, "MACAddress=%s\n", other.MacAddress)
+	}
+}
+
+// tunnelKeys maps tunnel parameters to their [Tunnel] keys.
+var tunnelKeys = map[string]string{
+	"local":  "Local",
+	"remote": "Remote",
+	"ttl":    "TTL",
+}
+
+// writeAddress writes an [Address] section for a.  Addresses that
+// share a subnet with an earlier one do not get a prefix route, as
+// networkd would otherwise try to add the same route twice.
+func writeAddress(a *gnet.IPNet, opts *util.AddressOptions, sharesPrefix bool, e *util.Err, nw io.Writer) {
+	fmt.Fprintf(nw, "\n[Address]\n")
+	fmt.Fprintf(nw, "Address=%s\n", a)
+	if sharesPrefix {
+		fmt.Fprintf(nw, "AddPrefixRoute=false\n")
+	}
+	if opts == nil {
+		return
+	}
+	if opts.Broadcast != nil {
+		fmt.Fprintf(nw, "Broadcast=%s\n", opts.Broadcast)
+	}
+	if opts.Scope != "" {
+		fmt.Fprintf(nw, "Scope=%s\n", opts.Scope)
+	}
+	if opts.PreferredLifetime != nil {
+		switch *opts.PreferredLifetime {
+		case 0:
+			fmt.Fprintf(nw, "PreferredLifetime=0\n")
+		case util.LifetimeForever:
+			fmt.Fprintf(nw, "PreferredLifetime=forever\n")
+		default:
+			e.Errorf("%s: systemd-networkd only supports a preferred-lifetime of 0 or forever", a)
+		}
+	}
+	if opts.ValidLifetime != nil && *opts.ValidLifetime != util.LifetimeForever {
+		e.Errorf("%s: systemd-networkd does not support setting a valid-lifetime other than forever", a)
+	}
 }
 
-func writeRoute(r util.Route, e *util.Err, nw io.Writer) {
+func writeRoute(r util.Route, defaultMetric int, e *util.Err, nw io.Writer) {
 	fmt.Fprintf(nw, "\n[Route]\n")
 	if r.From != nil {
 		fmt.Fprintf(nw, "Source=%s\n", r.From)
@@ -255,7 +514,7 @@ func writeRoute(r util.Route, e *util.Err, nw io.Writer) {
 	if r.OnLink {
 		fmt.Fprintf(nw, "GatewayOnLink=%v\n", r.OnLink)
 	}
-	if r.Metric != 0 {
+	if r.HasMetric(defaultMetric) {
 		fmt.Fprintf(nw, "Metric=%d\n", r.Metric)
 	}
 	if r.Type != "" {
@@ -284,14 +543,37 @@ func writeRoutePolicy(r util.RoutePolicy, e *util.Err, nw io.Writer) {
 		fmt.Fprintf(nw, "Priority=%d\n", r.Priority)
 	}
 	if r.FWMark != 0 {
-		fmt.Fprintf(nw, "FirewallMark=%d\n", r.FWMark)
+		fmt.Fprintf(nw, "FirewallMark=%s\n", r.FWMarkString())
 	}
 	if r.TOS != 0 {
 		fmt.Fprintf(nw, "TypeOfService=%d\n", r.TOS)
 	}
+	if r.IIF != "" {
+		fmt.Fprintf(nw, "IncomingInterface=%s\n", r.IIF)
+	}
+	if r.OIF != "" {
+		fmt.Fprintf(nw, "OutgoingInterface=%s\n", r.OIF)
+	}
+	if r.IPProto != 0 {
+		fmt.Fprintf(nw, "IPProtocol=%s\n", util.IPProtoName(r.IPProto))
+	}
+	if r.SPort != "" {
+		fmt.Fprintf(nw, "SourcePort=%s\n", r.SPort)
+	}
+	if r.DPort != "" {
+		fmt.Fprintf(nw, "DestinationPort=%s\n", r.DPort)
+	}
+	if r.SuppressPrefixLength != nil {
+		fmt.Fprintf(nw, "SuppressPrefixLength=%d\n", *r.SuppressPrefixLength)
+	}
 }
 
-func writeNetwork(n *util.Network, e *util.Err, nw io.Writer) {
+// writeNetwork writes the layer 3 config of owner.  Routes that send
+// traffic out of another interface are left for that interface to
+// write, as networkd ties routes to the link they are configured on.
+// DHCP clients that send a hostname without being given one send
+// hostname.
+func writeNetwork(owner string, n *util.Network, hostname string, defaultMetric int, e *util.Err, nw io.Writer) {
 	if n == nil {
 		return
 	}
@@ -315,32 +597,79 @@ func writeNetwork(n *util.Network, e *util.Err, nw io.Writer) {
 		wr("Network", "DHCP", "ipv4")
 	}
 
-	if n.DhcpIdentifier != "" {
+	if n.RawDhcpIdentifier() != "" {
+		e.Warnf("%s: raw dhcp-identifiers are unsupported by systemd-networkd, ignoring it", owner)
+	} else if n.DhcpIdentifier != "" {
 		wr("DHCP", "ClientIdentifier", n.DhcpIdentifier)
 	}
 
 	wr("Network", "IPv6AcceptRA", n.AcceptRa)
+	if n.WithoutCarrier() {
+		wr("Network", "ConfigureWithoutCarrier", "yes")
+	}
+	if n.IgnoreCarrier {
+		wr("Network", "IgnoreCarrierLoss", "yes")
+	}
+	if n.GratuitousArpCount != 0 || n.UnsolicitedNa {
+		e.Warnf("%s: gratuitous-arp-count and unsolicited-na are unsupported by systemd-networkd, ignoring them", owner)
+	}
 
 	for _, a := range n.Addresses {
-		wr("Network", "Address", a)
+		if n.AddressOpts(a) == nil && !n.SharesPrefix(a) {
+			wr("Network", "Address", a)
+		}
 	}
 
+	// Default routes that need a metric or are on-link must be
+	// written out as full Route sections.
+	gwRoutes := []util.Route{}
 	if n.Gateway4 != nil {
-		wr("Network", "Gateway4", n.Gateway4)
+		gw := util.Route{Via: n.Gateway4, Metric: n.Gateway4Metric, OnLink: n.GatewayOnLink}
+		if gw.HasMetric(defaultMetric) || gw.OnLink {
+			gwRoutes = append(gwRoutes, gw)
+		} else {
+			wr("Network", "Gateway4", n.Gateway4)
+		}
 	}
 
 	if n.Gateway6 != nil {
-		wr("Network", "Gateway6", n.Gateway6)
+		gw := util.Route{Via: n.Gateway6, Metric: n.Gateway6Metric, OnLink: n.GatewayOnLink}
+		if gw.HasMetric(defaultMetric) || gw.OnLink {
+			gwRoutes = append(gwRoutes, gw)
+		} else {
+			wr("Network", "Gateway6", n.Gateway6)
+		}
 	}
 
 	if n.Nameservers != nil {
 		for _, dns := range n.Nameservers.Addresses {
 			wr("Network", "DNS", dns)
 		}
-		if len(n.Nameservers.Search) > 0 {
-			wr("Network", "Domains", s2s(",")(n.Nameservers.Search))
+		if domains := n.Nameservers.Domains(); len(domains) > 0 {
+			wr("Network", "Domains", s2s(" ")(domains))
 		}
 	}
+	if n.DNSDefaultRoute != nil {
+		wr("Network", "DNSDefaultRoute", *n.DNSDefaultRoute)
+	}
+	if n.IPv6MTU != 0 {
+		wr("Network", "IPv6MTUBytes", n.IPv6MTU)
+	}
+	if n.IPv6Token != "" {
+		wr("Network", "IPv6Token", n.IPv6Token)
+	}
+	if n.IPv6DadTransmits != nil {
+		wr("Network", "IPv6DuplicateAddressDetection", *n.IPv6DadTransmits)
+	}
+	if keep := n.Keep(); keep != "" {
+		wr("Network", "KeepConfiguration", keep)
+	}
+	if n.IPForward != "" {
+		wr("Network", "IPForward", n.IPForward)
+	}
+	if n.IPMasquerade != "" {
+		wr("Network", "IPMasquerade", n.IPMasquerade)
+	}
 
 	if netLines, ok := toWrite["Network"]; ok {
 		for _, s := range netLines {
@@ -355,29 +684,103 @@ func writeNetwork(n *util.Network, e *util.Err, nw io.Writer) {
 		}
 	}
 
+	for _, a := range n.Addresses {
+		if opts, shared := n.AddressOpts(a), n.SharesPrefix(a); opts != nil || shared {
+			writeAddress(a, opts, shared, e, nw)
+		}
+	}
+	for _, r := range gwRoutes {
+		writeRoute(r, defaultMetric, e, nw)
+	}
 	for _, r := range n.Routes {
-		writeRoute(r, e, nw)
+		if r.Dev == "" || r.Dev == owner {
+			writeRoute(r, defaultMetric, e, nw)
+		}
 	}
 	for _, r := range n.RoutingPolicy {
 		writeRoutePolicy(r, e, nw)
 	}
-	if n.Dhcp4Overrides != nil {
-		fmt.Fprintf(nw, "\n[DHCPv4]\n")
-		fmt.Fprintf(nw, "SendHostname=%t\n", n.Dhcp4Overrides.SendHostname)
-		fmt.Fprintf(nw, "Hostname=%s\n", n.Dhcp4Overrides.Hostname)
-		fmt.Fprintf(nw, "UseDNS=%t\n", n.Dhcp4Overrides.UseDNS)
-		fmt.Fprintf(nw, "UseNTP=%t\n", n.Dhcp4Overrides.UseNTP)
-		fmt.Fprintf(nw, "UseMTU=%t\n", n.Dhcp4Overrides.UseMTU)
-		fmt.Fprintf(nw, "UseRoutes=%t\n", n.Dhcp4Overrides.UseRoutes)
+	for _, neigh := range n.Neighbors {
+		fmt.Fprintf(nw, "\n[Neighbor]\n")
+		fmt.Fprintf(nw, "Address=%s\n", neigh.IP)
+		fmt.Fprintf(nw, "MACAddress=%s\n", neigh.MacAddress)
+	}
+	writeDhcp(nw, "DHCPv4", n.Dhcp4Overrides, n, hostname, n.Dhcp4 && n.DhcpIdentifier == "duid")
+	writeDhcp(nw, "DHCPv6", n.Dhcp6Overrides, n, hostname, n.Dhcp6)
+	if o := n.RaOverrides; o != nil {
+		fmt.Fprintf(nw, "\n[IPv6AcceptRA]\n")
+		fmt.Fprintf(nw, "UseDNS=%t\n", o.UseDNS)
+		fmt.Fprintf(nw, "UseAutonomousPrefix=%t\n", o.UseAutonomousPrefix)
+		if o.Table != 0 {
+			fmt.Fprintf(nw, "RouteTable=%d\n", o.Table)
+		}
 	}
-	if n.Dhcp6Overrides != nil {
-		fmt.Fprintf(nw, "\n[DHCPv4]\n")
-		fmt.Fprintf(nw, "SendHostname=%t\n", n.Dhcp6Overrides.SendHostname)
-		fmt.Fprintf(nw, "Hostname=%s\n", n.Dhcp6Overrides.Hostname)
-		fmt.Fprintf(nw, "UseDNS=%t\n", n.Dhcp6Overrides.UseDNS)
-		fmt.Fprintf(nw, "UseNTP=%t\n", n.Dhcp6Overrides.UseNTP)
-		fmt.Fprintf(nw, "UseMTU=%t\n", n.Dhcp6Overrides.UseMTU)
-		fmt.Fprintf(nw, "UseRoutes=%t\n", n.Dhcp6Overrides.UseRoutes)
+}
+
+// writeDhcp writes the section for a DHCP client with its overrides,
+// along with the DUID and IAID of n when the client sends them.
+// hostname is sent when o does not give a hostname of its own.
+func writeDhcp(nw io.Writer, section string, o *util.Overrides, n *util.Network, hostname string, sendsDuid bool) {
+	sendsDuid = sendsDuid && (n.Duid != nil || n.Iaid != nil)
+	if o == nil && !sendsDuid {
+		return
+	}
+	fmt.Fprintf(nw, "\n[%s]\n", section)
+	if o != nil {
+		fmt.Fprintf(nw, "SendHostname=%t\n", o.SendHostname)
+		if o.Hostname != "" || !o.SendHostname {
+			hostname = o.Hostname
+		}
+		fmt.Fprintf(nw, "Hostname=%s\n", hostname)
+		fmt.Fprintf(nw, "UseDNS=%t\n", o.UseDNS)
+		fmt.Fprintf(nw, "UseNTP=%t\n", o.UseNTP)
+		fmt.Fprintf(nw, "UseMTU=%t\n", o.UseMTU)
+		fmt.Fprintf(nw, "UseRoutes=%t\n", o.UseRoutes)
+		if o.UseGateway != nil && section == "DHCPv4" {
+			fmt.Fprintf(nw, "UseGateway=%t\n", *o.UseGateway)
+		}
+		if section == "DHCPv4" {
+			writeDhcpOptions(nw, o)
+		}
+		if o.RouteMetric != 0 {
+			fmt.Fprintf(nw, "RouteMetric=%d\n", o.RouteMetric)
+		}
+		if o.RouteTable != 0 && section == "DHCPv4" {
+			fmt.Fprintf(nw, "RouteTable=%d\n", o.RouteTable)
+		}
+	}
+	if !sendsDuid {
+		return
+	}
+	if n.Duid != nil {
+		fmt.Fprintf(nw, "DUIDType=%s\n", n.Duid.Type)
+		if n.Duid.RawData != "" {
+			fmt.Fprintf(nw, "DUIDRawData=%s\n", n.Duid.RawData)
+		}
+	}
+	if n.Iaid != nil {
+		fmt.Fprintf(nw, "IAID=%d\n", *n.Iaid)
+	}
+}
+
+// writeDhcpOptions writes the options the DHCPv4 client of o sends and
+// requests, and how it talks to the server.
+func writeDhcpOptions(nw io.Writer, o *util.Overrides) {
+	if len(o.RequestOptions) > 0 {
+		codes := []string{}
+		for _, code := range o.RequestOptions {
+			codes = append(codes, strconv.Itoa(code))
+		}
+		fmt.Fprintf(nw, "RequestOptions=%s\n", strings.Join(codes, " "))
+	}
+	for _, opt := range o.SendOptions {
+		fmt.Fprintf(nw, "SendOption=%s\n", opt)
+	}
+	if o.MaxAttempts != 0 {
+		fmt.Fprintf(nw, "MaxAttempts=%d\n", o.MaxAttempts)
+	}
+	if o.ListenPort != 0 {
+		fmt.Fprintf(nw, "ListenPort=%d\n", o.ListenPort)
 	}
 }
 
@@ -393,6 +796,14 @@ func (s *Systemd) writeOut(i util.Interface, e *util.Err) {
 	defer nw.Close()
 	defer link.Close()
 	// Write link stuff first
+	if i.Type != "physical" {
+		if s.hasNetdev(i) {
+			writeDescription(i, link)
+		}
+		if i.Alias != "" {
+			e.Warnf("%s: systemd-networkd can only set the alias of physical interfaces, ignoring alias", i.Name)
+		}
+	}
 	switch i.Type {
 	case "physical":
 		s.writePhy(i, e, link)
@@ -402,28 +813,65 @@ func (s *Systemd) writeOut(i util.Interface, e *util.Err) {
 		s.writeBridge(i, e, link)
 	case "vlan":
 		s.writeVlan(i, e, link)
+	case "tunnel":
+		s.writeTunnel(i, e, link)
+	case "veth":
+		s.writeVeth(i, e, link)
 	default:
 		e.Errorf("Cannot write interface %s:%s", i.Type, i.Name)
 	}
 	// Network file
+	writeDescription(i, nw)
 	fmt.Fprintf(nw, "[Match]\n")
 	if s.bindMacs && i.Type == "physical" {
-		fmt.Fprintf(nw, "MACAddress=%s\n", i.CurrentHwAddr)
+		fmt.Fprintf(nw, "%s\n", macMatch(i))
 	} else {
 		fmt.Fprintf(nw, "Name=%s\n", i.Name)
 	}
-	if i.Optional || len(i.MacAddress) > 0 {
+	if i.AutoconnectPriority != nil {
+		e.Warnf("%s: systemd-networkd brings up all links at once, ignoring autoconnect-priority", i.Name)
+	}
+	flags := i.LinkFlags()
+	if i.Optional || i.RequiredFamily != "" || len(i.MacAddress) > 0 || i.MTU != 0 || !i.Autoconnects() || len(flags) > 0 || i.Group != 0 {
 		fmt.Fprintf(nw, "\n[Link]\n")
 		if i.Optional {
 			fmt.Fprintf(nw, "RequiredForOnline=no\n")
 		}
+		if i.RequiredFamily != "" {
+			fmt.Fprintf(nw, "RequiredFamilyForOnline=%s\n", i.RequiredFamily)
+		}
 		if len(i.MacAddress) > 0 {
 			fmt.Fprintf(nw, "MACAddress=%s\n", i.MacAddress)
 		}
+		if i.MTU != 0 {
+			fmt.Fprintf(nw, "MTUBytes=%d\n", i.MTU)
+		}
+		if !i.Autoconnects() {
+			fmt.Fprintf(nw, "ActivationPolicy=manual\n")
+		}
+		for _, f := range flags {
+			fmt.Fprintf(nw, "%s=%t\n", f.Key, f.On)
+		}
+		if i.Group != 0 {
+			fmt.Fprintf(nw, "Group=%d\n", i.Group)
+		}
 	}
 	fmt.Fprintf(nw, "\n[Network]\n")
 	s.writeParents(i, e, nw)
-	writeNetwork(i.Network, e, nw)
+	writeLLDP(i, nw)
+	writeNetwork(i.Name, i.Network, s.Hostname, s.RouteMetric(), e, nw)
+	for _, other := range s.sortedNames() {
+		on := s.Interfaces[other].Network
+		if other == i.Name || on == nil {
+			continue
+		}
+		for _, r := range on.Routes {
+			if r.Dev == i.Name {
+				writeRoute(r, s.RouteMetric(), e, nw)
+			}
+		}
+	}
+	s.writeBridgeVlans(i, nw)
 	for _, subName := range i.Interfaces {
 		sub := s.Interfaces[subName]
 		s.writeOut(sub, e)
@@ -450,19 +898,40 @@ func (s *Systemd) Write(dest string) error {
 	if !e.Empty() {
 		return e
 	}
-	os.MkdirAll(s.finalDest, 0755)
+	os.MkdirAll(s.finalDest, util.DirMode())
+	units, err := ioutil.TempDir("", "netwrangler-")
+	if err != nil {
+		e.Merge(err)
+		return e
+	}
+	defer os.RemoveAll(units)
+	undo := s.installWaitOnline(units, e)
+	if !e.Empty() {
+		return e
+	}
+	if s.minimal {
+		s.syncMinimal(e)
+		if !e.Empty() {
+			undo()
+		}
+		return e.OrNil()
+	}
 	names, err := filepath.Glob(path.Join(s.finalDest, "*"))
 	if err != nil {
 		e.Merge(err)
 		return e
 	}
+	stale := []string{}
 	for _, name := range names {
 		base := path.Base(name)
 		if base == "." || base == ".." {
 			continue
 		}
-		os.RemoveAll(name)
+		stale = append(stale, name)
+	}
+	util.Replace(s.dest, s.finalDest, stale, e)
+	if !e.Empty() {
+		undo()
 	}
-	util.Copy(s.dest, s.finalDest, e)
 	return e.OrNil()
 }
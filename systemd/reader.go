@@ -0,0 +1,941 @@
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+	"github.com/rackn/netwrangler/util"
+)
+
+// section is a single section of a systemd unit file.  Sections and
+// keys can both be repeated, so order is preserved.
+type section struct {
+	name string
+	keys [][2]string
+}
+
+func (s *section) get(k string) []string {
+	res := []string{}
+	for _, kv := range s.keys {
+		if kv[0] == k {
+			res = append(res, kv[1])
+		}
+	}
+	return res
+}
+
+// last returns the last value of k in the section, which is the one
+// that systemd will use for keys that can only have one value.
+func (s *section) last(k string) (string, bool) {
+	vals := s.get(k)
+	if len(vals) == 0 {
+		return "", false
+	}
+	return vals[len(vals)-1], true
+}
+
+// unit is a parsed .network, .netdev, or .link file.
+type unit struct {
+	name        string
+	kind        string
+	description string
+	sections    []*section
+}
+
+func (u *unit) all(name string) []*section {
+	res := []*section{}
+	for _, s := range u.sections {
+		if s.name == name {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// merged returns all the keys in every section named name as one
+// section.
+func (u *unit) merged(name string) *section {
+	res := &section{name: name}
+	for _, s := range u.all(name) {
+		res.keys = append(res.keys, s.keys...)
+	}
+	return res
+}
+
+func parseUnit(name, kind string, buf []byte) (*unit, error) {
+	res := &unit{name: name, kind: kind}
+	var cur *section
+	sc := bufio.NewScanner(strings.NewReader(string(buf)))
+	line := ""
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line += strings.TrimSpace(sc.Text())
+		if strings.HasSuffix(line, "\\") {
+			line = strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		l := line
+		line = ""
+		if cur == nil && strings.HasPrefix(l+" ", descriptionPrefix) {
+			res.description = strings.TrimSpace(strings.TrimPrefix(l, strings.TrimSpace(descriptionPrefix)))
+			continue
+		}
+		if l == "" || l[0] == '#' || l[0] == ';' {
+			continue
+		}
+		if l[0] == '[' {
+			if l[len(l)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: malformed section header %s", name, lineNo, l)
+			}
+			cur = &section{name: l[1 : len(l)-1]}
+			res.sections = append(res.sections, cur)
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key=value, got %s", name, lineNo, l)
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("%s:%d: %s is not in a section", name, lineNo, l)
+		}
+		cur.keys = append(cur.keys, [2]string{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])})
+	}
+	return res, sc.Err()
+}
+
+// Read satisfies the util.Reader interface.  For Systemd, src must
+// be a directory containing systemd-networkd .network, .netdev, and
+// .link files.  Files are processed in lexical order, and for
+// .network and .link files only the first one that matches an
+// interface applies, just like systemd-networkd does.
+func (s *Systemd) Read(src string, phys []util.Phy) (*util.Layout, error) {
+	names, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	s.units = []*unit{}
+	for _, fi := range names {
+		kind := strings.TrimPrefix(filepath.Ext(fi.Name()), ".")
+		switch kind {
+		case "network", "netdev", "link":
+		default:
+			continue
+		}
+		if fi.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(path.Join(src, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		u, err := parseUnit(fi.Name(), kind, buf)
+		if err != nil {
+			return nil, err
+		}
+		s.units = append(s.units, u)
+	}
+	return s.Compile(phys)
+}
+
+// rBool parses a systemd boolean.
+func rBool(e *util.Err, k, v string) bool {
+	res, _ := util.ValidateBool(e, k, strings.ToLower(v))
+	return res
+}
+
+// rYesNo parses a setting that is either one of vals or a boolean,
+// which is read as yes or no.
+func rYesNo(e *util.Err, k, v, yes string, vals ...string) string {
+	for _, val := range vals {
+		if v == val {
+			return v
+		}
+	}
+	if rBool(e, k, v) {
+		return yes
+	}
+	return "no"
+}
+
+// rInt parses a systemd integer.
+func rInt(e *util.Err, k, v string) int {
+	res, _ := util.ValidateInt(e, k, v, 0, 1<<32-1)
+	return int(res)
+}
+
+// rIP parses an address with an optional prefix.
+func rIP(e *util.Err, k, v string) *gnet.IPNet {
+	res, ok := util.ValidateIP(e, k, v)
+	if !ok {
+		return nil
+	}
+	return res
+}
+
+// rList splits a systemd list, which may be separated by whitespace
+// or commas.
+func rList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// rParam translates a systemd netdev setting into a Parameter value.
+func rParam(e *util.Err, k, v string) interface{} {
+	switch k {
+	case "arp-ip-targets":
+		res := []string{}
+		for _, addr := range rList(v) {
+			if rIP(e, k, addr) != nil {
+				res = append(res, addr)
+			}
+		}
+		return res
+	case "stp", "all-slaves-active", "tlb-dynamic-lb", "vlan-filtering":
+		return rBool(e, k, v)
+	case "ad-actor-system":
+		res, _ := util.ValidateMac(e, k, v)
+		return res
+	case "vlan-default-pvid":
+		if v == "none" {
+			return 0
+		}
+	}
+	if unit, ok := util.TimeParams[k]; ok {
+		res, _ := util.ValidateTime(e, k, v, unit, time.Second, 0, math.MaxInt32)
+		return int(res)
+	}
+	if res, ok := util.ValidateInt(&util.Err{}, k, v, 0, 1<<32-1); ok {
+		return int(res)
+	}
+	return v
+}
+
+// rBridgeVlans reads the [BridgeVLAN] sections of u into the VLAN
+// config of port on the bridge parent.  A port that lists VLANs
+// without a PVID is a trunk with a PVID of 0, and one that lists the
+// default PVID of the bridge does not need one of its own.
+func rBridgeVlans(e *util.Err, u *unit, parent util.Interface, port string) {
+	sects := u.all("BridgeVLAN")
+	if len(sects) == 0 || parent.Parameters == nil {
+		return
+	}
+	vlans, pvid := []string{}, int64(0)
+	for _, sect := range sects {
+		for _, v := range sect.get("VLAN") {
+			vlans = append(vlans, rList(v)...)
+		}
+		if v, ok := sect.last("PVID"); ok {
+			pvid = int64(rInt(e, "PVID", v))
+		}
+	}
+	parent.SetPortVlans(port, vlans, pvid)
+}
+
+func rParams(e *util.Err, sect *section, params []string, checks map[string]*util.Check, i *util.Interface) {
+	for _, k := range params {
+		if v, ok := sect.last(checks[k].Key(k)); ok {
+			i.Parameters[k] = rParam(e, k, v)
+		}
+	}
+}
+
+// rDuid reads the DUID and IAID in a DHCP section into res.
+func rDuid(e *util.Err, sect *section, res *util.Network) {
+	for _, kv := range sect.keys {
+		k, v := kv[0], kv[1]
+		switch k {
+		case "DUIDType":
+			if res.Duid == nil {
+				res.Duid = &util.Duid{}
+			}
+			// link-layer-time can be followed by the time to use.
+			res.Duid.Type = strings.SplitN(v, ":", 2)[0]
+		case "DUIDRawData":
+			if res.Duid == nil {
+				res.Duid = &util.Duid{}
+			}
+			res.Duid.RawData = v
+		case "IAID":
+			iaid := uint32(rInt(e, k, v))
+			res.Iaid = &iaid
+		}
+	}
+}
+
+// rOverrides reads the overrides in a DHCP section, or returns nil if
+// it has none.
+func rOverrides(e *util.Err, sect *section) *util.Overrides {
+	found := false
+	res := &util.Overrides{
+		UseDNS:       true,
+		UseNTP:       true,
+		SendHostname: true,
+		UseMTU:       true,
+		UseRoutes:    true,
+		UseDomains:   "true",
+	}
+	for _, kv := range sect.keys {
+		k, v := kv[0], kv[1]
+		switch k {
+		case "SendHostname":
+			res.SendHostname = rBool(e, k, v)
+		case "Hostname":
+			res.Hostname = v
+		case "UseDNS":
+			res.UseDNS = rBool(e, k, v)
+		case "UseNTP":
+			res.UseNTP = rBool(e, k, v)
+		case "UseMTU":
+			res.UseMTU = rBool(e, k, v)
+		case "UseRoutes":
+			res.UseRoutes = rBool(e, k, v)
+		case "UseGateway":
+			useGateway := rBool(e, k, v)
+			res.UseGateway = &useGateway
+		case "RequestOptions":
+			for _, code := range rList(v) {
+				res.RequestOptions = append(res.RequestOptions, rInt(e, k, code))
+			}
+		case "SendOption":
+			opt, err := util.ParseDhcpOption(v)
+			if err != nil {
+				e.Errorf("%s: %v", k, err)
+				continue
+			}
+			res.SendOptions = append(res.SendOptions, opt)
+		case "MaxAttempts":
+			res.MaxAttempts = rInt(e, k, v)
+		case "ListenPort":
+			res.ListenPort = rInt(e, k, v)
+		case "RouteMetric":
+			res.RouteMetric = rInt(e, k, v)
+		case "RouteTable":
+			res.RouteTable = rInt(e, k, v)
+		case "UseDomains":
+			res.UseDomains = strings.ToLower(v)
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return res
+}
+
+// rRaOverrides reads the overrides in an [IPv6AcceptRA] section, or
+// returns nil if it has none.
+func rRaOverrides(e *util.Err, sect *section) *util.RaOverrides {
+	found := false
+	res := &util.RaOverrides{
+		UseDNS:              true,
+		UseAutonomousPrefix: true,
+	}
+	for _, kv := range sect.keys {
+		k, v := kv[0], kv[1]
+		switch k {
+		case "UseDNS":
+			res.UseDNS = rBool(e, k, v)
+		case "UseAutonomousPrefix":
+			res.UseAutonomousPrefix = rBool(e, k, v)
+		case "RouteTable":
+			res.Table = rInt(e, k, v)
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return res
+}
+
+func rRoute(e *util.Err, sect *section) util.Route {
+	res := util.Route{}
+	for _, kv := range sect.keys {
+		k, v := kv[0], kv[1]
+		switch k {
+		case "Source":
+			res.From = rIP(e, k, v)
+		case "Destination":
+			res.To = rIP(e, k, v)
+		case "Gateway":
+			res.Via = rIP(e, k, v)
+		case "GatewayOnLink":
+			res.OnLink = rBool(e, k, v)
+		case "Metric":
+			res.Metric = rInt(e, k, v)
+		case "Type":
+			res.Type = v
+		case "Scope":
+			res.Scope = v
+		case "Table":
+			res.Table = rInt(e, k, v)
+		}
+	}
+	return res
+}
+
+// rFWMark reads a firewall mark with an optional mask.
+func rFWMark(e *util.Err, k, v string) (mark, mask int) {
+	mark, mask, err := util.ParseFWMark(v)
+	if err != nil {
+		e.Errorf("%s: %v", k, err)
+	}
+	return
+}
+
+func rRoutePolicy(e *util.Err, sect *section) util.RoutePolicy {
+	res := util.RoutePolicy{}
+	for _, kv := range sect.keys {
+		k, v := kv[0], kv[1]
+		switch k {
+		case "From":
+			res.From = rIP(e, k, v)
+		case "To":
+			res.To = rIP(e, k, v)
+		case "Table":
+			res.Table = rInt(e, k, v)
+		case "Priority":
+			res.Priority = rInt(e, k, v)
+		case "FirewallMark":
+			res.FWMark, res.FWMask = rFWMark(e, k, v)
+		case "TypeOfService":
+			res.TOS = rInt(e, k, v)
+		case "IncomingInterface":
+			res.IIF = v
+		case "OutgoingInterface":
+			res.OIF = v
+		case "IPProtocol":
+			res.IPProto, _ = util.ValidateIPProto(e, k, v)
+		case "SourcePort":
+			res.SPort, _ = util.ValidatePortRange(e, k, v)
+		case "DestinationPort":
+			res.DPort, _ = util.ValidatePortRange(e, k, v)
+		case "SuppressPrefixLength":
+			l := rInt(e, k, v)
+			res.SuppressPrefixLength = &l
+		}
+	}
+	return res
+}
+
+// setGateway records a default gateway.  It returns false if the
+// interface already has a default gateway for that address family.
+func setGateway(n *util.Network, gw *gnet.IPNet, metric int) bool {
+	if gw.IP.To4() != nil {
+		if n.Gateway4 != nil {
+			return false
+		}
+		n.Gateway4, n.Gateway4Metric = gw, metric
+	} else {
+		if n.Gateway6 != nil {
+			return false
+		}
+		n.Gateway6, n.Gateway6Metric = gw, metric
+	}
+	return true
+}
+
+// rNetwork translates the layer 3 settings in a .network file into a
+// Network.  If the file has no layer 3 settings, nil is returned.
+func rNetwork(e *util.Err, u *unit) *util.Network {
+	res := &util.Network{AcceptRa: true}
+	configured := false
+	sect := u.merged("Network")
+	for _, kv := range sect.keys {
+		k, v := kv[0], kv[1]
+		switch k {
+		case "DHCP":
+			switch strings.ToLower(v) {
+			case "yes", "true", "both":
+				res.Dhcp4, res.Dhcp6 = true, true
+			case "ipv4":
+				res.Dhcp4 = true
+			case "ipv6":
+				res.Dhcp6 = true
+			}
+		case "IPv6AcceptRA":
+			res.AcceptRa = rBool(e, k, v)
+		case "ConfigureWithoutCarrier":
+			res.ConfigureWithoutCarrier = rBool(e, k, v)
+		case "IgnoreCarrierLoss":
+			// IgnoreCarrierLoss can also be a timespan, which we
+			// have no way to express.
+			res.IgnoreCarrier = strings.ToLower(v) != "no" && strings.ToLower(v) != "false" && v != "0"
+		case "Address":
+			if addr := rIP(e, k, v); addr != nil {
+				res.Addresses = append(res.Addresses, addr)
+			}
+		case "Gateway", "Gateway4", "Gateway6":
+			if gw := rIP(e, k, v); gw != nil && !setGateway(res, gw, 0) {
+				res.Routes = append(res.Routes, util.Route{Via: gw})
+			}
+		case "DNS":
+			if res.Nameservers == nil {
+				res.Nameservers = &util.NSInfo{}
+			}
+			if addr := rIP(e, k, v); addr != nil {
+				res.Nameservers.Addresses = append(res.Nameservers.Addresses, addr)
+			}
+		case "DNSDefaultRoute":
+			dr := rBool(e, k, v)
+			res.DNSDefaultRoute = &dr
+		case "IPv6MTUBytes":
+			res.IPv6MTU = rInt(e, k, v)
+		case "IPv6Token":
+			res.IPv6Token = v
+		case "IPv6DuplicateAddressDetection":
+			dad := rInt(e, k, v)
+			res.IPv6DadTransmits = &dad
+		case "KeepConfiguration":
+			res.KeepConfiguration = v
+		case "IPForward":
+			res.IPForward = rYesNo(e, k, v, "yes", util.IPForwards...)
+		case "IPMasquerade":
+			// systemd reads a yes IPMasquerade as ipv4.
+			res.IPMasquerade = rYesNo(e, k, v, "ipv4", util.IPMasquerades...)
+		case "Domains":
+			if res.Nameservers == nil {
+				res.Nameservers = &util.NSInfo{}
+			}
+			res.Nameservers.Search = append(res.Nameservers.Search, rList(v)...)
+		default:
+			continue
+		}
+		configured = true
+	}
+	if res.IgnoreCarrier {
+		res.ConfigureWithoutCarrier = false
+	}
+	// [DHCP] is the older name of [DHCPv4].
+	for _, sect := range []string{"DHCP", "DHCPv4"} {
+		if v, ok := u.merged(sect).last("ClientIdentifier"); ok {
+			res.DhcpIdentifier = v
+			configured = true
+		}
+	}
+	for _, a := range u.all("Address") {
+		v, ok := a.last("Address")
+		if !ok {
+			continue
+		}
+		addr := rIP(e, "Address", v)
+		if addr == nil {
+			continue
+		}
+		configured = true
+		res.Addresses = append(res.Addresses, addr)
+		opts := &util.AddressOptions{}
+		if bcast, ok := a.last("Broadcast"); ok {
+			opts.Broadcast = rIP(e, "Broadcast", bcast)
+		}
+		if pl, ok := a.last("PreferredLifetime"); ok {
+			lt := util.LifetimeForever
+			if pl != "forever" && pl != "infinity" {
+				lt = util.Lifetime(rInt(e, "PreferredLifetime", pl))
+			}
+			opts.PreferredLifetime = &lt
+		}
+		if scope, ok := a.last("Scope"); ok {
+			opts.Scope = scope
+		}
+		if opts.Broadcast != nil || opts.PreferredLifetime != nil || opts.Scope != "" {
+			if res.AddressOptions == nil {
+				res.AddressOptions = map[string]*util.AddressOptions{}
+			}
+			res.AddressOptions[addr.String()] = opts
+		}
+	}
+	for _, r := range u.all("Route") {
+		configured = true
+		route := rRoute(e, r)
+		// A bare route via a gateway is a default route.
+		if route.Via != nil && route.To == nil && route.From == nil &&
+			route.Type == "" && route.Scope == "" && route.Table == 0 &&
+			setGateway(res, route.Via, route.Metric) {
+			res.GatewayOnLink = res.GatewayOnLink || route.OnLink
+			continue
+		}
+		res.Routes = append(res.Routes, route)
+	}
+	for _, r := range u.all("RoutingPolicyRule") {
+		configured = true
+		res.RoutingPolicy = append(res.RoutingPolicy, rRoutePolicy(e, r))
+	}
+	for _, n := range u.all("Neighbor") {
+		configured = true
+		neigh := util.Neighbor{}
+		if v, ok := n.last("Address"); ok {
+			neigh.IP = rIP(e, "Address", v)
+		}
+		mac, ok := n.last("LinkLayerAddress")
+		if !ok {
+			mac, _ = n.last("MACAddress")
+		}
+		if hw, ok := util.ValidateMac(e, "MACAddress", mac); ok {
+			neigh.MacAddress = hw
+		}
+		res.Neighbors = append(res.Neighbors, neigh)
+	}
+	if sects := u.all("DHCPv4"); len(sects) > 0 {
+		configured = true
+		res.Dhcp4Overrides = rOverrides(e, u.merged("DHCPv4"))
+		rDuid(e, u.merged("DHCPv4"), res)
+	}
+	if sects := u.all("DHCPv6"); len(sects) > 0 {
+		configured = true
+		res.Dhcp6Overrides = rOverrides(e, u.merged("DHCPv6"))
+		rDuid(e, u.merged("DHCPv6"), res)
+	}
+	if sects := u.all("IPv6AcceptRA"); len(sects) > 0 {
+		configured = true
+		res.RaOverrides = rRaOverrides(e, u.merged("IPv6AcceptRA"))
+	}
+	if !configured {
+		return nil
+	}
+	return res
+}
+
+// matches returns the phys that a [Match] section applies to.
+func matches(e *util.Err, u *unit, phys []util.Phy) []util.Phy {
+	m := u.merged("Match")
+	res := []util.Phy{}
+	names := []string{}
+	for _, v := range m.get("Name") {
+		names = append(names, rList(v)...)
+	}
+	macs := []gnet.HardwareAddr{}
+	for _, k := range []string{"MACAddress", "PermanentMACAddress"} {
+		for _, v := range m.get(k) {
+			for _, mac := range rList(v) {
+				if hw, ok := util.ValidateMac(e, u.name, mac); ok {
+					macs = append(macs, hw)
+				}
+			}
+		}
+	}
+	for _, phy := range phys {
+		if len(names) > 0 {
+			found := false
+			for _, name := range names {
+				if ms, _ := util.MatchPhys(util.Match{Name: name}, util.Interface{}, []util.Phy{phy}); len(ms) > 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if len(macs) > 0 {
+			found := false
+			for _, mac := range macs {
+				if phy.MatchesMac(mac) || string(mac) == string(phy.HardwareAddr) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if len(names) > 0 || len(macs) > 0 {
+			res = append(res, phy)
+		}
+	}
+	return res
+}
+
+// Compile satisfies the util.Reader interface.  It translates the
+// units loaded by Read into a Layout.
+func (s *Systemd) Compile(phys []util.Phy) (*util.Layout, error) {
+	e := &util.Err{Prefix: "systemd"}
+	l := &util.Layout{Interfaces: map[string]util.Interface{}, Renderer: "networkd"}
+	// netdevs first, since they define the virtual interfaces that
+	// .network files can refer to.
+	for _, u := range s.units {
+		if u.kind != "netdev" {
+			continue
+		}
+		nd := u.merged("NetDev")
+		name, _ := nd.last("Name")
+		kind, _ := nd.last("Kind")
+		if name == "" {
+			e.Errorf("%s: missing [NetDev] Name", u.name)
+			continue
+		}
+		if _, ok := l.Interfaces[name]; ok {
+			continue
+		}
+		intf := util.NewInterface()
+		intf.Name, intf.MatchID, intf.Type = name, name, kind
+		intf.Description = u.description
+		if mac, ok := nd.last("MACAddress"); ok {
+			intf.MacAddress, _ = util.ValidateMac(e, u.name, mac)
+		}
+		if _, ok := util.TunnelModes[kind]; ok || kind == "ip6tnl" {
+			intf.Type = "tunnel"
+			t := u.merged("Tunnel")
+			mode := kind
+			if kind == "ip6tnl" {
+				mode, _ = t.last("Mode")
+			}
+			intf.Parameters["mode"] = mode
+			for k, key := range tunnelKeys {
+				v, ok := t.last(key)
+				switch {
+				case !ok:
+				case k == "ttl":
+					intf.Parameters[k] = rInt(e, key, v)
+				default:
+					intf.Parameters[k] = v
+				}
+			}
+			l.Interfaces[name] = intf
+			continue
+		}
+		switch kind {
+		case "bond":
+			rParams(e, u.merged("Bond"), bondParams, bondChecks, &intf)
+		case "bridge":
+			rParams(e, u.merged("Bridge"), bridgeParams, bridgeChecks, &intf)
+		case "vlan":
+			id, ok := u.merged("VLAN").last("Id")
+			if !ok {
+				e.Errorf("%s: vlan %s is missing [VLAN] Id", u.name, name)
+				continue
+			}
+			intf.Parameters["id"] = rInt(e, "Id", id)
+			for k, key := range map[string]string{"ingress-qos-map": "IngressQOSMaps", "egress-qos-map": "EgressQOSMaps"} {
+				maps := []string{}
+				for _, v := range u.merged("VLAN").get(key) {
+					for _, m := range rList(v) {
+						maps = append(maps, strings.Replace(m, "-", ":", 1))
+					}
+				}
+				if len(maps) > 0 {
+					intf.Parameters[k] = maps
+				}
+			}
+		case "veth":
+			p := u.merged("Peer")
+			peer, ok := p.last("Name")
+			if !ok {
+				e.Errorf("%s: veth %s is missing [Peer] Name", u.name, name)
+				continue
+			}
+			intf.Parameters["peer"] = peer
+			// The netdev creates both ends of the pair.
+			if _, ok := l.Interfaces[peer]; !ok {
+				other := util.NewInterface()
+				other.Name, other.MatchID, other.Type = peer, peer, kind
+				other.Parameters["peer"] = name
+				if mac, ok := p.last("MACAddress"); ok {
+					other.MacAddress, _ = util.ValidateMac(e, u.name, mac)
+				}
+				l.Interfaces[peer] = other
+			}
+		default:
+			e.Errorf("%s: netdev kind %s is not supported", u.name, kind)
+			continue
+		}
+		l.Interfaces[name] = intf
+	}
+	// Physical interfaces only get the first .link file that matches them.
+	linked := map[string]bool{}
+	physIntfs := map[string]util.Interface{}
+	// renamed maps the names .link files give nics to their current
+	// names, which physIntfs is keyed by.
+	renamed := map[string]string{}
+	for _, u := range s.units {
+		if u.kind != "link" {
+			continue
+		}
+		for _, phy := range matches(e, u, phys) {
+			if linked[phy.Name] {
+				continue
+			}
+			linked[phy.Name] = true
+			intf, _ := util.MatchPhys(util.Match{Name: phy.Name}, util.NewInterface(), []util.Phy{phy})
+			i := intf[0]
+			lnk := u.merged("Link")
+			if wol, ok := lnk.last("WakeOnLan"); ok {
+				modes := []string{}
+				for _, mode := range rList(wol) {
+					switch mode {
+					case "off":
+					case "magic":
+						i.Parameters["wakeonlan"] = true
+					default:
+						modes = append(modes, mode)
+					}
+				}
+				if pw, ok := lnk.last("WakeOnLanPassword"); ok {
+					if pw, ok := util.ValidateWolPassword(e, u.name, pw); ok {
+						i.Parameters["wakeonlan-password"] = pw
+					}
+				}
+				for idx := range modes {
+					if modes[idx] != "secureon" {
+						continue
+					}
+					if i.Parameters["wakeonlan-password"] == nil {
+						e.Warnf("%s: WakeOnLan secureon needs a WakeOnLanPassword, ignoring it", u.name)
+					}
+					modes = append(modes[:idx], modes[idx+1:]...)
+					break
+				}
+				if len(modes) > 0 {
+					i.Parameters["wakeonlan-modes"] = modes
+				}
+			}
+			for _, v := range lnk.get("AlternativeName") {
+				i.AlternativeNames = append(i.AlternativeNames, rList(v)...)
+			}
+			if v, ok := lnk.last("Alias"); ok {
+				i.Alias = v
+			}
+			if v, ok := lnk.last("ReceivePacketSteeringCPUMask"); ok {
+				i.RpsCpus, _ = util.ValidateCPUs(e, u.name, strings.Replace(v, " ", ",", -1))
+			}
+			if v, ok := lnk.last("Name"); ok && v != phy.Name {
+				i.Name, i.Rename = v, true
+				renamed[v] = phy.Name
+			}
+			physIntfs[phy.Name] = i
+		}
+	}
+	configured := map[string]bool{}
+	for _, u := range s.units {
+		if u.kind != "network" {
+			continue
+		}
+		targets := []util.Interface{}
+		if names := u.merged("Match").get("Name"); len(names) == 1 {
+			if intf, ok := l.Interfaces[names[0]]; ok {
+				targets = append(targets, intf)
+			} else if cur, ok := renamed[names[0]]; ok {
+				targets = append(targets, physIntfs[cur])
+			}
+		}
+		if len(targets) == 0 {
+			for _, phy := range matches(e, u, phys) {
+				intf, ok := physIntfs[phy.Name]
+				if !ok {
+					res, _ := util.MatchPhys(util.Match{Name: phy.Name}, util.NewInterface(), []util.Phy{phy})
+					intf = res[0]
+				}
+				targets = append(targets, intf)
+			}
+		}
+		if len(targets) == 0 {
+			e.Errorf("%s: does not match any interfaces", u.name)
+			continue
+		}
+		lnk := u.merged("Link")
+		netSect := u.merged("Network")
+		for _, intf := range targets {
+			if configured[intf.Name] {
+				continue
+			}
+			configured[intf.Name] = true
+			if u.description != "" {
+				intf.Description = u.description
+			}
+			if v, ok := lnk.last("RequiredForOnline"); ok {
+				intf.Optional = !rBool(e, "RequiredForOnline", v)
+			}
+			if v, ok := lnk.last("RequiredFamilyForOnline"); ok {
+				intf.RequiredFamily = v
+			}
+			if v, ok := lnk.last("MACAddress"); ok {
+				intf.MacAddress, _ = util.ValidateMac(e, u.name, v)
+			}
+			if v, ok := lnk.last("MTUBytes"); ok {
+				intf.MTU = rInt(e, "MTUBytes", v)
+			}
+			if v, ok := lnk.last("ActivationPolicy"); ok && v == "manual" {
+				autoconnect := false
+				intf.Autoconnect = &autoconnect
+			}
+			for _, f := range []struct {
+				k  string
+				on **bool
+			}{{"ARP", &intf.ARP}, {"Multicast", &intf.Multicast}, {"AllMulticast", &intf.AllMulticast}} {
+				if v, ok := lnk.last(f.k); ok {
+					on := rBool(e, f.k, v)
+					*f.on = &on
+				}
+			}
+			if v, ok := lnk.last("Group"); ok {
+				intf.Group = rInt(e, "Group", v)
+			}
+			if v, ok := netSect.last("EmitLLDP"); ok {
+				intf.EmitLLDP, _ = util.ValidateEmitLLDP(e, "EmitLLDP", strings.ToLower(v))
+			}
+			// routers-only is the networkd default, and has no
+			// equivalent in a Layout.
+			if v, ok := netSect.last("LLDP"); ok && v != "routers-only" {
+				lldp := rBool(e, "LLDP", v)
+				intf.LLDP = &lldp
+			}
+			intf.Network = rNetwork(e, u)
+			if intf.Type == "physical" {
+				intf.MatchID = intf.Name
+				if cur, ok := renamed[intf.Name]; ok {
+					physIntfs[cur] = intf
+				} else {
+					physIntfs[intf.Name] = intf
+				}
+			} else {
+				l.Interfaces[intf.Name] = intf
+			}
+			for _, k := range []string{"Bond", "Bridge", "VLAN"} {
+				for _, pName := range netSect.get(k) {
+					parent, ok := l.Interfaces[pName]
+					if !ok {
+						e.Errorf("%s: %s=%s does not refer to a netdev", u.name, k, pName)
+						continue
+					}
+					parent.Interfaces = append(parent.Interfaces, intf.Name)
+					sort.Strings(parent.Interfaces)
+					l.Interfaces[pName] = parent
+				}
+			}
+			for _, pName := range netSect.get("Bridge") {
+				rBridgeVlans(e, u, l.Interfaces[pName], intf.Name)
+			}
+			if v, ok := netSect.last("PrimarySlave"); ok && (v == intf.Name || rBool(&util.Err{}, "PrimarySlave", v)) {
+				for _, pName := range netSect.get("Bond") {
+					parent := l.Interfaces[pName]
+					parent.Parameters["primary"] = intf.Name
+				}
+			}
+		}
+	}
+	for _, v := range physIntfs {
+		if configured[v.Name] {
+			l.Interfaces[v.Name] = v
+		}
+	}
+	if !e.Empty() {
+		return l, e
+	}
+	e.Merge(l.Validate())
+	return l, e.OrNil()
+}
+
+// ensure Systemd can be used as an input format.
+var _ util.Reader = &Systemd{}
@@ -0,0 +1,171 @@
+package systemd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rackn/netwrangler/util"
+)
+
+// Minimal makes Write leave the unit files in its destination alone
+// unless their contents changed, and record the commands that will
+// make systemd-networkd pick up the ones that did.  They are
+// available from Reloads once Write has finished.
+func (s *Systemd) Minimal() {
+	s.minimal = true
+}
+
+// Reloads returns the commands needed to apply the changes made by
+// the last Write in minimal mode, in the order they must be run.  It
+// is empty when nothing changed.
+func (s *Systemd) Reloads() []string {
+	return s.reloads
+}
+
+// unitFile is a unit file for a single interface.
+type unitFile struct {
+	base, intf, ext string
+	buf             []byte
+}
+
+// unitFiles reads the non-empty unit files in dir, keyed by the
+// interface and extension they are for.  Files that do not look like
+// ones we write are keyed by their name, and have no interface.
+func unitFiles(dir string) (map[string]unitFile, error) {
+	res := map[string]unitFile{}
+	names, err := filepath.Glob(path.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		st, err := os.Stat(name)
+		if err != nil || st.IsDir() {
+			continue
+		}
+		uf := unitFile{base: path.Base(name), ext: path.Ext(name)}
+		if uf.buf, err = ioutil.ReadFile(name); err != nil {
+			return nil, err
+		}
+		if len(uf.buf) == 0 {
+			// Copy skips empty files, so they are never live.
+			continue
+		}
+		key := uf.base
+		if idx := strings.Index(uf.base, "-"); idx > 0 {
+			switch uf.ext {
+			case ".network", ".netdev", ".link":
+				uf.intf = strings.TrimSuffix(uf.base[idx+1:], uf.ext)
+				key = uf.intf + uf.ext
+			}
+		}
+		res[key] = uf
+	}
+	return res, nil
+}
+
+// syncMinimal replaces the unit files in s.finalDest that differ from
+// the ones rendered into s.dest, and works out what has to be done
+// for systemd-networkd to pick up the changes.  Like a full Write, the
+// changed units are put in place with util.Replace, so a failure
+// leaves the live units as they were.  A modified netdev is
+// only recreated after it has been deleted, and link files are only
+// applied by udev.
+func (s *Systemd) syncMinimal(e *util.Err) {
+	s.reloads = []string{}
+	staged, err := unitFiles(s.dest)
+	if err != nil {
+		e.Merge(err)
+		return
+	}
+	live, err := unitFiles(s.finalDest)
+	if err != nil {
+		e.Merge(err)
+		return
+	}
+	keys := []string{}
+	for k := range staged {
+		keys = append(keys, k)
+	}
+	for k := range live {
+		if _, ok := staged[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	changed, err := ioutil.TempDir("", "netwrangler-")
+	if err != nil {
+		e.Merge(err)
+		return
+	}
+	defer os.RemoveAll(changed)
+	stale, deletes, reconfigures, triggers := []string{}, []string{}, []string{}, []string{}
+	reload := false
+	for _, k := range keys {
+		sf, isStaged := staged[k]
+		lf, isLive := live[k]
+		if isStaged && isLive && sf.base == lf.base && bytes.Equal(sf.buf, lf.buf) {
+			continue
+		}
+		if isLive {
+			stale = append(stale, path.Join(s.finalDest, lf.base))
+		}
+		if isStaged {
+			if err := ioutil.WriteFile(path.Join(changed, sf.base), sf.buf, 0644); err != nil {
+				e.Merge(err)
+			}
+		}
+		if isStaged && isLive && bytes.Equal(sf.buf, lf.buf) {
+			// Only the name of the file changed.
+			continue
+		}
+		reload = true
+		switch {
+		case lf.ext == ".netdev" && lf.intf != "":
+			deletes = append(deletes, "networkctl delete "+lf.intf)
+		case sf.ext == ".network" && sf.intf != "":
+			reconfigures = append(reconfigures, "networkctl reconfigure "+sf.intf)
+		case sf.ext == ".link" && sf.intf != "":
+			triggers = append(triggers, s.udevTrigger(sf.intf))
+		}
+	}
+	// Nothing live is touched until every changed unit is staged.
+	if !e.Empty() {
+		return
+	}
+	util.Replace(changed, s.finalDest, stale, e)
+	if !e.Empty() {
+		return
+	}
+	s.reloads = append(s.reloads, deletes...)
+	if reload {
+		s.reloads = append(s.reloads, "networkctl reload")
+	}
+	s.reloads = append(s.reloads, triggers...)
+	s.reloads = append(s.reloads, reconfigures...)
+}
+
+// udevTrigger returns the command that makes udev apply the link
+// file of the interface name.  A nic the link file renames does not
+// have that name until it is applied, so physical interfaces are
+// picked by their MAC address instead.
+func (s *Systemd) udevTrigger(name string) string {
+	if i, ok := s.Interfaces[name]; ok && len(i.CurrentHwAddr) > 0 {
+		return "udevadm trigger --action=add --subsystem-match=net --attr-match=address=" + i.CurrentHwAddr.String()
+	}
+	return "udevadm trigger --action=add /sys/class/net/" + name
+}
+
+// WriteReloadScript writes Reloads to dest as a shell script.
+func (s *Systemd) WriteReloadScript(dest string) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString("#!/bin/sh\n# Created by netwrangler\nset -e\n")
+	for _, cmd := range s.reloads {
+		buf.WriteString(cmd + "\n")
+	}
+	return ioutil.WriteFile(dest, buf.Bytes(), 0755)
+}
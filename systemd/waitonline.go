@@ -0,0 +1,269 @@
+package systemd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rackn/netwrangler/util"
+)
+
+// waitOnlineBin is systemd-networkd-wait-online, at the path it can be
+// found at on both merged and split /usr systems.
+const waitOnlineBin = "/lib/systemd/systemd-networkd-wait-online"
+
+// waitOnlineDropIn is the drop-in for systemd-networkd-wait-online
+// that Write manages under the unit dir.
+var waitOnlineDropIn = path.Join("systemd-networkd-wait-online.service.d", "10-netwrangler.conf")
+
+// deviceDropIn is the drop-in for the device unit of a nic that
+// Write manages under the unit dir.
+const deviceDropIn = "10-netwrangler.conf"
+
+// UnitDir makes Write manage drop-ins for
+// systemd-networkd-wait-online and for the device units of interfaces
+// in dir, which is usually /etc/systemd/system.  The drop-ins bound
+// how long boot waits for the interfaces with a wait-online-timeout,
+// make it wait for the nics with a wait-device-timeout to appear, and
+// order interfaces after the ones in their after and requires.  They
+// are removed when no interface needs them.  Without a unit dir,
+// wait-online-timeout, wait-device-timeout, after, and requires are
+// ignored.
+func (s *Systemd) UnitDir(dir string) {
+	s.unitDir = dir
+}
+
+// unitEscape escapes name the way systemd does to use it in a unit
+// name.
+func unitEscape(name string) string {
+	res := &strings.Builder{}
+	for idx, c := range []byte(name) {
+		plain := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			c == '_' || c == ':' || (c == '.' && idx > 0)
+		if plain {
+			res.WriteByte(c)
+		} else {
+			fmt.Fprintf(res, "\\x%02x", c)
+		}
+	}
+	return res.String()
+}
+
+// deviceUnit returns the name of the device unit systemd creates once
+// the interface name appears.
+func deviceUnit(name string) string {
+	return "sys-subsystem-net-devices-" + unitEscape(name) + ".device"
+}
+
+// waitDevices returns the interfaces boot should wait to appear.
+func (s *Systemd) waitDevices() []util.Interface {
+	res := []util.Interface{}
+	for _, k := range s.sortedNames() {
+		i := s.Interfaces[k]
+		if i.WaitDeviceTimeout != 0 && !i.Optional && i.Autoconnects() {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// waitOnline renders the drop-in for systemd-networkd-wait-online,
+// or returns nil if no interface has a wait-online-timeout or
+// wait-device-timeout.  It waits for the device units of the nics
+// with a wait-device-timeout to appear.  Each
+// distinct timeout gets a run of systemd-networkd-wait-online for the
+// interfaces with it, after the interfaces without one are waited
+// for as usual.
+func (s *Systemd) waitOnline() []byte {
+	groups := map[int][]string{}
+	timed := false
+	for _, k := range s.sortedNames() {
+		i := s.Interfaces[k]
+		if i.Optional || !i.Autoconnects() {
+			continue
+		}
+		groups[i.WaitOnlineTimeout] = append(groups[i.WaitOnlineTimeout], k)
+		timed = timed || i.WaitOnlineTimeout != 0
+	}
+	devices := s.waitDevices()
+	if !timed && len(devices) == 0 {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("# Created by netwrangler\n")
+	if len(devices) > 0 {
+		// Wants rather than Requires, so that a nic that never appears
+		// only delays boot by its timeout.
+		buf.WriteString("[Unit]\n")
+		for _, i := range devices {
+			fmt.Fprintf(buf, "Wants=%s\nAfter=%s\n", deviceUnit(i.Name), deviceUnit(i.Name))
+		}
+	}
+	if !timed {
+		return buf.Bytes()
+	}
+	if len(devices) > 0 {
+		buf.WriteString("\n")
+	}
+	timeouts := []int{}
+	for t := range groups {
+		timeouts = append(timeouts, t)
+	}
+	sort.Ints(timeouts)
+	buf.WriteString("[Service]\nExecStart=\n")
+	for _, t := range timeouts {
+		args := []string{waitOnlineBin}
+		if t != 0 {
+			args = append(args, fmt.Sprintf("--timeout=%d", t))
+		}
+		for _, name := range groups[t] {
+			args = append(args, "--interface="+name)
+		}
+		fmt.Fprintf(buf, "ExecStart=%s\n", strings.Join(args, " "))
+	}
+	return buf.Bytes()
+}
+
+// dropIns renders the drop-ins Write manages under the unit dir,
+// keyed by their path relative to it.
+func (s *Systemd) dropIns() map[string][]byte {
+	res := map[string][]byte{}
+	if buf := s.waitOnline(); buf != nil {
+		res[waitOnlineDropIn] = buf
+	}
+	waiting := map[string]bool{}
+	for _, i := range s.waitDevices() {
+		waiting[i.Name] = true
+	}
+	for _, k := range s.sortedNames() {
+		i := s.Interfaces[k]
+		after := i.OrderAfter()
+		if !waiting[k] && len(after) == 0 {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		buf.WriteString("# Created by netwrangler\n[Unit]\n")
+		if waiting[k] {
+			// JobRunningTimeoutSec bounds how long anything waits for
+			// the device to appear, like x-systemd.device-timeout in
+			// fstab.
+			fmt.Fprintf(buf, "JobRunningTimeoutSec=%d\n", i.WaitDeviceTimeout)
+		}
+		for _, dep := range after {
+			fmt.Fprintf(buf, "After=%s\n", deviceUnit(dep))
+		}
+		for _, dep := range i.Requires {
+			fmt.Fprintf(buf, "Requires=%s\n", deviceUnit(dep))
+		}
+		res[path.Join(deviceUnit(i.Name)+".d", deviceDropIn)] = buf.Bytes()
+	}
+	return res
+}
+
+// installWaitOnline stages the drop-ins under units, then swaps them
+// into the unit dir one drop-in dir at a time with util.Replace,
+// removing the ones it wrote before that are no longer needed.  The
+// drop-ins it replaces are kept under units, and the returned func
+// puts them back, for when the network config the new drop-ins go
+// with cannot be written.  If any drop-in cannot be swapped in, the
+// ones already swapped in are put back before it returns.
+func (s *Systemd) installWaitOnline(units string, e *util.Err) (undo func()) {
+	undo = func() {}
+	files := s.dropIns()
+	if s.unitDir == "" {
+		if len(files) > 0 {
+			e.Warnf("wait-online-timeout, wait-device-timeout, after, and requires need a unit dir to write systemd drop-ins to, ignoring them")
+		}
+		return
+	}
+	old, err := filepath.Glob(path.Join(s.unitDir, "sys-subsystem-net-devices-*.device.d", deviceDropIn))
+	if err != nil {
+		e.Merge(err)
+		return
+	}
+	old = append(old, path.Join(s.unitDir, waitOnlineDropIn))
+	live := map[string]bool{}
+	rels := []string{}
+	for _, target := range old {
+		if _, err := os.Lstat(target); err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(s.unitDir, target)
+		live[rel] = true
+		if _, ok := files[rel]; !ok {
+			rels = append(rels, rel)
+		}
+	}
+	for rel := range files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	// Nothing live is touched until every drop-in is staged and every
+	// one it replaces is kept.
+	for _, rel := range rels {
+		if buf, ok := files[rel]; ok {
+			stageFile(path.Join(units, "new", rel), buf, e)
+		}
+		if live[rel] {
+			buf, err := ioutil.ReadFile(path.Join(s.unitDir, rel))
+			if err != nil {
+				e.Merge(err)
+				continue
+			}
+			stageFile(path.Join(units, "old", rel), buf, e)
+		}
+	}
+	if !e.Empty() {
+		return
+	}
+	// swap swaps the drop-ins staged under from into the unit dir,
+	// removing the ones gone reports as not belonging there, and
+	// returns the ones it swapped.
+	swap := func(from string, rels []string, gone func(string) bool) []string {
+		done := []string{}
+		for _, rel := range rels {
+			target := path.Join(s.unitDir, path.Dir(rel))
+			stale := []string{}
+			if gone(rel) {
+				if _, err := os.Lstat(path.Join(s.unitDir, rel)); err == nil {
+					stale = append(stale, path.Join(s.unitDir, rel))
+				}
+			}
+			re := &util.Err{Prefix: path.Dir(rel)}
+			util.Replace(path.Join(units, from, path.Dir(rel)), target, stale, re)
+			if !re.Empty() {
+				e.Merge(re)
+				return done
+			}
+			done = append(done, rel)
+			// Only remove the drop-in dir if nothing else is in it.
+			if strings.HasPrefix(rel, "sys-subsystem-net-devices-") {
+				os.Remove(target)
+			}
+		}
+		return done
+	}
+	isNew := func(rel string) bool { return !live[rel] }
+	done := swap("new", rels, func(rel string) bool { _, ok := files[rel]; return !ok })
+	if !e.Empty() {
+		swap("old", done, isNew)
+		return
+	}
+	return func() { swap("old", rels, isNew) }
+}
+
+// stageFile writes buf to target, making the dirs it is in.
+func stageFile(target string, buf []byte, e *util.Err) {
+	if err := os.MkdirAll(path.Dir(target), util.DirMode()); err != nil {
+		e.Merge(err)
+		return
+	}
+	if err := ioutil.WriteFile(target, buf, 0644); err != nil {
+		e.Merge(err)
+	}
+}
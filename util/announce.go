@@ -0,0 +1,56 @@
+package util
+
+import (
+	"fmt"
+)
+
+// MaxGratuitousArpCount is the most gratuitous ARPs that can be sent
+// for each static address.
+const MaxGratuitousArpCount = 255
+
+// ArpingCmds returns the arping commands that announce the static
+// IPv4 addresses of n on dev with gratuitous ARPs.  Sending them
+// after bringing an interface up makes neighbors forget stale entries
+// for an address that just moved to this host.
+func (n *Network) ArpingCmds(dev string) []string {
+	res := []string{}
+	if n == nil || n.GratuitousArpCount == 0 {
+		return res
+	}
+	for _, addr := range n.Addresses {
+		if addr.IP.To4() == nil {
+			continue
+		}
+		res = append(res, fmt.Sprintf("arping -q -U -c %d -I %s %s", n.GratuitousArpCount, dev, addr.IP))
+	}
+	return res
+}
+
+// NdiscNotifyCmd returns the sysctl command that makes the kernel send
+// unsolicited neighbor advertisements for the IPv6 addresses on dev
+// whenever it comes up or fails over to another link, or an empty
+// string if n does not ask for them.  The key uses / as the separator
+// so that vlan names with a . in them work.
+func (n *Network) NdiscNotifyCmd(dev string, on bool) string {
+	if n == nil || !n.UnsolicitedNa {
+		return ""
+	}
+	val := 0
+	if on {
+		val = 1
+	}
+	return fmt.Sprintf("sysctl -q -w net/ipv6/conf/%s/ndisc_notify=%d", dev, val)
+}
+
+func (n *Network) validateAnnounce(e *Err) {
+	if n.GratuitousArpCount == 0 {
+		return
+	}
+	ValidateInt(e, "gratuitous-arp-count", n.GratuitousArpCount, 1, MaxGratuitousArpCount)
+	for _, addr := range n.Addresses {
+		if addr.IP.To4() != nil {
+			return
+		}
+	}
+	e.Errorf("gratuitous-arp-count requires a static IPv4 address")
+}
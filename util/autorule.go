@@ -0,0 +1,58 @@
+package util
+
+// reservedTables maps the routing tables the kernel sets up itself
+// to their names.  Routes with auto-rule must go in some other table,
+// as the kernel already has rules that look these up.
+var reservedTables = map[int]string{
+	253: "default",
+	254: "main",
+	255: "local",
+}
+
+// Rule returns the routing policy rule that sends traffic to the
+// table r is in.  It matches on the source address of r if it has
+// one, and on its destination otherwise.
+func (r Route) Rule() RoutePolicy {
+	if r.From != nil {
+		return RoutePolicy{From: r.From, Table: r.Table}
+	}
+	return RoutePolicy{To: r.To, Table: r.Table}
+}
+
+// addAutoRules adds the rules for the routes of n that ask for one
+// with auto-rule, unless n already has an identical rule.
+func (n *Network) addAutoRules(e *Err) {
+	for _, r := range n.Routes {
+		if !r.AutoRule {
+			continue
+		}
+		if name, ok := reservedTables[r.Table]; ok || r.Table == 0 {
+			if !ok {
+				name = "main"
+			}
+			e.Errorf("auto-rule: route to %s must be in a table other than %s", r.To, name)
+			continue
+		}
+		if r.From == nil && r.To != nil {
+			if ones, _ := r.To.Mask.Size(); ones == 0 {
+				e.Errorf("auto-rule: route to %s needs a from, or its rule would send all traffic to table %d", r.To, r.Table)
+				continue
+			}
+		}
+		rule := r.Rule()
+		if err := rule.validate(); err != nil {
+			e.Errorf("auto-rule: route to %s: %v", r.To, err)
+			continue
+		}
+		found := false
+		for _, rp := range n.RoutingPolicy {
+			if rp.IPString() == rule.IPString() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			n.RoutingPolicy = append(n.RoutingPolicy, rule)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package util
+
+// DefaultBondMode is the mode of a bond that does not set one.
+const DefaultBondMode = "balance-rr"
+
+// bondModeParams are the bond parameters the kernel only uses in one
+// mode, along with that mode.  Setting them on a bond in any other
+// mode is silently ignored by the kernel, which hides mistakes like
+// expecting min-links to take an active-backup bond down.
+var bondModeParams = []struct{ k, mode string }{
+	{"min-links", "802.3ad"},
+	{"lacp-rate", "802.3ad"},
+	{"ad-select", "802.3ad"},
+	{"ad-actor-system", "802.3ad"},
+	{"ad-actor-sys-prio", "802.3ad"},
+	{"packets-per-slave", "balance-rr"},
+	{"tlb-dynamic-lb", "balance-tlb"},
+}
+
+// BondMode returns the mode of the bond i.
+func (i Interface) BondMode() string {
+	if mode, ok := i.Parameters["mode"].(string); ok && mode != "" {
+		return mode
+	}
+	return DefaultBondMode
+}
+
+// validateBondMode checks that the parameters of a bond that only
+// apply to one mode are only set when the bond is in that mode.
+func (i *Interface) validateBondMode(e *Err) {
+	mode := i.BondMode()
+	for _, p := range bondModeParams {
+		if _, ok := i.Parameters[p.k]; ok && mode != p.mode {
+			e.Errorf("%s is only supported in %s mode, not %s", p.k, p.mode, mode)
+		}
+	}
+}
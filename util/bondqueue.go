@@ -0,0 +1,109 @@
+package util
+
+import (
+	"math"
+	"sort"
+)
+
+// MaxBondQueueID is the highest queue ID a bond member can have.  The
+// kernel further limits it to one less than the number of transmit
+// queues the bond has, which is 16 unless the bonding module is told
+// otherwise.
+const MaxBondQueueID = math.MaxUint16
+
+// ValidateQueueIDs validates that v maps bond members to the transmit
+// queue of the bond whose traffic they send.  A queue ID of 0 is the
+// kernel default of not being picked by queue.
+func ValidateQueueIDs(e *Err, k string, v interface{}) (res map[string]int64, valid bool) {
+	ports := map[string]interface{}{}
+	if err := Remarshal(v, &ports); err != nil {
+		e.Errorf("%s: %v does not map bond members to queue IDs", k, v)
+		return
+	}
+	res, valid = map[string]int64{}, true
+	for port, id := range ports {
+		qid, ok := ValidateInt(e, k+":"+port, id, 0, MaxBondQueueID)
+		if !ok {
+			valid = false
+			continue
+		}
+		res[port] = qid
+	}
+	return
+}
+
+// VQueueIDs validates that v maps bond members to queue IDs.
+func VQueueIDs() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{
+				"type":                 "object",
+				"additionalProperties": Schema{"type": "integer", "minimum": 0, "maximum": MaxBondQueueID},
+			}, true
+		}
+		return ValidateQueueIDs(e, k, v)
+	}
+}
+
+// QueueID returns the queue ID of the member port of the bond i, or 0
+// if it does not have one.
+func (i Interface) QueueID(port string) int64 {
+	res := map[string]int64{}
+	if v, ok := i.Parameters["queue-ids"]; ok {
+		Remarshal(v, &res)
+	}
+	return res[port]
+}
+
+// SetQueueID sets the queue ID of the member port of the bond i.
+func (i Interface) SetQueueID(port string, id int64) {
+	if id == 0 {
+		return
+	}
+	res := map[string]int64{}
+	if v, ok := i.Parameters["queue-ids"]; ok {
+		Remarshal(v, &res)
+	}
+	res[port] = id
+	i.Parameters["queue-ids"] = res
+}
+
+// validateQueueIDs checks the queue-ids of a bond.  They must be for
+// members of the bond, and no two members can send the traffic of the
+// same queue.
+func (i *Interface) validateQueueIDs(e *Err) {
+	v, ok := i.Parameters["queue-ids"]
+	if !ok {
+		return
+	}
+	if i.Type != "bond" {
+		e.Errorf("queue-ids are only supported on bonds")
+		return
+	}
+	ids, _ := ValidateQueueIDs(e, "queue-ids", v)
+	ports := []string{}
+	for port := range ids {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	users := map[int64]string{}
+	for _, port := range ports {
+		isMember := false
+		for _, name := range i.Interfaces {
+			isMember = isMember || name == port
+		}
+		if !isMember {
+			e.Errorf("%s has a queue-id, but is not a member of %s", port, i.Name)
+			continue
+		}
+		id := ids[port]
+		if id == 0 {
+			continue
+		}
+		if other, ok := users[id]; ok {
+			e.Errorf("queue-id %d is used by both %s and %s", id, other, port)
+			continue
+		}
+		users[id] = port
+	}
+}
@@ -0,0 +1,245 @@
+package util
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxVlanID is the highest VLAN ID a bridge port can be a member of.
+const MaxVlanID = 4094
+
+// BridgeVlanParams are the bridge parameters that configure VLAN
+// filtering.  vlan-default-pvid is the PVID ports get when they do
+// not have one in port-pvid, and a PVID of 0 means untagged frames
+// are dropped, which makes the port a pure trunk.
+var BridgeVlanParams = []string{
+	"vlan-filtering",
+	"vlan-default-pvid",
+	"port-vlans",
+	"port-pvid",
+}
+
+// parseVlanRange parses a VLAN ID or a from-to range of them.
+func parseVlanRange(s string) (from, to uint64, ok bool) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	from, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return
+	}
+	to = from
+	if len(parts) == 2 {
+		if to, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16); err != nil {
+			return
+		}
+	}
+	ok = from >= 1 && from <= to && to <= MaxVlanID
+	return
+}
+
+// ValidatePortVlans validates that v maps bridge ports to the VLANs
+// they carry tagged, which are VLAN IDs or from-to ranges of them.
+// The ranges are returned in canonical form.
+func ValidatePortVlans(e *Err, k string, v interface{}) (res map[string][]string, valid bool) {
+	ports := map[string][]string{}
+	if err := Remarshal(v, &ports); err != nil {
+		e.Errorf("%s: %v does not map ports to lists of VLANs", k, v)
+		return
+	}
+	res, valid = map[string][]string{}, true
+	for port, vlans := range ports {
+		for _, vlan := range vlans {
+			from, to, ok := parseVlanRange(vlan)
+			if !ok {
+				e.Errorf("%s: %s: %q is not a VLAN ID or range between 1 and %d", k, port, vlan, MaxVlanID)
+				valid = false
+				continue
+			}
+			canon := strconv.FormatUint(from, 10)
+			if to != from {
+				canon += "-" + strconv.FormatUint(to, 10)
+			}
+			res[port] = append(res[port], canon)
+		}
+	}
+	return
+}
+
+// VPortVlans validates that v maps bridge ports to lists of VLANs.
+func VPortVlans() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{
+				"type":                 "object",
+				"additionalProperties": Schema{"type": "array", "items": Schema{"type": "string"}},
+			}, true
+		}
+		return ValidatePortVlans(e, k, v)
+	}
+}
+
+// ValidatePortPvids validates that v maps bridge ports to their PVID.
+// A PVID of 0 is kept, as it is different from not setting one.
+func ValidatePortPvids(e *Err, k string, v interface{}) (res map[string]int64, valid bool) {
+	ports := map[string]interface{}{}
+	if err := Remarshal(v, &ports); err != nil {
+		e.Errorf("%s: %v does not map ports to PVIDs", k, v)
+		return
+	}
+	res, valid = map[string]int64{}, true
+	for port, pvid := range ports {
+		id, ok := ValidateInt(e, k+":"+port, pvid, 0, MaxVlanID)
+		if !ok {
+			valid = false
+			continue
+		}
+		res[port] = id
+	}
+	return
+}
+
+// VPortPvids validates that v maps bridge ports to their PVID.
+func VPortPvids() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{
+				"type":                 "object",
+				"additionalProperties": Schema{"type": "integer", "minimum": 0, "maximum": MaxVlanID},
+			}, true
+		}
+		return ValidatePortPvids(e, k, v)
+	}
+}
+
+// VlanFiltering returns whether the bridge i filters by VLAN.
+func (i Interface) VlanFiltering() bool {
+	on, _ := ValidateBool(&Err{}, "vlan-filtering", i.Parameters["vlan-filtering"])
+	return on
+}
+
+// DefaultPvid returns the PVID ports of the bridge i get when they do
+// not have their own, which is 1 unless vlan-default-pvid says
+// otherwise.
+func (i Interface) DefaultPvid() int64 {
+	v, ok := i.Parameters["vlan-default-pvid"]
+	if !ok {
+		return 1
+	}
+	res, _ := ValidateInt(&Err{}, "vlan-default-pvid", v, 0, MaxVlanID)
+	return res
+}
+
+// PortVlans returns the VLANs the port of the bridge i carries tagged.
+func (i Interface) PortVlans(port string) []string {
+	res := map[string][]string{}
+	if v, ok := i.Parameters["port-vlans"]; ok {
+		Remarshal(v, &res)
+	}
+	return res[port]
+}
+
+// PortPvid returns the PVID of the port of the bridge i, and whether
+// it is set for the port rather than coming from DefaultPvid.
+func (i Interface) PortPvid(port string) (int64, bool) {
+	res := map[string]int64{}
+	if v, ok := i.Parameters["port-pvid"]; ok {
+		Remarshal(v, &res)
+	}
+	if pvid, ok := res[port]; ok {
+		return pvid, true
+	}
+	return i.DefaultPvid(), false
+}
+
+// SetPortVlans sets the VLAN config of the port of the bridge i, as
+// read from a config that lists all of the VLANs of the port.  A pvid
+// that is the DefaultPvid is not kept, so only trunk ports and ports
+// with a different PVID get one of their own.
+func (i Interface) SetPortVlans(port string, vlans []string, pvid int64) {
+	if len(vlans) > 0 {
+		res := map[string][]string{}
+		if v, ok := i.Parameters["port-vlans"]; ok {
+			Remarshal(v, &res)
+		}
+		res[port] = vlans
+		i.Parameters["port-vlans"] = res
+	}
+	if pvid != i.DefaultPvid() {
+		res := map[string]int64{}
+		if v, ok := i.Parameters["port-pvid"]; ok {
+			Remarshal(v, &res)
+		}
+		res[port] = pvid
+		i.Parameters["port-pvid"] = res
+	}
+}
+
+// HasPortVlans returns whether the port of the bridge i has VLAN
+// config of its own.
+func (i Interface) HasPortVlans(port string) bool {
+	_, set := i.PortPvid(port)
+	return set || len(i.PortVlans(port)) > 0
+}
+
+// validateBridgeVlans checks the VLAN filtering config of a bridge.
+// Ports need vlan-filtering to be on, must be ports of the bridge,
+// and a trunk port with a PVID of 0 must carry some tagged VLANs, as
+// it would carry no traffic at all otherwise.
+func (i *Interface) validateBridgeVlans(e *Err) {
+	set := []string{}
+	for _, k := range BridgeVlanParams {
+		if _, ok := i.Parameters[k]; ok {
+			set = append(set, k)
+		}
+	}
+	if len(set) == 0 {
+		return
+	}
+	if i.Type != "bridge" {
+		e.Errorf("%v are only supported on bridges", set)
+		return
+	}
+	if v, ok := i.Parameters["vlan-default-pvid"]; ok {
+		ValidateInt(e, "vlan-default-pvid", v, 0, MaxVlanID)
+	}
+	vlans, pvids := map[string][]string{}, map[string]int64{}
+	if v, ok := i.Parameters["port-vlans"]; ok {
+		vlans, _ = ValidatePortVlans(e, "port-vlans", v)
+	}
+	if v, ok := i.Parameters["port-pvid"]; ok {
+		pvids, _ = ValidatePortPvids(e, "port-pvid", v)
+	}
+	if !i.VlanFiltering() {
+		for _, k := range set {
+			if k != "vlan-filtering" {
+				e.Errorf("%s needs vlan-filtering to be on", k)
+			}
+		}
+		return
+	}
+	ports := map[string]struct{}{}
+	for port := range vlans {
+		ports[port] = struct{}{}
+	}
+	for port := range pvids {
+		ports[port] = struct{}{}
+	}
+	names := []string{}
+	for port := range ports {
+		names = append(names, port)
+	}
+	sort.Strings(names)
+	for _, port := range names {
+		isPort := false
+		for _, name := range i.Interfaces {
+			isPort = isPort || name == port
+		}
+		if !isPort {
+			e.Errorf("%s has VLAN config, but is not a port of %s", port, i.Name)
+			continue
+		}
+		if pvid, ok := pvids[port]; ok && pvid == 0 && len(vlans[port]) == 0 {
+			e.Errorf("%s has a port-pvid of 0, which makes it a trunk, but it has no port-vlans to carry", port)
+		}
+	}
+}
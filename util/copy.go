@@ -1,45 +1,254 @@
 package util
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"os/user"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 )
 
-// Copy all of the files in one directory to another
-func Copy(src, target string, e *Err) {
+// ownerUID and ownerGID are the ids Copy gives the files it writes.
+// -1 leaves that id as the file was created with.
+var ownerUID, ownerGID = -1, -1
+
+// SetOwner arranges for Copy to give the files it writes to uid and
+// gid.  Passing -1 for either leaves that id as the file was created
+// with, which is the default.
+func SetOwner(uid, gid int) {
+	ownerUID, ownerGID = uid, gid
+}
+
+// dirMode is the mode Copy creates the directory it writes to with.
+var dirMode os.FileMode = 0755
+
+// SetDirMode arranges for Copy to create the directory it writes to,
+// and any missing parents, with mode.  Directories that already exist
+// are left alone.  The default is 0755.
+func SetDirMode(mode os.FileMode) {
+	dirMode = mode
+}
+
+// DirMode returns the mode output directories should be created with.
+func DirMode() os.FileMode {
+	return dirMode
+}
+
+// lookupID translates a user or group name into its numeric id.
+// Numeric ids are passed through as is.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// ParseOwner parses an owner in user[:group] form, where user and
+// group can be either names or numeric ids.  If there is no group, it
+// is left as -1.
+func ParseOwner(spec string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	parts := strings.SplitN(spec, ":", 2)
+	if parts[0] != "" {
+		uid, err = lookupID(parts[0], func(n string) (string, error) {
+			u, err := user.Lookup(n)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return -1, -1, fmt.Errorf("Invalid owner %s: %v", spec, err)
+		}
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		gid, err = lookupID(parts[1], func(n string) (string, error) {
+			g, err := user.LookupGroup(n)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return -1, -1, fmt.Errorf("Invalid owner %s: %v", spec, err)
+		}
+	}
+	return uid, gid, nil
+}
+
+// canChown returns whether Copy should change the ownership of the
+// files it writes to target.  Ownership can only be changed on Linux
+// when running as root, and it is left alone with a warning
+// otherwise.
+func canChown(target string, e *Err) bool {
+	if ownerUID == -1 && ownerGID == -1 {
+		return false
+	}
+	if runtime.GOOS != "linux" {
+		e.Warnf("file ownership can only be set on Linux, leaving files in %s as created", target)
+		return false
+	}
+	if os.Geteuid() != 0 {
+		e.Warnf("not running as root, leaving the ownership of files in %s as created", target)
+		return false
+	}
+	return true
+}
+
+// copyFile copies name to destName, giving it the mode of name and,
+// if chown is set, the owner from SetOwner.  It returns whether it
+// succeeded.
+func copyFile(name, destName string, chown bool, e *Err) bool {
+	src, err := os.Open(name)
+	if err != nil {
+		e.Errorf("Error opening src temp %s: %v", name, err)
+		return false
+	}
+	defer src.Close()
+	dest, err := os.Create(destName)
+	if err != nil {
+		e.Errorf("Error opening dest %s: %v", destName, err)
+		return false
+	}
+	defer dest.Close()
+	if _, err := io.Copy(dest, src); err != nil {
+		e.Errorf("Error copying %s to %s: %v", name, destName, err)
+		return false
+	}
+	if st, err := src.Stat(); err == nil {
+		dest.Chmod(st.Mode().Perm())
+	}
+	if chown {
+		if err := dest.Chown(ownerUID, ownerGID); err != nil {
+			e.Errorf("Error setting the owner of %s: %v", destName, err)
+			return false
+		}
+	}
+	if err := dest.Close(); err != nil {
+		e.Errorf("Error writing %s: %v", destName, err)
+		return false
+	}
+	return true
+}
+
+// staged returns the files in src that Copy and Replace write, which
+// are the regular files that are not empty.
+func staged(src string, e *Err) []string {
 	names, err := filepath.Glob(path.Join(src, "*"))
 	if err != nil {
 		e.Merge(err)
+		return nil
+	}
+	res := []string{}
+	for _, name := range names {
+		if st, err := os.Stat(name); err != nil || st.Size() == 0 || st.IsDir() {
+			continue
+		}
+		res = append(res, name)
+	}
+	return res
+}
+
+// Copy all of the files in one directory to another
+func Copy(src, target string, e *Err) {
+	names := staged(src, e)
+	if !e.Empty() {
 		return
 	}
-	if err := os.MkdirAll(target, 0755); err != nil {
+	chown := canChown(target, e)
+	if err := os.MkdirAll(target, dirMode); err != nil {
 		e.Merge(err)
 		return
 	}
 	for _, name := range names {
-		if st, err := os.Stat(name); err != nil || st.Size() == 0 || st.IsDir() {
+		copyFile(name, path.Join(target, path.Base(name)), chown, e)
+	}
+}
+
+// Replace replaces the files in target with the ones in src, removing
+// the files in stale as well, as one step that is undone if any part
+// of it fails.  The new files are first copied next to the old ones
+// under hidden temporary names, which nothing that reads network
+// config will pick up.  Only once all of them are there are the old
+// files moved aside and the new ones renamed into place.  If that
+// fails, the old files are put back.
+func Replace(src, target string, stale []string, e *Err) {
+	names := staged(src, e)
+	if !e.Empty() {
+		return
+	}
+	chown := canChown(target, e)
+	if err := os.MkdirAll(target, dirMode); err != nil {
+		e.Merge(err)
+		return
+	}
+	tmpName := func(base, kind string) string {
+		return path.Join(target, "."+base+"."+kind+"~")
+	}
+	news := []string{}
+	defer func() {
+		for _, base := range news {
+			os.Remove(tmpName(base, "new"))
+		}
+	}()
+	for _, name := range names {
+		base := path.Base(name)
+		news = append(news, base)
+		if !copyFile(name, tmpName(base, "new"), chown, e) {
+			return
+		}
+	}
+	// Everything that is replaced or removed is moved aside first so
+	// it can be put back.
+	olds, seen := []string{}, map[string]struct{}{}
+	for _, name := range stale {
+		seen[path.Base(name)] = struct{}{}
+		olds = append(olds, path.Base(name))
+	}
+	for _, base := range news {
+		if _, ok := seen[base]; ok {
 			continue
 		}
-		src, srcErr := os.Open(name)
-		destName := path.Join(target, path.Base(name))
-		dest, destErr := os.Create(destName)
-		if srcErr == nil {
-			defer src.Close()
-		} else {
-			e.Errorf("Error opening src temp %s: %v", name, srcErr)
+		if _, err := os.Lstat(path.Join(target, base)); err == nil {
+			olds = append(olds, base)
 		}
-		if destErr == nil {
-			defer dest.Close()
-		} else {
-			e.Errorf("Error opening dest %s: %v", destName, destErr)
+	}
+	moved, placed := []string{}, []string{}
+	revert := func() {
+		for _, base := range placed {
+			os.Remove(path.Join(target, base))
 		}
-		if destErr != nil || srcErr != nil {
-			continue
+		for _, base := range moved {
+			if err := os.Rename(tmpName(base, "old"), path.Join(target, base)); err != nil {
+				e.Errorf("Error restoring %s: %v", path.Join(target, base), err)
+			}
 		}
-		if _, err := io.Copy(dest, src); err != nil {
-			e.Errorf("Error copying %s to %s: %v", name, destName, err)
+	}
+	for _, base := range olds {
+		if err := os.Rename(path.Join(target, base), tmpName(base, "old")); err != nil {
+			e.Errorf("Error moving %s aside: %v", path.Join(target, base), err)
+			revert()
+			return
+		}
+		moved = append(moved, base)
+	}
+	for _, base := range news {
+		if err := os.Rename(tmpName(base, "new"), path.Join(target, base)); err != nil {
+			e.Errorf("Error renaming %s into place: %v", path.Join(target, base), err)
+			revert()
+			return
 		}
+		placed = append(placed, base)
+	}
+	for _, base := range moved {
+		os.RemoveAll(tmpName(base, "old"))
 	}
 }
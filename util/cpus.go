@@ -0,0 +1,203 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxCPUs is the most CPUs a CPU set can refer to, which is the most
+// the kernel can be built for.
+const MaxCPUs = 8192
+
+// parseCPUMask parses a hex CPU mask, which the kernel writes as comma
+// separated groups of up to 8 hex digits with the lowest CPUs last.
+func parseCPUMask(s string) ([]int, error) {
+	digits := strings.Replace(strings.TrimPrefix(strings.ToLower(s), "0x"), ",", "", -1)
+	if digits == "" {
+		return nil, fmt.Errorf("%q is not a hex CPU mask", s)
+	}
+	res := []int{}
+	for idx := 0; idx < len(digits); idx++ {
+		nibble, err := strconv.ParseUint(digits[len(digits)-1-idx:len(digits)-idx], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a hex CPU mask", s)
+		}
+		for bit := 0; bit < 4; bit++ {
+			if nibble&(1<<uint(bit)) != 0 {
+				res = append(res, idx*4+bit)
+			}
+		}
+	}
+	return res, nil
+}
+
+// parseCPUList parses a list of CPUs and from-to ranges of them.
+func parseCPUList(s string) ([]int, error) {
+	res := []int{}
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		from, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CPU or range of CPUs", part)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16); err != nil || to < from {
+				return nil, fmt.Errorf("%q is not a CPU or range of CPUs", part)
+			}
+		}
+		if to >= MaxCPUs {
+			return nil, fmt.Errorf("%q refers to CPUs past the last possible one, %d", part, MaxCPUs-1)
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			res = append(res, int(cpu))
+		}
+	}
+	return res, nil
+}
+
+// ParseCPUs parses a set of CPUs.  s is either a hex mask that starts
+// with 0x, or a comma separated list of CPUs and from-to ranges of
+// them, so that a bare number is always a CPU.  The CPUs are returned
+// sorted and without duplicates.
+func ParseCPUs(s string) ([]int, error) {
+	s = strings.TrimSpace(s)
+	var cpus []int
+	var err error
+	if strings.HasPrefix(strings.ToLower(s), "0x") {
+		cpus, err = parseCPUMask(s)
+	} else {
+		cpus, err = parseCPUList(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(cpus)
+	res := []int{}
+	for idx, cpu := range cpus {
+		if cpu >= MaxCPUs {
+			return nil, fmt.Errorf("%s refers to CPUs past the last possible one, %d", s, MaxCPUs-1)
+		}
+		if idx == 0 || cpu != cpus[idx-1] {
+			res = append(res, cpu)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%s does not refer to any CPUs", s)
+	}
+	return res, nil
+}
+
+// CPUList renders sorted CPUs as a comma separated list, with runs of
+// CPUs as from-to ranges.
+func CPUList(cpus []int) string {
+	res := []string{}
+	for idx := 0; idx < len(cpus); {
+		end := idx
+		for end+1 < len(cpus) && cpus[end+1] == cpus[end]+1 {
+			end++
+		}
+		if end == idx {
+			res = append(res, strconv.Itoa(cpus[idx]))
+		} else {
+			res = append(res, fmt.Sprintf("%d-%d", cpus[idx], cpus[end]))
+		}
+		idx = end + 1
+	}
+	return strings.Join(res, ",")
+}
+
+// CPUMask renders CPUs as the hex mask the kernel expects in the
+// rps_cpus and xps_cpus files of a queue.
+func CPUMask(cpus []int) string {
+	words := []uint32{0}
+	for _, cpu := range cpus {
+		for cpu/32 >= len(words) {
+			words = append(words, 0)
+		}
+		words[cpu/32] |= 1 << uint(cpu%32)
+	}
+	res := []string{fmt.Sprintf("%x", words[len(words)-1])}
+	for idx := len(words) - 2; idx >= 0; idx-- {
+		res = append(res, fmt.Sprintf("%08x", words[idx]))
+	}
+	return strings.Join(res, ",")
+}
+
+// ValidateCPUs validates that v is a set of CPUs that ParseCPUs
+// understands, and returns it as a CPUList.
+func ValidateCPUs(e *Err, k string, v interface{}) (res string, valid bool) {
+	var s string
+	switch val := v.(type) {
+	case string:
+		s = val
+	case int, int64, float64:
+		s = fmt.Sprintf("%v", val)
+	default:
+		e.Errorf("%s: %v is not a set of CPUs", k, v)
+		return
+	}
+	cpus, err := ParseCPUs(s)
+	if err != nil {
+		e.Errorf("%s: %v", k, err)
+		return
+	}
+	return CPUList(cpus), true
+}
+
+// VCPUs returns a Validator that validates a set of CPUs.
+func VCPUs() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"anyOf": []Schema{
+				{"type": "integer", "minimum": 0, "maximum": MaxCPUs - 1},
+				{"type": "string", "format": "cpus"},
+			}}, true
+		}
+		return ValidateCPUs(e, k, v)
+	}
+}
+
+// QueueCmds returns the shell commands that steer the packets the
+// queues of i receive and send to the CPUs in RpsCpus and XpsCpus.
+// The kernel only has per-queue settings for them, so each queue
+// gets the same mask.
+func (i Interface) QueueCmds() []string {
+	res := []string{}
+	for _, q := range []struct{ cpus, queues, file string }{
+		{i.RpsCpus, "rx", "rps_cpus"},
+		{i.XpsCpus, "tx", "xps_cpus"},
+	} {
+		if q.cpus == "" {
+			continue
+		}
+		cpus, err := ParseCPUs(q.cpus)
+		if err != nil {
+			continue
+		}
+		res = append(res, fmt.Sprintf("for q in /sys/class/net/%s/queues/%s-*/%s; do echo %s > $q; done",
+			i.Name, q.queues, q.file, CPUMask(cpus)))
+	}
+	return res
+}
+
+// validateQueueCPUs checks the RpsCpus and XpsCpus of i.
+func (i *Interface) validateQueueCPUs(e *Err) {
+	for _, q := range []struct {
+		k    string
+		cpus *string
+	}{{"rps-cpus", &i.RpsCpus}, {"xps-cpus", &i.XpsCpus}} {
+		if *q.cpus == "" {
+			continue
+		}
+		if i.Type != "physical" {
+			e.Errorf("%s is only supported on physical interfaces", q.k)
+			continue
+		}
+		if res, ok := ValidateCPUs(e, q.k, *q.cpus); ok {
+			*q.cpus = res
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package util
+
+import "fmt"
+
+// MaxDadTransmits is the most duplicate address detection probes that
+// can be sent for each IPv6 address.  Each probe holds the address
+// back from being used for a second, so more than a few only slows
+// bringing the interface up.
+const MaxDadTransmits = 10
+
+// DadTransmitsSysctl returns the sysctl setting that makes the kernel
+// send n.IPv6DadTransmits duplicate address detection probes for the
+// IPv6 addresses on dev, or an empty string if n does not change how
+// many are sent.  The key uses / as the separator so that vlan names
+// with a . in them work.
+func (n *Network) DadTransmitsSysctl(dev string) string {
+	if n == nil || n.IPv6DadTransmits == nil {
+		return ""
+	}
+	return fmt.Sprintf("net/ipv6/conf/%s/dad_transmits=%d", dev, *n.IPv6DadTransmits)
+}
+
+func (n *Network) validateDad(e *Err) {
+	if n.IPv6DadTransmits == nil {
+		return
+	}
+	if _, ok := ValidateInt(e, "ipv6-dad-transmits", *n.IPv6DadTransmits, 0, MaxDadTransmits); ok && *n.IPv6DadTransmits == 0 {
+		e.Warnf("ipv6-dad-transmits 0 turns off duplicate address detection, so an IPv6 address another host already uses will not be noticed")
+	}
+}
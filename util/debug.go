@@ -0,0 +1,229 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// String renders the Network as a single line of its settings for
+// debugging purposes.
+func (n *Network) String() string {
+	if n == nil {
+		return ""
+	}
+	res := []string{}
+	if n.Dhcp4 {
+		res = append(res, "dhcp4")
+	}
+	if n.Dhcp6 {
+		res = append(res, "dhcp6")
+	}
+	if n.Duid != nil {
+		res = append(res, "duid="+n.Duid.Type)
+	}
+	if n.Iaid != nil {
+		res = append(res, fmt.Sprintf("iaid=%d", *n.Iaid))
+	}
+	if len(n.Addresses) > 0 {
+		addrs := []string{}
+		for _, addr := range n.Addresses {
+			addrs = append(addrs, addr.String())
+		}
+		res = append(res, "addresses="+strings.Join(addrs, ","))
+	}
+	if n.Gateway4 != nil {
+		res = append(res, "gateway4="+n.Gateway4.String())
+	}
+	if n.Gateway6 != nil {
+		res = append(res, "gateway6="+n.Gateway6.String())
+	}
+	if len(n.Routes) > 0 {
+		res = append(res, fmt.Sprintf("routes=%d", len(n.Routes)))
+	}
+	if len(n.RoutingPolicy) > 0 {
+		res = append(res, fmt.Sprintf("routing-policy=%d", len(n.RoutingPolicy)))
+	}
+	if n.DNSDefaultRoute != nil {
+		res = append(res, fmt.Sprintf("dns-default-route=%t", *n.DNSDefaultRoute))
+	}
+	if n.IPv6MTU != 0 {
+		res = append(res, fmt.Sprintf("ipv6-mtu=%d", n.IPv6MTU))
+	}
+	if n.IPv6Token != "" {
+		res = append(res, "ipv6-address-token="+n.IPv6Token)
+	}
+	if n.IPv6DadTransmits != nil {
+		res = append(res, fmt.Sprintf("ipv6-dad-transmits=%d", *n.IPv6DadTransmits))
+	}
+	if n.Critical {
+		res = append(res, "critical")
+	}
+	if n.KeepConfiguration != "" {
+		res = append(res, "keep-configuration="+n.KeepConfiguration)
+	}
+	if n.IPForward != "" {
+		res = append(res, "ip-forward="+n.IPForward)
+	}
+	if n.IPMasquerade != "" {
+		res = append(res, "ip-masquerade="+n.IPMasquerade)
+	}
+	if n.IgnoreCarrier {
+		res = append(res, "ignore-carrier")
+	} else if n.ConfigureWithoutCarrier {
+		res = append(res, "configure-without-carrier")
+	}
+	return strings.Join(res, " ")
+}
+
+// String renders the Interface as a single line for debugging
+// purposes.
+func (i Interface) String() string {
+	res := []string{fmt.Sprintf("%s (%s)", i.Name, i.Type)}
+	if i.Description != "" {
+		res = append(res, fmt.Sprintf("%q", i.Description))
+	}
+	if i.Alias != "" {
+		res = append(res, fmt.Sprintf("alias=%q", i.Alias))
+	}
+	if i.Optional {
+		res = append(res, "optional")
+	}
+	if i.RequiredFamily != "" {
+		res = append(res, "required-family="+i.RequiredFamily)
+	}
+	if !i.Autoconnects() {
+		res = append(res, "autoconnect=false")
+	}
+	if i.AutoconnectPriority != nil {
+		res = append(res, fmt.Sprintf("autoconnect-priority=%d", *i.AutoconnectPriority))
+	}
+	if i.MTU != 0 {
+		res = append(res, fmt.Sprintf("mtu=%d", i.MTU))
+	}
+	for _, f := range i.LinkFlags() {
+		res = append(res, fmt.Sprintf("%s=%t", f.Name, f.On))
+	}
+	if i.Group != 0 {
+		res = append(res, fmt.Sprintf("group=%d", i.Group))
+	}
+	if len(i.After) > 0 {
+		res = append(res, "after="+strings.Join(i.After, ","))
+	}
+	if len(i.Requires) > 0 {
+		res = append(res, "requires="+strings.Join(i.Requires, ","))
+	}
+	if nw := i.Network.String(); nw != "" {
+		res = append(res, nw)
+	}
+	keys := []string{}
+	for k := range i.Parameters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res = append(res, fmt.Sprintf("%s=%v", k, i.Parameters[k]))
+	}
+	return strings.Join(res, " ")
+}
+
+func (l *Layout) writeTree(sb *strings.Builder, name string, depth int, path map[string]bool) {
+	indent := strings.Repeat("  ", depth)
+	intf, ok := l.Interfaces[name]
+	if !ok {
+		fmt.Fprintf(sb, "%s%s (missing)\n", indent, name)
+		return
+	}
+	if path[name] {
+		fmt.Fprintf(sb, "%s%s (cycle)\n", indent, name)
+		return
+	}
+	fmt.Fprintf(sb, "%s%s\n", indent, intf)
+	path[name] = true
+	for _, sub := range intf.Interfaces {
+		l.writeTree(sb, sub, depth+1, path)
+	}
+	delete(path, name)
+}
+
+// String renders the Layout as an indented tree starting from
+// Roots, with each interface followed by the interfaces it is built
+// on.  It is intended for debugging, and is safe to call on Layouts
+// that have not been validated.
+func (l *Layout) String() string {
+	sb := &strings.Builder{}
+	roots := l.Roots
+	if len(roots) == 0 {
+		for k := range l.Interfaces {
+			if _, ok := l.Child2Parent[k]; !ok {
+				roots = append(roots, k)
+			}
+		}
+		sort.Strings(roots)
+	}
+	for _, root := range roots {
+		l.writeTree(sb, root, 0, map[string]bool{})
+	}
+	return sb.String()
+}
+
+// Summary renders the salient settings of i as a short phrase: what
+// kind of interface it is, what it is built on, and how it gets its
+// addresses.
+func (i Interface) Summary() string {
+	kind := i.Type
+	switch i.Type {
+	case "bond":
+		kind = i.BondMode()
+	case "vlan":
+		kind = fmt.Sprintf("vlan %v", i.Parameters["id"])
+	case "tunnel":
+		kind = i.TunnelMode() + " tunnel"
+	case "veth":
+		kind = "veth peer of " + i.VethPeer()
+	}
+	if len(i.Interfaces) > 0 {
+		kind += " over " + strings.Join(i.Interfaces, ",")
+	}
+	res := []string{kind}
+	if n := i.Network; n != nil {
+		if n.Dhcp4 {
+			res = append(res, "dhcp4")
+		}
+		if n.Dhcp6 {
+			res = append(res, "dhcp6")
+		}
+		for _, addr := range n.Addresses {
+			res = append(res, addr.String())
+		}
+	}
+	if i.Optional {
+		res = append(res, "optional")
+	}
+	return strings.Join(res, ", ")
+}
+
+// Summary renders a digest of the Layout with one line per interface,
+// starting from Roots with each interface followed by the interfaces
+// it is built on.  Each interface is listed once, even if more than
+// one interface is built on it.
+func (l *Layout) Summary() string {
+	sb := &strings.Builder{}
+	seen := map[string]bool{}
+	var walk func(string)
+	walk = func(name string) {
+		intf, ok := l.Interfaces[name]
+		if !ok || seen[name] {
+			return
+		}
+		seen[name] = true
+		fmt.Fprintf(sb, "%s: %s\n", name, intf.Summary())
+		for _, sub := range intf.Interfaces {
+			walk(sub)
+		}
+	}
+	for _, root := range l.Roots {
+		walk(root)
+	}
+	return sb.String()
+}
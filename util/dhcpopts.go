@@ -0,0 +1,205 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MaxDhcpOptionCode is the highest DHCPv4 option code that can be
+// sent or requested.  0 and 255 are the pad and end options.
+const MaxDhcpOptionCode = 254
+
+// DhcpOptionTypes are the types the value of a sent DHCP option can
+// have, which determine how the value is encoded.
+var DhcpOptionTypes = []string{"uint8", "uint16", "uint32", "ipv4address", "ipv6address", "string"}
+
+// DhcpOption is a DHCP option that the client sends, such as the
+// vendor class in option 60.
+type DhcpOption struct {
+	Code  int    `json:"code"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// String renders o as code:type:value, which is how systemd-networkd
+// takes it.
+func (o DhcpOption) String() string {
+	return fmt.Sprintf("%d:%s:%s", o.Code, o.Type, o.Value)
+}
+
+// ParseDhcpOption parses an option rendered by DhcpOption.String.
+func ParseDhcpOption(s string) (DhcpOption, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return DhcpOption{}, fmt.Errorf("%q is not code:type:value", s)
+	}
+	code, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return DhcpOption{}, fmt.Errorf("%q does not start with an option code", s)
+	}
+	res := DhcpOption{Code: code, Type: parts[1], Value: parts[2]}
+	return res, res.check()
+}
+
+// check checks that o has a code that can be sent, and a value that
+// can be encoded as its type.
+func (o DhcpOption) check() error {
+	if o.Code < 1 || o.Code > MaxDhcpOptionCode {
+		return fmt.Errorf("option code %d must be between 1 and %d", o.Code, MaxDhcpOptionCode)
+	}
+	bits := 0
+	switch o.Type {
+	case "uint8":
+		bits = 8
+	case "uint16":
+		bits = 16
+	case "uint32":
+		bits = 32
+	case "ipv4address", "ipv6address":
+		ip := net.ParseIP(o.Value)
+		if ip == nil || (ip.To4() != nil) != (o.Type == "ipv4address") {
+			return fmt.Errorf("option %d: %q is not an %s", o.Code, o.Value, o.Type)
+		}
+	case "string":
+		if o.Value == "" || len(o.Value) > math.MaxUint8 {
+			return fmt.Errorf("option %d: strings must be between 1 and %d bytes long", o.Code, math.MaxUint8)
+		}
+	default:
+		return fmt.Errorf("option %d: type %q is not one of %v", o.Code, o.Type, DhcpOptionTypes)
+	}
+	if bits != 0 {
+		if _, err := strconv.ParseUint(o.Value, 0, bits); err != nil {
+			return fmt.Errorf("option %d: %q is not a %s", o.Code, o.Value, o.Type)
+		}
+	}
+	return nil
+}
+
+// VDhcpOptions returns a Validator that validates a list of DHCP
+// options to send.  Values can be given as numbers for the integer
+// types.
+func VDhcpOptions() Validator {
+	checks := map[string]*Check{
+		"code":  C(VI(1, MaxDhcpOptionCode)),
+		"type":  C(VS(DhcpOptionTypes...)),
+		"value": C(vScalar()),
+	}
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "array", "items": ChecksSchema(checks)}, true
+		}
+		items, ok := v.([]interface{})
+		if !ok {
+			e.Errorf("%s: %v is not a list of options", k, v)
+			return nil, false
+		}
+		res, valid := []DhcpOption{}, true
+		for _, item := range items {
+			opt := DhcpOption{}
+			if !ValidateAndMarshal(e, item, checks, &opt) {
+				valid = false
+				continue
+			}
+			if err := opt.check(); err != nil {
+				e.Errorf("%s: %v", k, err)
+				valid = false
+				continue
+			}
+			res = append(res, opt)
+		}
+		return res, valid
+	}
+}
+
+// vScalar returns a Validator that takes a string or a number as a
+// string.
+func vScalar() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"anyOf": []Schema{{"type": "string"}, {"type": "integer"}}}, true
+		}
+		switch val := v.(type) {
+		case string:
+			return val, true
+		case int, int64, float64:
+			return fmt.Sprintf("%v", val), true
+		}
+		e.Errorf("%s: %v is not a string or a number", k, v)
+		return nil, false
+	}
+}
+
+// VDhcpOptionCodes returns a Validator that validates a list of DHCP
+// option codes to request.
+func VDhcpOptionCodes() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "array", "items": Schema{"type": "integer", "minimum": 1, "maximum": MaxDhcpOptionCode}}, true
+		}
+		items, ok := v.([]interface{})
+		if !ok {
+			e.Errorf("%s: %v is not a list of option codes", k, v)
+			return nil, false
+		}
+		res, valid := []int{}, true
+		for _, item := range items {
+			code, ok := ValidateInt(e, k, item, 1, MaxDhcpOptionCode)
+			valid = valid && ok
+			res = append(res, int(code))
+		}
+		return res, valid
+	}
+}
+
+// DhcpOptionKeys returns the keys of the DHCP option and client
+// settings that o sets, for output formats that cannot write them to
+// warn about.
+func (o *Overrides) DhcpOptionKeys() []string {
+	res := []string{}
+	if o == nil {
+		return res
+	}
+	if len(o.RequestOptions) > 0 {
+		res = append(res, "request-options")
+	}
+	if len(o.SendOptions) > 0 {
+		res = append(res, "send-options")
+	}
+	if o.MaxAttempts != 0 {
+		res = append(res, "max-attempts")
+	}
+	if o.ListenPort != 0 {
+		res = append(res, "listen-port")
+	}
+	return res
+}
+
+// validateDhcpOptions checks the DHCP options and client settings of
+// the overrides of n.  They only apply to DHCPv4, as DHCPv6 options
+// are numbered differently.
+func (n *Network) validateDhcpOptions(e *Err) {
+	for _, k := range n.Dhcp6Overrides.DhcpOptionKeys() {
+		e.Warnf("dhcp6-overrides %s has no effect, as it is only supported for DHCPv4", k)
+	}
+	o := n.Dhcp4Overrides
+	if o == nil {
+		return
+	}
+	for _, code := range o.RequestOptions {
+		ValidateInt(e, "request-options", code, 1, MaxDhcpOptionCode)
+	}
+	for _, opt := range o.SendOptions {
+		if err := opt.check(); err != nil {
+			e.Errorf("send-options: %v", err)
+		}
+	}
+	if o.MaxAttempts != 0 {
+		ValidateInt(e, "max-attempts", o.MaxAttempts, 1, math.MaxUint32)
+	}
+	if o.ListenPort != 0 {
+		ValidateInt(e, "listen-port", o.ListenPort, 1, math.MaxUint16)
+	}
+}
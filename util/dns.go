@@ -0,0 +1,76 @@
+package util
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RoutingOnlyPrefix marks a domain in NSInfo.Search that is only used
+// to pick the interface whose name servers resolve names in it, and
+// is never appended to names that are looked up.  The routing-only
+// domain ~. sends every lookup that no other domain matches to the
+// name servers of its interface.
+const RoutingOnlyPrefix = "~"
+
+var domainLabel = regexp.MustCompile(`^[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?$`)
+
+// validDomain returns whether domain is a syntactically valid domain
+// name, ignoring a single trailing dot.
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !domainLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// RoutingDomains returns the routing-only domains in n without their
+// RoutingOnlyPrefix, in lower case with any duplicates removed.  The
+// root domain is returned as a single dot.
+func (n *NSInfo) RoutingDomains() []string {
+	res := []string{}
+	if n == nil {
+		return res
+	}
+	seen := map[string]struct{}{}
+	for _, domain := range n.Search {
+		if !strings.HasPrefix(domain, RoutingOnlyPrefix) {
+			continue
+		}
+		domain = strings.ToLower(strings.TrimPrefix(domain, RoutingOnlyPrefix))
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+		res = append(res, domain)
+	}
+	return res
+}
+
+// Domains returns the search domains in n followed by its
+// routing-only domains with their RoutingOnlyPrefix, which is the
+// form both systemd-resolved and NetworkManager take them in.
+func (n *NSInfo) Domains() []string {
+	res := n.SearchDomains()
+	for _, domain := range n.RoutingDomains() {
+		res = append(res, RoutingOnlyPrefix+domain)
+	}
+	return res
+}
+
+func (n *NSInfo) validateDomains(e *Err) {
+	for _, domain := range n.Search {
+		name := strings.TrimPrefix(domain, RoutingOnlyPrefix)
+		if name == "." && name != domain {
+			continue
+		}
+		if !validDomain(name) {
+			e.Errorf("search: %q is not a valid domain", domain)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DuidTypes maps the kinds of DHCP unique identifiers a Duid can have
+// to their type codes from RFC 8415.
+var DuidTypes = map[string]int{
+	"link-layer-time": 1,
+	"vendor":          2,
+	"link-layer":      3,
+	"uuid":            4,
+}
+
+// maxDuidRawData is the most bytes a DUID can have after its type
+// code.
+const maxDuidRawData = 128
+
+// Duid is the DHCP unique identifier a client sends to identify
+// itself.
+type Duid struct {
+	// Type is the kind of DUID, which must be one of DuidTypes.
+	Type string `json:"type"`
+	// RawData is the contents of the DUID after the type code, as
+	// colon separated hex bytes.  If unset, it is generated based on
+	// Type.
+	RawData string `json:"raw-data,omitempty"`
+}
+
+// hexBytes parses colon separated hex bytes.
+func hexBytes(s string) ([]byte, error) {
+	res := []byte{}
+	for _, part := range strings.Split(s, ":") {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return nil, fmt.Errorf("%s is not a hex byte", part)
+		}
+		res = append(res, byte(b))
+	}
+	return res, nil
+}
+
+// Bytes returns the raw data of the DUID.
+func (d *Duid) Bytes() ([]byte, error) {
+	if d.RawData == "" {
+		return nil, nil
+	}
+	return hexBytes(d.RawData)
+}
+
+// String renders the whole DUID, type code included, as colon
+// separated hex bytes, or an empty string if there is no raw data.
+func (d *Duid) String() string {
+	buf, err := d.Bytes()
+	if err != nil || len(buf) == 0 {
+		return ""
+	}
+	code := DuidTypes[d.Type]
+	return net.HardwareAddr(append([]byte{byte(code >> 8), byte(code)}, buf...)).String()
+}
+
+func (d *Duid) validate(e *Err) {
+	if _, ok := DuidTypes[d.Type]; !ok {
+		e.Errorf("duid: type %q is not one of link-layer-time, vendor, link-layer, or uuid", d.Type)
+		return
+	}
+	buf, err := d.Bytes()
+	switch {
+	case err != nil:
+		e.Errorf("duid: raw-data %s: %v", d.RawData, err)
+	case len(buf) > maxDuidRawData:
+		e.Errorf("duid: raw-data must not be longer than %d bytes", maxDuidRawData)
+	case d.Type == "uuid" && len(buf) != 0 && len(buf) != 16:
+		e.Errorf("duid: raw-data for a uuid must be 16 bytes long")
+	}
+}
+
+// maxClientID is the most bytes a DHCPv4 client identifier can have,
+// which is the most an option can hold.
+const maxClientID = 255
+
+// RawDhcpIdentifier returns the client identifier of n if its
+// DhcpIdentifier is one given as hex bytes rather than mac or duid,
+// or an empty string otherwise.
+func (n *Network) RawDhcpIdentifier() string {
+	switch n.DhcpIdentifier {
+	case "", "mac", "duid":
+		return ""
+	}
+	return n.DhcpIdentifier
+}
+
+// validateDhcpIdentifier checks the dhcp-identifier of n, which is
+// mac, duid, or the raw client identifier DHCPv4 sends as colon
+// separated hex bytes.  A raw one starts with its type byte, which
+// RFC 2132 says must be followed by at least one more byte.
+func (n *Network) validateDhcpIdentifier(e *Err) {
+	id := n.RawDhcpIdentifier()
+	if id == "" {
+		return
+	}
+	buf, err := hexBytes(id)
+	switch {
+	case err != nil:
+		e.Errorf("dhcp-identifier %q is not mac, duid, or colon separated hex bytes: %v", id, err)
+	case len(buf) < 2:
+		e.Errorf("dhcp-identifier %s must have a type byte followed by at least one more byte", id)
+	case len(buf) > maxClientID:
+		e.Errorf("dhcp-identifier must not be longer than %d bytes", maxClientID)
+	default:
+		n.DhcpIdentifier = strings.ToLower(id)
+	}
+}
+
+// validateDuid checks the DUID and IAID settings of n.  They are only
+// sent by DHCPv6, or by DHCPv4 when dhcp-identifier is duid.
+func (n *Network) validateDuid(e *Err) {
+	if n.Duid != nil {
+		n.Duid.validate(e)
+	}
+	if n.Duid == nil && n.Iaid == nil {
+		return
+	}
+	if !n.Dhcp6 && !(n.Dhcp4 && n.DhcpIdentifier == "duid") {
+		e.Warnf("duid and iaid are only used by dhcp6, or by dhcp4 when dhcp-identifier is duid")
+	}
+}
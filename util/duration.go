@@ -0,0 +1,75 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeParams maps the bond and bridge parameters that are times to
+// the unit they are kept in, which is also the unit of a number
+// without a suffix.  Bonds time their monitoring in milliseconds like
+// the kernel does, everything else is in seconds.
+var TimeParams = map[string]time.Duration{
+	"mii-monitor-interval":  time.Millisecond,
+	"arp-interval":          time.Millisecond,
+	"up-delay":              time.Millisecond,
+	"down-delay":            time.Millisecond,
+	"learn-packet-interval": time.Second,
+	"max-age":               time.Second,
+	"hello-time":            time.Second,
+	"forward-delay":         time.Second,
+	"ageing-time":           time.Second,
+}
+
+// ParseTime parses a whole number followed by an optional ms or s
+// suffix.  A number without a suffix is a number of bare.
+func ParseTime(s string, bare time.Duration) (time.Duration, error) {
+	num, unit := strings.TrimSpace(s), bare
+	switch {
+	case strings.HasSuffix(num, "ms"):
+		num, unit = strings.TrimSuffix(num, "ms"), time.Millisecond
+	case strings.HasSuffix(num, "s"):
+		num, unit = strings.TrimSuffix(num, "s"), time.Second
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(num), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number with an optional ms or s suffix", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// ValidateTime translates v into a number of unit between min and max.
+// v can be a number of unit, or a string that ParseTime understands
+// with a number without a suffix being a number of bare.
+func ValidateTime(e *Err, k string, v interface{}, unit, bare time.Duration, min, max int64) (res int64, valid bool) {
+	s, ok := v.(string)
+	if !ok {
+		return ValidateInt(e, k, v, min, max)
+	}
+	d, err := ParseTime(s, bare)
+	if err != nil {
+		e.Errorf("%s: %v", k, err)
+		return
+	}
+	if d%unit != 0 {
+		e.Errorf("%s: %s is not a whole number of %s", k, s, unit)
+		return
+	}
+	return ValidateInt(e, k, int64(d/unit), min, max)
+}
+
+// VT returns a Validator for times kept in unit, which can have a ms
+// or s suffix.
+func VT(unit time.Duration, min, max int64) Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"anyOf": []Schema{
+				{"type": "integer", "minimum": min, "maximum": max},
+				{"type": "string", "format": "time"},
+			}}, true
+		}
+		return ValidateTime(e, k, v, unit, unit, min, max)
+	}
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"log"
 	"strings"
 )
 
@@ -20,6 +21,12 @@ func (e *Err) Errorf(s string, args ...interface{}) {
 	e.msgs = append(e.msgs, fmt.Sprintf(s, args...))
 }
 
+// Warnf logs a message about a non-fatal problem.  Unlike Errorf, it
+// does not add a message to the Err.
+func (e *Err) Warnf(s string, args ...interface{}) {
+	log.Printf("%s: warning: %s", e.Prefix, fmt.Sprintf(s, args...))
+}
+
 // Error satisfies the error interface
 func (e *Err) Error() string {
 	res := []string{}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"net"
+	"sort"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+)
+
+// DefaultForbiddenPrefixes are the prefixes that no Layout may have
+// static addresses in, on top of its own ForbiddenPrefixes.  It is
+// empty unless set, so nothing is forbidden by default.
+var DefaultForbiddenPrefixes []*gnet.IPNet
+
+// ValidatePrefixes validates that v is a list of CIDR prefixes, and
+// returns them with their host bits cleared.
+func ValidatePrefixes(e *Err, k string, v interface{}) (res []*gnet.IPNet, valid bool) {
+	addrs, ok := ValidateIPList(e, k, v, true)
+	if !ok {
+		return
+	}
+	res, valid = []*gnet.IPNet{}, true
+	for _, addr := range addrs {
+		res = append(res, &gnet.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask})
+	}
+	return
+}
+
+// forbiddenPrefix returns the first forbidden prefix of l that addr is
+// in, or nil if it is in none of them.
+func (l *Layout) forbiddenPrefix(addr *gnet.IPNet) *gnet.IPNet {
+	for _, prefixes := range [][]*gnet.IPNet{DefaultForbiddenPrefixes, l.ForbiddenPrefixes} {
+		for _, prefix := range prefixes {
+			if (*net.IPNet)(prefix).Contains(addr.IP) {
+				return prefix
+			}
+		}
+	}
+	return nil
+}
+
+// validateForbiddenPrefixes checks that no interface in l has a static
+// address in one of the forbidden prefixes.
+func (l *Layout) validateForbiddenPrefixes(e *Err) {
+	if len(DefaultForbiddenPrefixes) == 0 && len(l.ForbiddenPrefixes) == 0 {
+		return
+	}
+	for _, prefix := range l.ForbiddenPrefixes {
+		if prefix == nil || !prefix.IsCIDR() {
+			e.Errorf("forbidden prefix %v is not in CIDR form", prefix)
+			return
+		}
+	}
+	names := []string{}
+	for k := range l.Interfaces {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		n := l.Interfaces[k].Network
+		if n == nil {
+			continue
+		}
+		for _, addr := range n.Addresses {
+			if prefix := l.forbiddenPrefix(addr); prefix != nil {
+				e.Errorf("%s: address %s is in the forbidden range %s", k, addr, prefix)
+			}
+		}
+	}
+}
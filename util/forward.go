@@ -0,0 +1,64 @@
+package util
+
+// IPForwards are the valid values of ip-forward.  yes forwards both
+// IPv4 and IPv6.
+var IPForwards = []string{"yes", "no", "ipv4", "ipv6"}
+
+// IPMasquerades are the valid values of ip-masquerade.
+var IPMasquerades = []string{"no", "ipv4", "ipv6", "both"}
+
+// families returns which IP families an ip-forward or ip-masquerade
+// value applies to.
+func families(v string) (v4, v6 bool) {
+	switch v {
+	case "yes", "both":
+		return true, true
+	case "ipv4":
+		return true, false
+	case "ipv6":
+		return false, true
+	}
+	return false, false
+}
+
+// ForwardSysctls returns the sysctl settings that turn on forwarding
+// for the families n.IPForward asks for.  Forwarding is a system wide
+// setting, so they apply to every interface, not just the one that
+// asks for it.
+func (n *Network) ForwardSysctls() []string {
+	if n == nil {
+		return nil
+	}
+	res := []string{}
+	v4, v6 := families(n.IPForward)
+	if v4 {
+		res = append(res, "net/ipv4/ip_forward=1")
+	}
+	if v6 {
+		res = append(res, "net/ipv6/conf/all/forwarding=1")
+	}
+	return res
+}
+
+// validateForward checks ip-forward and ip-masquerade.  Masquerading
+// rewrites the source of forwarded packets, so it needs forwarding for
+// each family it masquerades.
+func (n *Network) validateForward(e *Err) {
+	if n.IPForward != "" {
+		ValidateStrIn(e, "ip-forward", n.IPForward, IPForwards...)
+	}
+	if n.IPMasquerade == "" {
+		return
+	}
+	if _, ok := ValidateStrIn(e, "ip-masquerade", n.IPMasquerade, IPMasquerades...); !ok {
+		return
+	}
+	masq4, masq6 := families(n.IPMasquerade)
+	fwd4, fwd6 := families(n.IPForward)
+	if masq4 && !fwd4 {
+		e.Errorf("ip-masquerade %s needs ip-forward to be yes or ipv4", n.IPMasquerade)
+	}
+	if masq6 && !fwd6 {
+		e.Errorf("ip-masquerade %s needs ip-forward to be yes or ipv6", n.IPMasquerade)
+	}
+}
@@ -0,0 +1,207 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// HostnameVars are the fields that a DHCP hostname template can
+// refer to.  MAC addresses are rendered as lower case hex digits
+// without separators so that they are valid in a hostname.
+type HostnameVars struct {
+	// MAC is the MAC address of the interface.
+	MAC string
+	// Interface is the name of the interface.
+	Interface string
+	// BootMac is the MAC address of the interface the system booted from.
+	BootMac string
+}
+
+func hostnameMac(mac net.HardwareAddr) string {
+	return strings.Replace(mac.String(), ":", "", -1)
+}
+
+func expandHostname(tmpl string, vars HostnameVars) (string, error) {
+	t, err := template.New("hostname").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ValidateHostnameTemplate checks that tmpl parses as a template and
+// only refers to fields in HostnameVars.
+func ValidateHostnameTemplate(tmpl string) error {
+	_, err := expandHostname(tmpl, HostnameVars{})
+	return err
+}
+
+func (o *Overrides) expandHostname(vars HostnameVars) (*Overrides, error) {
+	if o == nil || !strings.Contains(o.Hostname, "{{") {
+		return o, nil
+	}
+	hostname, err := expandHostname(o.Hostname, vars)
+	if err != nil {
+		return nil, err
+	}
+	if hostname == "" {
+		return nil, fmt.Errorf("hostname %q expands to an empty string", o.Hostname)
+	}
+	res := *o
+	res.Hostname = hostname
+	return &res, nil
+}
+
+// ExpandHostnames expands any templated DHCP hostnames in the Layout
+// against the interface they are configured on.  phys is used to find
+// the MAC address of the interface the system booted from.
+func (l *Layout) ExpandHostnames(phys []Phy) error {
+	e := &Err{Prefix: "hostname"}
+	bootMac := ""
+	for _, phy := range phys {
+		if phy.BootIf {
+			bootMac = hostnameMac(net.HardwareAddr(phy.HardwareAddr))
+			break
+		}
+	}
+	for k, i := range l.Interfaces {
+		if i.Network == nil {
+			continue
+		}
+		vars := HostnameVars{Interface: i.Name, BootMac: bootMac}
+		if len(i.MacAddress) > 0 {
+			vars.MAC = hostnameMac(net.HardwareAddr(i.MacAddress))
+		} else if len(i.CurrentHwAddr) > 0 {
+			vars.MAC = hostnameMac(net.HardwareAddr(i.CurrentHwAddr))
+		}
+		v4, err4 := i.Network.Dhcp4Overrides.expandHostname(vars)
+		if err4 != nil {
+			e.Errorf("%s: dhcp4-overrides: %v", k, err4)
+		}
+		v6, err6 := i.Network.Dhcp6Overrides.expandHostname(vars)
+		if err6 != nil {
+			e.Errorf("%s: dhcp6-overrides: %v", k, err6)
+		}
+		if err4 != nil || err6 != nil ||
+			(v4 == i.Network.Dhcp4Overrides && v6 == i.Network.Dhcp6Overrides) {
+			continue
+		}
+		// Networks may be shared between interfaces matched by the same
+		// stanza, so the expanded hostnames get their own copy.
+		nw := *i.Network
+		nw.Dhcp4Overrides, nw.Dhcp6Overrides = v4, v6
+		i.Network = &nw
+		l.Interfaces[k] = i
+	}
+	return e.OrNil()
+}
+
+// maxHostnameLen and maxLabelLen are the longest a hostname and each
+// of its dot separated labels can be under RFC 1123.
+const (
+	maxHostnameLen = 253
+	maxLabelLen    = 63
+)
+
+// ValidateHostname checks that h is a hostname as allowed by RFC 1123:
+// dot separated labels of letters, digits, and hyphens that neither
+// start nor end with a hyphen.
+func ValidateHostname(e *Err, k, h string) bool {
+	if h == "" || len(h) > maxHostnameLen {
+		e.Errorf("%s: %q must be between 1 and %d characters long", k, h, maxHostnameLen)
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > maxLabelLen {
+			e.Errorf("%s: %q must be made of labels between 1 and %d characters long", k, h, maxLabelLen)
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			e.Errorf("%s: %q has a label that starts or ends with a hyphen", k, h)
+			return false
+		}
+		for _, c := range label {
+			if !(c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+				e.Errorf("%s: %q can only contain letters, digits, hyphens, and dots", k, h)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hostsAddr is the address Debian derived systems map the system
+// hostname to in /etc/hosts when it has no static address.
+const hostsAddr = "127.0.1.1"
+
+// defaultHosts is the /etc/hosts WriteHostname starts from when there
+// is not one already.
+const defaultHosts = "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"
+
+// hostsFile returns hosts with any existing entries for hostsAddr
+// replaced by one for hostname, and its short form if it has a domain.
+func hostsFile(hosts, hostname string) string {
+	names := hostname
+	if idx := strings.Index(hostname, "."); idx > 0 {
+		names += " " + hostname[:idx]
+	}
+	sb := &strings.Builder{}
+	for _, line := range strings.SplitAfter(hosts, "\n") {
+		fields := strings.Fields(line)
+		if line == "" || (len(fields) > 0 && fields[0] == hostsAddr) {
+			continue
+		}
+		sb.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(sb, "%s\t%s\n", hostsAddr, names)
+	return sb.String()
+}
+
+// WriteHostname writes the hostname of the Layout to etc/hostname
+// under root, and maps it to 127.0.1.1 in etc/hosts there, keeping
+// the rest of any etc/hosts that is already present.  It does nothing
+// if the Layout has no hostname.
+func (l *Layout) WriteHostname(root string) error {
+	if l.Hostname == "" {
+		return nil
+	}
+	e := &Err{Prefix: "hostname"}
+	etc := path.Join(root, "etc")
+	hosts, err := ioutil.ReadFile(path.Join(etc, "hosts"))
+	if os.IsNotExist(err) {
+		hosts, err = []byte(defaultHosts), nil
+	}
+	if err != nil {
+		e.Merge(err)
+		return e
+	}
+	staged, err := ioutil.TempDir("", "netwrangler-")
+	if err != nil {
+		e.Merge(err)
+		return e
+	}
+	defer os.RemoveAll(staged)
+	if err := ioutil.WriteFile(path.Join(staged, "hostname"), []byte(l.Hostname+"\n"), 0644); err != nil {
+		e.Merge(err)
+	}
+	if err := ioutil.WriteFile(path.Join(staged, "hosts"), []byte(hostsFile(string(hosts), l.Hostname)), 0644); err != nil {
+		e.Merge(err)
+	}
+	if e.Empty() {
+		Copy(staged, etc, e)
+	}
+	return e.OrNil()
+}
@@ -0,0 +1,37 @@
+package util
+
+// KeepConfigurations are the valid values of keep-configuration.
+var KeepConfigurations = []string{"yes", "no", "static", "dhcp", "dhcp-on-stop"}
+
+// Keep returns which of the addresses and routes of n should be kept
+// when the network service stops or restarts.  Unless it was set,
+// critical interfaces keep what they got from DHCP, or their static
+// configuration if they do not use DHCP, so that restarting the
+// network service cannot cut them off.
+func (n *Network) Keep() string {
+	switch {
+	case n == nil:
+		return ""
+	case n.KeepConfiguration != "":
+		return n.KeepConfiguration
+	case !n.Critical:
+		return ""
+	case n.Dhcp4 || n.Dhcp6:
+		return "dhcp"
+	default:
+		return "static"
+	}
+}
+
+func (n *Network) validateKeep(e *Err) {
+	if n.KeepConfiguration == "" {
+		return
+	}
+	ValidateStrIn(e, "keep-configuration", n.KeepConfiguration, KeepConfigurations...)
+	switch n.KeepConfiguration {
+	case "dhcp", "dhcp-on-stop":
+		if !n.Dhcp4 && !n.Dhcp6 {
+			e.Warnf("keep-configuration %s has no effect without dhcp4 or dhcp6", n.KeepConfiguration)
+		}
+	}
+}
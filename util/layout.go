@@ -1,11 +1,15 @@
 package util
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	yaml "github.com/ghodss/yaml"
 	gnet "github.com/rackn/gohai/plugins/net"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"os"
 	"sort"
 	"strings"
@@ -23,11 +27,11 @@ type Route struct {
 	// OnLink has the kernel skip the reachability check for the Via
 	// address.
 	OnLink bool `json:"on-link,omitempty"`
-	// Metric is the route metric.  It defaults to 100 of omitted.
+	// Metric is the route metric.  If omitted, it defaults to the
+	// DefaultMetric of the Layout the route is in.
 	Metric int `json:"metric,omitempty"`
-	// Type is the type of the route.  It can be one of 'unicast',
-	// 'unreachable','blackhole', or 'prohibit'.  If omitted, defaults
-	// to 'unicast'
+	// Type is the type of the route.  It can be any of RouteTypes.  If
+	// omitted, defaults to 'unicast'
 	Type string `json:"type,omitempty"`
 	// Scope is the scope of the route.  It can be one of
 	// 'global','link', or 'host'.  If omitted, defaults to 'global'
@@ -35,11 +39,28 @@ type Route struct {
 	// Table is the table the route should be inserted into, if you want
 	// something other than the default table for the route type.
 	Table int `json:"table,omitempty"`
+	// Dev is the interface the route sends traffic out of, if it is
+	// not the interface the route is configured on.
+	Dev string `json:"dev,omitempty"`
+	// AutoRule adds a routing policy rule that sends traffic from the
+	// From address of the route, or to its To address if it has no
+	// From, to its Table.
+	AutoRule bool `json:"auto-rule,omitempty"`
+}
+
+// DevFor returns the name of the interface that the route sends
+// traffic out of when it is configured on i.
+func (r Route) DevFor(i Interface) string {
+	if r.Dev != "" {
+		return r.Dev
+	}
+	return i.Name
 }
 
 // IPString translates a Route into the appropriate ip command
-// arguments to add said route to a running system.
-func (r Route) IPString(i Interface) string {
+// arguments to add said route to a running system.  The metric is
+// left off when it is defaultMetric.
+func (r Route) IPString(i Interface, defaultMetric int) string {
 	res := []string{}
 	if r.To != nil {
 		res = append(res, "to")
@@ -51,7 +72,7 @@ func (r Route) IPString(i Interface) string {
 	if r.From != nil {
 		res = append(res, "src", r.From.String())
 	}
-	if r.Metric != 0 && r.Metric != 100 {
+	if r.HasMetric(defaultMetric) {
 		res = append(res, "metric", fmt.Sprintf("%d", r.Metric))
 	}
 	if r.Table != 0 && r.Table != 253 {
@@ -66,19 +87,39 @@ func (r Route) IPString(i Interface) string {
 	if r.Scope != "" && r.Scope != "global" {
 		res = append(res, "scope", r.Scope)
 	}
-	res = append(res, "dev", i.Name)
+	res = append(res, "dev", r.DevFor(i))
 	return strings.Join(res, " ")
 }
 
+// HasMetric returns whether the route sets a metric other than
+// defaultMetric, and so needs its metric written out.
+func (r Route) HasMetric(defaultMetric int) bool {
+	return r.Metric != 0 && r.Metric != defaultMetric
+}
+
+// RouteTypes are the valid types of routes.
+var RouteTypes = []string{"unicast", "local", "nat", "throw", "multicast", "unreachable", "blackhole", "prohibit"}
+
 func (r *Route) validate() error {
 	e := &Err{Prefix: "Route"}
 	if r.Via != nil && r.Via.IsCIDR() {
 		e.Errorf("Via must be a single IP address, not %s", r.Via)
 	}
+	if r.Type != "" {
+		ValidateStrIn(e, "type", r.Type, RouteTypes...)
+	}
 	switch r.Type {
-	case "unicast":
+	case "unicast", "nat":
 		if r.To == nil || r.Via == nil {
-			e.Errorf("unicast routes require 'to' and 'via'")
+			e.Errorf("%s routes require 'to' and 'via'", r.Type)
+		}
+	case "throw", "unreachable", "blackhole", "prohibit":
+		// These routes never forward the packets they match.
+		if r.To == nil {
+			e.Errorf("%s routes require 'to'", r.Type)
+		}
+		if r.Via != nil {
+			e.Errorf("%s routes cannot have 'via'", r.Type)
 		}
 	default:
 		if r.To == nil {
@@ -104,9 +145,31 @@ type RoutePolicy struct {
 	// FWMark (if set) specifies that a packet must have a matching mark
 	// from the firewall to be considered.
 	FWMark int `json:"mark,omitempty"`
+	// FWMask (if set) limits the FWMark match to the bits that are
+	// set in it.  It is a netwrangler extension.
+	FWMask int `json:"mark-mask,omitempty"`
 	// TOS is (if set) the value of the TOS field that the packet must
 	// have to be considered for this policy.
 	TOS int `json:"type-of-service,omitempty"`
+	// IIF (if set) is the interface packets must come in on to be
+	// considered.  It is a netwrangler extension.
+	IIF string `json:"iif,omitempty"`
+	// OIF (if set) is the interface packets must be sent out of to
+	// be considered.  It is a netwrangler extension.
+	OIF string `json:"oif,omitempty"`
+	// IPProto (if set) is the number of the IP protocol packets must
+	// carry to be considered.  It is a netwrangler extension.
+	IPProto int `json:"ipproto,omitempty"`
+	// SPort and DPort (if set) are the source and destination port
+	// or from-to range of ports packets must have to be considered.
+	// They are netwrangler extensions.
+	SPort string `json:"sport,omitempty"`
+	DPort string `json:"dport,omitempty"`
+	// SuppressPrefixLength (if set) makes the rule ignore routes from
+	// its table whose prefix is this long or shorter, which lets the
+	// main table be consulted for all but the default route.  It is
+	// a netwrangler extension.
+	SuppressPrefixLength *int `json:"suppress-prefix-length,omitempty"`
 }
 
 // Overrides are the overrides that can be set for DHCP4 and DHCP6
@@ -123,11 +186,40 @@ type Overrides struct {
 	Hostname        string  `json:"hostname"`
 	// UseRoutes default is true, when set uses routes defined by DHCP server.
 	UseRoutes       bool    `json:"use-routes"`
+	// UseGateway is whether the default route from the DHCP server is
+	// used.  If unset, it follows UseRoutes.  It is a netwrangler
+	// extension.
+	UseGateway      *bool   `json:"use-gateway,omitempty"`
 	// RouteMetric set default vale of route lower number is higher priority.
 	RouteMetric     int     `json:"route-metric"`
+	// RouteTable is the routing table the routes from the DHCP server
+	// go in, if not the main one.  It is a netwrangler extension.
+	RouteTable      int     `json:"route-table,omitempty"`
 	// UseDomains, Default is true, either takes a Bool or Route when set
 	// it uses the search domains from the dhcp server
 	UseDomains      string  `json:"use-domains"`
+	// RequestOptions are the codes of extra options the DHCP client
+	// asks the server for.  It is a netwrangler extension.
+	RequestOptions  []int   `json:"request-options,omitempty"`
+	// SendOptions are extra options the DHCP client sends, such as
+	// a vendor class.  It is a netwrangler extension.
+	SendOptions     []DhcpOption `json:"send-options,omitempty"`
+	// MaxAttempts is how many requests the DHCP client sends before
+	// giving up, if it should ever give up.  It is a netwrangler
+	// extension.
+	MaxAttempts     int     `json:"max-attempts,omitempty"`
+	// ListenPort is the port the DHCP client listens on, if not the
+	// standard one.  It is a netwrangler extension.
+	ListenPort      int     `json:"listen-port,omitempty"`
+}
+
+// UsesGateway returns whether the default route from the DHCP server
+// is used.
+func (o *Overrides) UsesGateway() bool {
+	if o.UseGateway != nil {
+		return *o.UseGateway
+	}
+	return o.UseRoutes
 }
 
 // IPString translates a RoutePolicy into the appropriate ip command
@@ -144,14 +236,32 @@ func (r RoutePolicy) IPString() string {
 		res = append(res, "pref", fmt.Sprintf("%d", r.Priority))
 	}
 	if r.FWMark != 0 {
-		res = append(res, "fwmark", fmt.Sprintf("%d", r.FWMark))
+		res = append(res, "fwmark", r.FWMarkString())
 	}
 	if r.TOS != 0 {
 		res = append(res, "tos", fmt.Sprintf("%d", r.TOS))
 	}
+	if r.IIF != "" {
+		res = append(res, "iif", r.IIF)
+	}
+	if r.OIF != "" {
+		res = append(res, "oif", r.OIF)
+	}
+	if r.IPProto != 0 {
+		res = append(res, "ipproto", fmt.Sprintf("%d", r.IPProto))
+	}
+	if r.SPort != "" {
+		res = append(res, "sport", r.SPort)
+	}
+	if r.DPort != "" {
+		res = append(res, "dport", r.DPort)
+	}
 	if r.Table != 0 {
 		res = append(res, "table", fmt.Sprintf("%d", r.Table))
 	}
+	if r.SuppressPrefixLength != nil {
+		res = append(res, "suppress_prefixlength", fmt.Sprintf("%d", *r.SuppressPrefixLength))
+	}
 	return strings.Join(res, " ")
 }
 
@@ -160,7 +270,54 @@ func (r *RoutePolicy) validate() error {
 	if (r.From != nil) == (r.To != nil) {
 		e.Errorf("Route policy must include either a From or a To")
 	}
+	r.validateMatches(e)
+
+	return e.OrNil()
+}
+
+// Neighbor defines a static ARP (for IPv4) or NDP (for IPv6) entry.
+type Neighbor struct {
+	// IP is the address of the neighbor.
+	IP *gnet.IPNet `json:"ip"`
+	// MacAddress is the hardware address of the neighbor.
+	MacAddress gnet.HardwareAddr `json:"macaddress,omitempty"`
+}
+
+// IPString translates a Neighbor into the appropriate ip command
+// arguments to add said neighbor to a running system.
+func (n Neighbor) IPString(i Interface) string {
+	return strings.Join([]string{
+		n.IP.String(),
+		"lladdr", n.MacAddress.String(),
+		"dev", i.Name,
+		"nud", "permanent",
+	}, " ")
+}
 
+func (n *Neighbor) validate(nw *Network) error {
+	e := &Err{Prefix: "neighbor"}
+	if n.IP == nil {
+		e.Errorf("neighbors require an ip")
+		return e
+	}
+	if n.IP.IsCIDR() {
+		e.Errorf("%s must be a single IP address", n.IP)
+	}
+	if len(n.MacAddress) == 0 {
+		e.Errorf("%s: neighbors require a macaddress", n.IP)
+	}
+	v4 := n.IP.IP.To4() != nil
+	if (v4 && nw.Dhcp4) || (!v4 && (nw.Dhcp6 || nw.AcceptRa)) {
+		// The subnet is not known until DHCP or SLAAC has done its thing.
+		return e.OrNil()
+	}
+	for _, addr := range nw.Addresses {
+		prefix := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+		if prefix.Contains(n.IP.IP) {
+			return e.OrNil()
+		}
+	}
+	e.Errorf("%s is not in any subnet configured on the interface", n.IP)
 	return e.OrNil()
 }
 
@@ -168,15 +325,158 @@ func (r *RoutePolicy) validate() error {
 // configuration.
 type NSInfo struct {
 	// Search is a list of domains that should be searched when
-	// resolving domains.
+	// resolving domains.  Domains starting with RoutingOnlyPrefix
+	// are not searched, they only route lookups of names in them to
+	// the name servers of this interface.
 	Search []string `json:"search,omitempty"`
 	// Addresses is a list of DNS name server addresses.
 	Addresses []*gnet.IPNet `json:"addresses,omitempty"`
 }
 
+// SearchDomains returns the search domains in lower case with any
+// duplicates removed, in the order they were first listed.
+// Routing-only domains are left out.
+func (n *NSInfo) SearchDomains() []string {
+	res := []string{}
+	if n == nil {
+		return res
+	}
+	seen := map[string]struct{}{}
+	for _, domain := range n.Search {
+		if strings.HasPrefix(domain, RoutingOnlyPrefix) {
+			continue
+		}
+		domain = strings.ToLower(domain)
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+		res = append(res, domain)
+	}
+	return res
+}
+
 func (n *NSInfo) validate() error {
 	e := &Err{Prefix: "nameservers"}
 	ValidateIPList(e, "addresses", n.Addresses, false)
+	n.validateDomains(e)
+	return e.OrNil()
+}
+
+// LifetimeForever is the address lifetime the kernel uses for
+// addresses that never expire.
+const LifetimeForever = Lifetime(math.MaxUint32)
+
+// Lifetime is an address lifetime in seconds.  LifetimeForever is
+// rendered as "forever".
+type Lifetime int64
+
+func (l Lifetime) String() string {
+	if l == LifetimeForever {
+		return "forever"
+	}
+	return fmt.Sprintf("%d", l)
+}
+
+// MarshalJSON renders LifetimeForever as "forever", and everything else
+// as a number.
+func (l Lifetime) MarshalJSON() ([]byte, error) {
+	if l == LifetimeForever {
+		return json.Marshal(l.String())
+	}
+	return json.Marshal(int64(l))
+}
+
+// UnmarshalJSON accepts either a number of seconds or "forever".
+func (l *Lifetime) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err == nil {
+		if s != "forever" && s != "infinity" {
+			return fmt.Errorf("invalid lifetime %q", s)
+		}
+		*l = LifetimeForever
+		return nil
+	}
+	var v int64
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return err
+	}
+	*l = Lifetime(v)
+	return nil
+}
+
+// AddressOptions holds optional settings for a single static address.
+type AddressOptions struct {
+	// Broadcast is the broadcast address to use for an IPv4 address.
+	// If omitted, the kernel default will be used.
+	Broadcast *gnet.IPNet `json:"broadcast,omitempty"`
+	// PreferredLifetime is the number of seconds the address will be
+	// preferred for new connections.  0 marks the address as
+	// deprecated, LifetimeForever means it will never be deprecated.
+	PreferredLifetime *Lifetime `json:"preferred-lifetime,omitempty"`
+	// ValidLifetime is the number of seconds the address will remain
+	// on the interface.  It must not be less than PreferredLifetime.
+	ValidLifetime *Lifetime `json:"valid-lifetime,omitempty"`
+	// Scope is the scope of the address.  It can be one of 'global',
+	// 'link', or 'host'.  If omitted, defaults to 'global'
+	Scope string `json:"scope,omitempty"`
+}
+
+// Scopes are the valid scopes for addresses and routes.
+var Scopes = []string{"global", "link", "host"}
+
+// HasLifetimes returns whether either address lifetime has been set.
+func (a *AddressOptions) HasLifetimes() bool {
+	return a.PreferredLifetime != nil || a.ValidLifetime != nil
+}
+
+// HasScope returns whether the address has a scope other than the
+// default.
+func (a *AddressOptions) HasScope() bool {
+	return a.Scope != "" && a.Scope != "global"
+}
+
+// IPString translates an address and its options into the
+// appropriate ip command arguments to add said address to i on a
+// running system.
+func (a *AddressOptions) IPString(addr *gnet.IPNet, i Interface) string {
+	res := []string{addr.String()}
+	if a.Broadcast != nil {
+		res = append(res, "broadcast", a.Broadcast.IP.String())
+	}
+	if a.HasScope() {
+		res = append(res, "scope", a.Scope)
+	}
+	res = append(res, "dev", i.Name)
+	if a.ValidLifetime != nil {
+		res = append(res, "valid_lft", a.ValidLifetime.String())
+	}
+	if a.PreferredLifetime != nil {
+		res = append(res, "preferred_lft", a.PreferredLifetime.String())
+	}
+	return strings.Join(res, " ")
+}
+
+func (a *AddressOptions) validate(addr *gnet.IPNet) error {
+	e := &Err{Prefix: "address " + addr.String()}
+	if a.PreferredLifetime != nil && a.ValidLifetime != nil &&
+		*a.ValidLifetime < *a.PreferredLifetime {
+		e.Errorf("valid-lifetime %s must not be less than preferred-lifetime %s",
+			a.ValidLifetime, a.PreferredLifetime)
+	}
+	if a.Scope != "" {
+		ValidateStrIn(e, "scope", a.Scope, Scopes...)
+	}
+	if a.Broadcast != nil {
+		prefix := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+		if addr.IP.To4() == nil || a.Broadcast.IP.To4() == nil {
+			e.Errorf("broadcast %s: broadcast addresses are only valid for IPv4", a.Broadcast)
+		} else if a.Broadcast.IsCIDR() {
+			e.Errorf("broadcast %s must be a single IP address", a.Broadcast)
+		} else if !prefix.Contains(a.Broadcast.IP) {
+			e.Errorf("broadcast %s is not in %s", a.Broadcast, prefix)
+		}
+	}
 	return e.OrNil()
 }
 
@@ -187,6 +487,9 @@ type Network struct {
 	// autogenerating one in response to an IPv6 router advertisement
 	// packet.
 	AcceptRa bool `json:"accept-ra,omitempty"`
+	// RaOverrides change what is used from the router advertisements
+	// accepted when AcceptRa is set.
+	RaOverrides *RaOverrides `json:"ra-overrides,omitempty"`
 	// Dhcp4 specifies whether an IPv4 address should be solicited for
 	// this interface via DHCP.
 	Dhcp4 bool `json:"dhcp4,omitempty"`
@@ -204,20 +507,45 @@ type Network struct {
 	// DhcpIdentifier specifies what should be used as a unique
 	// identifier for this interface when performing DHCP operations.
 	// If unset, a generated Client ID will be used.  THe only other
-	// valid value is 'mac' which specifies that the MAC address on the
-	// interface should be used.
+	// valid values are 'mac' which specifies that the MAC address on the
+	// interface should be used, 'duid' which specifies that
+	// DHCPv4 should identify the client with its DUID as well, and a
+	// raw client identifier as colon separated hex bytes.
 	DhcpIdentifier string `json:"dhcp-identifier,omitempty"`
+	// Duid is the DHCP unique identifier the client sends.  If unset,
+	// the one the DHCP client generates is used.
+	Duid *Duid `json:"duid,omitempty"`
+	// Iaid is the identity association identifier the client sends.
+	// If unset, the DHCP client derives one from the interface.
+	Iaid *uint32 `json:"iaid,omitempty"`
 	// Addresses is a list of IP addresses in CIDR format that should be
 	// assigned to this interface.  If this list is set and the DHCP
 	// flags are also set, these addresses and the DHCP addresses will
 	// be added to the interface.
 	Addresses []*gnet.IPNet `json:"addresses,omitempty"`
+	// AddressOptions holds any additional settings for the addresses
+	// in Addresses, keyed by the address in CIDR format.
+	AddressOptions map[string]*AddressOptions `json:"address-options,omitempty"`
 	// Gateway4 is the IPv4 default gateway address that should be set
 	// for this interface.
 	Gateway4 *gnet.IPNet `json:"gateway4,omitempty"`
 	// Gateway6 is the IPv6 default gateway address that should be set
 	// for this interface.
 	Gateway6 *gnet.IPNet `json:"gateway6,omitempty"`
+	// GatewayOnLink has the kernel skip the reachability check for
+	// Gateway4 and Gateway6, which is needed when they are not in the
+	// subnet of any address on the interface.
+	GatewayOnLink bool `json:"gateway-on-link,omitempty"`
+	// Gateway4Metric is the metric of the default route via Gateway4.
+	// If unset, the route will not be given an explicit metric.
+	Gateway4Metric int `json:"gateway4-metric,omitempty"`
+	// Gateway6Metric is the metric of the default route via Gateway6.
+	// If unset, the route will not be given an explicit metric.
+	Gateway6Metric int `json:"gateway6-metric,omitempty"`
+	// GatewayMetric is the metric of the default routes via Gateway4
+	// and Gateway6 that do not set a metric of their own.  It is
+	// folded into Gateway4Metric and Gateway6Metric by validation.
+	GatewayMetric int `json:"gateway-metric,omitempty"`
 	// Nameservers defines what DNS name servers and search domains
 	// should be used.
 	Nameservers *NSInfo `json:"nameservers,omitempty"`
@@ -227,12 +555,148 @@ type Network struct {
 	// RoutingPolicy defines additional routing policy entries that
 	// should be added when this interface is brought up.
 	RoutingPolicy []RoutePolicy `json:"routing-policy,omitempty"`
+	// Neighbors defines static ARP and NDP entries that should be
+	// added when this interface is brought up.
+	Neighbors []Neighbor `json:"neighbors,omitempty"`
+	// GratuitousArpCount is the number of gratuitous ARPs that should
+	// be sent for each static IPv4 address once this interface is up,
+	// so that a service address moving between hosts is picked up by
+	// its neighbors right away.  If unset, none are sent.
+	GratuitousArpCount int `json:"gratuitous-arp-count,omitempty"`
+	// UnsolicitedNa signals that unsolicited IPv6 neighbor
+	// advertisements should be sent when this interface comes up or
+	// fails over.
+	UnsolicitedNa bool `json:"unsolicited-na,omitempty"`
+	// ConfigureWithoutCarrier signals that the interface should be
+	// configured even when it has no carrier.
+	ConfigureWithoutCarrier bool `json:"configure-without-carrier,omitempty"`
+	// IgnoreCarrier signals that the interface should be configured
+	// without a carrier, and keep its configuration when it loses
+	// carrier.
+	IgnoreCarrier bool `json:"ignore-carrier,omitempty"`
+	// DNSDefaultRoute is whether the name servers of this interface
+	// should resolve names that do not match a routing-only domain of
+	// any interface.  If unset, the resolver decides based on the
+	// domains and routes of the interface.
+	DNSDefaultRoute *bool `json:"dns-default-route,omitempty"`
+	// IPv6MTU is the MTU IPv6 packets sent over the interface can
+	// have, if it should be smaller than the MTU of the link.
+	IPv6MTU int `json:"ipv6-mtu,omitempty"`
+	// IPv6DadTransmits is how many duplicate address detection probes
+	// are sent for each IPv6 address before it is used, if it should
+	// not be the kernel default of 1.  0 turns duplicate address
+	// detection off, which lets an address that moves between hosts,
+	// as with VRRP, be used right away.
+	IPv6DadTransmits *int `json:"ipv6-dad-transmits,omitempty"`
+	// IPv6Token is the interface identifier, like ::1, that addresses
+	// autogenerated from router advertisements should use instead of
+	// one derived from the MAC address.
+	IPv6Token string `json:"ipv6-address-token,omitempty"`
+	// Critical signals that the interface must not lose its
+	// configuration while the network service restarts, as when it
+	// carries the root filesystem.
+	Critical bool `json:"critical,omitempty"`
+	// KeepConfiguration is which addresses and routes of the interface
+	// are kept when the network service stops.  It can be any of
+	// KeepConfigurations.  If unset, it is derived from Critical.
+	KeepConfiguration string `json:"keep-configuration,omitempty"`
+	// IPForward is which families of packets the system forwards,
+	// for interfaces on a router.  It can be any of IPForwards.
+	IPForward string `json:"ip-forward,omitempty"`
+	// IPMasquerade is which families of packets forwarded out of the
+	// interface get the address of the interface as their source, as
+	// for a NAT gateway.  It can be any of IPMasquerades.
+	IPMasquerade string `json:"ip-masquerade,omitempty"`
+}
+
+// WithoutCarrier returns whether n should be configured when its
+// interface has no carrier.
+func (n *Network) WithoutCarrier() bool {
+	return n != nil && (n.ConfigureWithoutCarrier || n.IgnoreCarrier)
+}
+
+// AddressOpts returns the AddressOptions for addr, or nil if there are
+// none.
+func (n *Network) AddressOpts(addr *gnet.IPNet) *AddressOptions {
+	if n == nil || n.AddressOptions == nil {
+		return nil
+	}
+	return n.AddressOptions[addr.String()]
+}
+
+// offLink returns true if gw is known to not be in the subnet of any
+// address on the interface.  That is only known when all the
+// addresses in its family are static ones.
+func (n *Network) offLink(gw *gnet.IPNet) bool {
+	v4 := gw.IP.To4() != nil
+	if gw.IP.IsLinkLocalUnicast() || (v4 && n.Dhcp4) || (!v4 && (n.Dhcp6 || n.AcceptRa)) {
+		return false
+	}
+	found := false
+	for _, addr := range n.Addresses {
+		if (addr.IP.To4() != nil) != v4 {
+			continue
+		}
+		found = true
+		if addr.IP.Mask(addr.Mask).Equal(gw.IP.Mask(addr.Mask)) {
+			return false
+		}
+	}
+	return found
+}
+
+// checkOffLink makes the gateways on-link when one of them is not in
+// the subnet of any address, as the default route through it could
+// not be added otherwise.
+func (n *Network) checkOffLink(e *Err) {
+	if n.GatewayOnLink {
+		return
+	}
+	for _, gw := range []*gnet.IPNet{n.Gateway4, n.Gateway6} {
+		if gw != nil && n.offLink(gw) {
+			e.Warnf("gateway %s is not in the subnet of any address, treating it as on-link", gw.IP)
+			n.GatewayOnLink = true
+		}
+	}
+}
+
+// SharesPrefix returns true if an address before addr in Addresses is
+// in the same subnet.  The kernel only needs one prefix route for the
+// subnet, so addr does not need one of its own.
+func (n *Network) SharesPrefix(addr *gnet.IPNet) bool {
+	if n == nil {
+		return false
+	}
+	for _, other := range n.Addresses {
+		if other.String() == addr.String() {
+			return false
+		}
+		if other.Mask.String() == addr.Mask.String() && other.IP.Mask(other.Mask).Equal(addr.IP.Mask(addr.Mask)) {
+			return true
+		}
+	}
+	return false
 }
 
 func (n *Network) configure() bool {
 	return n != nil
 }
 
+// hasLayer3 returns true if n has any layer 3 settings beyond the
+// defaults every interface gets.
+func (n *Network) hasLayer3() bool {
+	return n != nil && (n.Dhcp4 || n.Dhcp6 ||
+		len(n.Addresses) > 0 ||
+		n.Gateway4 != nil || n.Gateway6 != nil ||
+		n.Nameservers != nil || n.DNSDefaultRoute != nil ||
+		n.IPv6MTU != 0 || n.IPv6Token != "" ||
+		n.IPv6DadTransmits != nil ||
+		n.IPForward != "" || n.IPMasquerade != "" ||
+		len(n.Routes) > 0 ||
+		len(n.RoutingPolicy) > 0 ||
+		len(n.Neighbors) > 0)
+}
+
 // SetupStaticOnly returns true if this Network should be configured
 // using static addressing without DHCP.
 func (n *Network) SetupStaticOnly() bool {
@@ -254,30 +718,75 @@ func (n *Network) SetupDHCPOnly() bool {
 
 func (n *Network) validate() error {
 	e := &Err{Prefix: "network"}
-	ValidateStrIn(e, "dhcp-identifier", n.DhcpIdentifier, "mac", "")
+	n.validateDhcpIdentifier(e)
+	n.validateDuid(e)
 	if n.Addresses == nil {
 		n.Addresses = []*gnet.IPNet{}
 	}
 	ValidateIPList(e, "addresses", n.Addresses, true)
+	optKeys := map[string]struct{}{}
+	for k := range n.AddressOptions {
+		optKeys[k] = struct{}{}
+	}
+	for _, addr := range n.Addresses {
+		if opts := n.AddressOpts(addr); opts != nil {
+			e.Merge(opts.validate(addr))
+		}
+		delete(optKeys, addr.String())
+	}
+	orphans := []string{}
+	for k := range optKeys {
+		orphans = append(orphans, k)
+	}
+	sort.Strings(orphans)
+	for _, k := range orphans {
+		e.Errorf("address options for %s, which is not in addresses", k)
+	}
 	if n.Gateway4 != nil && n.Gateway4.IP.To4() == nil {
 		e.Errorf("Gateway4 %s is not an IPv4 address", n.Gateway4)
 	}
 	if n.Gateway6 != nil && n.Gateway6.IP.To4() != nil {
 		e.Errorf("Gateway6 %s is not an IPv6 address", n.Gateway6)
 	}
+	n.checkOffLink(e)
+	if n.Gateway4Metric != 0 && n.Gateway4 == nil {
+		e.Errorf("gateway4-metric requires gateway4")
+	}
+	if n.Gateway6Metric != 0 && n.Gateway6 == nil {
+		e.Errorf("gateway6-metric requires gateway6")
+	}
+	n.validateGatewayMetrics(e)
+	if o := n.Dhcp6Overrides; o != nil && o.UseGateway != nil {
+		e.Warnf("dhcp6-overrides use-gateway has no effect, as DHCPv6 does not provide a gateway")
+	}
+	n.validateDhcpOptions(e)
 	if n.Nameservers != nil {
 		e.Merge(n.Nameservers.validate())
 	}
+	if n.IPv6MTU != 0 {
+		ValidateInt(e, "ipv6-mtu", n.IPv6MTU, MinIPv6MTU, MaxIPv6MTU)
+	}
+	n.validateDad(e)
+	n.validateRaOverrides(e)
+	n.validateDhcpTables(e)
+	n.validateIPv6Token(e)
+	n.validateKeep(e)
+	n.validateForward(e)
 	if n.Routes != nil {
 		for _, route := range n.Routes {
 			e.Merge(route.validate())
 		}
 	}
+	n.addAutoRules(e)
 	if n.RoutingPolicy != nil {
 		for _, rp := range n.RoutingPolicy {
 			e.Merge(rp.validate())
 		}
 	}
+	for _, neigh := range n.Neighbors {
+		e.Merge(neigh.validate(n))
+	}
+	n.validateAnnounce(e)
 	return e.OrNil()
 }
 
@@ -285,8 +794,8 @@ func (n *Network) validate() error {
 // network interfaces that may be required by the Layout.
 type Interface struct {
 	// Type is the type of Interface.  Valid values are
-	// 'physical','bond','bridge', and 'vlan'.  Additional interface
-	// types may be added as needed.
+	// 'physical','bond','bridge', 'vlan', 'tunnel', and 'veth'.
+	// Additional interface types may be added as needed.
 	Type string `json:"type"`
 	// MatchID is the ID that the interface was identified as from the
 	// input format.  It is permitted to have multiple Interfaces with
@@ -295,27 +804,108 @@ type Interface struct {
 	// Interfaces.  All other Interfaces mustt have unique MatchID
 	// fields.
 	MatchID string `json:"match-id"`
-	// Name is the final name that the interface should have. We
-	// currently do not support renaming physical interfaces.  The
+	// Name is the final name that the interface should have.  The
 	// Read() function on the input formats is responsible for any
 	// translation needed to turn a MatchID into a Name (or series of
 	// interfaces with unique Names).  All Interfaces must have unique
 	// Names.
 	Name string `json:"name"`
+	// Rename is set on physical interfaces that must be given Name by
+	// their permanent MAC address, as the kernel names them
+	// differently.
+	Rename bool `json:"rename,omitempty"`
+	// Description is free text describing what the interface is for.
+	// It is rendered as a comment or an interface alias where the
+	// output format allows.
+	Description string `json:"description,omitempty"`
+	// Alias is the ifalias of the interface, which shows up in ip link
+	// and as the SNMP ifAlias.  Unlike AlternativeNames it cannot be
+	// used to refer to the interface, and it takes the place of
+	// Description where that would be rendered as an alias.
+	Alias string `json:"alias,omitempty"`
 	// CurrentHwAddr is the MAC address of a physical interface.  The
 	// Read() function of the input format is responsible for setting
 	// this to a proper value.
 	CurrentHwAddr gnet.HardwareAddr `json:"hwaddr,omitempty"`
+	// PermanentHwAddr is the burned-in MAC address of a physical
+	// interface, if it is known.  Unlike CurrentHwAddr, it does not
+	// change when the interface is enslaved to a bond.
+	PermanentHwAddr gnet.HardwareAddr `json:"permanent-hwaddr,omitempty"`
 	// MacAddress is the MAC address we want the interface to have.  Not
 	// all interface type support this.  Specifically, we do not yet
 	// support changing the mac address on a physical interface that
 	// already exists.
 	MacAddress gnet.HardwareAddr `json:"macaddress,omitempty"`
+	// MTU is the maximum transmission unit of the interface in bytes.
+	// If unset, it is derived from related interfaces by Validate
+	// where possible, and left at the kernel default otherwise.
+	MTU int `json:"mtu,omitempty"`
+	// AlternativeNames are additional names the interface can be
+	// referred to by.  They are currently only supported on physical
+	// interfaces.
+	AlternativeNames []string `json:"alternative-names,omitempty"`
 	// Optional indicates to the output format that this interface is
 	// not required to be present or created for it to finish bringing
 	// up the network.  Optionality bubbles upwards from child to
 	// parent.
 	Optional bool `json:"optional,omitempty"`
+	// RequiredFamily is the address family the interface must have
+	// configured before it is considered online.  It must be empty or
+	// one of RequiredFamilies, and it does not change whether the
+	// interface is Optional.
+	RequiredFamily string `json:"required-family,omitempty"`
+	// WaitOnlineTimeout is the most seconds that boot waits for the
+	// interface to come online, if it should not wait as long as the
+	// output format does by default.  It must be between 1 and
+	// MaxWaitOnlineTimeout, and cannot be set on an Optional
+	// interface, as those are never waited for.
+	WaitOnlineTimeout int `json:"wait-online-timeout,omitempty"`
+	// WaitDeviceTimeout is the most seconds that boot waits for a
+	// physical interface that is slow to be probed to appear before
+	// the network is considered up.  It must be between 1 and
+	// MaxWaitOnlineTimeout, and has no effect on an Optional
+	// interface.
+	WaitDeviceTimeout int `json:"wait-device-timeout,omitempty"`
+	// RpsCpus and XpsCpus are the CPUs that receive packet steering
+	// and transmit packet steering spread the queues of a physical
+	// interface over, as a CPUList.  If unset, the kernel default of
+	// not steering packets is left alone.
+	RpsCpus string `json:"rps-cpus,omitempty"`
+	XpsCpus string `json:"xps-cpus,omitempty"`
+	// Autoconnect is whether the interface should be brought up at
+	// boot.  If unset, it is.  Unlike Optional, an interface that is
+	// not brought up at boot is never waited for.
+	Autoconnect *bool `json:"autoconnect,omitempty"`
+	// AutoconnectPriority orders the interfaces that are brought up at
+	// boot when the output format can, with higher priorities going
+	// first.  It must be between MinAutoconnectPriority and
+	// MaxAutoconnectPriority.
+	AutoconnectPriority *int `json:"autoconnect-priority,omitempty"`
+	// EmitLLDP is whether the interface should send LLDP packets.  It
+	// is "true", "false", one of EmitLLDPAgents to send them to a
+	// specific kind of bridge, or empty to leave the default alone.
+	EmitLLDP string `json:"emit-lldp,omitempty"`
+	// LLDP is whether the interface should listen for LLDP packets.
+	// If unset, the default of the output format is used.
+	LLDP *bool `json:"lldp,omitempty"`
+	// ARP, Multicast, and AllMulticast turn the link level flags of
+	// the same names on or off.  If unset, the kernel default is
+	// kept.
+	ARP          *bool `json:"arp,omitempty"`
+	Multicast    *bool `json:"multicast,omitempty"`
+	AllMulticast *bool `json:"allmulticast,omitempty"`
+	// Group is the link group the interface is put in, which lets
+	// ip commands and firewall rules act on every interface in it at
+	// once.  It must be between 0 and MaxLinkGroup, and 0 leaves the
+	// interface in the default group.
+	Group int `json:"group,omitempty"`
+	// After lists the interfaces that must be brought up before this
+	// one, for dependencies that interfaces does not capture, such as
+	// the underlay of a tunnel.  Requires does the same, and also
+	// keeps this interface from coming up without them when the
+	// output format can.
+	After    []string `json:"after,omitempty"`
+	Requires []string `json:"requires,omitempty"`
 	// Interfaces holds the names of other Interfaces that the current
 	// Interface will build upon.  Not all interface types build on
 	// other interfaces.
@@ -328,6 +918,13 @@ type Interface struct {
 	// applied to this Interface once it is brought up, if any.
 	Network *Network `json:"network,omitempty"`
 	bindMac bool
+	wasDown bool
+}
+
+// WasDown returns whether i is a physical interface that is known to
+// have been down when the phys were gathered.
+func (i Interface) WasDown() bool {
+	return i.wasDown
 }
 
 // NewInterface returns a new Interface with non-nil Interfaces and
@@ -339,20 +936,292 @@ func NewInterface() Interface {
 	}
 }
 
+// ExtensionPrefix starts the names of Parameters that hold site
+// specific extensions rather than settings of the interface type.
+const ExtensionPrefix = "x-"
+
+// IsExtension returns whether the parameter k is an extension.
+func IsExtension(k string) bool {
+	return strings.HasPrefix(k, ExtensionPrefix)
+}
+
+// MinAutoconnectPriority and MaxAutoconnectPriority bound the
+// AutoconnectPriority of an interface, following NetworkManager.
+const (
+	MinAutoconnectPriority = -999
+	MaxAutoconnectPriority = 999
+)
+
+// MaxLinkGroup is the highest link group systemd-networkd accepts.
+const MaxLinkGroup = 2147483647
+
+// MaxWaitOnlineTimeout is the longest WaitOnlineTimeout or
+// WaitDeviceTimeout an interface can have, which is a day.
+const MaxWaitOnlineTimeout = 86400
+
+// Autoconnects returns whether the interface is brought up at boot.
+func (i Interface) Autoconnects() bool {
+	return i.Autoconnect == nil || *i.Autoconnect
+}
+
+// RequiredFamilies are the values RequiredFamily can have.
+var RequiredFamilies = []string{"ipv4", "ipv6", "both", "any"}
+
+// maxDescriptionLen is the longest interface alias the kernel accepts
+// (IFALIASZ less the trailing NUL).
+const maxDescriptionLen = 255
+
+// descriptionForbidden are the characters that cannot be used in a
+// description or alias, as they would break out of the comments and
+// quoted shell variables they are rendered into.
+const descriptionForbidden = "\"\\$`\r\n"
+
+// validateMacAddress checks that the MAC address the interface is
+// given is one the kernel will accept as the address of a device.
+func (i *Interface) validateMacAddress(e *Err) {
+	mac := i.MacAddress
+	switch {
+	case len(mac) == 0:
+	case mac[0]&1 != 0:
+		e.Errorf("macaddress %s is not a unicast address", mac)
+	case bytes.Count(mac, []byte{0}) == len(mac):
+		e.Errorf("macaddress %s is all zeros", mac)
+	}
+}
+
+// maxAltNameLen is the longest alternative name the kernel accepts
+// (ALTIFNAMSIZ less the trailing NUL).
+const maxAltNameLen = 127
+
+// BindHwAddr returns the MAC address that should be used to bind
+// config to a physical interface, preferring the permanent one.
+func (i Interface) BindHwAddr() gnet.HardwareAddr {
+	if len(i.PermanentHwAddr) > 0 {
+		return i.PermanentHwAddr
+	}
+	return i.CurrentHwAddr
+}
+
+// validateRouteDevs checks that routes sending traffic out of another
+// interface refer to one that can have layer 3 config.
+func (i *Interface) validateRouteDevs(l *Layout, e *Err) {
+	if i.Network == nil {
+		return
+	}
+	for _, r := range i.Network.Routes {
+		if r.Dev == "" || r.Dev == i.Name {
+			continue
+		}
+		if _, ok := l.Interfaces[r.Dev]; !ok {
+			e.Errorf("route to %v refers to undefined dev %s", r.To, r.Dev)
+			continue
+		}
+		for _, parent := range l.Interfaces {
+			if parent.Type != "bond" && parent.Type != "bridge" {
+				continue
+			}
+			for _, child := range parent.Interfaces {
+				if child == r.Dev {
+					e.Errorf("route to %v cannot use dev %s, it is enslaved to %s", r.To, r.Dev, parent.Name)
+				}
+			}
+		}
+	}
+}
+
+// validateAdActor checks the LACP actor settings of a bond.  The
+// kernel refuses an actor system that is a multicast or all-zero MAC
+// address.
+func (i *Interface) validateAdActor(e *Err) {
+	if v, ok := i.Parameters["ad-actor-system"]; ok {
+		if mac, valid := ValidateMac(e, "ad-actor-system", v); valid {
+			if len(mac) == 0 || mac[0]&1 == 1 || net.HardwareAddr(mac).String() == "00:00:00:00:00:00" {
+				e.Errorf("ad-actor-system %s must be a unicast, non-zero MAC address", mac)
+			}
+		}
+	}
+}
+
+// validateBondDelays checks that the up and down delays of a bond are
+// multiples of its MII monitoring interval.  The kernel rounds them
+// down to a multiple otherwise, which is rarely what was intended.
+func (i *Interface) validateBondDelays(e *Err) {
+	v, ok := i.Parameters["mii-monitor-interval"]
+	if !ok {
+		return
+	}
+	mii, valid := ValidateInt(e, "mii-monitor-interval", v, 0, math.MaxInt32)
+	if !valid || mii == 0 {
+		return
+	}
+	for _, k := range []string{"up-delay", "down-delay"} {
+		v, ok := i.Parameters[k]
+		if !ok {
+			continue
+		}
+		delay, valid := ValidateInt(e, k, v, 0, math.MaxInt32)
+		if !valid || delay%mii == 0 {
+			continue
+		}
+		nearest := (delay + mii/2) / mii * mii
+		e.Errorf("%s %d is not a multiple of mii-monitor-interval %d, the nearest valid value is %d", k, delay, mii, nearest)
+	}
+}
+
+// maxBondTargets is the most ARP or NS targets a bond can monitor.
+const maxBondTargets = 16
+
+// validateNSTargets checks the IPv6 neighbor solicitation targets of a
+// bond.  Like ARP targets they are probed every arp-interval, and the
+// kernel will not use them together with MII monitoring.
+func (i *Interface) validateNSTargets(e *Err) {
+	v, ok := i.Parameters["ns-ip6-targets"]
+	if !ok {
+		return
+	}
+	targets, valid := ValidateIPList(e, "ns-ip6-targets", v, false)
+	if !valid {
+		return
+	}
+	for _, t := range targets {
+		if t.IP.To4() != nil || t.IsCIDR() {
+			e.Errorf("ns-ip6-targets: %s is not a bare IPv6 address", t)
+		}
+	}
+	if len(targets) > maxBondTargets {
+		e.Errorf("ns-ip6-targets: a bond can have at most %d targets", maxBondTargets)
+	}
+	if mii, ok := i.Parameters["mii-monitor-interval"]; ok {
+		if val, _ := ValidateInt(e, "mii-monitor-interval", mii, 0, math.MaxInt32); val != 0 {
+			e.Errorf("ns-ip6-targets cannot be used with mii-monitor-interval")
+		}
+	}
+	interval := int64(0)
+	if arp, ok := i.Parameters["arp-interval"]; ok {
+		interval, _ = ValidateInt(e, "arp-interval", arp, 0, math.MaxInt32)
+	}
+	if interval == 0 {
+		e.Warnf("ns-ip6-targets are only monitored when arp-interval is set")
+	}
+}
+
+// restrictedGroupFwd are the bits of group-forward-mask the kernel
+// refuses to set, as forwarding STP, pause, and LACP frames would
+// break the bridge and its neighbors.
+const restrictedGroupFwd = 0x7
+
+// validateGroupFwdMask checks the group-forward-mask of a bridge,
+// which picks the link local groups 01:80:c2:00:00:0X it forwards.
+func (i *Interface) validateGroupFwdMask(e *Err) {
+	v, ok := i.Parameters["group-forward-mask"]
+	if !ok {
+		return
+	}
+	if i.Type != "bridge" {
+		e.Errorf("group-forward-mask is only supported on bridges")
+		return
+	}
+	mask, valid := ValidateInt(e, "group-forward-mask", v, 0, math.MaxUint16)
+	if valid && mask&restrictedGroupFwd != 0 {
+		e.Errorf("group-forward-mask %#x must not forward STP, pause, or LACP frames (mask %#x)", mask, restrictedGroupFwd)
+	}
+}
+
 func (i *Interface) validate(l *Layout) error {
 	e := &Err{Prefix: i.Type + ":" + i.MatchID}
 	if i.Interfaces == nil {
 		i.Interfaces = []string{}
 	}
-	if i.Type == "physical" {
-		if len(i.Interfaces) > 0 {
-			e.Errorf("%s:%s must not refer to sub interfaces %v", i.Type, i.Name, i.Interfaces)
+	if len(i.AlternativeNames) > 0 && i.Type != "physical" {
+		e.Errorf("%s:%s: alternative-names are only supported on physical interfaces", i.Type, i.Name)
+	}
+	for _, name := range i.AlternativeNames {
+		switch {
+		case name == "" || name == "." || name == "..":
+			e.Errorf("alternative name %q is not valid", name)
+		case len(name) > maxAltNameLen:
+			e.Errorf("alternative name %s is longer than %d characters", name, maxAltNameLen)
+		case strings.ContainsAny(name, "/: \t\n"):
+			e.Errorf("alternative name %q must not contain '/', ':', or whitespace", name)
+		case name == i.Name:
+			e.Errorf("alternative name %s is the same as the interface name", name)
+		}
+	}
+	if len(i.Description) > maxDescriptionLen {
+		e.Errorf("description is longer than %d characters", maxDescriptionLen)
+	}
+	if strings.ContainsAny(i.Description, descriptionForbidden) {
+		e.Errorf("description %q must be a single line without any of %q", i.Description, descriptionForbidden)
+	}
+	if len(i.Alias) > maxDescriptionLen {
+		e.Errorf("alias is longer than %d characters", maxDescriptionLen)
+	}
+	if strings.ContainsAny(i.Alias, descriptionForbidden) {
+		e.Errorf("alias %q must be a single line without any of %q", i.Alias, descriptionForbidden)
+	}
+	if i.RequiredFamily != "" {
+		ValidateStrIn(e, "required-family", i.RequiredFamily, RequiredFamilies...)
+		if i.Optional {
+			e.Warnf("required-family %s has no effect on an optional interface", i.RequiredFamily)
+		}
+	}
+	if i.WaitOnlineTimeout != 0 {
+		ValidateInt(e, "wait-online-timeout", i.WaitOnlineTimeout, 1, MaxWaitOnlineTimeout)
+		if i.Optional {
+			e.Errorf("wait-online-timeout cannot be set on an optional interface, which is never waited for")
+		} else if !i.Autoconnects() {
+			e.Warnf("wait-online-timeout has no effect when autoconnect is false")
+		}
+	}
+	if i.WaitDeviceTimeout != 0 {
+		ValidateInt(e, "wait-device-timeout", i.WaitDeviceTimeout, 1, MaxWaitOnlineTimeout)
+		switch {
+		case i.Type != "physical":
+			e.Errorf("wait-device-timeout can only be set on physical interfaces")
+		case i.Optional:
+			e.Warnf("wait-device-timeout has no effect on an optional interface, which is never waited for")
+		case !i.Autoconnects():
+			e.Warnf("wait-device-timeout has no effect when autoconnect is false")
+		}
+	}
+	i.validateQueueCPUs(e)
+	i.validateMTU(e)
+	if i.AutoconnectPriority != nil {
+		ValidateInt(e, "autoconnect-priority", *i.AutoconnectPriority, MinAutoconnectPriority, MaxAutoconnectPriority)
+		if !i.Autoconnects() {
+			e.Warnf("autoconnect-priority has no effect when autoconnect is false")
 		}
-		return e.OrNil()
 	}
+	i.validateMacAddress(e)
+	i.validateLinkFlags(e)
+	ValidateInt(e, "group", i.Group, 0, MaxLinkGroup)
+	i.validateOrder(l, e)
+	// The network of every interface is validated, including physical
+	// ones and the members of bonds and bridges whose network is
+	// discarded later, so that mistakes in it are reported rather
+	// than silently written out or dropped.
 	if i.Network != nil {
 		e.Merge(i.Network.validate())
 	}
+	i.validateRouteDevs(l, e)
+	if i.Type == "bond" {
+		i.validateAdActor(e)
+		i.validateBondMode(e)
+		i.validateBondDelays(e)
+		i.validateNSTargets(e)
+	}
+	i.validateGroupFwdMask(e)
+	i.validateBridgeVlans(e)
+	i.validateQueueIDs(e)
+	i.validateTunnel(e)
+	i.validateVeth(l, e)
+	i.validateRename(e)
+	if i.Type == "physical" || i.Type == "tunnel" || i.Type == "veth" {
+		if len(i.Interfaces) > 0 {
+			e.Errorf("%s:%s must not refer to sub interfaces %v", i.Type, i.Name, i.Interfaces)
+		}
+		return e.OrNil()
+	}
 	sort.Strings(i.Interfaces)
 	for _, name := range i.Interfaces {
 		child, ok := l.Interfaces[name]
@@ -428,6 +1297,83 @@ type Layout struct {
 	Child2Parent map[string][]string
 	// Roots contains the tops of the network configuration.
 	Roots []string
+	// Renderer is the backend the source configuration asked to be
+	// rendered with.  It must be empty or one of the keys of
+	// Renderers.
+	Renderer string `json:",omitempty"`
+	// Hostname is the hostname the system should have, if the source
+	// configuration set one.  It is only written out when asked for,
+	// as it is not part of the network configuration proper.
+	Hostname string `json:",omitempty"`
+	// DefaultMetric is the metric routes get when they do not set
+	// one.  Writers leave the metric off routes whose metric is the
+	// default.  If 0, DefaultRouteMetric is used.
+	DefaultMetric int `json:",omitempty"`
+	// ForbiddenPrefixes are prefixes that interfaces may not have
+	// static addresses in, such as the link-local or documentation
+	// ranges, on top of DefaultForbiddenPrefixes.
+	ForbiddenPrefixes []*gnet.IPNet `json:",omitempty"`
+}
+
+// DefaultRouteMetric is the default metric of a Layout that does not
+// set one.
+const DefaultRouteMetric = 100
+
+// RouteMetric returns the metric routes in l get when they do not set
+// one.
+func (l *Layout) RouteMetric() int {
+	if l.DefaultMetric != 0 {
+		return l.DefaultMetric
+	}
+	return DefaultRouteMetric
+}
+
+// Renderers maps the renderers an input format can ask for to the
+// output format that writes configuration for them.
+var Renderers = map[string]string{
+	"networkd":       "systemd",
+	"NetworkManager": "nmkeyfile",
+}
+
+// DefaultRenderer is the renderer a Layout gets when its input does
+// not ask for one.
+var DefaultRenderer = "networkd"
+
+// rendererAliases maps common wrong spellings of renderers to the
+// renderer that was probably meant.
+var rendererAliases = map[string]string{
+	"systemd":          "networkd",
+	"systemd-networkd": "networkd",
+	"networkmanager":   "NetworkManager",
+	"network-manager":  "NetworkManager",
+	"nm":               "NetworkManager",
+}
+
+// RendererNames returns the keys of Renderers in a stable order.
+func RendererNames() []string {
+	res := []string{}
+	for k := range Renderers {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ValidateRenderer validates that r is one of Renderers.  An empty r
+// is valid, and is replaced with DefaultRenderer.
+func ValidateRenderer(e *Err, k, r string) (string, bool) {
+	if r == "" {
+		return DefaultRenderer, true
+	}
+	if _, ok := Renderers[r]; ok {
+		return r, true
+	}
+	if alias, ok := rendererAliases[strings.ToLower(r)]; ok {
+		e.Errorf("%s: %q is not one of %v, did you mean %q?", k, r, RendererNames(), alias)
+	} else {
+		e.Errorf("%s: %q is not one of %v", k, r, RendererNames())
+	}
+	return r, false
 }
 
 func (l *Layout) Compile(phys []Phy) (*Layout, error) {
@@ -477,12 +1423,14 @@ func (l *Layout) Write(dest string) error {
 	return err
 }
 
-func (l *Layout) cyclic(intf string, working []string, clean map[string]struct{}, e *Err) {
+// cyclic reports any cycle reachable from intf in graph, which maps
+// each interface to the ones that must come up after it.
+func (l *Layout) cyclic(intf string, working []string, clean map[string]struct{}, graph map[string][]string, e *Err) {
 	if _, ok := clean[intf]; ok {
 		// We already know that this interface is not part of a cycle.
 		return
 	}
-	next, found := l.Child2Parent[intf]
+	next, found := graph[intf]
 	if !found {
 		// We hit the end of a branch.  Mark all working nodes as clean.
 		for _, n := range working {
@@ -498,8 +1446,37 @@ func (l *Layout) cyclic(intf string, working []string, clean map[string]struct{}
 	}
 	working = append(working, intf)
 	for _, n := range next {
-		l.cyclic(n, working, clean, e)
+		l.cyclic(n, working, clean, graph, e)
+	}
+}
+
+// ClaimedPhys returns the sorted names of the physical interfaces l
+// will configure, whether it configures them directly or through the
+// bonds, bridges, and vlans built on them.
+func (l *Layout) ClaimedPhys() []string {
+	claimed := map[string]struct{}{}
+	var walk func(string)
+	walk = func(name string) {
+		intf, ok := l.Interfaces[name]
+		if !ok {
+			return
+		}
+		if intf.Type == "physical" {
+			claimed[name] = struct{}{}
+		}
+		for _, child := range intf.Interfaces {
+			walk(child)
+		}
 	}
+	for name := range l.Interfaces {
+		walk(name)
+	}
+	res := []string{}
+	for name := range claimed {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
 }
 
 // Validate validates that the Layout describes a sane network
@@ -509,6 +1486,12 @@ func (l *Layout) cyclic(intf string, working []string, clean map[string]struct{}
 func (l *Layout) Validate() error {
 	e := &Err{Prefix: "layout"}
 	l.Child2Parent = map[string][]string{}
+	if l.Hostname != "" {
+		ValidateHostname(e, "hostname", l.Hostname)
+	}
+	if l.DefaultMetric < 0 || int64(l.DefaultMetric) > math.MaxUint32 {
+		e.Errorf("default metric %d must be between 0 and %d", l.DefaultMetric, uint32(math.MaxUint32))
+	}
 	members := []string{}
 	for k := range l.Interfaces {
 		members = append(members, k)
@@ -518,26 +1501,49 @@ func (l *Layout) Validate() error {
 		v := l.Interfaces[k]
 		e.Merge(v.validate(l))
 	}
+	altNames := map[string]string{}
+	for _, k := range members {
+		altNames[k] = k
+	}
+	for _, k := range members {
+		for _, name := range l.Interfaces[k].AlternativeNames {
+			if other, ok := altNames[name]; ok && other != k {
+				e.Errorf("%s: alternative name %s is already used by %s", k, name, other)
+				continue
+			}
+			altNames[name] = k
+		}
+	}
+	l.validateForbiddenPrefixes(e)
 	if !e.Empty() {
 		return e
 	}
+	l.validateRenamedMembers(e)
 	for _, k := range members {
 		v := l.Interfaces[k]
 		if (v.Type == "bridge" || v.Type == "bond") && len(v.Interfaces) > 0 {
 			for idx := range v.Interfaces {
 				child := l.Interfaces[v.Interfaces[idx]]
+				if child.Network.hasLayer3() {
+					e.Warnf("interface %s has layer-3 config that will be discarded because it is enslaved to %s", child.Name, v.Name)
+				}
 				child.Network = nil
 				l.Interfaces[child.Name] = child
 			}
 		}
 	}
+	l.validateRoutes(members, e)
 	cleanInterfaces := map[string]struct{}{}
-	for k := range l.Interfaces {
+	upBefore := l.upBefore()
+	for _, k := range members {
 		if _, ok := l.Child2Parent[k]; !ok {
 			l.Roots = append(l.Roots, k)
 		}
-		l.cyclic(k, []string{}, cleanInterfaces, e)
+		l.cyclic(k, []string{}, cleanInterfaces, upBefore, e)
 	}
 	sort.Strings(l.Roots)
+	if e.Empty() {
+		l.deriveMTUs(e)
+	}
 	return e.OrNil()
 }
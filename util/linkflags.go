@@ -0,0 +1,55 @@
+package util
+
+// LinkFlag is a link level flag of an interface that is turned on or
+// off.
+type LinkFlag struct {
+	// Name is the name of the flag as ip link knows it.
+	Name string
+	// Key is the name of the flag in the [Link] section of a
+	// systemd-networkd .network file.
+	Key string
+	On  bool
+}
+
+// IPArgs returns the arguments to ip link set that set f.
+func (f LinkFlag) IPArgs() string {
+	if f.On {
+		return f.Name + " on"
+	}
+	return f.Name + " off"
+}
+
+// LinkFlags returns the link flags that i sets, in a stable order.
+// Flags that are not set are left at the kernel default, which is on
+// for arp and multicast and off for allmulticast.
+func (i Interface) LinkFlags() []LinkFlag {
+	res := []LinkFlag{}
+	for _, f := range []struct {
+		name, key string
+		on        *bool
+	}{
+		{"arp", "ARP", i.ARP},
+		{"multicast", "Multicast", i.Multicast},
+		{"allmulticast", "AllMulticast", i.AllMulticast},
+	} {
+		if f.on != nil {
+			res = append(res, LinkFlag{Name: f.name, Key: f.key, On: *f.on})
+		}
+	}
+	return res
+}
+
+// validateLinkFlags warns when i turns off ARP while having static
+// IPv4 addresses, as nothing on the link will be able to resolve
+// them.
+func (i *Interface) validateLinkFlags(e *Err) {
+	if i.ARP == nil || *i.ARP || i.Network == nil {
+		return
+	}
+	for _, addr := range i.Network.Addresses {
+		if addr.IP.To4() != nil {
+			e.Warnf("arp is off, so neighbors will not be able to resolve static address %s", addr)
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// LLDPNeighbor holds what lldpd knows about the switch port an
+// interface is plugged in to.
+type LLDPNeighbor struct {
+	// SysName is the system name the neighboring switch advertises.
+	SysName string `json:"sysname,omitempty"`
+	// ChassisID is the chassis ID the neighboring switch advertises.
+	ChassisID string `json:"chassis-id,omitempty"`
+	// PortID is the ID of the port on the neighboring switch.
+	PortID string `json:"port-id,omitempty"`
+	// PortDescr is the description of the port on the neighboring
+	// switch.
+	PortDescr string `json:"port-descr,omitempty"`
+}
+
+// lldpTimeout is how long we will wait for lldpctl to answer.
+var lldpTimeout = 10 * time.Second
+
+// lldpEntries flattens the various shapes lldpctl uses for
+// collections. A single entry is rendered as an object keyed by
+// name, multiple entries are rendered as a list of such objects.
+func lldpEntries(v interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range val {
+			res[k] = vv
+		}
+	case []interface{}:
+		for _, item := range val {
+			for k, vv := range lldpEntries(item) {
+				res[k] = vv
+			}
+		}
+	}
+	return res
+}
+
+func lldpMap(v interface{}, k string) map[string]interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	res, _ := m[k].(map[string]interface{})
+	return res
+}
+
+func lldpStr(v interface{}, k string) string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch val := m[k].(type) {
+	case string:
+		return val
+	case map[string]interface{}:
+		res, _ := val["value"].(string)
+		return res
+	}
+	return ""
+}
+
+// ParseLLDP parses the output of `lldpctl -f json` into a map of
+// local interface name to the neighbor seen on that interface.
+func ParseLLDP(buf []byte) (map[string]LLDPNeighbor, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		return nil, fmt.Errorf("Error parsing lldpctl output: %v", err)
+	}
+	res := map[string]LLDPNeighbor{}
+	lldp, ok := doc["lldp"].(map[string]interface{})
+	if !ok {
+		return res, nil
+	}
+	for name, v := range lldpEntries(lldp["interface"]) {
+		n := LLDPNeighbor{}
+		if chassis := lldpMap(v, "chassis"); chassis != nil {
+			if _, found := chassis["id"]; found {
+				n.ChassisID = lldpStr(chassis, "id")
+			} else {
+				for sysName, c := range lldpEntries(chassis) {
+					n.SysName = sysName
+					n.ChassisID = lldpStr(c, "id")
+					break
+				}
+			}
+		}
+		if port := lldpMap(v, "port"); port != nil {
+			n.PortID = lldpStr(port, "id")
+			n.PortDescr = lldpStr(port, "descr")
+		}
+		res[name] = n
+	}
+	return res, nil
+}
+
+// GatherLLDP asks lldpctl for the current set of LLDP neighbors.
+func GatherLLDP(ctx context.Context) (map[string]LLDPNeighbor, error) {
+	ctx, cancel := context.WithTimeout(ctx, lldpTimeout)
+	defer cancel()
+	buf, err := exec.CommandContext(ctx, "lldpctl", "-f", "json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error running lldpctl: %v", err)
+	}
+	return ParseLLDP(buf)
+}
+
+// GatherPhysWithLLDP gathers all the physical interfaces present on
+// the machine with opts just like GatherPhys, and then attaches any LLDP
+// neighbor information lldpd has for them.  If lldpctl is not
+// available or fails, the phys are returned without LLDP
+// information.
+func GatherPhysWithLLDP(opts GatherPhysOpts) ([]Phy, error) {
+	res, err := GatherPhys(opts)
+	if err != nil {
+		return res, err
+	}
+	neighbors, err := GatherLLDP(context.Background())
+	if err != nil {
+		return res, nil
+	}
+	for i := range res {
+		if n, ok := neighbors[res[i].Name]; ok {
+			nn := n
+			res[i].LLDP = &nn
+		}
+	}
+	return res, nil
+}
+
+// EmitLLDPAgents are the LLDP agents other than the default nearest
+// bridge that an interface can emit LLDP packets to.
+var EmitLLDPAgents = []string{"nearest-bridge", "non-tpmr-bridge", "customer-bridge"}
+
+// lldpAgentFlags maps EmitLLDPAgents to their lldptool agent names.
+var lldpAgentFlags = map[string]string{
+	"nearest-bridge":  "nb",
+	"non-tpmr-bridge": "nntpmrb",
+	"customer-bridge": "ncb",
+}
+
+// ValidateEmitLLDP validates that v is either a boolean or one of
+// EmitLLDPAgents.  Booleans are returned as "true" or "false".
+func ValidateEmitLLDP(e *Err, k string, v interface{}) (res string, valid bool) {
+	if s, ok := v.(string); ok {
+		for _, agent := range EmitLLDPAgents {
+			if s == agent {
+				return s, true
+			}
+		}
+	}
+	b, valid := ValidateBool(&Err{}, k, v)
+	if !valid {
+		e.Errorf("%s: %v must be a boolean or one of %v", k, v, EmitLLDPAgents)
+		return
+	}
+	return fmt.Sprintf("%t", b), true
+}
+
+// VEmitLLDP returns a Validator that validates emit-lldp settings.
+func VEmitLLDP() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"anyOf": []Schema{{"type": "boolean"}, strSchema(EmitLLDPAgents)}}, true
+		}
+		return ValidateEmitLLDP(e, k, v)
+	}
+}
+
+// LLDPToolCmd returns the lldptool command that makes lldpad send and
+// receive LLDP on the Interface as requested by EmitLLDP and LLDP, or
+// an empty string if neither is set.
+func (i Interface) LLDPToolCmd() string {
+	if i.EmitLLDP == "" && i.LLDP == nil {
+		return ""
+	}
+	rx := i.LLDP == nil || *i.LLDP
+	tx := i.EmitLLDP != "" && i.EmitLLDP != "false"
+	status := "disabled"
+	switch {
+	case rx && tx:
+		status = "rxtx"
+	case rx:
+		status = "rx"
+	case tx:
+		status = "tx"
+	}
+	res := "lldptool -L -i " + i.Name
+	if agent, ok := lldpAgentFlags[i.EmitLLDP]; ok {
+		res += " -g " + agent
+	}
+	return res + " adminStatus=" + status
+}
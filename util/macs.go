@@ -0,0 +1,72 @@
+package util
+
+import (
+	"crypto/sha256"
+	"sort"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+)
+
+// StableMac derives a locally administered unicast MAC address from
+// seed and name, so that an interface named name gets the same
+// address every time it is created on a machine with seed.
+func StableMac(seed, name string) gnet.HardwareAddr {
+	sum := sha256.Sum256([]byte(seed + "\n" + name))
+	mac := gnet.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&^1 | 2
+	return mac
+}
+
+// wantsStableMac returns whether i is a virtual interface that the
+// kernel would otherwise give a random or borrowed MAC address.
+func (i Interface) wantsStableMac() bool {
+	switch i.Type {
+	case "bond", "bridge", "vlan", "veth":
+		return true
+	case "tunnel":
+		return ethernetTunnels[i.TunnelMode()]
+	}
+	return false
+}
+
+// GenerateMacs gives the bonds, bridges, vlans, veths, and ethernet
+// tunnels in l that have no MAC address one derived from seed with StableMac.
+// The generated addresses must not be used by any other interface in
+// l.
+func (l *Layout) GenerateMacs(seed string) error {
+	e := &Err{Prefix: "macs"}
+	if seed == "" {
+		e.Errorf("a seed is needed to generate MAC addresses")
+		return e
+	}
+	names := []string{}
+	used := map[string]string{}
+	for k, intf := range l.Interfaces {
+		names = append(names, k)
+		for _, mac := range []gnet.HardwareAddr{intf.MacAddress, intf.CurrentHwAddr, intf.PermanentHwAddr} {
+			if len(mac) > 0 {
+				used[mac.String()] = k
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		intf := l.Interfaces[k]
+		if !intf.wantsStableMac() || len(intf.MacAddress) > 0 {
+			continue
+		}
+		mac := StableMac(seed, k)
+		if mac[0]&2 == 0 {
+			e.Errorf("%s: generated MAC address %s is not locally administered", k, mac)
+			continue
+		}
+		if other, ok := used[mac.String()]; ok {
+			e.Errorf("%s: generated MAC address %s is already used by %s", k, mac, other)
+			continue
+		}
+		used[mac.String()] = k
+		intf.MacAddress = mac
+		l.Interfaces[k] = intf
+	}
+	return e.OrNil()
+}
@@ -0,0 +1,41 @@
+package util
+
+import gnet "github.com/rackn/gohai/plugins/net"
+
+// validateGatewayMetrics hands GatewayMetric down to the default
+// routes via Gateway4 and Gateway6 that do not set a metric of their
+// own, and warns about static and DHCP default routes that would
+// tie, as then which of them is used is up to the order they were
+// added in.
+func (n *Network) validateGatewayMetrics(e *Err) {
+	if n.GatewayMetric != 0 {
+		if n.Gateway4 == nil && n.Gateway6 == nil {
+			e.Errorf("gateway-metric requires gateway4 or gateway6")
+		}
+		if n.Gateway4 != nil && n.Gateway4Metric == 0 {
+			n.Gateway4Metric = n.GatewayMetric
+		}
+		if n.Gateway6 != nil && n.Gateway6Metric == 0 {
+			n.Gateway6Metric = n.GatewayMetric
+		}
+		n.GatewayMetric = 0
+	}
+	for _, family := range []struct {
+		name   string
+		dhcp   bool
+		gw     *gnet.IPNet
+		metric int
+		o      *Overrides
+	}{
+		{"4", n.Dhcp4, n.Gateway4, n.Gateway4Metric, n.Dhcp4Overrides},
+		{"6", n.Dhcp6, n.Gateway6, n.Gateway6Metric, n.Dhcp6Overrides},
+	} {
+		if !family.dhcp || family.gw == nil || family.o == nil || !family.o.UseRoutes {
+			continue
+		}
+		if family.metric != 0 && family.metric == family.o.RouteMetric {
+			e.Warnf("gateway%s-metric and dhcp%s-overrides route-metric are both %d, so which default route is used is not deterministic",
+				family.name, family.name, family.metric)
+		}
+	}
+}
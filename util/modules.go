@@ -0,0 +1,84 @@
+package util
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+)
+
+// typeModules maps the types of virtual interfaces to the kernel
+// module that creates them.
+var typeModules = map[string]string{
+	"bond":   "bonding",
+	"bridge": "bridge",
+	"vlan":   "8021q",
+	"veth":   "veth",
+}
+
+// tunnelModules maps the modes of tunnels to the kernel module that
+// creates them.
+var tunnelModules = map[string]string{
+	"ipip":      "ipip",
+	"sit":       "sit",
+	"gre":       "ip_gre",
+	"gretap":    "ip_gre",
+	"ip6gre":    "ip6_gre",
+	"ip6gretap": "ip6_gre",
+	"ipip6":     "ip6_tunnel",
+	"ip6ip6":    "ip6_tunnel",
+}
+
+// Module returns the kernel module needed to create i, or an empty
+// string if i does not need one.
+func (i Interface) Module() string {
+	if i.Type == "tunnel" {
+		return tunnelModules[i.TunnelMode()]
+	}
+	return typeModules[i.Type]
+}
+
+// ModuleAvailable returns whether the kernel module name is either
+// already loaded or built in, or can be loaded by modprobe.  On
+// systems other than Linux, which have no kernel modules to check,
+// every module is taken to be available.
+func ModuleAvailable(name string) bool {
+	if runtime.GOOS != "linux" {
+		return true
+	}
+	if _, err := os.Stat(path.Join("/sys/module", name)); err == nil {
+		return true
+	}
+	return exec.Command("modinfo", "-n", name).Run() == nil
+}
+
+// CheckModules checks that the kernel modules needed to create the
+// interfaces in l are available, as reported by available.  It is
+// usually passed ModuleAvailable, and is only asked about each module
+// once.
+func (l *Layout) CheckModules(available func(string) bool) error {
+	e := &Err{Prefix: "modules"}
+	names := []string{}
+	for k := range l.Interfaces {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	checked := map[string]bool{}
+	for _, k := range names {
+		intf := l.Interfaces[k]
+		mod := intf.Module()
+		if mod == "" {
+			continue
+		}
+		ok, found := checked[mod]
+		if !found {
+			ok = available(mod)
+			checked[mod] = ok
+		}
+		if !ok {
+			e.Errorf("%s %s: kernel module %s is not available", intf.Type, k, mod)
+		}
+	}
+	return e.OrNil()
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MinMTU and MaxMTU bound the MTU of an interface.  The kernel will
+// not run IPv4 over anything smaller than MinMTU.
+const (
+	MinMTU = 68
+	MaxMTU = 65535
+)
+
+// MinIPv6MTU and MaxIPv6MTU bound the IPv6 MTU of an interface.
+// IPv6 requires every link to carry packets of at least MinIPv6MTU.
+const (
+	MinIPv6MTU = 1280
+	MaxIPv6MTU = 65536
+)
+
+func (i *Interface) validateMTU(e *Err) {
+	if i.MTU != 0 {
+		ValidateInt(e, "mtu", i.MTU, MinMTU, MaxMTU)
+	}
+	if i.Network != nil && i.Network.IPv6MTU != 0 && i.MTU != 0 && i.Network.IPv6MTU > i.MTU {
+		e.Errorf("ipv6-mtu %d is larger than the mtu %d", i.Network.IPv6MTU, i.MTU)
+	}
+}
+
+// deriveMTUs fills in the MTUs that can be derived from related
+// interfaces.  Bond members get the MTU of their bond and vice versa,
+// as the kernel forces them to be the same, and vlans get the MTU of
+// their link.  Bridges are then checked for ports with mixed MTUs.
+// It must only be called once Child2Parent has been populated and
+// checked for cycles.
+func (l *Layout) deriveMTUs(e *Err) {
+	names := []string{}
+	for k := range l.Interfaces {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		bond := l.Interfaces[k]
+		if bond.Type != "bond" {
+			continue
+		}
+		if bond.MTU == 0 {
+			for _, m := range bond.Interfaces {
+				member := l.Interfaces[m]
+				if member.MTU == 0 {
+					continue
+				}
+				if bond.MTU == 0 {
+					bond.MTU = member.MTU
+				} else if bond.MTU != member.MTU {
+					e.Errorf("bond %s: members have different mtus %d and %d", k, bond.MTU, member.MTU)
+					break
+				}
+			}
+			l.Interfaces[k] = bond
+		}
+		if bond.MTU == 0 {
+			continue
+		}
+		for _, m := range bond.Interfaces {
+			member := l.Interfaces[m]
+			if member.MTU == 0 {
+				member.MTU = bond.MTU
+				l.Interfaces[m] = member
+			} else if member.MTU != bond.MTU {
+				e.Errorf("%s: mtu %d does not match the mtu %d of bond %s", m, member.MTU, bond.MTU, k)
+			}
+		}
+	}
+	done := map[string]struct{}{}
+	for _, k := range names {
+		l.deriveVlanMTU(k, done, e)
+	}
+	for _, k := range names {
+		l.validateBridgeMTU(k, e)
+	}
+}
+
+// validateBridgeMTU warns when the ports of the bridge name have
+// different MTUs and the bridge does not have the smallest one, or
+// when the bridge has a larger MTU than some of its ports.  Either
+// way frames that are too big for a port are dropped.  Ports without
+// an MTU keep the one they come up with, which is not known here, so
+// they are not checked.
+func (l *Layout) validateBridgeMTU(name string, e *Err) {
+	br := l.Interfaces[name]
+	if br.Type != "bridge" {
+		return
+	}
+	ports := []string{}
+	for _, p := range br.Interfaces {
+		if l.Interfaces[p].MTU != 0 {
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) == 0 {
+		return
+	}
+	sort.Strings(ports)
+	min, mixed := l.Interfaces[ports[0]].MTU, false
+	for _, p := range ports[1:] {
+		mtu := l.Interfaces[p].MTU
+		mixed = mixed || mtu != min
+		if mtu < min {
+			min = mtu
+		}
+	}
+	offending := []string{}
+	for _, p := range ports {
+		if mtu := l.Interfaces[p].MTU; (br.MTU == 0 && mixed) || (br.MTU != 0 && mtu < br.MTU) {
+			offending = append(offending, fmt.Sprintf("%s (mtu %d)", p, mtu))
+		}
+	}
+	switch {
+	case len(offending) == 0:
+	case br.MTU == 0:
+		e.Warnf("bridge %s: ports %s have different mtus, set the mtu of the bridge to %d so frames are not dropped", name, strings.Join(offending, ", "), min)
+	default:
+		e.Warnf("bridge %s: mtu %d is larger than the mtu of ports %s, which will drop larger frames", name, br.MTU, strings.Join(offending, ", "))
+	}
+}
+
+// deriveVlanMTU derives the MTU of the vlan name from its link, after
+// deriving the MTU of the link if that is a vlan too.
+func (l *Layout) deriveVlanMTU(name string, done map[string]struct{}, e *Err) {
+	if _, ok := done[name]; ok {
+		return
+	}
+	done[name] = struct{}{}
+	vlan := l.Interfaces[name]
+	if vlan.Type != "vlan" || len(vlan.Interfaces) == 0 {
+		return
+	}
+	l.deriveVlanMTU(vlan.Interfaces[0], done, e)
+	link := l.Interfaces[vlan.Interfaces[0]]
+	switch {
+	case link.MTU == 0:
+	case vlan.MTU == 0:
+		vlan.MTU = link.MTU
+		l.Interfaces[name] = vlan
+	case vlan.MTU > link.MTU:
+		e.Errorf("vlan %s: mtu %d is larger than the mtu %d of its link %s", name, vlan.MTU, link.MTU, link.Name)
+	}
+}
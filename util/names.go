@@ -0,0 +1,173 @@
+package util
+
+import (
+	"sort"
+	"strings"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+)
+
+// currentName returns the name the nic that will become intf has
+// right now, or an empty string if it is not one of phys.  Nics are
+// found by MAC address when one is known, as that is what they keep
+// across a rename.  Bond slaves can share a MAC address, so a nic
+// that already has the name of intf wins.
+func currentName(intf Interface, phys []Phy) string {
+	macs := []gnet.HardwareAddr{}
+	for _, mac := range []gnet.HardwareAddr{intf.PermanentHwAddr, intf.CurrentHwAddr} {
+		if len(mac) > 0 {
+			macs = append(macs, mac)
+		}
+	}
+	for _, phy := range phys {
+		if phy.Name != intf.Name {
+			continue
+		}
+		if len(macs) == 0 {
+			return phy.Name
+		}
+		for _, mac := range macs {
+			if phy.MatchesMac(mac) {
+				return phy.Name
+			}
+		}
+	}
+	for _, mac := range macs {
+		for _, phy := range phys {
+			if phy.MatchesMac(mac) {
+				return phy.Name
+			}
+		}
+	}
+	return ""
+}
+
+// ValidateNames validates that the interfaces in l can be given their
+// names on a machine with phys.  The kernel will only give an
+// interface a name that no other interface has, so a virtual
+// interface cannot take the name of a nic, a nic cannot be renamed
+// to the name of another nic that keeps its name, and nics cannot be
+// renamed in a cycle.
+func (l *Layout) ValidateNames(phys []Phy) error {
+	e := &Err{Prefix: "names"}
+	names := []string{}
+	for k := range l.Interfaces {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	existing := map[string]struct{}{}
+	for _, phy := range phys {
+		existing[phy.Name] = struct{}{}
+	}
+	// renames maps the current name of a nic to the name it will get.
+	renames := map[string]string{}
+	for _, k := range names {
+		intf := l.Interfaces[k]
+		if intf.Type != "physical" {
+			continue
+		}
+		if cur := currentName(intf, phys); cur != "" && cur != k {
+			renames[cur] = k
+		}
+	}
+	for _, k := range names {
+		if _, ok := existing[k]; !ok {
+			continue
+		}
+		if _, ok := renames[k]; ok {
+			// The nic that has the name now is moving out of the way.
+			continue
+		}
+		intf := l.Interfaces[k]
+		if intf.Type != "physical" {
+			e.Errorf("%s %s: name is already used by a physical nic", intf.Type, k)
+			continue
+		}
+		if cur := currentName(intf, phys); cur != k {
+			e.Errorf("%s: cannot rename %s to %s, which is already used by a physical nic", k, cur, k)
+		}
+	}
+	froms := []string{}
+	for k := range renames {
+		froms = append(froms, k)
+	}
+	sort.Strings(froms)
+	reported := map[string]struct{}{}
+	for _, start := range froms {
+		path := []string{start}
+		for next, ok := renames[start]; ok; next, ok = renames[next] {
+			if _, done := reported[next]; done {
+				break
+			}
+			path = append(path, next)
+			if next == start {
+				for _, n := range path {
+					reported[n] = struct{}{}
+				}
+				e.Errorf("rename cycle: %s", strings.Join(path, " -> "))
+				break
+			}
+			if len(path) > len(renames) {
+				// A cycle that start leads into but is not part of.
+				break
+			}
+		}
+	}
+	return e.OrNil()
+}
+
+// maxIfNameLen is the longest name the kernel will give an interface
+// (IFNAMSIZ less the trailing NUL).
+const maxIfNameLen = 15
+
+// validateRename checks that a renamed interface is a physical one
+// that can be found by its permanent MAC address, and that the kernel
+// will accept its new name.
+func (i *Interface) validateRename(e *Err) {
+	if !i.Rename {
+		return
+	}
+	if i.Type != "physical" {
+		e.Errorf("only physical interfaces can be renamed")
+		return
+	}
+	validateIfName(e, "name", i.Name)
+	if len(i.PermanentHwAddr) == 0 {
+		e.Errorf("cannot rename to %s without knowing the permanent MAC address", i.Name)
+	}
+}
+
+// validateRenamedMembers checks that no member of a bond or bridge is
+// renamed.  The kernel only renames interfaces that are down, so the
+// rename would have to happen before the member is enslaved, and
+// nothing orders the two.  It needs l.Child2Parent.
+func (l *Layout) validateRenamedMembers(e *Err) {
+	names := []string{}
+	for k := range l.Child2Parent {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if !l.Interfaces[k].Rename {
+			continue
+		}
+		for _, parent := range l.Child2Parent[k] {
+			if p := l.Interfaces[parent]; p.Type == "bond" || p.Type == "bridge" {
+				e.Errorf("%s: cannot be renamed, as it is a member of %s %s", k, p.Type, parent)
+			}
+		}
+	}
+}
+
+// validateIfName checks that the kernel will give an interface name,
+// which is the k of some interface.
+func validateIfName(e *Err, k, name string) {
+	switch {
+	case name == "" || name == "." || name == "..":
+		e.Errorf("%s %q is not valid", k, name)
+	case len(name) > maxIfNameLen:
+		e.Errorf("%s %s is longer than %d characters", k, name, maxIfNameLen)
+	case strings.ContainsAny(name, "/: \t\n"):
+		e.Errorf("%s %q must not contain '/', ':', or whitespace", k, name)
+	}
+}
@@ -0,0 +1,55 @@
+package util
+
+import "sort"
+
+// OrderAfter returns the names of the interfaces that i must be
+// brought up after, which are the ones it lists in After and
+// Requires, sorted and without duplicates.
+func (i Interface) OrderAfter() []string {
+	seen := map[string]struct{}{}
+	res := []string{}
+	for _, names := range [][]string{i.After, i.Requires} {
+		for _, name := range names {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// validateOrder checks that the interfaces i is ordered after are
+// other interfaces in l.
+func (i *Interface) validateOrder(l *Layout, e *Err) {
+	for _, name := range i.OrderAfter() {
+		if name == i.Name {
+			e.Errorf("cannot be ordered after itself")
+			continue
+		}
+		if _, ok := l.Interfaces[name]; !ok {
+			e.Errorf("ordered after %s, which does not exist", name)
+		}
+	}
+}
+
+// upBefore returns the interfaces that must be up before each
+// interface in l is brought up: the ones it is built on, and the ones
+// it is ordered after.
+func (l *Layout) upBefore() map[string][]string {
+	res := map[string][]string{}
+	for k, parents := range l.Child2Parent {
+		res[k] = append(res[k], parents...)
+	}
+	for name, i := range l.Interfaces {
+		for _, dep := range i.OrderAfter() {
+			res[dep] = append(res[dep], name)
+		}
+	}
+	for k := range res {
+		sort.Strings(res[k])
+	}
+	return res
+}
@@ -2,8 +2,15 @@ package util
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
 
 	gnet "github.com/rackn/gohai/plugins/net"
 )
@@ -14,16 +21,59 @@ type Match struct {
 	Name       string            `json:"name,omitempty"`
 	MacAddress gnet.HardwareAddr `json:"macaddress,omitempty"`
 	Driver     string            `json:"driver,omitempty"`
+	LLDPPort   string            `json:"lldp-port,omitempty"`
+	LLDPSwitch string            `json:"lldp-switch,omitempty"`
+}
+
+// String renders the Match as a comma separated list of key=value pairs.
+func (m Match) String() string {
+	parts := []string{}
+	if m.Name != "" {
+		parts = append(parts, "name="+m.Name)
+	}
+	if len(m.MacAddress) > 0 {
+		parts = append(parts, "macaddress="+m.MacAddress.String())
+	}
+	if m.Driver != "" {
+		parts = append(parts, "driver="+m.Driver)
+	}
+	if m.LLDPPort != "" {
+		parts = append(parts, "lldp-port="+m.LLDPPort)
+	}
+	if m.LLDPSwitch != "" {
+		parts = append(parts, "lldp-switch="+m.LLDPSwitch)
+	}
+	return strings.Join(parts, ",")
 }
 
 type Phy struct {
 	gnet.Interface
 	BootIf bool
+	// LLDP is the LLDP neighbor seen on this interface, if any.
+	LLDP *LLDPNeighbor `json:",omitempty"`
+	// PermanentHwAddr is the burned-in MAC address of the interface,
+	// if it is known.  It differs from HardwareAddr when the
+	// interface is enslaved to a bond.
+	PermanentHwAddr gnet.HardwareAddr `json:",omitempty"`
+	// DerivedName is the predictable name DerivedName computes for
+	// the interface when udev did not give it a StableName.  It is
+	// matched like StableName.
+	DerivedName string `json:",omitempty"`
+}
+
+// MatchesMac returns whether mac is the MAC address of the phy.  The
+// permanent MAC address is used when it is known, since bond slaves
+// can share the same current MAC address.
+func (p Phy) MatchesMac(mac []byte) bool {
+	if len(p.PermanentHwAddr) > 0 {
+		return bytes.Equal(mac, p.PermanentHwAddr)
+	}
+	return bytes.Equal(mac, p.HardwareAddr)
 }
 
 func MatchPhys(m Match, tmpl Interface, phys []Phy) ([]Interface, error) {
 	res := []Interface{}
-	var matchName, matchDriver *regexp.Regexp
+	var matchName, matchDriver, matchPort, matchSwitch *regexp.Regexp
 	var err error
 	if m.Name != "" {
 		matchName, err = Glob2RE(m.Name)
@@ -37,11 +87,31 @@ func MatchPhys(m Match, tmpl Interface, phys []Phy) ([]Interface, error) {
 			return res, err
 		}
 	}
+	if m.LLDPPort != "" {
+		matchPort, err = Glob2RE(m.LLDPPort)
+		if err != nil {
+			return res, err
+		}
+	}
+	if m.LLDPSwitch != "" {
+		matchSwitch, err = Glob2RE(m.LLDPSwitch)
+		if err != nil {
+			return res, err
+		}
+	}
 	for _, phy := range phys {
 		if matchDriver != nil && !matchDriver.MatchString(phy.Driver) {
 			continue
 		}
-		if len(m.MacAddress) > 0 && !bytes.Equal(m.MacAddress, phy.HardwareAddr) {
+		if matchPort != nil && (phy.LLDP == nil ||
+			!(matchPort.MatchString(phy.LLDP.PortID) ||
+				matchPort.MatchString(phy.LLDP.PortDescr))) {
+			continue
+		}
+		if matchSwitch != nil && (phy.LLDP == nil || !matchSwitch.MatchString(phy.LLDP.SysName)) {
+			continue
+		}
+		if len(m.MacAddress) > 0 && !phy.MatchesMac(m.MacAddress) {
 			continue
 		}
 		if m.Name == "bootif" {
@@ -50,6 +120,7 @@ func MatchPhys(m Match, tmpl Interface, phys []Phy) ([]Interface, error) {
 			}
 		} else if matchName != nil && !(matchName.MatchString(phy.Name) ||
 			matchName.MatchString(phy.StableName) ||
+			matchName.MatchString(phy.DerivedName) ||
 			matchName.MatchString(phy.OrdinalName)) {
 			continue
 		}
@@ -57,14 +128,136 @@ func MatchPhys(m Match, tmpl Interface, phys []Phy) ([]Interface, error) {
 		intf.Name = phy.Name
 		intf.Type = "physical"
 		intf.CurrentHwAddr = phy.HardwareAddr
+		intf.PermanentHwAddr = phy.PermanentHwAddr
+		// Every nic has some flags, so none at all means they are
+		// not known.
+		intf.wasDown = phy.Flags != 0 && phy.Flags&gnet.Flags(net.FlagUp) == 0
 		res = append(res, intf)
 	}
 	return res, nil
 }
 
+// ExcludePhys returns phys without the ones whose name matches any
+// of the globs in exclude.  Names are matched the same way
+// MatchPhys matches them.
+func ExcludePhys(phys []Phy, exclude []string) ([]Phy, error) {
+	if len(exclude) == 0 {
+		return phys, nil
+	}
+	res := []Phy{}
+	matchers := []*regexp.Regexp{}
+	for _, glob := range exclude {
+		if glob == "" {
+			continue
+		}
+		re, err := Glob2RE(glob)
+		if err != nil {
+			return phys, err
+		}
+		matchers = append(matchers, re)
+	}
+	for _, phy := range phys {
+		excluded := false
+		for _, re := range matchers {
+			if re.MatchString(phy.Name) ||
+				re.MatchString(phy.StableName) ||
+				re.MatchString(phy.DerivedName) ||
+				re.MatchString(phy.OrdinalName) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			res = append(res, phy)
+		}
+	}
+	return res, nil
+}
+
+// Merge fills in the fields of p from the non-zero fields of other,
+// which override the ones p already has.  Structs are merged field by
+// field, so other can add to what p knows without wiping out the rest.
+// Both must be for the same interface, and if they both know a MAC
+// address it must be the same.
+func (p *Phy) Merge(other Phy) error {
+	if p.Name != other.Name {
+		return fmt.Errorf("cannot merge phy %s into %s", other.Name, p.Name)
+	}
+	for _, macs := range [][2]gnet.HardwareAddr{
+		{p.HardwareAddr, other.HardwareAddr},
+		{p.PermanentHwAddr, other.PermanentHwAddr},
+	} {
+		if len(macs[0]) > 0 && len(macs[1]) > 0 && !bytes.Equal(macs[0], macs[1]) {
+			return fmt.Errorf("phy %s: conflicting MAC addresses %s and %s", p.Name, macs[0], macs[1])
+		}
+	}
+	mergeValue(reflect.ValueOf(p).Elem(), reflect.ValueOf(other))
+	return nil
+}
+
+// mergeValue sets dst to src unless src is the zero value, recursing
+// into the exported fields of structs.
+func mergeValue(dst, src reflect.Value) {
+	if src.Kind() == reflect.Struct {
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				mergeValue(dst.Field(i), src.Field(i))
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(src.Interface(), reflect.Zero(src.Type()).Interface()) {
+		dst.Set(src)
+	}
+}
+
+// MergePhys merges sets of phys from different sources by interface
+// name, with the phys in later sets overriding and adding to the ones
+// in earlier sets.  Phys are returned in the order their names were
+// first seen.
+func MergePhys(sets ...[]Phy) ([]Phy, error) {
+	res := []Phy{}
+	idx := map[string]int{}
+	for _, set := range sets {
+		for _, phy := range set {
+			at, ok := idx[phy.Name]
+			if !ok {
+				idx[phy.Name] = len(res)
+				res = append(res, phy)
+				continue
+			}
+			if err := res[at].Merge(phy); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// DefaultVirtualDrivers are the drivers of the paravirtualized nics
+// that VMs commonly get, which are gathered when
+// GatherPhysOpts.IncludeVirtual is set without any Drivers.
+var DefaultVirtualDrivers = []string{"virtio_net", "vmxnet3", "ena", "hv_netvsc", "gve"}
+
+// GatherPhysOpts changes which interfaces are gathered as phys.  The
+// zero value gathers the physical interfaces and loopback.
+type GatherPhysOpts struct {
+	// IncludeVirtual also gathers virtual interfaces whose driver
+	// matches one of Drivers, so that VM nics can be matched like
+	// physical ones.
+	IncludeVirtual bool
+	// Drivers are globs matching the drivers of the virtual
+	// interfaces to gather.  If empty, DefaultVirtualDrivers is used.
+	Drivers []string
+}
+
 // GatherPhys gathers all the physical interfaces present on the machine.
-// Loopback interfaces and virtual interfaces will be skipped.
-func GatherPhys() ([]Phy, error) {
+// Virtual interfaces will be skipped unless opts includes them.
+func GatherPhys(opts GatherPhysOpts) ([]Phy, error) {
+	want, err := opts.wantPhy()
+	if err != nil {
+		return nil, err
+	}
 	info, err := gnet.Gather()
 	if err != nil {
 		return nil, err
@@ -72,9 +265,146 @@ func GatherPhys() ([]Phy, error) {
 	res := []Phy{}
 
 	for _, intf := range info.Interfaces {
+		if want(intf) {
+			phy := Phy{Interface: intf, PermanentHwAddr: permanentHwAddr(intf.Name)}
+			phy.deriveName()
+			res = append(res, phy)
+		}
+	}
+	return res, nil
+}
+
+// wantPhy returns a function that returns whether an interface is one
+// GatherPhys should return.
+func (o GatherPhysOpts) wantPhy() (func(gnet.Interface) bool, error) {
+	drivers := []*regexp.Regexp{}
+	if o.IncludeVirtual {
+		globs := o.Drivers
+		if len(globs) == 0 {
+			globs = DefaultVirtualDrivers
+		}
+		for _, glob := range globs {
+			if glob == "" {
+				continue
+			}
+			re, err := Glob2RE(glob)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid virtual driver %s: %v", glob, err)
+			}
+			drivers = append(drivers, re)
+		}
+	}
+	return func(intf gnet.Interface) bool {
 		if intf.Sys.IsPhysical || intf.Flags&gnet.Flags(net.FlagLoopback) != 0 {
-			res = append(res, Phy{intf, false})
+			return true
+		}
+		for _, re := range drivers {
+			if intf.Driver != "" && re.MatchString(intf.Driver) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// gohaiFlags parses interface flags in the form gohai marshals them.
+func gohaiFlags(s string) (gnet.Flags, error) {
+	var res net.Flags
+	for _, flag := range strings.Split(s, "|") {
+		switch flag {
+		case "0", "":
+		case "up":
+			res |= net.FlagUp
+		case "broadcast":
+			res |= net.FlagBroadcast
+		case "loopback":
+			res |= net.FlagLoopback
+		case "pointtopoint":
+			res |= net.FlagPointToPoint
+		case "multicast":
+			res |= net.FlagMulticast
+		case "running":
+			// Not in all versions of net.Flags, and we do not care about it.
+		default:
+			return 0, fmt.Errorf("Unknown interface flag %s", flag)
+		}
+	}
+	return gnet.Flags(res), nil
+}
+
+// PhysFromGohai converts the JSON output of the gohai net plugin into
+// Phys, skipping the same interfaces GatherPhys does with opts.  buf can hold
+// either the full gohai output or just its Networking section.  The
+// permanent MAC addresses of the interfaces are not known, as they
+// cannot be looked up on the machine gohai ran on.
+func PhysFromGohai(buf []byte, opts GatherPhysOpts) ([]Phy, error) {
+	want, err := opts.wantPhy()
+	if err != nil {
+		return nil, err
+	}
+	full := map[string]json.RawMessage{}
+	if err := json.Unmarshal(buf, &full); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling gohai output: %v", err)
+	}
+	if nw, ok := full["Networking"]; ok {
+		buf = nw
+	}
+	info := &struct {
+		Interfaces []struct {
+			gnet.Interface
+			// These shadow the fields in Interface that cannot be
+			// unmarshalled from what gohai marshals them as.
+			Flags        string
+			HardwareAddr string
+		}
+	}{}
+	if err := json.Unmarshal(buf, info); err != nil {
+		return nil, fmt.Errorf("Error unmarshalling gohai net info: %v", err)
+	}
+	if info.Interfaces == nil {
+		return nil, fmt.Errorf("gohai output has no network interfaces")
+	}
+	res := []Phy{}
+	for _, gi := range info.Interfaces {
+		intf := gi.Interface
+		var err error
+		if intf.Flags, err = gohaiFlags(gi.Flags); err != nil {
+			return nil, fmt.Errorf("%s: %v", intf.Name, err)
+		}
+		if gi.HardwareAddr != "" {
+			mac, err := net.ParseMAC(gi.HardwareAddr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", intf.Name, err)
+			}
+			intf.HardwareAddr = gnet.HardwareAddr(mac)
+		}
+		if want(intf) {
+			phy := Phy{Interface: intf}
+			phy.deriveName()
+			res = append(res, phy)
 		}
 	}
 	return res, nil
 }
+
+// permanentHwAddr finds the permanent MAC address of the named
+// interface.  Bond slaves expose it in sysfs, otherwise we ask
+// ethtool.  If neither knows, nil is returned.
+func permanentHwAddr(name string) gnet.HardwareAddr {
+	buf, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, "bonding_slave", "perm_hwaddr"))
+	if err != nil {
+		buf, err = exec.Command("ethtool", "-P", name).Output()
+		if err != nil {
+			return nil
+		}
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) == 0 {
+		return nil
+	}
+	mac, err := net.ParseMAC(fields[len(fields)-1])
+	if err != nil || bytes.Equal(mac, make([]byte, len(mac))) {
+		return nil
+	}
+	return gnet.HardwareAddr(mac)
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ValidateQOSMap validates that v is a list of from:to priority
+// mappings, where from is between 0 and fromMax and to is between 0
+// and toMax.  The mappings are returned in canonical form.
+func ValidateQOSMap(e *Err, k string, v interface{}, fromMax, toMax uint64) (res []string, valid bool) {
+	maps := []string{}
+	if err := Remarshal(v, &maps); err != nil {
+		e.Errorf("%s: %v is not a list of from:to mappings", k, v)
+		return
+	}
+	valid = true
+	seen := map[uint64]string{}
+	for _, m := range maps {
+		parts := strings.Split(m, ":")
+		if len(parts) != 2 {
+			e.Errorf("%s: %q is not a from:to mapping", k, m)
+			valid = false
+			continue
+		}
+		from, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+		if err != nil || from > fromMax {
+			e.Errorf("%s: %q must map from a priority between 0 and %d", k, m, fromMax)
+			valid = false
+			continue
+		}
+		to, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil || to > toMax {
+			e.Errorf("%s: %q must map to a priority between 0 and %d", k, m, toMax)
+			valid = false
+			continue
+		}
+		if other, ok := seen[from]; ok {
+			e.Errorf("%s: %q maps priority %d again, it is already mapped by %q", k, m, from, other)
+			valid = false
+			continue
+		}
+		seen[from] = m
+		res = append(res, strconv.FormatUint(from, 10)+":"+strconv.FormatUint(to, 10))
+	}
+	return
+}
+
+// VQOSMap validates that v is a list of from:to priority mappings.
+func VQOSMap(fromMax, toMax uint64) Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "array", "items": Schema{"type": "string"}}, true
+		}
+		return ValidateQOSMap(e, k, v, fromMax, toMax)
+	}
+}
+
+// The ranges of the VLAN QoS maps.  Ingress maps translate the 802.1p
+// priority of incoming frames into the kernel's packet priority, and
+// egress maps translate the other way.
+const (
+	VlanPrioMax = 7
+	SkbPrioMax  = math.MaxUint32
+)
+
+// QOSMap returns the VLAN QoS mappings stored in the Interface
+// parameter k, which is either ingress-qos-map or egress-qos-map.
+func (i Interface) QOSMap(k string) []string {
+	res := []string{}
+	if v, ok := i.Parameters[k]; ok {
+		Remarshal(v, &res)
+	}
+	return res
+}
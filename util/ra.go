@@ -0,0 +1,53 @@
+package util
+
+import (
+	"math"
+	"net"
+)
+
+// RaOverrides change what is taken from the IPv6 router
+// advertisements an interface accepts.
+type RaOverrides struct {
+	// UseDNS default is true, DNS servers and search domains are
+	// set from router advertisements.
+	UseDNS bool `json:"use-dns"`
+	// UseAutonomousPrefix default is true, addresses are generated
+	// with SLAAC from the prefixes routers advertise as autonomous.
+	UseAutonomousPrefix bool `json:"use-autonomous-prefix"`
+	// Table is the routing table routes learned from router
+	// advertisements are added to.  If unset, they go into the main
+	// table.
+	Table int `json:"table,omitempty"`
+}
+
+// validateRaOverrides checks the ra-overrides of n, which only matter
+// when n accepts router advertisements.
+func (n *Network) validateRaOverrides(e *Err) {
+	o := n.RaOverrides
+	if o == nil {
+		return
+	}
+	if o.Table != 0 {
+		ValidateInt(e, "ra-overrides: table", o.Table, 1, math.MaxUint32)
+	}
+	if !n.AcceptRa {
+		e.Warnf("ra-overrides have no effect when accept-ra is off")
+	}
+}
+
+// validateIPv6Token checks that the ipv6-address-token of n is an
+// IPv6 interface identifier: a non-zero address whose upper 64 bits
+// are all zero, like ::1.
+func (n *Network) validateIPv6Token(e *Err) {
+	if n.IPv6Token == "" {
+		return
+	}
+	ip := net.ParseIP(n.IPv6Token)
+	if ip == nil || ip.To4() != nil || !ip.Mask(net.CIDRMask(64, 128)).Equal(net.IPv6zero) || ip.Equal(net.IPv6zero) {
+		e.Errorf("ipv6-address-token %s is not an IPv6 interface identifier like ::1", n.IPv6Token)
+		return
+	}
+	if !n.AcceptRa {
+		e.Warnf("ipv6-address-token has no effect when accept-ra is off")
+	}
+}
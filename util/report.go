@@ -0,0 +1,119 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// MatchResult records which physical interfaces a single ethernet
+// stanza resolved to.
+type MatchResult struct {
+	// Stanza is the name of the ethernet stanza in the source config.
+	Stanza string `json:"stanza"`
+	// Match is the match that was used to find the physical interfaces.
+	Match Match `json:"match"`
+	// Phys are the names of the physical interfaces the stanza matched.
+	Phys []string `json:"phys"`
+	// Error is set if the match itself was invalid.
+	Error string `json:"error,omitempty"`
+}
+
+// MatchReport is a preflight report of how the ethernet stanzas in a
+// config will resolve against a set of physical interfaces.  It is
+// separate from compilation, and does not care whether the rest of
+// the config is valid.
+type MatchReport struct {
+	Results []MatchResult `json:"results"`
+	// Unmatched are the stanzas that did not match any physical interfaces.
+	Unmatched []string `json:"unmatched"`
+	// Conflicts maps physical interface names to the stanzas that
+	// claim them, for physical interfaces claimed more than once.
+	Conflicts map[string][]string `json:"conflicts"`
+	// Unclaimed are the physical interfaces no stanza matched.
+	Unclaimed []string `json:"unclaimed"`
+}
+
+// NewMatchReport builds a MatchReport by matching each stanza in
+// matches against phys with MatchPhys.
+func NewMatchReport(matches map[string]Match, phys []Phy) *MatchReport {
+	res := &MatchReport{
+		Results:   []MatchResult{},
+		Unmatched: []string{},
+		Conflicts: map[string][]string{},
+		Unclaimed: []string{},
+	}
+	names := []string{}
+	for k := range matches {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	claims := map[string][]string{}
+	for _, k := range names {
+		mr := MatchResult{Stanza: k, Match: matches[k], Phys: []string{}}
+		intfs, err := MatchPhys(mr.Match, Interface{}, phys)
+		if err != nil {
+			mr.Error = err.Error()
+		}
+		for _, intf := range intfs {
+			mr.Phys = append(mr.Phys, intf.Name)
+			claims[intf.Name] = append(claims[intf.Name], k)
+		}
+		if len(mr.Phys) == 0 {
+			res.Unmatched = append(res.Unmatched, k)
+		}
+		res.Results = append(res.Results, mr)
+	}
+	for _, phy := range phys {
+		switch len(claims[phy.Name]) {
+		case 0:
+			res.Unclaimed = append(res.Unclaimed, phy.Name)
+		case 1:
+		default:
+			res.Conflicts[phy.Name] = claims[phy.Name]
+		}
+	}
+	return res
+}
+
+// OK returns whether every stanza matched at least one physical
+// interface and no physical interface was claimed more than once.
+func (r *MatchReport) OK() bool {
+	return len(r.Unmatched) == 0 && len(r.Conflicts) == 0
+}
+
+// WriteTable writes the report to out as a human readable table.
+func (r *MatchReport) WriteTable(out io.Writer) error {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STANZA\tMATCH\tPHYS\tNOTES")
+	for _, mr := range r.Results {
+		phys := strings.Join(mr.Phys, ",")
+		if phys == "" {
+			phys = "-"
+		}
+		notes := []string{}
+		if mr.Error != "" {
+			notes = append(notes, mr.Error)
+		} else if len(mr.Phys) == 0 {
+			notes = append(notes, "no match")
+		}
+		for _, p := range mr.Phys {
+			others := []string{}
+			for _, other := range r.Conflicts[p] {
+				if other != mr.Stanza {
+					others = append(others, other)
+				}
+			}
+			if len(others) > 0 {
+				notes = append(notes, fmt.Sprintf("%s also claimed by %s", p, strings.Join(others, ",")))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", mr.Stanza, mr.Match, phys, strings.Join(notes, "; "))
+	}
+	if len(r.Unclaimed) > 0 {
+		fmt.Fprintf(tw, "\nUnclaimed phys: %s\n", strings.Join(r.Unclaimed, ","))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,165 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+)
+
+// Tables the kernel puts routes in when they do not pick one.
+const (
+	mainTable  = 254
+	localTable = 255
+)
+
+// routeKey is what identifies a route to the kernel.  Two routes with
+// the same key cannot both be added, no matter which interface they
+// are on.
+type routeKey struct {
+	to     string
+	table  int
+	metric int
+}
+
+// keyFor returns the canonical key of r, with the defaults the kernel
+// would fill in.  The destination is reduced to its network address,
+// and a metric of 0 is defaultMetric, which is what every output
+// format gives a route without one.
+func (r Route) keyFor(defaultMetric int) routeKey {
+	mask := r.To.Mask
+	if len(mask) == 0 {
+		bits := net.IPv6len * 8
+		if r.To.IP.To4() != nil {
+			bits = net.IPv4len * 8
+		}
+		mask = net.CIDRMask(bits, bits)
+	}
+	ip := r.To.IP
+	if v4 := ip.To4(); v4 != nil && len(mask) == net.IPv4len {
+		ip = v4
+	}
+	res := routeKey{
+		to:     (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String(),
+		table:  r.Table,
+		metric: r.Metric,
+	}
+	if res.table == 0 {
+		res.table = mainTable
+		if r.Type == "local" {
+			res.table = localTable
+		}
+	}
+	if res.metric == 0 {
+		res.metric = defaultMetric
+	}
+	return res
+}
+
+// target is everything about r when configured on the interface dev
+// other than its key: where it sends the traffic it matches, and how.
+// Two routes with the same key are only duplicates when their targets
+// are the same as well.
+func (r Route) target(dev string) string {
+	res := []string{}
+	if r.Type != "" && r.Type != "unicast" {
+		res = append(res, r.Type)
+	}
+	if r.Via != nil {
+		res = append(res, "via", r.Via.IP.String())
+	}
+	res = append(res, "dev", r.DevFor(Interface{Name: dev}))
+	if r.From != nil {
+		res = append(res, "src", r.From.String())
+	}
+	if r.Scope != "" && r.Scope != "global" {
+		res = append(res, "scope", r.Scope)
+	}
+	if r.OnLink {
+		res = append(res, "onlink")
+	}
+	if r.AutoRule {
+		res = append(res, "auto-rule")
+	}
+	return strings.Join(res, " ")
+}
+
+func (k routeKey) String() string {
+	res := k.to
+	if k.table != mainTable {
+		res += fmt.Sprintf(" table %d", k.table)
+	}
+	return res + fmt.Sprintf(" metric %d", k.metric)
+}
+
+// gatewayRoutes returns the default routes that gateway4 and gateway6
+// of n stand for.
+func (n *Network) gatewayRoutes() []Route {
+	res := []Route{}
+	for _, gw := range []struct {
+		via    *gnet.IPNet
+		metric int
+		bits   int
+	}{
+		{n.Gateway4, n.Gateway4Metric, net.IPv4len * 8},
+		{n.Gateway6, n.Gateway6Metric, net.IPv6len * 8},
+	} {
+		if gw.via == nil {
+			continue
+		}
+		to := &gnet.IPNet{IP: make(net.IP, gw.bits/8), Mask: net.CIDRMask(0, gw.bits)}
+		res = append(res, Route{To: to, Via: gw.via, Metric: gw.metric, OnLink: n.GatewayOnLink})
+	}
+	return res
+}
+
+// validateRoutes checks the routes of all the interfaces in l against
+// each other, including the default routes their gateways stand for.
+// Routes that are exact duplicates of one that came before them are
+// dropped, as adding the same route twice is harmless but fails.
+// Routes to the same destination in the same table with the same
+// metric that differ in anything else are an error, as only the first
+// one could be added.
+func (l *Layout) validateRoutes(names []string, e *Err) {
+	seen := map[routeKey]string{}
+	owner := map[routeKey]string{}
+	// check records r as configured on name, and returns whether it
+	// should be kept.
+	check := func(name, what string, r Route) bool {
+		key, target := r.keyFor(l.RouteMetric()), r.target(name)
+		prev, ok := seen[key]
+		switch {
+		case !ok:
+			seen[key], owner[key] = target, name
+		case prev == target:
+			return false
+		default:
+			e.Errorf("%s: %s to %s %s conflicts with the route %s on %s", name, what, key, target, prev, owner[key])
+		}
+		return true
+	}
+	for _, name := range names {
+		n := l.Interfaces[name].Network
+		if n == nil {
+			continue
+		}
+		// Gateways cannot be dropped, so they are checked first.
+		for _, r := range n.gatewayRoutes() {
+			check(name, "gateway route", r)
+		}
+	}
+	for _, name := range names {
+		n := l.Interfaces[name].Network
+		if n == nil || len(n.Routes) == 0 {
+			continue
+		}
+		kept := []Route{}
+		for _, r := range n.Routes {
+			if r.To == nil || check(name, "route", r) {
+				kept = append(kept, r)
+			}
+		}
+		n.Routes = kept
+	}
+}
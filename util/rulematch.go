@@ -0,0 +1,194 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IPProtocols maps the names of the IP protocols routing policy rules
+// can match on to their numbers.  Other protocols can be matched by
+// number.
+var IPProtocols = map[string]int{
+	"icmp":      1,
+	"igmp":      2,
+	"tcp":       6,
+	"udp":       17,
+	"gre":       47,
+	"esp":       50,
+	"ah":        51,
+	"ipv6-icmp": 58,
+	"sctp":      132,
+}
+
+// IPProtoName returns the name of the IP protocol numbered proto, or
+// the number itself if it is not in IPProtocols.
+func IPProtoName(proto int) string {
+	for k, v := range IPProtocols {
+		if v == proto {
+			return k
+		}
+	}
+	return strconv.Itoa(proto)
+}
+
+// ValidateIPProto validates that v is the name of an IP protocol in
+// IPProtocols or a protocol number, and returns the number.
+func ValidateIPProto(e *Err, k string, v interface{}) (res int, valid bool) {
+	if s, ok := v.(string); ok {
+		if proto, ok := IPProtocols[strings.ToLower(s)]; ok {
+			return proto, true
+		}
+		if _, err := strconv.Atoi(s); err != nil {
+			names := []string{}
+			for name := range IPProtocols {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			e.Errorf("%s: %s is not a protocol number or one of %v", k, s, names)
+			return
+		}
+	}
+	proto, ok := ValidateInt(e, k, v, 1, math.MaxUint8)
+	return int(proto), ok
+}
+
+// VIPProto returns a Validator that validates an IP protocol.
+func VIPProto() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			names := []interface{}{}
+			for name := range IPProtocols {
+				names = append(names, name)
+			}
+			sort.Slice(names, func(i, j int) bool { return names[i].(string) < names[j].(string) })
+			return Schema{"anyOf": []Schema{
+				{"type": "integer", "minimum": 1, "maximum": math.MaxUint8},
+				{"type": "string", "enum": names},
+			}}, true
+		}
+		return ValidateIPProto(e, k, v)
+	}
+}
+
+// ParsePortRange parses a port or a from-to range of them, and
+// returns it in canonical form.
+func ParsePortRange(s string) (string, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	from, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil || from == 0 {
+		return "", fmt.Errorf("%q is not a port or range of ports between 1 and %d", s, math.MaxUint16)
+	}
+	if len(parts) == 1 {
+		return strconv.FormatUint(from, 10), nil
+	}
+	to, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+	if err != nil || to < from {
+		return "", fmt.Errorf("%q is not a port or range of ports between 1 and %d", s, math.MaxUint16)
+	}
+	if to == from {
+		return strconv.FormatUint(from, 10), nil
+	}
+	return fmt.Sprintf("%d-%d", from, to), nil
+}
+
+// ValidatePortRange validates that v is a port or a from-to range of
+// them, and returns it in canonical form.
+func ValidatePortRange(e *Err, k string, v interface{}) (res string, valid bool) {
+	var s string
+	switch val := v.(type) {
+	case string:
+		s = val
+	case int, int64, float64:
+		s = fmt.Sprintf("%v", val)
+	default:
+		e.Errorf("%s: %v is not a port or range of ports", k, v)
+		return
+	}
+	res, err := ParsePortRange(s)
+	if err != nil {
+		e.Errorf("%s: %v", k, err)
+		return
+	}
+	return res, true
+}
+
+// VPortRange returns a Validator that validates a port or a range of
+// them.
+func VPortRange() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"anyOf": []Schema{
+				{"type": "integer", "minimum": 1, "maximum": math.MaxUint16},
+				{"type": "string", "format": "ports"},
+			}}, true
+		}
+		return ValidatePortRange(e, k, v)
+	}
+}
+
+// FWMarkString renders the FWMark of r, followed by its FWMask if it
+// has one.
+func (r RoutePolicy) FWMarkString() string {
+	if r.FWMask == 0 {
+		return strconv.Itoa(r.FWMark)
+	}
+	return fmt.Sprintf("%d/%d", r.FWMark, r.FWMask)
+}
+
+// ParseFWMark parses a firewall mark with an optional mask, as in
+// 16/0xff.  Both are decimal unless they start with 0x.
+func ParseFWMark(s string) (mark, mask int, err error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	for idx, part := range parts {
+		v, err := strconv.ParseUint(strings.TrimSpace(part), 0, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q is not a firewall mark with an optional mask", s)
+		}
+		if idx == 0 {
+			mark = int(v)
+		} else {
+			mask = int(v)
+		}
+	}
+	return
+}
+
+// validateMatches checks the interface, protocol, port, and firewall
+// mark matches of r, and its suppress-prefix-length.
+func (r *RoutePolicy) validateMatches(e *Err) {
+	if r.FWMask != 0 && r.FWMark == 0 {
+		e.Errorf("mark-mask %d needs a mark to apply to", r.FWMask)
+	}
+	if r.FWMask != 0 && r.FWMark&^r.FWMask != 0 {
+		e.Errorf("mark %d has bits set that mark-mask %d clears", r.FWMark, r.FWMask)
+	}
+	if r.SuppressPrefixLength != nil {
+		max := 128
+		if (r.From != nil && r.From.IP.To4() != nil) || (r.To != nil && r.To.IP.To4() != nil) {
+			max = 32
+		}
+		if *r.SuppressPrefixLength < 0 || *r.SuppressPrefixLength > max {
+			e.Errorf("suppress-prefix-length %d must be between 0 and %d", *r.SuppressPrefixLength, max)
+		}
+	}
+	if r.IIF != "" {
+		validateIfName(e, "iif", r.IIF)
+	}
+	if r.OIF != "" {
+		validateIfName(e, "oif", r.OIF)
+	}
+	if r.IPProto < 0 || r.IPProto > math.MaxUint8 {
+		e.Errorf("ipproto %d must be between 1 and %d", r.IPProto, math.MaxUint8)
+	}
+	for _, p := range []struct{ k, v string }{{"sport", r.SPort}, {"dport", r.DPort}} {
+		if p.v == "" {
+			continue
+		}
+		if _, err := ParsePortRange(p.v); err != nil {
+			e.Errorf("%s: %v", p.k, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+)
+
+// Schema is a JSON Schema document or fragment.  Validators describe
+// the values they accept as a Schema, which allows input formats to
+// publish a schema for the documents they understand.
+//
+// Only the subset of JSON Schema that the validators need is
+// generated, and Validate only understands that subset:  type,
+// properties, required, additionalProperties, propertyNames,
+// minProperties, maxProperties, items, enum, minimum, maximum, anyOf,
+// not, and format.  The formats are netwrangler specific:
+//
+// * ip, ipv4, ipv6: an address with an optional prefix length
+//
+// * cidr: an address with a prefix length
+//
+// * mac: a MAC address
+//
+// * time: a whole number with an optional ms or s suffix
+//
+// * cpus: a hex CPU mask that starts with 0x, or a list of CPUs and
+// ranges of them
+//
+// * ports: a port or a from-to range of them
+type Schema map[string]interface{}
+
+// schemaProbe is passed to a Validator in place of a value to ask it
+// to describe the values it accepts.
+type schemaProbe struct{}
+
+// Probing returns whether v is a request for a Validator to describe
+// itself.  Validators must check for this first, and if it is they
+// must return the Schema for the values they accept and true.
+func Probing(v interface{}) bool {
+	_, ok := v.(schemaProbe)
+	return ok
+}
+
+// SchemaOf asks val to describe the values it accepts.  Validators
+// that do not know how to describe themselves get an empty Schema,
+// which accepts anything.
+func SchemaOf(val Validator) Schema {
+	if val == nil {
+		return Schema{}
+	}
+	res, ok := val(&Err{}, "", schemaProbe{})
+	if s, isSchema := res.(Schema); ok && isSchema {
+		return s
+	}
+	return Schema{}
+}
+
+// ChecksSchema describes an object whose keys are validated by checks.
+func ChecksSchema(checks map[string]*Check) Schema {
+	props := map[string]interface{}{}
+	for k, c := range checks {
+		s := Schema{}
+		for kk, vv := range SchemaOf(c.c) {
+			s[kk] = vv
+		}
+		if c.d != nil {
+			s["default"] = c.d
+		}
+		props[k] = s
+	}
+	return Schema{"type": "object", "properties": props}
+}
+
+// Merge returns a copy of s with the properties of the object
+// schemas in others added to it.
+func (s Schema) Merge(others ...Schema) Schema {
+	res := Schema{}
+	props := map[string]interface{}{}
+	for k, v := range s {
+		res[k] = v
+	}
+	for _, o := range append([]Schema{s}, others...) {
+		if p, ok := o["properties"].(map[string]interface{}); ok {
+			for k, v := range p {
+				props[k] = v
+			}
+		}
+	}
+	res["properties"] = props
+	return res
+}
+
+func schemaTypeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case int, int64, uint, uint64:
+		return "integer"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func schemaFloat(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case uint:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	}
+	return 0, false
+}
+
+func schemaFormat(format, s string) bool {
+	switch format {
+	case "mac":
+		_, err := net.ParseMAC(s)
+		return err == nil
+	case "time":
+		_, err := ParseTime(s, time.Second)
+		return err == nil
+	case "cpus":
+		_, err := ParseCPUs(s)
+		return err == nil
+	case "ports":
+		_, err := ParsePortRange(s)
+		return err == nil
+	case "ip", "ipv4", "ipv6", "cidr":
+		addr := &gnet.IPNet{}
+		if addr.UnmarshalText([]byte(s)) != nil {
+			return false
+		}
+		switch format {
+		case "ipv4":
+			return addr.IP.To4() != nil
+		case "ipv6":
+			return addr.IP.To4() == nil
+		case "cidr":
+			return addr.IsCIDR()
+		}
+	}
+	return true
+}
+
+// Validate checks v (as unmarshalled from JSON) against s, and
+// returns an error for every place v does not conform.  Errors are
+// prefixed with the path to the offending value.
+func (s Schema) Validate(path string, v interface{}) []error {
+	res := []error{}
+	fail := func(f string, args ...interface{}) {
+		msg := fmt.Sprintf(f, args...)
+		if path != "" {
+			msg = path + ": " + msg
+		}
+		res = append(res, fmt.Errorf("%s", msg))
+	}
+	vType := schemaTypeOf(v)
+	switch t := s["type"].(type) {
+	case string:
+		if t != vType && !(t == "number" && vType == "integer") {
+			fail("expected %s, got %s", t, vType)
+			return res
+		}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, ev := range enum {
+			if reflect.DeepEqual(ev, v) {
+				found = true
+				break
+			}
+			if ef, ok := schemaFloat(ev); ok {
+				if vf, ok := schemaFloat(v); ok && ef == vf {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			fail("%v is not one of %v", v, enum)
+		}
+	}
+	if f, ok := schemaFloat(v); ok {
+		if min, ok := schemaFloat(s["minimum"]); ok && f < min {
+			fail("%v is less than %v", v, s["minimum"])
+		}
+		if max, ok := schemaFloat(s["maximum"]); ok && f > max {
+			fail("%v is greater than %v", v, s["maximum"])
+		}
+	}
+	if format, ok := s["format"].(string); ok {
+		if str, ok := v.(string); ok && !schemaFormat(format, str) {
+			fail("%q is not a valid %s", str, format)
+		}
+	}
+	if not, ok := s["not"].(Schema); ok && len(not.Validate(path, v)) == 0 {
+		fail("is not supported")
+	}
+	if anyOf, ok := s["anyOf"].([]Schema); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if len(sub.Validate(path, v)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("%v does not match any allowed form", v)
+		}
+	}
+	switch val := v.(type) {
+	case []interface{}:
+		if items, ok := s["items"].(Schema); ok {
+			for i, item := range val {
+				res = append(res, items.Validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+	case map[string]interface{}:
+		if min, ok := schemaFloat(s["minProperties"]); ok && float64(len(val)) < min {
+			fail("must have at least %v keys", s["minProperties"])
+		}
+		if max, ok := schemaFloat(s["maxProperties"]); ok && float64(len(val)) > max {
+			fail("must have at most %v keys", s["maxProperties"])
+		}
+		if required, ok := s["required"].([]string); ok {
+			for _, k := range required {
+				if _, found := val[k]; !found {
+					fail("missing required key %s", k)
+				}
+			}
+		}
+		props, _ := s["properties"].(map[string]interface{})
+		keys := []string{}
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		names, _ := s["propertyNames"].(Schema)
+		for _, k := range keys {
+			sub := strings.TrimPrefix(path+"."+k, ".")
+			if names != nil {
+				res = append(res, names.Validate(sub, k)...)
+			}
+			if p, ok := props[k].(Schema); ok {
+				res = append(res, p.Validate(sub, val[k])...)
+			} else if ap, ok := s["additionalProperties"].(Schema); ok {
+				res = append(res, ap.Validate(sub, val[k])...)
+			}
+		}
+	}
+	return res
+}
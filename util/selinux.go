@@ -0,0 +1,28 @@
+package util
+
+import (
+	"os"
+	"os/exec"
+	"path"
+)
+
+// selinuxfs is where the kernel exposes SELinux.  It only has an
+// enforce file when SELinux is enabled.
+var selinuxfs = "/sys/fs/selinux"
+
+// Restorecon resets the SELinux contexts of dir and the files in it to
+// the defaults of the loaded policy, so that the services that read
+// them are allowed to.  It does nothing when SELinux is disabled or
+// restorecon is not installed.
+func Restorecon(dir string, e *Err) {
+	if _, err := os.Stat(path.Join(selinuxfs, "enforce")); err != nil {
+		return
+	}
+	bin, err := exec.LookPath("restorecon")
+	if err != nil {
+		return
+	}
+	if out, err := exec.Command(bin, "-R", dir).CombinedOutput(); err != nil {
+		e.Errorf("Error restoring the SELinux contexts of %s: %v: %s", dir, err, out)
+	}
+}
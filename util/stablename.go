@@ -0,0 +1,77 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gnet "github.com/rackn/gohai/plugins/net"
+)
+
+// pciAddr matches a PCI address in domain:bus:slot.function form.
+var pciAddr = regexp.MustCompile(`^([0-9a-f]{4,8}):([0-9a-f]{2}):([0-9a-f]{2})\.([0-7])$`)
+
+// pciName returns the predictable name of a nic at the PCI address
+// addr, the way udev's path naming scheme would give it.  The domain
+// is only part of the name when it is not 0, and the function when
+// it is not 0.
+func pciName(addr string) string {
+	parts := pciAddr.FindStringSubmatch(strings.ToLower(addr))
+	if parts == nil {
+		return ""
+	}
+	nums := []uint64{}
+	for _, p := range parts[1:] {
+		n, err := strconv.ParseUint(p, 16, 32)
+		if err != nil {
+			return ""
+		}
+		nums = append(nums, n)
+	}
+	res := "en"
+	if nums[0] != 0 {
+		res += fmt.Sprintf("P%d", nums[0])
+	}
+	res += fmt.Sprintf("p%ds%d", nums[1], nums[2])
+	if nums[3] != 0 {
+		res += fmt.Sprintf("f%d", nums[3])
+	}
+	return res
+}
+
+// DerivedName computes a predictable name for intf from its PCI
+// address, or failing that its MAC address, for systems where udev
+// does not provide one, such as ones booted with net.ifnames=0.  The
+// PCI address is taken from the sysfs bus address of the nic, or
+// from its udev path.  An empty name is returned for interfaces that
+// have neither.
+func DerivedName(intf gnet.Interface) string {
+	if intf.Flags&gnet.Flags(net.FlagLoopback) != 0 {
+		return ""
+	}
+	if name := pciName(path.Base(intf.Sys.BusAddress)); name != "" {
+		return name
+	}
+	if name := pciName(strings.TrimPrefix(intf.Path, "pci-")); name != "" {
+		return name
+	}
+	mac := intf.HardwareAddr
+	if len(mac) != 6 || mac.String() == "00:00:00:00:00:00" {
+		return ""
+	}
+	return "enx" + strings.Replace(mac.String(), ":", "", -1)
+}
+
+// deriveName sets the DerivedName of p when udev did not give it a
+// StableName of its own.
+func (p *Phy) deriveName() {
+	if p.StableName != "" && p.StableName != p.Name {
+		return
+	}
+	if name := DerivedName(p.Interface); name != p.Name {
+		p.DerivedName = name
+	}
+}
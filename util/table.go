@@ -0,0 +1,58 @@
+package util
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// ValidateTable translates v, which is either a routing table number
+// or the name of one of the tables the kernel sets up itself, into a
+// table number.
+func ValidateTable(e *Err, k string, v interface{}) (res int64, valid bool) {
+	if s, ok := v.(string); ok {
+		for num, name := range reservedTables {
+			if s == name {
+				return int64(num), true
+			}
+		}
+		if _, err := strconv.ParseUint(s, 10, 32); err != nil {
+			e.Errorf("%s: %s is not a table number or one of default, main, or local", k, s)
+			return
+		}
+	}
+	return ValidateInt(e, k, v, 1, math.MaxUint32)
+}
+
+// VTable returns a Validator for routing tables, which can be given
+// by number or by the name of a table the kernel sets up itself.
+func VTable() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			names := []string{}
+			for _, name := range reservedTables {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return Schema{"anyOf": []Schema{
+				{"type": "integer", "minimum": 1, "maximum": int64(math.MaxUint32)},
+				strSchema(names),
+			}}, true
+		}
+		return ValidateTable(e, k, v)
+	}
+}
+
+// validateDhcpTables checks the tables the routes from DHCP go in.
+// DHCPv6 does not hand out routes, so a table for it has no effect.
+func (n *Network) validateDhcpTables(e *Err) {
+	if o := n.Dhcp4Overrides; o != nil && o.RouteTable != 0 {
+		ValidateInt(e, "dhcp4-overrides: route-table", o.RouteTable, 1, math.MaxUint32)
+		if !o.UseRoutes {
+			e.Warnf("dhcp4-overrides: route-table has no effect when use-routes is false")
+		}
+	}
+	if o := n.Dhcp6Overrides; o != nil && o.RouteTable != 0 {
+		e.Warnf("dhcp6-overrides: route-table has no effect, as DHCPv6 does not provide routes; ra-overrides table sets the table of the routes from router advertisements")
+	}
+}
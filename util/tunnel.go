@@ -0,0 +1,78 @@
+package util
+
+import (
+	"net"
+	"strings"
+)
+
+// TunnelModes maps the kinds of tunnels an Interface of type tunnel
+// can be to the IP version of their endpoints.
+var TunnelModes = map[string]int{
+	"ipip":      4,
+	"sit":       4,
+	"gre":       4,
+	"gretap":    4,
+	"ip6gre":    6,
+	"ip6gretap": 6,
+	"ipip6":     6,
+	"ip6ip6":    6,
+}
+
+// ethernetTunnels are the tunnel modes that carry ethernet frames,
+// and so are the only ones with a MAC address.
+var ethernetTunnels = map[string]bool{
+	"gretap":    true,
+	"ip6gretap": true,
+}
+
+// TunnelMode returns the mode of a tunnel, or an empty string if i is
+// not one.
+func (i Interface) TunnelMode() string {
+	if i.Type != "tunnel" {
+		return ""
+	}
+	mode, _ := i.Parameters["mode"].(string)
+	return mode
+}
+
+// validateTunnel checks that the endpoints of a tunnel are bare
+// addresses of the family its mode runs over, and that only tunnels
+// carrying ethernet frames are given a MAC address.
+func (i *Interface) validateTunnel(e *Err) {
+	if i.Type != "tunnel" {
+		return
+	}
+	mode := i.TunnelMode()
+	family, ok := TunnelModes[mode]
+	if !ok {
+		e.Errorf("mode %q is not a supported tunnel mode", mode)
+		return
+	}
+	if _, ok := i.Parameters["remote"]; !ok {
+		e.Errorf("%s tunnels need a remote endpoint", mode)
+	}
+	for _, k := range []string{"local", "remote"} {
+		v, ok := i.Parameters[k]
+		if !ok {
+			continue
+		}
+		addr, _ := v.(string)
+		if strings.Contains(addr, "/") {
+			e.Errorf("%s %s must be an address without a prefix", k, addr)
+			continue
+		}
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+			e.Errorf("%s %v is not an IP address", k, v)
+		case (ip.To4() != nil) != (family == 4):
+			e.Errorf("%s %s must be an IPv%d address for %s tunnels", k, addr, family, mode)
+		}
+	}
+	if ttl, ok := i.Parameters["ttl"]; ok {
+		ValidateInt(e, "ttl", ttl, 1, 255)
+	}
+	if len(i.MacAddress) > 0 && !ethernetTunnels[mode] {
+		e.Errorf("macaddress can only be set on gretap and ip6gretap tunnels, not %s", mode)
+	}
+}
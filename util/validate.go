@@ -2,6 +2,8 @@ package util
 
 import (
 	"encoding/json"
+	"net"
+	"sort"
 	"strconv"
 
 	gnet "github.com/rackn/gohai/plugins/net"
@@ -22,6 +24,9 @@ type Validator func(e *Err, k string, v interface{}) (res interface{}, valid boo
 
 // ValidateUnsupp always fails due to an unsupported key
 func ValidateUnsupp(e *Err, k string, v interface{}) (res interface{}, valid bool) {
+	if Probing(v) {
+		return Schema{"not": Schema{}}, true
+	}
 	e.Errorf("Key %s is not supported", k)
 	return v, false
 }
@@ -95,6 +100,14 @@ func ValidateStrIn(e *Err, k string, v interface{}, vals ...string) (res string,
 
 // ValidateMac validates that v is a hardware address
 func ValidateMac(e *Err, k string, v interface{}) (res gnet.HardwareAddr, valid bool) {
+	if s, ok := v.(string); ok {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			e.Errorf("%s: %q is not a valid MAC address", k, v)
+			return
+		}
+		return gnet.HardwareAddr(mac), true
+	}
 	res, valid = v.(gnet.HardwareAddr)
 	if !valid {
 		if err := Remarshal(v, &res); err != nil {
@@ -136,11 +149,24 @@ func ValidateIPList(e *Err, k string, v interface{}, cidr bool) (res []*gnet.IPN
 			continue
 		}
 		valid = false
-		e.Errorf("%s: %v is not in the expected format", k, addr)
+		if cidr {
+			e.Errorf("%s: address %v must include a prefix length, e.g. %s", k, addr, exampleCIDR(addr))
+		} else {
+			e.Errorf("%s: address %v must not include a prefix length, e.g. %s", k, addr, addr.IP)
+		}
 	}
 	return
 }
 
+// exampleCIDR returns addr with the prefix length most commonly used
+// for its address family, for use in error messages.
+func exampleCIDR(addr *gnet.IPNet) string {
+	if addr.IP.To4() != nil {
+		return addr.IP.String() + "/24"
+	}
+	return addr.IP.String() + "/64"
+}
+
 // Check carries around a validator and a default value to be used when checking things.
 type Check struct {
 	d interface{}
@@ -159,6 +185,15 @@ func (c *Check) Validate(e *Err, k string, v interface{}) (interface{}, bool) {
 	return c.c(e, k, v)
 }
 
+// Translate returns v as translated by the value translator of the
+// Check, or v unchanged if it has none.
+func (c *Check) Translate(v interface{}) interface{} {
+	if c.v == nil {
+		return v
+	}
+	return c.v(v)
+}
+
 func (c *Check) Key(n string) string {
 	if c.k == "" {
 		return n
@@ -218,7 +253,15 @@ func ValidateAndMarshal(e *Err, vals interface{}, checks map[string]*Check, val
 	}
 	res := map[string]interface{}{}
 	resOK := true
-	for key, check := range checks {
+	keys := make([]string, 0, len(checks))
+	for key := range checks {
+		keys = append(keys, key)
+	}
+	// Check keys in a stable order so that errors are reported
+	// consistently.
+	sort.Strings(keys)
+	for _, key := range keys {
+		check := checks[key]
 		v, found := m[key]
 		if !found {
 			if check.d != nil {
@@ -246,9 +289,32 @@ func ValidateAndMarshal(e *Err, vals interface{}, checks map[string]*Check, val
 	return resOK
 }
 
+func strSchema(r []string) Schema {
+	res := Schema{"type": "string"}
+	if len(r) > 0 {
+		enum := []interface{}{}
+		for _, v := range r {
+			enum = append(enum, v)
+		}
+		res["enum"] = enum
+	}
+	return res
+}
+
+func ipsSchema(cidr bool) Schema {
+	format := "ip"
+	if cidr {
+		format = "cidr"
+	}
+	return Schema{"type": "array", "items": Schema{"type": "string", "format": format}}
+}
+
 // VB returns a Validator that will validate boolean-ish values.
 func VB() Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "boolean"}, true
+		}
 		return ValidateBool(e, k, v)
 	}
 }
@@ -257,6 +323,9 @@ func VB() Validator {
 // be in a certian range.
 func VI(min, max int64) Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "integer", "minimum": min, "maximum": max}, true
+		}
 		return ValidateInt(e, k, v, min, max)
 	}
 }
@@ -265,6 +334,9 @@ func VI(min, max int64) Validator {
 // be one of a few set values.
 func VS(r ...string) Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return strSchema(r), true
+		}
 		return ValidateStrIn(e, k, v, r...)
 	}
 }
@@ -273,6 +345,9 @@ func VS(r ...string) Validator {
 // in a slice of strings are in a set of specified values
 func VSS(rs ...string) Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "array", "items": strSchema(rs)}, true
+		}
 		res := []string{}
 		resOK := true
 		if err := Remarshal(v, &res); err != nil {
@@ -291,6 +366,9 @@ func VSS(rs ...string) Validator {
 // VIP validates that v is an IP.
 func VIP() Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "string", "format": "ip"}, true
+		}
 		return ValidateIP(e, k, v)
 	}
 }
@@ -299,6 +377,9 @@ func VIP() Validator {
 // represents an IP with an IPv4 address.
 func VIP4() Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "string", "format": "ipv4"}, true
+		}
 		res, valid := ValidateIP(e, k, v)
 		valid = valid && res.IP.To4() != nil
 		return res, valid
@@ -309,6 +390,9 @@ func VIP4() Validator {
 // represents an IP with an IPv6 address.
 func VIP6() Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "string", "format": "ipv6"}, true
+		}
 		res, valid := ValidateIP(e, k, v)
 		valid = valid && res.IP.To4() == nil
 		return res, valid
@@ -319,6 +403,9 @@ func VIP6() Validator {
 // that must either all be CIDR formatted or bare addresses.
 func VIPS(cidr bool) Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return ipsSchema(cidr), true
+		}
 		return ValidateIPList(e, k, v, cidr)
 	}
 }
@@ -327,6 +414,9 @@ func VIPS(cidr bool) Validator {
 // represents a gnet.HardwareAddr
 func VMAC() Validator {
 	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "string", "format": "mac"}, true
+		}
 		return ValidateMac(e, k, v)
 	}
 }
@@ -0,0 +1,61 @@
+package util
+
+import "sort"
+
+// VethPeer returns the name of the other end of a veth, or an empty
+// string if i is not one.
+func (i Interface) VethPeer() string {
+	if i.Type != "veth" {
+		return ""
+	}
+	peer, _ := i.Parameters["peer"].(string)
+	return peer
+}
+
+// validateVeth checks that the peer of a veth is another veth in l
+// that has it as its peer in turn, so that every veth is one end of
+// exactly one pair.  The ends of a pair cannot be enslaved to the
+// same bond or bridge, as that would loop traffic back into it.
+func (i *Interface) validateVeth(l *Layout, e *Err) {
+	if i.Type != "veth" {
+		return
+	}
+	peer := i.VethPeer()
+	validateIfName(e, "peer", peer)
+	if peer == i.Name {
+		e.Errorf("veth cannot be its own peer")
+		return
+	}
+	other, ok := l.Interfaces[peer]
+	switch {
+	case !ok:
+		e.Errorf("peer %s is not declared", peer)
+		return
+	case other.Type != "veth":
+		e.Errorf("peer %s is a %s, not a veth", peer, other.Type)
+		return
+	case other.VethPeer() != i.Name:
+		e.Errorf("peer %s is paired with %s", peer, other.VethPeer())
+		return
+	}
+	names := []string{}
+	for k := range l.Interfaces {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		parent := l.Interfaces[k]
+		if parent.Type != "bond" && parent.Type != "bridge" {
+			continue
+		}
+		found := 0
+		for _, child := range parent.Interfaces {
+			if child == i.Name || child == peer {
+				found++
+			}
+		}
+		if found == 2 {
+			e.Errorf("veth and its peer %s cannot both be enslaved to %s %s", peer, parent.Type, k)
+		}
+	}
+}
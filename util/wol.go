@@ -0,0 +1,94 @@
+package util
+
+import (
+	"net"
+	"strings"
+)
+
+// WolModes are the Wake-on-LAN modes that can be enabled on a
+// physical interface, in the order they are rendered.
+var WolModes = []string{"phy", "unicast", "multicast", "broadcast", "arp", "magic", "secureon"}
+
+// wolFlags maps Wake-on-LAN modes to their ethtool flag.
+var wolFlags = map[string]string{
+	"phy":       "p",
+	"unicast":   "u",
+	"multicast": "m",
+	"broadcast": "b",
+	"arp":       "a",
+	"magic":     "g",
+	"secureon":  "s",
+}
+
+// ValidateWolPassword validates that v is a SecureOn password,
+// which is 6 bytes of hex formatted like a MAC address.
+func ValidateWolPassword(e *Err, k string, v interface{}) (res string, valid bool) {
+	s, ok := v.(string)
+	if !ok {
+		e.Errorf("%s: %v is not a string", k, v)
+		return
+	}
+	pw, err := net.ParseMAC(s)
+	if err != nil || len(pw) != 6 {
+		e.Errorf("%s: SecureOn password must be 6 bytes of hex in xx:xx:xx:xx:xx:xx form", k)
+		return
+	}
+	return pw.String(), true
+}
+
+// VWOLPW validates that v is a SecureOn password.
+func VWOLPW() Validator {
+	return func(e *Err, k string, v interface{}) (interface{}, bool) {
+		if Probing(v) {
+			return Schema{"type": "string", "format": "mac"}, true
+		}
+		return ValidateWolPassword(e, k, v)
+	}
+}
+
+// WakeOnLan returns the Wake-on-LAN modes enabled on the Interface
+// along with the SecureOn password, if any.  Setting a password
+// implies the secureon mode.
+func (i Interface) WakeOnLan() (modes []string, password string) {
+	enabled := map[string]bool{}
+	if v, ok := i.Parameters["wakeonlan"]; ok {
+		enabled["magic"], _ = ValidateBool(&Err{}, "wakeonlan", v)
+	}
+	if v, ok := i.Parameters["wakeonlan-modes"]; ok {
+		extra := []string{}
+		if Remarshal(v, &extra) == nil {
+			for _, mode := range extra {
+				enabled[mode] = true
+			}
+		}
+	}
+	if v, ok := i.Parameters["wakeonlan-password"]; ok {
+		password, _ = v.(string)
+		enabled["secureon"] = password != ""
+	}
+	for _, mode := range WolModes {
+		if enabled[mode] {
+			modes = append(modes, mode)
+		}
+	}
+	return
+}
+
+// EthtoolWol returns the ethtool options that enable the
+// Wake-on-LAN modes on the Interface, or an empty string if none are
+// enabled.
+func (i Interface) EthtoolWol() string {
+	modes, password := i.WakeOnLan()
+	if len(modes) == 0 {
+		return ""
+	}
+	flags := []string{}
+	for _, mode := range modes {
+		flags = append(flags, wolFlags[mode])
+	}
+	res := "wol " + strings.Join(flags, "")
+	if password != "" {
+		res += " sopass " + password
+	}
+	return res
+}